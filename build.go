@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Regular expressions for secure output. Only lines that match these expressions in
@@ -23,6 +24,7 @@ var (
 	secprintfExp = regexp.MustCompile(`.*secprintf\(.*SECRET, .+, "(.+)"\);.*`)
 	successExp   = regexp.MustCompile(`.*success\(.+, SECRET, "(.+)"\);.*`)
 	partialExp   = regexp.MustCompile(`.*partial_credit\(SECRET, "(.+)",.+\);.*`)
+	t161Exp      = regexp.MustCompile(`.*t161_[a-z_]+\(SECRET, "([^"]+)".*\);.*`)
 )
 
 func GetDeployKeySSHCmd(users []string, keyDir string) string {
@@ -78,7 +80,18 @@ type BuildTest struct {
 	PointsEarned    uint   `json:"points_earned" bson:"points_earned"`
 	ScoringMethod   string `json:"scoring_method" bson:"scoring_method"`
 
-	startTime TimeFixedPoint
+	// Build cache (see buildcache.go). CacheHit is true if the build was
+	// skipped because we already had the output.
+	CacheKey string `json:"cache_key" bson:"cache_key"`
+	CacheHit bool   `json:"cache_hit" bson:"cache_hit"`
+
+	// Compiler errors and warnings (see diagnostics.go)
+	Diagnostics []*BuildDiagnostic `json:"diagnostics" bson:"diagnostics"`
+
+	// Digests of the secure output keys (see secure.go)
+	KeyDigests []*KeyDigest `json:"key_digests" bson:"key_digests"`
+
+	startTime time.Time
 	dir       string // The base (temp) directory for the build.
 	wasCached bool   // Was the base directory cached
 	isTempDir bool   // Is the build directory a temp dir that should be removed?
@@ -93,6 +106,15 @@ type BuildTest struct {
 	keyLock sync.Mutex
 
 	overlayCommitID string
+
+	recipe  *BuildRecipe
+	history *commitHistory
+
+	cacheKey   string
+	cache      *buildCache
+	cacheEntry *buildCacheEntry
+
+	unlock func() // Unlocks the build directory (see buildlock.go)
 }
 
 // A variant of a Test Command for builds
@@ -113,20 +135,64 @@ type BuildCommand struct {
 	Status string `json:"status"`
 
 	test     *BuildTest
+	network  bool                                  // Does this command need the network?
+	shell    bool                                  // Run the command line with /bin/sh -c
+	quiet    bool                                  // Don't show the handler's output if it fails
+	env      []string                              // Extra environment variables (KEY=value)
 	startDir string                                // The directory to run this command in
+	makeDirs []string                              // Directories recursive makes are in, innermost last
 	handler  func(*BuildTest, *BuildCommand) error // Invoke after command exits to determine success
 }
 
 // BuildConf specifies the configuration for building os161.
 type BuildConf struct {
-	Repo             string   // The git repository to clone
-	CommitID         string   // The git commit id (HEAD, hash, etc.) to check out
-	KConfig          string   // The os161 kernel config file for the build
-	RequiredCommit   string   // A commit required to be in git log
-	CacheDir         string   // Cache for previous builds
-	RequiresUserland bool     // Does userland need to be built?
-	Overlay          string   // The overlay to use (append to overlay dir in env)
-	Users            []string // The users who own the repo. Needed for the finding the key.
+	Repo             string              // The git repository to clone
+	CommitID         string              // The git commit id (HEAD, hash, etc.) to check out
+	KConfig          string              // The os161 kernel config file for the build
+	RequiredCommit   string              // A commit required to be in git log
+	Commits          *CommitRequirements // Commits required (or not allowed) in git log
+	CacheDir         string              // Cache for previous builds
+	RequiresUserland bool                // Does userland need to be built?
+	Timeout          uint                // Seconds for the whole build (0 for no limit)
+	CommandTimeout   uint                // Seconds for each build command (0 for no limit)
+	Warnings         *WarningPolicy      // Fail the build for warnings in specific files
+	Overlay          string              // The overlay to use (append to overlay dir in env)
+	OverlayCommit    string              // The overlay's commit, if it isn't in a repository (remote builds)
+	Users            []string            // The users who own the repo. Needed for the finding the key.
+	Recipe           *BuildRecipe        // The build recipe, or nil to use RecipeName
+	RecipeName       string              // A recipe from the environment, or "" for the default
+}
+
+// TargetBuild specifies target-specific build settings.
+type TargetBuild struct {
+	Timeout        uint           `yaml:"timeout" bson:"timeout"`                 // Seconds for the whole build (0 for no limit)
+	CommandTimeout uint           `yaml:"command_timeout" bson:"command_timeout"` // Seconds for each command (0 for no limit)
+	Warnings       *WarningPolicy `yaml:"warnings" bson:"warnings"`               // What to do about compiler warnings
+
+	// How to build (see recipes.go). Targets can name a recipe from the
+	// recipes directory, or declare their own steps.
+	Recipe    string       `yaml:"recipe" bson:"recipe"`
+	Env       []string     `yaml:"env" bson:"env"`
+	Clean     []string     `yaml:"clean" bson:"clean"`
+	Steps     []*BuildStep `yaml:"steps" bson:"steps"`
+	Artifacts []string     `yaml:"artifacts" bson:"artifacts"`
+}
+
+// BuildConf returns the target's build configuration. The caller still needs
+// to set the repository, commit, users, and cache directory.
+func (t *Target) BuildConf() *BuildConf {
+	return &BuildConf{
+		KConfig:          t.KConfig,
+		RequiredCommit:   t.RequiredCommit,
+		Commits:          t.Commits,
+		RequiresUserland: t.RequiresUserland,
+		Timeout:          t.Build.Timeout,
+		CommandTimeout:   t.Build.CommandTimeout,
+		Warnings:         t.Build.Warnings,
+		Overlay:          t.Name,
+		Recipe:           t.Build.recipe(t.Name),
+		RecipeName:       t.Build.Recipe,
+	}
 }
 
 // Use the BuildConf to create a sequence of commands that will build an os161 kernel
@@ -144,6 +210,7 @@ func (b *BuildConf) ToBuildTest(env *TestEnvironment) (*BuildTest, error) {
 		PointsAvailable: uint(0),
 		PointsEarned:    uint(0),
 		ScoringMethod:   TEST_SCORING_ENTIRE,
+		Diagnostics:     make([]*BuildDiagnostic, 0),
 		conf:            b,
 		env:             env,
 	}
@@ -151,10 +218,20 @@ func (b *BuildConf) ToBuildTest(env *TestEnvironment) (*BuildTest, error) {
 	if err := t.initDirs(); err != nil {
 		return nil, err
 	}
+	if err := t.initRecipe(); err != nil {
+		return nil, err
+	}
+	if err := t.resolveCommitTags(); err != nil {
+		return nil, err
+	}
+	t.initCacheKey()
+	t.CacheKey = t.cacheKey
 
 	t.addGitCommands()
 	t.addOverlayCommand()
-	t.addBuildCommands()
+	if err := t.addBuildCommands(); err != nil {
+		return nil, err
+	}
 
 	return t, nil
 }
@@ -164,66 +241,114 @@ func (t *BuildTest) RootDir() string {
 	return t.rootDir
 }
 
-// Convert a command's raw output into individual OutputLines
-func makeLines(rawoutput []byte) []*OutputLine {
-	lines := strings.Split(string(rawoutput), "\n")
-	output := make([]*OutputLine, len(lines))
+// Get the time since the build started, for output timestamps
+func (t *BuildTest) getWallTime() TimeFixedPoint {
+	if t.startTime.IsZero() {
+		return TimeFixedPoint(0)
+	}
+	return TimeFixedPoint(time.Since(t.startTime).Seconds())
+}
 
-	for i, l := range lines {
-		output[i] = &OutputLine{
-			Line:     l,
-			SimTime:  TimeFixedPoint(i),
-			WallTime: TimeFixedPoint(i),
-		}
+func (cmd *BuildCommand) newLine(line string) *OutputLine {
+	now := cmd.test.getWallTime()
+	return &OutputLine{
+		Line:     line,
+		SimTime:  now,
+		WallTime: now,
 	}
-	return output
+}
+
+// Add a line of output and send it on so it shows up while the command runs.
+func (cmd *BuildCommand) addOutput(env *TestEnvironment, line *OutputLine) {
+	cmd.Output = append(cmd.Output, line)
+	env.notifyAndLogErr("Build Command Output", cmd, MSG_PERSIST_OUTPUT, MSG_FIELD_OUTPUT)
 }
 
 // Execute an individual BuildTest command
 func (cmd *BuildCommand) Run(env *TestEnvironment) error {
 	tokens := strings.Split(cmd.Input.Line, " ")
+	if cmd.shell {
+		tokens = []string{"/bin/sh", "-c", cmd.Input.Line}
+	}
 	if len(tokens) < 1 {
 		return errors.New("BuildCommand: Empty command")
 	}
 
 	cmd.Output = make([]*OutputLine, 0)
-
-	// Add a line indicating what the build process is doing
-	cmd.Output = append(cmd.Output, &OutputLine{
-		Line:     "Exec: " + cmd.Input.Line,
-		SimTime:  TimeFixedPoint(1),
-		WallTime: TimeFixedPoint(1),
-	})
-
 	cmd.Status = COMMAND_STATUS_RUNNING
 
 	env.notifyAndLogErr("Build Command Status", cmd,
 		MSG_PERSIST_UPDATE, MSG_FIELD_OUTPUT|MSG_FIELD_STATUS)
 
-	c := exec.Command(tokens[0], tokens[1:]...)
-	c.Dir = cmd.startDir
-	c.Env = cmd.test.cmdEnv
+	// Add a line indicating what the build process is doing
+	cmd.addOutput(env, cmd.newLine("Exec: "+cmd.Input.Line))
+
+	// Stop if the whole build is out of time
+	timeout, buildLimit := cmd.test.commandTimeout()
+	if timeout < 0 {
+		cmd.Status = COMMAND_STATUS_TIMEOUT
+		err := cmd.test.timeoutError()
+		cmd.addOutput(env, cmd.newLine(fmt.Sprintf("%v", err)))
+		return err
+	}
 
-	output, err := c.CombinedOutput()
+	// Output is streamed, except for commands with handlers, which just
+	// produce data for the handler (e.g. the commit history).
+	buffered := make([]*OutputLine, 0)
+	onLine := func(line string) {
+		if cmd.handler == nil {
+			cmd.test.addDiagnostic(cmd, line)
+			cmd.addOutput(env, cmd.newLine(line))
+		} else {
+			buffered = append(buffered, cmd.newLine(line))
+		}
+	}
+
+	status, err := cmd.execute(env, tokens, timeout, onLine)
+
+	handlerFailed := false
+	if err == nil && cmd.handler != nil {
+		output := cmd.Output
+		cmd.Output = append(cmd.Output, buffered...)
+
+		err = cmd.handler(cmd.test, cmd)
+
+		// Clean up output
+		cmd.Output = output
+
+		if err != nil {
+			status = COMMAND_STATUS_INCORRECT
+			handlerFailed = true
+		}
+	}
 
 	if err != nil {
-		cmd.Output = append(cmd.Output, makeLines(output)...)
-	} else {
-		if cmd.handler != nil {
-			cmd.Output = makeLines(output)
-			err = cmd.handler(cmd.test, cmd)
-			if err == nil {
-				// Clean up output
-				cmd.Output = cmd.Output[0:1]
+		// Show what the handler saw
+		if !cmd.quiet {
+			for _, line := range buffered {
+				cmd.addOutput(env, line)
 			}
 		}
 
+		// And why it failed
+		if handlerFailed {
+			for _, line := range strings.Split(err.Error(), "\n") {
+				cmd.addOutput(env, cmd.newLine(line))
+			}
+		}
+
+		if status == COMMAND_STATUS_TIMEOUT && buildLimit {
+			err = cmd.test.timeoutError()
+		}
+
+		cmd.Status = status
+		if status != COMMAND_STATUS_INCORRECT {
+			// Make it clear which limit was exceeded
+			cmd.addOutput(env, cmd.newLine(fmt.Sprintf("%v", err)))
+		}
+	} else {
 		// Success
-		cmd.Output = append(cmd.Output, &OutputLine{
-			Line:     "OK",
-			SimTime:  TimeFixedPoint(2),
-			WallTime: TimeFixedPoint(2),
-		})
+		cmd.addOutput(env, cmd.newLine("OK"))
 	}
 
 	env.notifyAndLogErr("Build Command Output", cmd, MSG_PERSIST_UPDATE, MSG_FIELD_OUTPUT)
@@ -231,9 +356,38 @@ func (cmd *BuildCommand) Run(env *TestEnvironment) error {
 	return err
 }
 
+// Get the timeout for the next command. This is the command timeout or the
+// time left for the build, whichever is first. buildLimit is true if it's the
+// time left for the build, which is negative if the build is out of time.
+func (t *BuildTest) commandTimeout() (timeout time.Duration, buildLimit bool) {
+	if t.conf.CommandTimeout > 0 {
+		timeout = time.Duration(t.conf.CommandTimeout) * time.Second
+	}
+
+	if t.conf.Timeout > 0 && !t.startTime.IsZero() {
+		left := t.startTime.Add(time.Duration(t.conf.Timeout) * time.Second).Sub(time.Now())
+		if left <= 0 {
+			return -1, true
+		} else if timeout <= 0 || left < timeout {
+			return left, true
+		}
+	}
+
+	return timeout, false
+}
+
+func (t *BuildTest) timeoutError() error {
+	return errors.New(fmt.Sprintf("Build timed out after %v seconds", t.conf.Timeout))
+}
+
 type BuildResults struct {
 	RootDir string
 	TempDir string
+	RootKey string // Unique to the contents of RootDir
+
+	cache      *buildCache
+	cacheEntry *buildCacheEntry
+	unlock     func()
 }
 
 // Figure out the build directory location, create it if it doesn't exist.
@@ -268,8 +422,7 @@ func (t *BuildTest) initDirs() (err error) {
 	t.srcDir = path.Join(buildDir, "src")
 	t.rootDir = path.Join(buildDir, "root")
 
-	// TODO: Lock the build directory
-
+	// The directory is locked in Run, since we don't need it for cache hits
 	return
 }
 
@@ -281,20 +434,65 @@ func (t *BuildTest) Run(env *TestEnvironment) (*BuildResults, error) {
 	t.env.keyMap = make(map[string]string)
 	t.setCommandEnv()
 
+	t.startTime = time.Now()
 	t.Result = TEST_RESULT_RUNNING
 	t.env.notifyAndLogErr("Build Test Running", t, MSG_PERSIST_UPDATE, MSG_FIELD_STATUS)
 
 	defer func() {
+		if t.Result == TEST_RESULT_CORRECT {
+			t.saveKeys()
+		}
 		env.notifyAndLogErr("Build Test Complete", t, MSG_PERSIST_COMPLETE, 0)
 	}()
 
+	// Skip the build entirely if we've already built this
+	if t.CacheHit, err = t.useCachedBuild(); t.CacheHit {
+		env.notifyAndLogErr("Build Test Output", t.Commands[0], MSG_PERSIST_UPDATE, MSG_FIELD_STATUS|MSG_FIELD_OUTPUT)
+		if err == nil {
+			err = t.checkWarnings()
+		}
+		if err != nil {
+			t.Result = TEST_RESULT_INCORRECT
+			t.cleanup()
+			return nil, err
+		}
+		t.Result = TEST_RESULT_CORRECT
+		return t.results(), nil
+	}
+
+	// Build on a worker if we have any
+	if pool := env.buildWorkers(); pool != nil {
+		res, err := pool.build(t)
+		if err != errNoWorkers {
+			if err != nil {
+				t.cleanup()
+			}
+			return res, err
+		}
+	}
+
+	// Other builds of this repo share the directory, so wait our turn
+	if err = t.lockDir(); err != nil {
+		t.Result = TEST_RESULT_INCORRECT
+		t.cleanup()
+		return nil, err
+	}
+	t.prepareDir()
+
 	for _, c := range t.Commands {
 
 		err = c.Run(env)
 
 		if err != nil {
-			c.Status = COMMAND_STATUS_INCORRECT
-			t.Result = TEST_RESULT_INCORRECT
+			// Keep the sandbox status if a limit was exceeded
+			if c.Status == COMMAND_STATUS_RUNNING || c.Status == COMMAND_STATUS_CORRECT {
+				c.Status = COMMAND_STATUS_INCORRECT
+			}
+			if c.Status == COMMAND_STATUS_TIMEOUT {
+				t.Result = TEST_RESULT_TIMEOUT
+			} else {
+				t.Result = TEST_RESULT_INCORRECT
+			}
 		} else {
 			c.Status = COMMAND_STATUS_CORRECT
 		}
@@ -302,42 +500,84 @@ func (t *BuildTest) Run(env *TestEnvironment) (*BuildResults, error) {
 		env.notifyAndLogErr("Build Test Output", c, MSG_PERSIST_UPDATE, MSG_FIELD_STATUS|MSG_FIELD_OUTPUT)
 
 		if err != nil {
-			if t.isTempDir {
-				os.RemoveAll(t.dir)
-			}
+			t.cleanup()
 			return nil, err
 		}
 	}
 
+	if err = t.checkArtifacts(); err != nil {
+		t.cleanup()
+		return nil, err
+	}
+
+	// The warning policy depends on the target, so we cache the build first
+	t.saveCachedBuild()
+
+	// If the root was cached, we're done with the build directory
+	if t.cacheEntry != nil {
+		t.unlockDir()
+	}
+
+	if err = t.checkWarnings(); err != nil {
+		t.cleanup()
+		return nil, err
+	}
+
 	t.Result = TEST_RESULT_CORRECT
 
-	// Package up the results for the caller
+	return t.results(), nil
+}
+
+// Fail the build if the warning policy doesn't allow its warnings
+func (t *BuildTest) checkWarnings() error {
+	err := t.conf.Warnings.Check(t.Diagnostics)
+	if err != nil {
+		t.Result = TEST_RESULT_INCORRECT
+	}
+	return err
+}
+
+// Package up the results for the caller
+func (t *BuildTest) results() *BuildResults {
 	res := &BuildResults{
-		RootDir: t.rootDir,
+		RootDir:    t.rootDir,
+		RootKey:    t.ID,
+		cache:      t.cache,
+		cacheEntry: t.cacheEntry,
+		unlock:     t.unlock,
 	}
+	t.unlock = nil
 	if t.isTempDir {
 		res.TempDir = t.dir
 	}
-
-	return res, nil
+	// Cache entry directories are never reused, so builds that share an entry
+	// can share the root.
+	if t.cacheEntry != nil {
+		res.RootKey = t.rootDir
+	}
+	return res
 }
 
-// Handler function for finding a required commit.
-func commitCheckHandler(t *BuildTest, command *BuildCommand) error {
-	for _, l := range command.Output {
-		if t.conf.RequiredCommit == l.Line {
-			return nil
-		}
+// Clean up after a failed build
+func (t *BuildTest) cleanup() {
+	if t.cacheEntry != nil {
+		t.cache.release(t.cacheEntry)
+		t.cacheEntry = nil
+	}
+	t.unlockDir()
+	if t.isTempDir {
+		os.RemoveAll(t.dir)
 	}
-
-	return errors.New("Cannot find required commit id")
 }
 
 // Set up the command environment. Specifically, we need to set the GIT_SSH_COMMAND
 // env variable based users' repo we're building. This forces git to use a specific
 // key file, which we need because each user generates a deployment key for test161.
+//
+// We also have bmake print the directories it enters (-w), so we know where
+// the file names in diagnostics from recursive builds (i.e. userland) are.
 func (t *BuildTest) setCommandEnv() {
-	t.cmdEnv = os.Environ()
+	t.cmdEnv = append(os.Environ(), "MAKEFLAGS=-w")
 	if cmd := GetDeployKeySSHCmd(t.conf.Users, t.env.KeyDir); cmd != "" {
 		t.cmdEnv = append(t.cmdEnv, cmd)
 	} else {
@@ -354,19 +594,18 @@ func (t *BuildTest) addGitCommands() {
 		// First, reset it so we remove previous overlay changes
 		t.addCommand("git reset --hard", t.srcDir) // tracked files
 		t.addCommand("git clean -d -f", t.srcDir)  // untracked files
-		t.addCommand("git fetch", t.srcDir)
+		cmd := t.addCommand("git fetch", t.srcDir)
+		cmd.network = true
 		t.wasCached = true
 	} else {
-		t.addCommand(fmt.Sprintf("git clone %v src", t.conf.Repo), t.dir)
+		cmd := t.addCommand(fmt.Sprintf("git clone %v src", t.conf.Repo), t.dir)
+		cmd.network = true
 	}
 
 	t.addCommand(fmt.Sprintf("git checkout %v", t.conf.CommitID), t.srcDir)
 
-	// Before building, we may need to check for a specific commit
-	if len(t.conf.RequiredCommit) > 0 {
-		cmd := t.addCommand(fmt.Sprintf("git log --pretty=format:%v", "%H"), t.srcDir)
-		cmd.handler = commitCheckHandler
-	}
+	// Before building, we may need to check for specific commits
+	t.addHistoryCommands()
 }
 
 const KEYBYTES = 32
@@ -434,11 +673,14 @@ func (t *BuildTest) doSecureOverlayFile(filename string, done chan error) {
 	for scanner.Scan() {
 		line := scanner.Text()
 
-		// Try secprintf and success (single lines only).
+		// Try secprintf, success, partial_credit, and the structured
+		// output functions (single lines only).
 		var res []string
 		if res = secprintfExp.FindStringSubmatch(line); len(res) == 0 {
 			if res = successExp.FindStringSubmatch(line); len(res) == 0 {
-				res = partialExp.FindStringSubmatch(line)
+				if res = partialExp.FindStringSubmatch(line); len(res) == 0 {
+					res = t161Exp.FindStringSubmatch(line)
+				}
 			}
 		}
 
@@ -583,38 +825,33 @@ func (t *BuildTest) addOverlayCommand() {
 	cmd := t.addCommand("sync", t.srcDir)
 	cmd.handler = overlayHandler
 
-	// Get the overlay commit
+	// Get the overlay commit, unless the server already told us
+	if len(t.conf.OverlayCommit) > 0 {
+		t.overlayCommitID = t.conf.OverlayCommit
+		return
+	}
 	cmd = t.addCommand("git rev-parse HEAD", t.env.OverlayRoot)
 	cmd.handler = overlayCommitHandler
 }
 
-// Add the chunk of commands needed to build OS/161
-func (t *BuildTest) addBuildCommands() error {
-	confDir := path.Join(t.srcDir, "kern/conf")
-	compDir := path.Join(path.Join(t.srcDir, "kern/compile"), t.conf.KConfig)
-
-	os.RemoveAll(compDir)
-
-	t.addCommand("./configure --ostree="+t.rootDir, t.srcDir)
-
-	if t.conf.RequiresUserland {
-		t.addCommand("bmake clean", t.srcDir)
-		t.addCommand("bmake", t.srcDir)
-		t.addCommand("bmake install", t.srcDir)
+// Get the commit of the overlay repository
+func overlayCommit(overlayRoot string) (string, error) {
+	out, err := exec.Command("git", "-C", overlayRoot, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", err
 	}
-
-	t.addCommand("./config "+t.conf.KConfig, confDir)
-	t.addCommand("bmake clean", compDir)
-	t.addCommand("bmake depend", compDir)
-	t.addCommand("bmake", compDir)
-	t.addCommand("bmake install", compDir)
-
-	return nil
+	return strings.TrimSpace(string(out)), nil
 }
 
 // Add an individual build command by specifying the command line and
 // directory to run from.
 func (t *BuildTest) addCommand(cmdLine string, dir string) *BuildCommand {
+	cmd := t.newCommand(cmdLine, dir)
+	t.Commands = append(t.Commands, cmd)
+	return cmd
+}
+
+func (t *BuildTest) newCommand(cmdLine string, dir string) *BuildCommand {
 	cmd := &BuildCommand{
 		Type:     "build",
 		Output:   []*OutputLine{},
@@ -628,7 +865,5 @@ func (t *BuildTest) addCommand(cmdLine string, dir string) *BuildCommand {
 	cmd.handler = nil
 	cmd.test = t
 
-	t.Commands = append(t.Commands, cmd)
-
 	return cmd
 }
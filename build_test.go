@@ -96,3 +96,31 @@ func TestHexString(t *testing.T) {
 		assert.Equal(test.expected, isHexString(test.input))
 	}
 }
+
+func TestBuildConfFromTarget(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	target := &Target{
+		Name:             "asst2",
+		KConfig:          "ASST2",
+		RequiredCommit:   "abc123",
+		RequiresUserland: true,
+		Build: TargetBuild{
+			Timeout:        600,
+			CommandTimeout: 120,
+			Warnings:       &WarningPolicy{Points: 1},
+		},
+	}
+
+	conf := target.BuildConf()
+	assert.Equal("ASST2", conf.KConfig)
+	assert.Equal("abc123", conf.RequiredCommit)
+	assert.True(conf.RequiresUserland)
+	assert.Equal(uint(600), conf.Timeout)
+	assert.Equal(uint(120), conf.CommandTimeout)
+	assert.Equal(target.Build.Warnings, conf.Warnings)
+	assert.Equal("asst2", conf.Overlay)
+	assert.Equal("", conf.Repo)
+	assert.Equal("", conf.CommitID)
+}
@@ -0,0 +1,455 @@
+package test161
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/termie/go-shutil"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements the content-addressed build cache. Builds of the same
+// commit, with the same overlay, kernel config, userland flag, and toolchain,
+// produce the same root directory, so we keep the output of successful builds
+// and reuse it instead of building again. This happens a lot when students
+// resubmit the same commit to different (sub)targets.
+//
+// Each entry is a directory in CacheDir/roots with the root directory and the
+// entry metadata, which includes the secure output keys that were compiled
+// into the binaries and the commit history (for required commit checks).
+// Entry directories have a random suffix so a rebuilt entry never has the
+// same path as one that was evicted, since workers cache roots by path.
+
+const (
+	BUILD_CACHE_DIR  = "roots"
+	BUILD_CACHE_SIZE = 32 // Max number of cached roots
+)
+
+// Toolchain compilers, in the order we try them
+var buildToolchainCmds = []string{"os161-gcc", "mips-harvard-os161-gcc"}
+
+type buildCacheEntry struct {
+	Key         string             `json:"key"`
+	KeyMap      map[string]string  `json:"keys"`
+	Commits     []string           `json:"commits"`
+	PatchIDs    map[string]string  `json:"patch_ids,omitempty"`
+	Diagnostics []*BuildDiagnostic `json:"diagnostics"`
+	Created     time.Time          `json:"created"`
+
+	dir      string
+	users    int
+	lastUsed time.Time
+}
+
+type buildCache struct {
+	dir     string
+	l       sync.Mutex
+	entries map[string]*buildCacheEntry
+}
+
+var (
+	buildCacheLock sync.Mutex
+	buildCaches    = make(map[string]*buildCache)
+
+	toolchainOnce    sync.Once
+	toolchainVersion string
+)
+
+// Get the version of the OS/161 toolchain, or "" if we can't find it.
+func getToolchainVersion() string {
+	toolchainOnce.Do(func() {
+		for _, cmd := range buildToolchainCmds {
+			if out, err := exec.Command(cmd, "--version").Output(); err == nil {
+				toolchainVersion = strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+				return
+			}
+		}
+	})
+	return toolchainVersion
+}
+
+// Get the build cache for a cache directory, loading existing entries the
+// first time.
+func getBuildCache(cacheDir string) (*buildCache, error) {
+	buildCacheLock.Lock()
+	defer buildCacheLock.Unlock()
+
+	if cache, ok := buildCaches[cacheDir]; ok {
+		return cache, nil
+	}
+
+	cache := &buildCache{
+		dir:     path.Join(cacheDir, BUILD_CACHE_DIR),
+		entries: make(map[string]*buildCacheEntry),
+	}
+	if err := os.MkdirAll(cache.dir, 0770); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(cache.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		dir := path.Join(cache.dir, f.Name())
+		entry, err := loadBuildCacheEntry(dir)
+		if err != nil || cache.entries[entry.Key] != nil {
+			// Incomplete or duplicate
+			os.RemoveAll(dir)
+			continue
+		}
+		entry.lastUsed = f.ModTime()
+		cache.entries[entry.Key] = entry
+	}
+
+	buildCaches[cacheDir] = cache
+	return cache, nil
+}
+
+func loadBuildCacheEntry(dir string) (*buildCacheEntry, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, "entry.json"))
+	if err != nil {
+		return nil, err
+	}
+	entry := &buildCacheEntry{}
+	if err = json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	if len(entry.Key) == 0 {
+		return nil, errors.New("Missing build cache key")
+	}
+	entry.dir = dir
+	return entry, nil
+}
+
+func (entry *buildCacheEntry) rootDir() string {
+	return path.Join(entry.dir, "root")
+}
+
+// Returns true if the entry's commit history includes the commit.
+func (entry *buildCacheEntry) hasCommit(commit string) bool {
+	for _, c := range entry.Commits {
+		if c == commit {
+			return true
+		}
+	}
+	return false
+}
+
+// The entry's commit history, for commit requirement checks. Entries from
+// older versions only have the commits.
+func (entry *buildCacheEntry) history() *commitHistory {
+	return &commitHistory{
+		Commits:  entry.Commits,
+		PatchIDs: entry.PatchIDs,
+	}
+}
+
+// Look up a build, marking it in use. The entry must be released when the
+// caller is done with its root directory.
+func (cache *buildCache) acquire(key string) *buildCacheEntry {
+	cache.l.Lock()
+	defer cache.l.Unlock()
+
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+
+	// Make sure it hasn't been removed out from under us
+	if _, err := os.Stat(entry.rootDir()); err != nil {
+		delete(cache.entries, key)
+		return nil
+	}
+
+	entry.users += 1
+	entry.lastUsed = time.Now()
+	now := time.Now()
+	os.Chtimes(entry.dir, now, now)
+
+	return entry
+}
+
+func (cache *buildCache) release(entry *buildCacheEntry) {
+	cache.l.Lock()
+	defer cache.l.Unlock()
+	entry.users -= 1
+}
+
+// Add a build to the cache, copying its root directory. The new entry is
+// returned in use. If someone else beat us to it, we get their entry.
+func (cache *buildCache) add(entry *buildCacheEntry, rootDir string) (*buildCacheEntry, error) {
+	if existing := cache.acquire(entry.Key); existing != nil {
+		return existing, nil
+	}
+
+	// Copy to a temp directory first so we never have partial entries
+	dir, err := ioutil.TempDir(cache.dir, entry.Key+".")
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(dir, 0770); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	entry.dir = dir
+	entry.Created = time.Now()
+
+	// shutil can't copy sockets
+	os.RemoveAll(path.Join(rootDir, ".sockets/"))
+
+	if err = shutil.CopyTree(rootDir, entry.rootDir(), nil); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(dir, "entry.json"), data, 0660)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	cache.l.Lock()
+	defer cache.l.Unlock()
+
+	if existing, ok := cache.entries[entry.Key]; ok {
+		os.RemoveAll(dir)
+		existing.users += 1
+		existing.lastUsed = time.Now()
+		return existing, nil
+	}
+
+	entry.users = 1
+	entry.lastUsed = time.Now()
+	cache.entries[entry.Key] = entry
+	cache.evict()
+
+	return entry, nil
+}
+
+// Sort entries by last use, oldest first
+type buildCacheEntriesByUse []*buildCacheEntry
+
+func (b buildCacheEntriesByUse) Len() int           { return len(b) }
+func (b buildCacheEntriesByUse) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b buildCacheEntriesByUse) Less(i, j int) bool { return b[i].lastUsed.Before(b[j].lastUsed) }
+
+// Remove the least recently used entries that aren't in use until we're
+// under the cache size. Must hold cache.l.
+func (cache *buildCache) evict() {
+	if len(cache.entries) <= BUILD_CACHE_SIZE {
+		return
+	}
+
+	entries := make([]*buildCacheEntry, 0, len(cache.entries))
+	for _, entry := range cache.entries {
+		if entry.users == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Sort(buildCacheEntriesByUse(entries))
+
+	for _, entry := range entries {
+		if len(cache.entries) <= BUILD_CACHE_SIZE {
+			break
+		}
+		os.RemoveAll(entry.dir)
+		delete(cache.entries, entry.Key)
+	}
+}
+
+// Compute the build's cache key, or "" if the build can't be cached. The key
+// covers the build recipe too, unless it's the default. We only
+// cache builds of specific commits, since branches and tags move, and only
+// if we know the overlay commit and toolchain version.
+func (t *BuildTest) initCacheKey() {
+	t.cacheKey = ""
+
+	if len(t.conf.CacheDir) == 0 || len(t.conf.CommitID) != 40 || !isHexString(t.conf.CommitID) {
+		return
+	}
+
+	toolchain := getToolchainVersion()
+	if len(toolchain) == 0 {
+		return
+	}
+
+	overlay := ""
+	if len(t.conf.Overlay) > 0 && t.env != nil {
+		overlayPath := path.Join(t.env.OverlayRoot, t.conf.Overlay)
+		if _, err := os.Stat(overlayPath); err == nil {
+			commit, err := overlayCommit(t.env.OverlayRoot)
+			if err != nil {
+				return
+			}
+			t.overlayCommitID = commit
+			overlay = t.conf.Overlay + "@" + t.overlayCommitID
+		}
+	}
+
+	parts := []string{
+		strings.ToLower(t.conf.CommitID),
+		overlay,
+		t.conf.KConfig,
+		fmt.Sprintf("%v", t.conf.RequiresUserland),
+		toolchain,
+	}
+
+	// Other recipes build different things (this keeps existing keys the same)
+	if t.recipe != nil && t.recipe != DefaultBuildRecipe {
+		parts = append(parts, t.recipe.hash())
+	}
+
+	text := strings.Join(parts, "\n")
+
+	hashbytes := sha256.Sum256([]byte(text))
+	t.cacheKey = strings.ToLower(hex.EncodeToString(hashbytes[:]))
+}
+
+// Try to use a cached build. Returns true if we found one, in which case the
+// build test has been updated with the cached results.
+func (t *BuildTest) useCachedBuild() (bool, error) {
+	if len(t.cacheKey) == 0 {
+		return false, nil
+	}
+
+	cache, err := getBuildCache(t.conf.CacheDir)
+	if err != nil {
+		t.env.Log.Println("Error opening build cache:", err)
+		return false, nil
+	}
+
+	entry := cache.acquire(t.cacheKey)
+	if entry == nil {
+		return false, nil
+	}
+
+	// The commit requirements depend on the target, so check them here. If
+	// the entry doesn't have the history we need, build it again.
+	reqs := t.commitRequirements()
+	history := entry.history()
+	if !history.canCheck(reqs) {
+		cache.release(entry)
+		return false, nil
+	}
+
+	t.useCacheEntry(cache, entry)
+
+	cmd := t.newCommand(fmt.Sprintf("cache %v", t.cacheKey), t.dir)
+	cmd.Output = append(cmd.Output, &OutputLine{
+		Line:     fmt.Sprintf("Using cached build from %v", entry.Created.Format(time.RFC1123)),
+		SimTime:  TimeFixedPoint(1),
+		WallTime: TimeFixedPoint(1),
+	})
+	t.Commands = []*BuildCommand{cmd}
+
+	if err := reqs.Check(history); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			cmd.Output = append(cmd.Output, &OutputLine{
+				Line:     line,
+				SimTime:  TimeFixedPoint(1),
+				WallTime: TimeFixedPoint(1),
+			})
+		}
+		cmd.Status = COMMAND_STATUS_INCORRECT
+		return true, err
+	}
+
+	cmd.Status = COMMAND_STATUS_CORRECT
+	return true, nil
+}
+
+// Point the build at a cache entry, whose root we now hold.
+func (t *BuildTest) useCacheEntry(cache *buildCache, entry *buildCacheEntry) {
+	t.cache = cache
+	t.cacheEntry = entry
+	t.rootDir = entry.rootDir()
+
+	for id, key := range entry.KeyMap {
+		t.env.keyMap[id] = key
+	}
+
+	if entry.Diagnostics != nil {
+		t.Diagnostics = entry.Diagnostics
+	}
+}
+
+// Save a successful build to the cache. Errors are logged since the build
+// itself is fine.
+func (t *BuildTest) saveCachedBuild() {
+	if len(t.cacheKey) == 0 {
+		return
+	}
+
+	history, err := readCommitHistory(t.srcDir, t.cmdEnv)
+	if err != nil {
+		t.env.Log.Println("Error getting commit history for build cache:", err)
+		return
+	}
+
+	t.saveCacheEntry(history)
+}
+
+// Save the build's root to the cache, along with the commit history of what
+// was built. Remote builds send us their history.
+func (t *BuildTest) saveCacheEntry(history *commitHistory) {
+	if len(t.cacheKey) == 0 {
+		return
+	}
+
+	cache, err := getBuildCache(t.conf.CacheDir)
+	if err != nil {
+		t.env.Log.Println("Error opening build cache:", err)
+		return
+	}
+
+	entry := &buildCacheEntry{
+		Key:         t.cacheKey,
+		KeyMap:      make(map[string]string),
+		Commits:     history.Commits,
+		PatchIDs:    history.PatchIDs,
+		Diagnostics: t.Diagnostics,
+	}
+	for id, key := range t.env.keyMap {
+		entry.KeyMap[id] = key
+	}
+
+	if entry, err = cache.add(entry, t.rootDir); err != nil {
+		t.env.Log.Println("Error adding build to cache:", err)
+		return
+	}
+
+	// Use the cached copy so later builds of the repo don't change our root
+	t.useCacheEntry(cache, entry)
+}
+
+// Release the build's root directory. Cached roots stay around for the next
+// build, temp directories are removed, and shared build directories are
+// unlocked.
+func (res *BuildResults) Release() {
+	if res.cacheEntry != nil {
+		res.cache.release(res.cacheEntry)
+		res.cacheEntry = nil
+	}
+	if res.unlock != nil {
+		res.unlock()
+		res.unlock = nil
+	}
+	if len(res.TempDir) > 0 {
+		os.RemoveAll(res.TempDir)
+	}
+}
@@ -0,0 +1,157 @@
+package test161
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func makeBuildCacheRoot(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "test161-root")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if err = ioutil.WriteFile(path.Join(dir, "kernel"), []byte(contents), 0664); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return dir
+}
+
+func TestBuildCacheAddAcquire(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	cacheDir, err := ioutil.TempDir("", "test161-cache")
+	assert.Nil(err)
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := getBuildCache(cacheDir)
+	assert.Nil(err)
+	if cache == nil {
+		t.FailNow()
+	}
+
+	assert.Nil(cache.acquire("abc"))
+
+	root := makeBuildCacheRoot(t, "kernel1")
+	defer os.RemoveAll(root)
+
+	entry, err := cache.add(&buildCacheEntry{
+		Key:     "abc",
+		KeyMap:  map[string]string{"sem1": "1234"},
+		Commits: []string{"c1", "c2"},
+	}, root)
+	assert.Nil(err)
+	if entry == nil {
+		t.FailNow()
+	}
+	assert.Equal(1, entry.users)
+	assert.True(entry.hasCommit("c2"))
+	assert.False(entry.hasCommit("c3"))
+
+	data, err := ioutil.ReadFile(path.Join(entry.rootDir(), "kernel"))
+	assert.Nil(err)
+	assert.Equal("kernel1", string(data))
+
+	// Adding the same key again gets the existing entry
+	again, err := cache.add(&buildCacheEntry{Key: "abc"}, root)
+	assert.Nil(err)
+	assert.Equal(entry, again)
+	assert.Equal(2, entry.users)
+
+	cache.release(entry)
+	cache.release(entry)
+	assert.Equal(0, entry.users)
+
+	found := cache.acquire("abc")
+	assert.Equal(entry, found)
+	cache.release(found)
+
+	// A new cache for the same directory loads the existing entries
+	buildCacheLock.Lock()
+	delete(buildCaches, cacheDir)
+	buildCacheLock.Unlock()
+	cache, err = getBuildCache(cacheDir)
+	assert.Nil(err)
+	found = cache.acquire("abc")
+	if assert.NotNil(found) {
+		assert.Equal(entry.dir, found.dir)
+		assert.Equal("1234", found.KeyMap["sem1"])
+		assert.Equal([]string{"c1", "c2"}, found.Commits)
+	}
+}
+
+func TestBuildCacheEvict(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	cacheDir, err := ioutil.TempDir("", "test161-cache")
+	assert.Nil(err)
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := getBuildCache(cacheDir)
+	assert.Nil(err)
+	if cache == nil {
+		t.FailNow()
+	}
+
+	root := makeBuildCacheRoot(t, "kernel")
+	defer os.RemoveAll(root)
+
+	// Keep the first one in use
+	first, err := cache.add(&buildCacheEntry{Key: "key0"}, root)
+	assert.Nil(err)
+
+	for i := 1; i <= BUILD_CACHE_SIZE+1; i++ {
+		entry, err := cache.add(&buildCacheEntry{Key: fmt.Sprintf("key%v", i)}, root)
+		assert.Nil(err)
+		if entry != nil {
+			cache.release(entry)
+		}
+	}
+
+	assert.Equal(BUILD_CACHE_SIZE, len(cache.entries))
+	assert.NotNil(cache.entries["key0"])
+	assert.Nil(cache.entries["key1"])
+	assert.Nil(cache.entries["key2"])
+	assert.NotNil(cache.entries[fmt.Sprintf("key%v", BUILD_CACHE_SIZE+1)])
+
+	cache.release(first)
+
+	files, err := ioutil.ReadDir(cache.dir)
+	assert.Nil(err)
+	assert.Equal(BUILD_CACHE_SIZE, len(files))
+}
+
+func TestBuildCacheKey(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// Only specific commits are cacheable
+	for _, commit := range []string{"HEAD", "master", "e1a2fbd0", ""} {
+		test := &BuildTest{
+			conf: &BuildConf{
+				CacheDir: "/tmp",
+				CommitID: commit,
+				KConfig:  "DUMBVM",
+			},
+		}
+		test.initCacheKey()
+		assert.Equal("", test.cacheKey, commit)
+	}
+
+	// And only if we're caching
+	test := &BuildTest{
+		conf: &BuildConf{
+			CommitID: "e1a2fbd038c618b6d9e636a94e1907dc92e94ca6",
+			KConfig:  "DUMBVM",
+		},
+	}
+	test.initCacheKey()
+	assert.Equal("", test.cacheKey)
+}
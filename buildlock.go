@@ -0,0 +1,158 @@
+package test161
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Builds from the same repository share a build directory in the cache (see
+// BuildTest.initDirs), so only one of them can use it at a time. Within the
+// server, builds wait for each other in lockBuildDir. We also flock a file in
+// the directory in case another process (e.g. a second server or a local
+// test161) is using the same cache.
+
+// BUILD_LOCK_FILE is the file we flock in each build directory.
+const BUILD_LOCK_FILE = ".test161.lock"
+
+// BuildLockInfo describes a build directory that is in use, for the server
+// stats.
+type BuildLockInfo struct {
+	Dir     string    `json:"dir"`
+	Holder  string    `json:"holder"` // ID of the build holding the lock
+	Since   time.Time `json:"since"`
+	Waiting int       `json:"waiting"` // Builds waiting for the lock
+}
+
+type buildDirLock struct {
+	sem     chan bool
+	holder  string
+	since   time.Time
+	waiting int
+}
+
+var (
+	buildLocksLock sync.Mutex
+	buildLocks     = make(map[string]*buildDirLock)
+)
+
+// Lock the build directory, waiting until the holder releases it. Returns
+// the function to unlock it.
+func lockBuildDir(dir, holder string) (func(), error) {
+	buildLocksLock.Lock()
+	lock, ok := buildLocks[dir]
+	if !ok {
+		lock = &buildDirLock{sem: make(chan bool, 1)}
+		buildLocks[dir] = lock
+	}
+	lock.waiting += 1
+	buildLocksLock.Unlock()
+
+	lock.sem <- true
+
+	buildLocksLock.Lock()
+	lock.waiting -= 1
+	lock.holder = holder
+	lock.since = time.Now()
+	buildLocksLock.Unlock()
+
+	release := func() {
+		buildLocksLock.Lock()
+		lock.holder = ""
+		if lock.waiting == 0 {
+			delete(buildLocks, dir)
+		}
+		buildLocksLock.Unlock()
+		<-lock.sem
+	}
+
+	file, err := os.OpenFile(path.Join(dir, BUILD_LOCK_FILE), os.O_CREATE|os.O_RDWR, 0660)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		release()
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+			file.Close()
+			release()
+		})
+	}, nil
+}
+
+// Sort locks by directory
+type buildLocksByDir []*BuildLockInfo
+
+func (b buildLocksByDir) Len() int           { return len(b) }
+func (b buildLocksByDir) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b buildLocksByDir) Less(i, j int) bool { return b[i].Dir < b[j].Dir }
+
+// BuildLocks returns the build directories that are in use or waited for.
+func BuildLocks() []*BuildLockInfo {
+	buildLocksLock.Lock()
+	defer buildLocksLock.Unlock()
+
+	res := make([]*BuildLockInfo, 0, len(buildLocks))
+	for dir, lock := range buildLocks {
+		res = append(res, &BuildLockInfo{
+			Dir:     dir,
+			Holder:  lock.holder,
+			Since:   lock.since,
+			Waiting: lock.waiting,
+		})
+	}
+	sort.Sort(buildLocksByDir(res))
+	return res
+}
+
+// Lock the build's directory, if it's shared.
+func (t *BuildTest) lockDir() error {
+	if t.isTempDir || t.unlock != nil {
+		return nil
+	}
+
+	holder := t.SubmissionID
+	if len(holder) == 0 {
+		holder = t.ID
+	}
+
+	unlock, err := lockBuildDir(t.dir, holder)
+	if err != nil {
+		return err
+	}
+	t.unlock = unlock
+	return nil
+}
+
+func (t *BuildTest) unlockDir() {
+	if t.unlock != nil {
+		t.unlock()
+		t.unlock = nil
+	}
+}
+
+// Get the build directory ready, now that we hold the lock. The commands were
+// planned before we had it, so another build may have cloned the repo since.
+func (t *BuildTest) prepareDir() {
+	if t.isTempDir {
+		return
+	}
+
+	if len(t.Commands) > 0 && strings.HasPrefix(t.Commands[0].Input.Line, "git clone ") {
+		os.RemoveAll(t.srcDir)
+	}
+
+	// Always start from clean build directories
+	t.cleanRecipeDirs()
+}
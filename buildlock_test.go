@@ -0,0 +1,129 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func findBuildLock(dir string) *BuildLockInfo {
+	for _, info := range BuildLocks() {
+		if info.Dir == dir {
+			return info
+		}
+	}
+	return nil
+}
+
+func TestBuildLockContention(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test161-lock")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	unlock, err := lockBuildDir(dir, "first")
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+
+	info := findBuildLock(dir)
+	if assert.NotNil(info) {
+		assert.Equal("first", info.Holder)
+		assert.Equal(0, info.Waiting)
+	}
+
+	locked := make(chan func())
+	go func() {
+		unlock2, err := lockBuildDir(dir, "second")
+		assert.Nil(err)
+		locked <- unlock2
+	}()
+
+	// The second build waits
+	for i := 0; i < 100; i++ {
+		if info = findBuildLock(dir); info != nil && info.Waiting == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.NotNil(info) {
+		assert.Equal("first", info.Holder)
+		assert.Equal(1, info.Waiting)
+	}
+	select {
+	case <-locked:
+		assert.Fail("Lock acquired while held")
+	default:
+	}
+
+	unlock()
+	unlock() // Unlocking twice is harmless
+
+	var unlock2 func()
+	select {
+	case unlock2 = <-locked:
+	case <-time.After(5 * time.Second):
+		assert.Fail("Lock not acquired after release")
+		t.FailNow()
+	}
+
+	info = findBuildLock(dir)
+	if assert.NotNil(info) {
+		assert.Equal("second", info.Holder)
+		assert.Equal(0, info.Waiting)
+	}
+
+	unlock2()
+	assert.Nil(findBuildLock(dir))
+}
+
+func TestBuildLockPrepare(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test161-lock")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	test := &BuildTest{
+		dir:    dir,
+		srcDir: dir + "/src",
+		conf:   &BuildConf{KConfig: "ASST1", Repo: "git@example.com:repo.git"},
+		recipe: DefaultBuildRecipe,
+	}
+	compDir := test.srcDir + "/kern/compile/ASST1"
+	assert.Nil(os.MkdirAll(compDir, 0770))
+
+	// Planned a fetch, so keep the source but clean the compile directory
+	test.addCommand("git fetch", test.srcDir)
+	test.prepareDir()
+	_, err = os.Stat(compDir)
+	assert.NotNil(err)
+	_, err = os.Stat(test.srcDir)
+	assert.Nil(err)
+
+	// Planned a clone, but someone else cloned it first
+	test.Commands = nil
+	test.addCommand("git clone git@example.com:repo.git src", dir)
+	test.prepareDir()
+	_, err = os.Stat(test.srcDir)
+	assert.NotNil(err)
+
+	// The lock is released with the results
+	assert.Nil(test.lockDir())
+	assert.NotNil(findBuildLock(dir))
+	res := test.results()
+	assert.Nil(test.unlock)
+	res.Release()
+	assert.Nil(findBuildLock(dir))
+}
@@ -121,6 +121,9 @@ type CommandTemplate struct {
 	Panic    string             `yaml:"panics"`   // CMD_OPT
 	TimesOut string             `yaml:"timesout"` // CMD_OPT
 	Timeout  float32            `yaml:"timeout"`  // Timeout in sec. A timeout of 0.0 uses the test default.
+
+	// Partial credit sub-checks (see subchecks.go)
+	SubChecks []*SubCheck `yaml:"subchecks"`
 }
 
 // An expected line of output, which may either be expanded or not.
@@ -152,6 +155,8 @@ func (ct *CommandTemplate) Clone() *CommandTemplate {
 		clone.Input = append(clone.Input, s)
 	}
 
+	clone.SubChecks = copySubChecks(ct.SubChecks)
+
 	return &clone
 }
 
@@ -259,6 +264,11 @@ func (c *Command) Instantiate(env *TestEnvironment) error {
 	c.TimesOut = tmpl.TimesOut
 	c.Timeout = tmpl.Timeout
 
+	// Targets can replace the template's sub-checks
+	if len(c.SubChecks) == 0 {
+		c.SubChecks = copySubChecks(tmpl.SubChecks)
+	}
+
 	// Input
 
 	// Check if  we need to create some input. If args haven't already been
@@ -351,6 +361,9 @@ func CommandTemplatesFromString(text string) (*CommandTemplates, error) {
 
 	for _, t := range cmds.Templates {
 		t.fixDefaults()
+		if err := checkSubChecks(t.SubChecks); err != nil {
+			return nil, fmt.Errorf("Command %v: %v", t.Name, err)
+		}
 	}
 
 	return cmds, nil
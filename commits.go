@@ -0,0 +1,364 @@
+package test161
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// This file checks the commit history of a submission. Targets can require
+// commits (e.g. handout updates) and forbid others (e.g. leaked solution sets).
+// A requirement is a commit id or a patch id. Patch ids (from git patch-id
+// --stable) are the same for a commit and its rebased copies, so students who
+// rebase onto our updates still pass. A requirement can also name a tag, which
+// is resolved on the server against our clone of the handout repository (never
+// the student's, where tags can be created or moved) and checked by the
+// resulting commit and patch id.
+
+// A CommitRequirement identifies a commit that must, or must not, be in the
+// history. Either Commit or PatchID can match.
+type CommitRequirement struct {
+	Name    string `yaml:"name" bson:"name"`         // What to call it when the check fails
+	Commit  string `yaml:"commit" bson:"commit"`     // A commit id (or at least 7 characters of one)
+	PatchID string `yaml:"patch_id" bson:"patch_id"` // The patch id of a commit in the history
+	Tag     string `yaml:"tag" bson:"tag"`           // A tag in the handout repository, resolved on the server
+}
+
+// CommitRequirements are checked before building.
+type CommitRequirements struct {
+	Require []*CommitRequirement `yaml:"require" bson:"require"`
+	Forbid  []*CommitRequirement `yaml:"forbid" bson:"forbid"`
+}
+
+// The commit history of the repo we built
+type commitHistory struct {
+	Commits  []string
+	PatchIDs map[string]string // Patch id -> commit
+}
+
+// The commands that get the history. Patch ids are only computed for
+// non-merge commits.
+const (
+	HISTORY_LOG_CMD      = "git log --pretty=format:%H"
+	HISTORY_PATCH_ID_CMD = "git log -p --no-merges --no-color --no-ext-diff | git patch-id --stable"
+)
+
+// The command that gets the patch id of a tag's commit in the handout repository
+const TAG_PATCH_ID_CMD = "git show --no-color --no-ext-diff %v | git patch-id --stable"
+
+// Tags we'll look up. They're passed to git, so keep them to ordinary names.
+var validTagRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+func (r *CommitRequirement) String() string {
+	if len(r.Name) > 0 {
+		return r.Name
+	} else if len(r.Tag) > 0 {
+		return "tag " + r.Tag
+	} else if len(r.Commit) > 0 {
+		return r.Commit
+	} else {
+		return "patch " + r.PatchID
+	}
+}
+
+func (reqs *CommitRequirements) all() []*CommitRequirement {
+	if reqs == nil {
+		return nil
+	}
+	res := make([]*CommitRequirement, 0, len(reqs.Require)+len(reqs.Forbid))
+	res = append(res, reqs.Require...)
+	res = append(res, reqs.Forbid...)
+	return res
+}
+
+func (reqs *CommitRequirements) empty() bool {
+	return len(reqs.all()) == 0
+}
+
+func (reqs *CommitRequirements) needPatchIDs() bool {
+	for _, r := range reqs.all() {
+		if len(r.PatchID) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the requirements are well-formed.
+func (reqs *CommitRequirements) Validate() error {
+	for _, r := range reqs.all() {
+		if len(r.Commit) == 0 && len(r.PatchID) == 0 && len(r.Tag) == 0 {
+			return errors.New("Commit requirements need a commit, tag, or patch_id")
+		}
+		if len(r.Tag) > 0 && (len(r.Commit) > 0 || len(r.PatchID) > 0) {
+			return fmt.Errorf("Commit requirement for tag %v can't also give a commit or patch_id", r.Tag)
+		}
+		if len(r.Tag) > 0 && !validTagRegexp.MatchString(r.Tag) {
+			return fmt.Errorf("Invalid tag in commit requirement: %v", r.Tag)
+		}
+		if len(r.Commit) > 0 && (len(r.Commit) < 7 || !isHexString(r.Commit)) {
+			return fmt.Errorf("Invalid commit id in commit requirement: %v", r.Commit)
+		}
+		if len(r.PatchID) > 0 && !isHexString(r.PatchID) {
+			return fmt.Errorf("Invalid patch id in commit requirement: %v", r.PatchID)
+		}
+	}
+	return nil
+}
+
+// HasTags returns true if any requirement is given by tag, in which case the
+// server needs a handout repository to resolve it.
+func (reqs *CommitRequirements) HasTags() bool {
+	for _, r := range reqs.all() {
+		if len(r.Tag) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve a tag in the handout repository to its commit and patch id. Merge
+// commits don't have a patch id.
+func resolveTag(handoutDir, tag string) (commit, patchID string, err error) {
+	c := exec.Command("git", "-C", handoutDir, "rev-parse", "--verify", "--quiet", tag+"^{commit}")
+	out, err := c.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to resolve tag %v in the handout repository", tag)
+	}
+	commit = strings.TrimSpace(string(out))
+
+	c = exec.Command("/bin/sh", "-c", fmt.Sprintf(TAG_PATCH_ID_CMD, commit))
+	c.Dir = handoutDir
+	if out, err = c.Output(); err != nil {
+		return "", "", fmt.Errorf("Unable to get the patch id of tag %v: %v", tag, err)
+	}
+	if fields := strings.Fields(string(out)); len(fields) == 2 {
+		patchID = fields[0]
+	}
+	return commit, patchID, nil
+}
+
+// Resolve the tag requirements against the handout repository, returning a
+// copy that checks the tags' commits and patch ids. Requirements that have
+// already been resolved (e.g. on the server, for a worker) are left alone.
+// Without a handout repository, unresolved tags are dropped.
+func (reqs *CommitRequirements) resolveTags(handoutDir string) (*CommitRequirements, error) {
+	if !reqs.HasTags() {
+		return reqs, nil
+	}
+
+	resolve := func(list []*CommitRequirement) ([]*CommitRequirement, error) {
+		res := make([]*CommitRequirement, 0, len(list))
+		for _, r := range list {
+			req := *r
+			if len(r.Tag) > 0 && len(r.Commit) == 0 && len(r.PatchID) == 0 {
+				if len(handoutDir) == 0 {
+					continue
+				}
+				var err error
+				if req.Commit, req.PatchID, err = resolveTag(handoutDir, r.Tag); err != nil {
+					return nil, err
+				}
+			}
+			res = append(res, &req)
+		}
+		return res, nil
+	}
+
+	var err error
+	resolved := &CommitRequirements{}
+	if resolved.Require, err = resolve(reqs.Require); err != nil {
+		return nil, err
+	}
+	if resolved.Forbid, err = resolve(reqs.Forbid); err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// Resolve the build's tag requirements. The server has to have a handout
+// repository (see test161-server), so the only builds without one should be
+// students' local builds, which skip them.
+func (t *BuildTest) resolveCommitTags() error {
+	if !t.conf.Commits.HasTags() {
+		return nil
+	}
+	if len(t.env.HandoutDir) == 0 {
+		t.env.Log.Println("Warning: no handout repository, skipping tag commit requirements")
+	}
+	reqs, err := t.conf.Commits.resolveTags(t.env.HandoutDir)
+	if err != nil {
+		return err
+	}
+	t.conf.Commits = reqs
+	return nil
+}
+
+// Returns true if the history has a commit (or an abbreviation of one).
+func (h *commitHistory) hasCommit(commit string) bool {
+	commit = strings.ToLower(commit)
+	for _, c := range h.Commits {
+		if strings.HasPrefix(c, commit) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the requirement matches a commit in the history.
+func (h *commitHistory) matches(r *CommitRequirement) bool {
+	if len(r.Commit) > 0 && h.hasCommit(r.Commit) {
+		return true
+	}
+	if len(r.PatchID) > 0 {
+		if _, ok := h.PatchIDs[strings.ToLower(r.PatchID)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if we have the history we need to check the requirements.
+func (h *commitHistory) canCheck(reqs *CommitRequirements) bool {
+	if reqs.needPatchIDs() && h.PatchIDs == nil {
+		return false
+	}
+	return true
+}
+
+// Check returns an error describing every requirement the history fails.
+func (reqs *CommitRequirements) Check(h *commitHistory) error {
+	problems := make([]string, 0)
+
+	for _, r := range reqs.Require {
+		if !h.matches(r) {
+			problems = append(problems, fmt.Sprintf("Cannot find required commit: %v", r))
+		}
+	}
+	for _, r := range reqs.Forbid {
+		if h.matches(r) {
+			problems = append(problems, fmt.Sprintf("Found a commit that is not allowed: %v", r))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// Parse git patch-id output (patch id, commit).
+func parsePatchIDs(lines []string, ids map[string]string) {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			ids[fields[0]] = fields[1]
+		}
+	}
+}
+
+// Get the command's output, without the Exec line.
+func commandLines(cmd *BuildCommand) []string {
+	lines := make([]string, 0, len(cmd.Output))
+	for i, l := range cmd.Output {
+		if i == 0 && strings.HasPrefix(l.Line, "Exec: ") {
+			continue
+		}
+		lines = append(lines, l.Line)
+	}
+	return lines
+}
+
+// The commit requirements for the build, including the old single required
+// commit.
+func (t *BuildTest) commitRequirements() *CommitRequirements {
+	reqs := &CommitRequirements{}
+	if t.conf.Commits != nil {
+		reqs.Require = append(reqs.Require, t.conf.Commits.Require...)
+		reqs.Forbid = append(reqs.Forbid, t.conf.Commits.Forbid...)
+	}
+	if len(t.conf.RequiredCommit) > 0 {
+		reqs.Require = append(reqs.Require, &CommitRequirement{Commit: t.conf.RequiredCommit})
+	}
+	return reqs
+}
+
+// Handler functions for the history commands
+func commitLogHandler(t *BuildTest, command *BuildCommand) error {
+	t.history.Commits = make([]string, 0)
+	for _, line := range commandLines(command) {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			t.history.Commits = append(t.history.Commits, line)
+		}
+	}
+	return nil
+}
+
+func patchIDHandler(t *BuildTest, command *BuildCommand) error {
+	t.history.PatchIDs = make(map[string]string)
+	parsePatchIDs(commandLines(command), t.history.PatchIDs)
+	return nil
+}
+
+// Add the commands that check the commit requirements, after checkout. The
+// last one checks the requirements once we have everything.
+func (t *BuildTest) addHistoryCommands() {
+	reqs := t.commitRequirements()
+	if reqs.empty() {
+		return
+	}
+
+	t.history = &commitHistory{}
+
+	cmd := t.addCommand(HISTORY_LOG_CMD, t.srcDir)
+	cmd.handler = commitLogHandler
+	cmd.quiet = true
+
+	if reqs.needPatchIDs() {
+		cmd = t.addCommand(HISTORY_PATCH_ID_CMD, t.srcDir)
+		cmd.shell = true
+		cmd.handler = patchIDHandler
+		cmd.quiet = true
+	}
+
+	handler := cmd.handler
+	cmd.handler = func(t *BuildTest, command *BuildCommand) error {
+		if err := handler(t, command); err != nil {
+			return err
+		}
+		return reqs.Check(t.history)
+	}
+}
+
+// Read the history directly, for the build cache.
+func readCommitHistory(dir string, env []string) (*commitHistory, error) {
+	run := func(args ...string) ([]string, error) {
+		c := exec.Command(args[0], args[1:]...)
+		c.Dir = dir
+		c.Env = env
+		out, err := c.Output()
+		if err != nil {
+			return nil, err
+		}
+		return strings.Split(string(out), "\n"), nil
+	}
+
+	h := &commitHistory{
+		PatchIDs: make(map[string]string),
+	}
+
+	lines, err := run(strings.Split(HISTORY_LOG_CMD, " ")...)
+	if err != nil {
+		return nil, err
+	}
+	h.Commits = strings.Fields(strings.Join(lines, "\n"))
+
+	if lines, err = run("/bin/sh", "-c", HISTORY_PATCH_ID_CMD); err != nil {
+		return nil, err
+	}
+	parsePatchIDs(lines, h.PatchIDs)
+
+	return h, nil
+}
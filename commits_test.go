@@ -0,0 +1,232 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+var gitTestEnv = append(os.Environ(),
+	"GIT_AUTHOR_NAME=test161", "GIT_AUTHOR_EMAIL=test161@example.com",
+	"GIT_COMMITTER_NAME=test161", "GIT_COMMITTER_EMAIL=test161@example.com",
+)
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	c := exec.Command("git", args...)
+	c.Dir = dir
+	c.Env = gitTestEnv
+	out, err := c.CombinedOutput()
+	if err != nil {
+		t.Log(string(out))
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func gitCommitFile(t *testing.T, dir, file, text string) string {
+	if err := ioutil.WriteFile(path.Join(dir, file), []byte(text), 0664); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", file)
+	runGit(t, dir, "commit", "-q", "-m", file)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
+
+func TestCommitRequirements(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	history := &commitHistory{
+		Commits:  []string{"aaaaaaa111", "bbbbbbb222"},
+		PatchIDs: map[string]string{"1234": "aaaaaaa111"},
+	}
+
+	reqs := &CommitRequirements{
+		Require: []*CommitRequirement{
+			&CommitRequirement{Commit: "aaaaaaa"},
+			&CommitRequirement{Commit: "bbbbbbb"},
+			&CommitRequirement{Name: "handout update", Commit: "ddddddd444", PatchID: "1234"},
+		},
+		Forbid: []*CommitRequirement{
+			&CommitRequirement{Name: "solutions", Commit: "eeeeeee555"},
+			&CommitRequirement{PatchID: "9999"},
+		},
+	}
+	assert.Nil(reqs.Validate())
+	assert.Nil(reqs.Check(history))
+
+	reqs.Require = append(reqs.Require, &CommitRequirement{Name: "asst2 update", PatchID: "5678"})
+	reqs.Forbid = append(reqs.Forbid, &CommitRequirement{Name: "leaked", Commit: "bbbbbbb"})
+	err := reqs.Check(history)
+	if assert.NotNil(err) {
+		assert.Equal("Cannot find required commit: asst2 update\nFound a commit that is not allowed: leaked", err.Error())
+	}
+
+	// Old cache entries only have commits
+	assert.False((&commitHistory{Commits: history.Commits}).canCheck(reqs))
+	assert.True(history.canCheck(reqs))
+
+	assert.NotNil((&CommitRequirements{Require: []*CommitRequirement{&CommitRequirement{}}}).Validate())
+	assert.NotNil((&CommitRequirements{Forbid: []*CommitRequirement{&CommitRequirement{Commit: "xyz"}}}).Validate())
+	assert.NotNil((&CommitRequirements{Forbid: []*CommitRequirement{&CommitRequirement{Commit: "abc"}}}).Validate())
+	var none *CommitRequirements
+	assert.Nil(none.Validate())
+}
+
+func TestCommitHistoryRebase(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// Handout repo with an update the students need
+	dir, err := ioutil.TempDir("", "test161-commits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	runGit(t, dir, "init", "-q")
+	base := gitCommitFile(t, dir, "base.c", "base\n")
+	runGit(t, dir, "checkout", "-q", "-b", "update")
+	update := gitCommitFile(t, dir, "update.c", "update\n")
+
+	// The student rebases the update onto their work
+	runGit(t, dir, "checkout", "-q", base)
+	runGit(t, dir, "checkout", "-q", "-b", "student")
+	gitCommitFile(t, dir, "synch.c", "locks\n")
+	runGit(t, dir, "cherry-pick", update)
+
+	history, err := readCommitHistory(dir, gitTestEnv)
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	assert.True(history.hasCommit(base))
+	assert.False(history.hasCommit(update))
+
+	// Patch ids survive the rebase
+	c := exec.Command("/bin/sh", "-c", "git show "+update+" | git patch-id --stable")
+	c.Dir = dir
+	out, err := c.Output()
+	assert.Nil(err)
+	updatePatchID := strings.Fields(string(out))[0]
+
+	reqs := &CommitRequirements{
+		Require: []*CommitRequirement{
+			&CommitRequirement{Commit: base},
+			&CommitRequirement{Name: "update", Commit: update, PatchID: updatePatchID},
+		},
+	}
+	assert.Nil(reqs.Check(history))
+
+	reqs.Require[1].PatchID = ""
+	assert.NotNil(reqs.Check(history))
+
+	// The same checks as build commands
+	env := defaultEnv.CopyEnvironment()
+	env.Persistence = &DoNothingPersistence{}
+	test := &BuildTest{
+		env:       env,
+		srcDir:    dir,
+		cmdEnv:    gitTestEnv,
+		startTime: time.Now(),
+		conf: &BuildConf{
+			RequiredCommit: base,
+			Commits: &CommitRequirements{
+				Require: []*CommitRequirement{&CommitRequirement{Name: "update", PatchID: updatePatchID}},
+				Forbid:  []*CommitRequirement{&CommitRequirement{Name: "solutions", Commit: base}},
+			},
+		},
+	}
+	test.addHistoryCommands()
+	assert.Equal(2, len(test.Commands))
+
+	for i, cmd := range test.Commands {
+		err = cmd.Run(env)
+		if i < len(test.Commands)-1 {
+			assert.Nil(err)
+		}
+	}
+	if assert.NotNil(err) {
+		assert.Equal("Found a commit that is not allowed: solutions", err.Error())
+		last := test.Commands[1]
+		assert.Equal("Found a commit that is not allowed: solutions", last.Output[len(last.Output)-1].Line)
+	}
+}
+
+func TestCommitRequirementTags(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test161-tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Our handout repo, with a tagged update
+	handout := path.Join(dir, "handout")
+	student := path.Join(dir, "student")
+	assert.Nil(os.Mkdir(handout, 0770))
+	runGit(t, handout, "init", "-q")
+	base := gitCommitFile(t, handout, "base.c", "base\n")
+	update := gitCommitFile(t, handout, "update.c", "update\n")
+	runGit(t, handout, "tag", "asst3-update")
+
+	// The student rebases the update onto their work, and moves the tag
+	runGit(t, dir, "clone", "-q", handout, student)
+	runGit(t, student, "reset", "-q", "--hard", base)
+	mine := gitCommitFile(t, student, "synch.c", "locks\n")
+	runGit(t, student, "cherry-pick", update)
+	runGit(t, student, "tag", "-f", "asst3-update", mine)
+
+	reqs := &CommitRequirements{
+		Require: []*CommitRequirement{&CommitRequirement{Name: "update", Tag: "asst3-update"}},
+		Forbid:  []*CommitRequirement{&CommitRequirement{Commit: "eeeeeee555"}},
+	}
+	assert.Nil(reqs.Validate())
+	assert.True(reqs.HasTags())
+
+	resolved, err := reqs.resolveTags(handout)
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	assert.Equal(update, resolved.Require[0].Commit)
+	assert.NotEqual("", resolved.Require[0].PatchID)
+	assert.Equal(1, len(resolved.Forbid))
+	assert.Equal("", reqs.Require[0].Commit)
+
+	// Already resolved requirements are left alone
+	again, err := resolved.resolveTags("")
+	assert.Nil(err)
+	assert.Equal(resolved.Require[0].Commit, again.Require[0].Commit)
+
+	history, err := readCommitHistory(student, gitTestEnv)
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	assert.Nil(resolved.Check(history))
+
+	// The student's own tag doesn't count
+	resolved.Require[0].PatchID = ""
+	if err = resolved.Check(history); assert.NotNil(err) {
+		assert.Equal("Cannot find required commit: update", err.Error())
+	}
+
+	// Local builds skip tags
+	local, err := reqs.resolveTags("")
+	assert.Nil(err)
+	assert.Equal(0, len(local.Require))
+	assert.Equal(1, len(local.Forbid))
+
+	_, err = (&CommitRequirements{Require: []*CommitRequirement{&CommitRequirement{Tag: "missing"}}}).resolveTags(handout)
+	assert.NotNil(err)
+
+	assert.NotNil((&CommitRequirements{Require: []*CommitRequirement{&CommitRequirement{Tag: "-x"}}}).Validate())
+	assert.NotNil((&CommitRequirements{Require: []*CommitRequirement{&CommitRequirement{Tag: "t", Commit: base}}}).Validate())
+	var none *CommitRequirements
+	assert.False(none.HasTags())
+}
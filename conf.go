@@ -152,7 +152,7 @@ func TestFromFile(filename string) (*Test, error) {
 	return test, err
 }
 
-// TestFromFile parses the test string and sets configuration defaults.
+// TestFromString parses the test string and sets configuration defaults.
 func TestFromString(data string) (*Test, error) {
 
 	t, err := confFromString(data)
@@ -160,18 +160,30 @@ func TestFromString(data string) (*Test, error) {
 		return nil, err
 	}
 
+	// Parameterized tests expand into multiple tests
+	if len(t.Matrix) > 0 {
+		return nil, errors.New("test161: test declares a parameter matrix, use TestsFromString")
+	}
+
+	if err = t.initTest(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *Test) initTest() error {
 	// Check for empty commands and expand syntatic sugar before getting
 	// started. Doing this first makes the main loop and retry logic simpler.
 
 	t.ID = uuid.NewV4().String()
-	err = t.initCommands()
-	if err != nil {
-		return nil, err
+	if err := t.initCommands(); err != nil {
+		return err
 	}
 
 	t.Result = TEST_RESULT_NONE
 
-	return t, nil
+	return nil
 }
 
 func (t *Test) MergeConf(defaults Test) error {
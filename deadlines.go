@@ -0,0 +1,221 @@
+package test161
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// This file handles target deadlines. Targets can have an open date, before
+// which submissions aren't accepted, and a close date (the deadline). After
+// the deadline, a target's late policy determines how long late submissions
+// are still accepted and how much they're penalized. Students can be given
+// extensions, which move their deadline for a target.
+//
+// Late penalties are applied to the submission score. The score before the
+// penalty is kept as the submission's RawScore.
+
+// Late penalty curves
+const (
+	LATE_PENALTY_NONE        = "none"        // Late submissions aren't penalized
+	LATE_PENALTY_LINEAR      = "linear"      // Grows linearly to Max at the end of the window
+	LATE_PENALTY_STEP        = "step"        // Rate for each (started) interval
+	LATE_PENALTY_EXPONENTIAL = "exponential" // The score decays by Rate each interval
+)
+
+// Formats for target dates, which are in the server's time zone unless
+// specified.
+var targetDateFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// A LatePolicy specifies how a target handles submissions after its deadline.
+type LatePolicy struct {
+	Window   float64 `yaml:"window" bson:"window"`     // Hours after the deadline that submissions are accepted
+	Penalty  string  `yaml:"penalty" bson:"penalty"`   // LATE_PENALTY_*
+	Rate     float64 `yaml:"rate" bson:"rate"`         // Penalty (fraction) per interval, for step and exponential
+	Interval float64 `yaml:"interval" bson:"interval"` // Hours, defaults to 24
+	Max      float64 `yaml:"max" bson:"max"`           // Max penalty (fraction), defaults to 1
+}
+
+// An Extension moves a student's deadline for a target.
+type Extension struct {
+	Target string    `bson:"target"`
+	Until  time.Time `bson:"until"`
+}
+
+func parseTargetDate(date string) (time.Time, error) {
+	for _, format := range targetDateFormats {
+		if t, err := time.ParseInLocation(format, date, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("Invalid date: %v", date))
+}
+
+// Parse the target's dates and check its late policy.
+func (t *Target) initDeadlines() error {
+	var err error
+
+	if len(t.Opens) > 0 {
+		if t.opensAt, err = parseTargetDate(t.Opens); err != nil {
+			return err
+		}
+	}
+	if len(t.Closes) > 0 {
+		if t.closesAt, err = parseTargetDate(t.Closes); err != nil {
+			return err
+		}
+		if !t.opensAt.IsZero() && !t.closesAt.After(t.opensAt) {
+			return errors.New("The target must close after it opens")
+		}
+	}
+
+	if t.Late == nil {
+		return nil
+	}
+
+	late := t.Late
+	if late.Interval <= 0 {
+		late.Interval = 24
+	}
+	if late.Max <= 0 || late.Max > 1 {
+		late.Max = 1
+	}
+	if late.Window < 0 || late.Rate < 0 || late.Rate > 1 {
+		return errors.New("Late window and rate must be positive, and rate must be at most 1")
+	}
+
+	switch late.Penalty {
+	case "":
+		late.Penalty = LATE_PENALTY_NONE
+	case LATE_PENALTY_NONE, LATE_PENALTY_LINEAR, LATE_PENALTY_STEP, LATE_PENALTY_EXPONENTIAL:
+	default:
+		return errors.New(fmt.Sprintf("Invalid late penalty: %v", late.Penalty))
+	}
+
+	return nil
+}
+
+// Get the penalty (fraction of the score) for a submission that's hours late.
+func (late *LatePolicy) penalty(hours float64) float64 {
+	if hours <= 0 {
+		return 0
+	}
+
+	var penalty float64
+
+	switch late.Penalty {
+	case LATE_PENALTY_LINEAR:
+		if late.Window > 0 {
+			penalty = late.Max * hours / late.Window
+		} else {
+			penalty = late.Max
+		}
+	case LATE_PENALTY_STEP:
+		penalty = late.Rate * math.Ceil(hours/late.Interval)
+	case LATE_PENALTY_EXPONENTIAL:
+		penalty = 1 - math.Pow(1-late.Rate, hours/late.Interval)
+	}
+
+	return math.Min(penalty, late.Max)
+}
+
+// Returns true if the extension applies to the target, which includes
+// extensions for a subtarget's metatarget.
+func (ext *Extension) appliesTo(t *Target) bool {
+	return ext.Target == t.Name || (len(t.MetaName) > 0 && ext.Target == t.MetaName)
+}
+
+// Deadline returns the deadline for the students, which is the latest of the
+// target's deadline and any extensions the students have. A zero time means
+// there is no deadline.
+func (t *Target) Deadline(students []*Student) time.Time {
+	deadline := t.closesAt
+	if deadline.IsZero() {
+		return deadline
+	}
+
+	for _, student := range students {
+		for _, ext := range student.Extensions {
+			if ext.appliesTo(t) && ext.Until.After(deadline) {
+				deadline = ext.Until
+			}
+		}
+	}
+	return deadline
+}
+
+// Format a date for error messages
+func formatTargetDate(t time.Time) string {
+	return t.Format("Mon Jan 2 2006 15:04 MST")
+}
+
+// CheckSubmissionTime returns an error if the students can't submit to the
+// target at the given time.
+func (t *Target) CheckSubmissionTime(students []*Student, now time.Time) error {
+	if !t.opensAt.IsZero() && now.Before(t.opensAt) {
+		return errors.New(fmt.Sprintf("The target '%v' doesn't open until %v.", t.Name, formatTargetDate(t.opensAt)))
+	}
+
+	deadline := t.Deadline(students)
+	if deadline.IsZero() || !now.After(deadline) {
+		return nil
+	}
+
+	if t.Late == nil || t.Late.Window <= 0 {
+		return errors.New(fmt.Sprintf("The deadline for '%v' (%v) has passed.", t.Name, formatTargetDate(deadline)))
+	}
+
+	lastLate := deadline.Add(time.Duration(t.Late.Window * float64(time.Hour)))
+	if now.After(lastLate) {
+		return errors.New(fmt.Sprintf("The deadline for '%v' (%v) has passed, and late submissions were accepted until %v.",
+			t.Name, formatTargetDate(deadline), formatTargetDate(lastLate)))
+	}
+
+	return nil
+}
+
+// LatePenalty returns how late (in hours) a submission at the given time is,
+// and the fraction of the score it loses.
+func (t *Target) LatePenalty(students []*Student, when time.Time) (hours, penalty float64) {
+	deadline := t.Deadline(students)
+	if deadline.IsZero() || !when.After(deadline) {
+		return 0, 0
+	}
+
+	hours = when.Sub(deadline).Hours()
+	if t.Late == nil {
+		// Past the deadline with no late policy, so the server should have rejected it
+		return hours, 1
+	}
+	return hours, t.Late.penalty(hours)
+}
+
+// Set the submission's late penalty for a target. Staff submissions are never
+// late.
+func (s *Submission) setLatePenalty(target *Target, students []*Student) {
+	if s.IsStaff {
+		s.LateHours, s.LatePenalty = 0, 0
+	} else {
+		s.LateHours, s.LatePenalty = target.LatePenalty(students, s.SubmissionTime)
+	}
+	s.Score = s.adjustedScore()
+}
+
+// The score after the warning and late penalties, rounded to the nearest
+// point.
+func (s *Submission) adjustedScore() uint {
+	score := uint(0)
+	if s.RawScore > s.WarningPenalty {
+		score = s.RawScore - s.WarningPenalty
+	}
+	if s.LatePenalty <= 0 {
+		return score
+	}
+	return uint(math.Floor(float64(score)*(1-s.LatePenalty) + 0.5))
+}
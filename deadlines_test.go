@@ -0,0 +1,181 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+	"time"
+)
+
+func deadlineTarget(t *testing.T, extra string) *Target {
+	text := `---
+name: asst1
+points: 100
+opens: 2017-02-01
+closes: 2017-02-10 17:00
+` + extra
+	target, err := TargetFromString(text)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return target
+}
+
+func deadlineTime(date string) time.Time {
+	res, _ := parseTargetDate(date)
+	return res
+}
+
+func TestDeadlineParse(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	target := deadlineTarget(t, `late:
+  window: 48
+  penalty: step
+  rate: 0.1
+`)
+	assert.Equal(deadlineTime("2017-02-01 00:00"), target.opensAt)
+	assert.Equal(deadlineTime("2017-02-10 17:00:00"), target.closesAt)
+	if assert.NotNil(target.Late) {
+		assert.Equal(LATE_PENALTY_STEP, target.Late.Penalty)
+		assert.Equal(float64(24), target.Late.Interval)
+		assert.Equal(float64(1), target.Late.Max)
+	}
+
+	bad := []string{
+		"name: asst1\ncloses: tomorrow\n",
+		"name: asst1\nopens: 2017-02-10\ncloses: 2017-02-01\n",
+		"name: asst1\ncloses: 2017-02-01\nlate:\n  penalty: quadratic\n",
+		"name: asst1\ncloses: 2017-02-01\nlate:\n  rate: 2\n",
+	}
+	for _, text := range bad {
+		_, err := TargetFromString(text)
+		assert.NotNil(err, text)
+	}
+
+	// No dates, no deadline
+	target, err := TargetFromString("name: asst1\n")
+	assert.Nil(err)
+	assert.True(target.Deadline(nil).IsZero())
+	assert.Nil(target.CheckSubmissionTime(nil, time.Now()))
+}
+
+func TestDeadlineCheck(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	target := deadlineTarget(t, "")
+	assert.NotNil(target.CheckSubmissionTime(nil, deadlineTime("2017-01-31 23:59")))
+	assert.Nil(target.CheckSubmissionTime(nil, deadlineTime("2017-02-05")))
+	assert.Nil(target.CheckSubmissionTime(nil, deadlineTime("2017-02-10 17:00")))
+	assert.NotNil(target.CheckSubmissionTime(nil, deadlineTime("2017-02-10 17:01")))
+
+	target = deadlineTarget(t, "late:\n  window: 24\n")
+	assert.Nil(target.CheckSubmissionTime(nil, deadlineTime("2017-02-11 16:59")))
+	assert.NotNil(target.CheckSubmissionTime(nil, deadlineTime("2017-02-11 17:01")))
+
+	hours, penalty := target.LatePenalty(nil, deadlineTime("2017-02-11 05:00"))
+	assert.Equal(float64(12), hours)
+	assert.Equal(float64(0), penalty)
+}
+
+func TestDeadlineExtensions(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	target := deadlineTarget(t, "")
+	until := deadlineTime("2017-02-12 17:00")
+
+	students := []*Student{
+		&Student{Email: "a@test161.ops-class.org"},
+		&Student{
+			Email: "b@test161.ops-class.org",
+			Extensions: []*Extension{
+				&Extension{Target: "asst2", Until: deadlineTime("2017-03-12")},
+				&Extension{Target: "asst1", Until: until},
+			},
+		},
+	}
+
+	// Partners share the latest extension
+	assert.Equal(until, target.Deadline(students))
+	assert.Equal(target.closesAt, target.Deadline(students[:1]))
+	assert.Nil(target.CheckSubmissionTime(students, deadlineTime("2017-02-11")))
+	assert.NotNil(target.CheckSubmissionTime(students[:1], deadlineTime("2017-02-11")))
+
+	// Extensions for the metatarget apply to its subtargets
+	target.Name = "asst1.1"
+	target.MetaName = "asst1"
+	assert.Equal(until, target.Deadline(students))
+
+	// Extensions can't move the deadline earlier
+	students[1].Extensions[1].Until = deadlineTime("2017-02-09")
+	assert.Equal(target.closesAt, target.Deadline(students))
+}
+
+func TestDeadlinePenalties(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	late := &LatePolicy{Window: 96, Interval: 24, Max: 1}
+
+	tests := []struct {
+		penalty  string
+		rate     float64
+		hours    float64
+		expected float64
+	}{
+		{LATE_PENALTY_NONE, 0.1, 30, 0},
+		{LATE_PENALTY_LINEAR, 0, 0, 0},
+		{LATE_PENALTY_LINEAR, 0, 48, 0.5},
+		{LATE_PENALTY_LINEAR, 0, 96, 1},
+		{LATE_PENALTY_STEP, 0.1, 1, 0.1},
+		{LATE_PENALTY_STEP, 0.1, 24, 0.1},
+		{LATE_PENALTY_STEP, 0.1, 25, 0.2},
+		{LATE_PENALTY_STEP, 0.4, 96, 1},
+		{LATE_PENALTY_EXPONENTIAL, 0.5, 24, 0.5},
+		{LATE_PENALTY_EXPONENTIAL, 0.5, 48, 0.75},
+		{LATE_PENALTY_EXPONENTIAL, 0.5, 12, 1 - math.Sqrt(0.5)},
+	}
+
+	for _, test := range tests {
+		late.Penalty = test.penalty
+		late.Rate = test.rate
+		assert.InDelta(test.expected, late.penalty(test.hours), 0.0001, "%v %v", test.penalty, test.hours)
+	}
+
+	// Max caps the penalty
+	late.Penalty = LATE_PENALTY_STEP
+	late.Rate = 0.2
+	late.Max = 0.3
+	assert.Equal(0.3, late.penalty(72))
+}
+
+func TestDeadlineAdjustedScore(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	target := deadlineTarget(t, "late:\n  window: 72\n  penalty: step\n  rate: 0.25\n")
+
+	s := &Submission{SubmissionTime: deadlineTime("2017-02-11 12:00")}
+	s.setLatePenalty(target, nil)
+	assert.Equal(float64(19), s.LateHours)
+	assert.Equal(0.25, s.LatePenalty)
+
+	s.RawScore = 90
+	assert.Equal(uint(68), s.adjustedScore())
+
+	// Staff are never late
+	s.IsStaff = true
+	s.setLatePenalty(target, nil)
+	assert.Equal(float64(0), s.LatePenalty)
+	assert.Equal(uint(90), s.Score)
+
+	// On time
+	s = &Submission{SubmissionTime: deadlineTime("2017-02-10 12:00"), RawScore: 50}
+	s.setLatePenalty(target, nil)
+	assert.Equal(float64(0), s.LateHours)
+	assert.Equal(uint(50), s.Score)
+}
@@ -0,0 +1,283 @@
+package test161
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// This file handles exporting a TestGroup's dependency graph so that it can
+// be visualized (DOT) or processed by other tools (JSON). The graph can be
+// annotated with the results of the last run of each test, which makes it
+// easy to see why a test was skipped.
+
+// Dependency graph export formats
+const (
+	DEP_GRAPH_FORMAT_DOT  = "dot"
+	DEP_GRAPH_FORMAT_JSON = "json"
+)
+
+// A DepGraph is the exportable form of a TestGroup's dependency graph.
+type DepGraph struct {
+	Name  string          `json:"name"`
+	Nodes []*DepGraphNode `json:"nodes"`
+	Edges []*DepGraphEdge `json:"edges"`
+}
+
+// A DepGraphNode is a single test in the dependency graph.
+type DepGraphNode struct {
+	ID              string         `json:"id"`
+	Name            string         `json:"name"`
+	Tags            []string       `json:"tags"`
+	IsDependency    bool           `json:"is_dependency"`
+	PointsAvailable uint           `json:"points_avail"`
+	LastRun         *LastRunResult `json:"last_run,omitempty"`
+}
+
+// There is an edge From -> To if From depends on To.
+type DepGraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// LastRunResult records the outcome of the most recent run of a test.
+type LastRunResult struct {
+	Result          TestResult     `json:"result"`
+	PointsAvailable uint           `json:"points_avail"`
+	PointsEarned    uint           `json:"points_earned"`
+	WallTime        TimeFixedPoint `json:"walltime"`
+	Timestamp       time.Time      `json:"timestamp"`
+	Metrics         []*Metric      `json:"metrics,omitempty"`
+}
+
+// LastRunResults maps test IDs to the result of their last run.
+type LastRunResults map[string]*LastRunResult
+
+// LastRunResultsFromFile loads the last run results from a JSON file. A missing
+// file is not an error; it just means nothing has been run yet.
+func LastRunResultsFromFile(file string) (LastRunResults, error) {
+	results := make(LastRunResults)
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return results, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("Error loading last run results from %v: %v", file, err)
+	}
+
+	return results, nil
+}
+
+// Save writes the last run results to a JSON file. The results are written to
+// a temporary file first, so readers never see a partial file.
+func (lr LastRunResults) Save(file string) error {
+	data, err := json.Marshal(lr)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(file), path.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0664)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// UpdateLastRunResults records the results of the group in the last run file.
+// Concurrent runs each read, update, and write the file, so we hold a lock
+// (file.lock) while we do. A corrupt file is replaced.
+func UpdateLastRunResults(file string, tg *TestGroup, when time.Time) error {
+	lock, err := os.OpenFile(file+".lock", os.O_CREATE|os.O_RDWR, 0664)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	results, err := LastRunResultsFromFile(file)
+	if err != nil {
+		results = make(LastRunResults)
+	}
+	results.Update(tg, when)
+
+	return results.Save(file)
+}
+
+// Update records the results of every test in the group that finished
+// running. Tests that never ran keep their previous result.
+func (lr LastRunResults) Update(tg *TestGroup, when time.Time) {
+	for id, test := range tg.Tests {
+		switch test.Result {
+		case TEST_RESULT_NONE, TEST_RESULT_RUNNING:
+			continue
+		}
+
+		// Skipped tests don't tell us how long the test takes, so keep the
+		// previous time.
+		wallTime := test.WallTime
+		if prev, ok := lr[id]; ok && wallTime == 0 {
+			wallTime = prev.WallTime
+		}
+		lr[id] = &LastRunResult{
+			Result:          test.Result,
+			PointsAvailable: test.PointsAvailable,
+			PointsEarned:    test.PointsEarned,
+			WallTime:        wallTime,
+			Timestamp:       when,
+			Metrics:         test.Metrics,
+		}
+	}
+}
+
+// ExportDependencyGraph creates the exportable dependency graph for the
+// group. If lastRun is non-nil, nodes are annotated with their last result.
+func (tg *TestGroup) ExportDependencyGraph(lastRun LastRunResults) (*DepGraph, error) {
+	// Build the real graph first so we catch any inconsistencies.
+	g, err := tg.DependencyGraph()
+	if err != nil {
+		return nil, err
+	}
+
+	name := ""
+	if tg.Config != nil {
+		name = tg.Config.Name
+	}
+
+	dg := &DepGraph{
+		Name:  name,
+		Nodes: make([]*DepGraphNode, 0, len(g.NodeMap)),
+		Edges: make([]*DepGraphEdge, 0),
+	}
+
+	ids := make([]string, 0, len(g.NodeMap))
+	for id := range g.NodeMap {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		test := tg.Tests[id]
+		node := &DepGraphNode{
+			ID:              id,
+			Name:            test.Name,
+			Tags:            test.Tags,
+			IsDependency:    test.IsDependency,
+			PointsAvailable: test.PointsAvailable,
+		}
+		if lastRun != nil {
+			node.LastRun = lastRun[id]
+		}
+		dg.Nodes = append(dg.Nodes, node)
+
+		deps := make([]string, 0, len(g.NodeMap[id].EdgesOut))
+		for depId := range g.NodeMap[id].EdgesOut {
+			deps = append(deps, depId)
+		}
+		sort.Strings(deps)
+
+		for _, depId := range deps {
+			dg.Edges = append(dg.Edges, &DepGraphEdge{id, depId})
+		}
+	}
+
+	return dg, nil
+}
+
+// JSON returns the graph as JSON.
+func (dg *DepGraph) JSON() (string, error) {
+	if data, err := json.MarshalIndent(dg, "", "  "); err != nil {
+		return "", err
+	} else {
+		return string(data), nil
+	}
+}
+
+// Node colors for the last result
+var dotResultColors = map[TestResult]string{
+	TEST_RESULT_CORRECT:   "palegreen",
+	TEST_RESULT_INCORRECT: "lightcoral",
+	TEST_RESULT_SKIP:      "lightblue",
+	TEST_RESULT_ABORT:     "lightgray",
+}
+
+// Quote a string for use as a DOT ID. Newlines become line breaks in labels.
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
+
+// DOT returns the graph in the Graphviz DOT language. Tests that are only
+// included as dependencies are dashed, and annotated tests are filled in
+// according to their last result.
+func (dg *DepGraph) DOT() string {
+	bb := &bytes.Buffer{}
+
+	fmt.Fprintf(bb, "digraph %v {\n", dotQuote(dg.Name))
+	fmt.Fprintf(bb, "\tnode [shape=box];\n")
+
+	for _, node := range dg.Nodes {
+		label := node.ID
+		attrs := make([]string, 0)
+
+		if node.LastRun != nil {
+			label += fmt.Sprintf("\n%v", node.LastRun.Result)
+			if node.PointsAvailable > 0 {
+				label += fmt.Sprintf(" (%v/%v)", node.LastRun.PointsEarned, node.PointsAvailable)
+			}
+			if color, ok := dotResultColors[node.LastRun.Result]; ok {
+				attrs = append(attrs, "style=filled", "fillcolor="+color)
+			}
+		} else if node.PointsAvailable > 0 {
+			label += fmt.Sprintf("\n%v points", node.PointsAvailable)
+		}
+
+		if node.IsDependency {
+			if len(attrs) > 0 {
+				attrs[0] = `style="filled,dashed"`
+			} else {
+				attrs = append(attrs, "style=dashed")
+			}
+		}
+
+		attrs = append([]string{"label=" + dotQuote(label)}, attrs...)
+		fmt.Fprintf(bb, "\t%v [%v];\n", dotQuote(node.ID), strings.Join(attrs, ", "))
+	}
+
+	for _, edge := range dg.Edges {
+		fmt.Fprintf(bb, "\t%v -> %v;\n", dotQuote(edge.From), dotQuote(edge.To))
+	}
+
+	fmt.Fprintf(bb, "}\n")
+
+	return bb.String()
+}
@@ -0,0 +1,163 @@
+package test161
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func depGraphTestGroup(t *testing.T) *TestGroup {
+	config := &GroupConfig{
+		Name:    "locks",
+		UseDeps: true,
+		Tests:   []string{"sync/lt1.t"},
+		Env:     defaultEnv,
+	}
+
+	tg, errs := GroupFromConfig(config)
+	assert.Equal(t, 0, len(errs))
+	if tg == nil {
+		t.FailNow()
+	}
+	return tg
+}
+
+func TestDepGraphExport(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tg := depGraphTestGroup(t)
+
+	dg, err := tg.ExportDependencyGraph(nil)
+	assert.Nil(err)
+	if dg == nil {
+		t.FailNow()
+	}
+
+	assert.Equal("locks", dg.Name)
+
+	ids := make([]string, 0)
+	for _, node := range dg.Nodes {
+		ids = append(ids, node.ID)
+		assert.Nil(node.LastRun)
+		assert.Equal(node.ID != "sync/lt1.t", node.IsDependency)
+	}
+	assert.Equal([]string{
+		"boot.t",
+		"sync/lt1.t",
+		"threads/tt1.t",
+		"threads/tt2.t",
+		"threads/tt3.t",
+	}, ids)
+
+	edges := make([]string, 0)
+	for _, edge := range dg.Edges {
+		edges = append(edges, edge.From+"->"+edge.To)
+	}
+	assert.Equal([]string{
+		"sync/lt1.t->threads/tt1.t",
+		"sync/lt1.t->threads/tt2.t",
+		"sync/lt1.t->threads/tt3.t",
+		"threads/tt1.t->boot.t",
+		"threads/tt2.t->boot.t",
+		"threads/tt3.t->boot.t",
+	}, edges)
+
+	// JSON round trip
+	text, err := dg.JSON()
+	assert.Nil(err)
+	other := &DepGraph{}
+	assert.Nil(json.Unmarshal([]byte(text), other))
+	assert.Equal(dg, other)
+
+	// DOT
+	dot := dg.DOT()
+	assert.True(strings.HasPrefix(dot, `digraph "locks" {`))
+	assert.True(strings.Contains(dot, `"sync/lt1.t" -> "threads/tt1.t";`))
+	assert.True(strings.Contains(dot, `"boot.t" [label="boot.t", style=dashed];`))
+	assert.True(strings.Contains(dot, `"sync/lt1.t" [label="sync/lt1.t"];`))
+}
+
+func TestDepGraphLastRun(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tg := depGraphTestGroup(t)
+
+	tg.Tests["boot.t"].Result = TEST_RESULT_CORRECT
+	tg.Tests["threads/tt1.t"].Result = TEST_RESULT_INCORRECT
+	tg.Tests["sync/lt1.t"].Result = TEST_RESULT_SKIP
+	tg.Tests["sync/lt1.t"].PointsAvailable = 10
+
+	lastRun := make(LastRunResults)
+	lastRun.Update(tg, time.Now())
+
+	// Tests that didn't run aren't recorded
+	assert.Equal(3, len(lastRun))
+
+	// Save and reload
+	dir, err := ioutil.TempDir("", "test161")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "lastrun.json")
+
+	empty, err := LastRunResultsFromFile(file)
+	assert.Nil(err)
+	assert.Equal(0, len(empty))
+
+	assert.Nil(lastRun.Save(file))
+	loaded, err := LastRunResultsFromFile(file)
+	assert.Nil(err)
+	assert.Equal(3, len(loaded))
+	if r, ok := loaded["sync/lt1.t"]; assert.True(ok) {
+		assert.Equal(TEST_RESULT_SKIP, r.Result)
+		assert.Equal(uint(10), r.PointsAvailable)
+	}
+
+	// Concurrent runs don't lose each other's results
+	var wg sync.WaitGroup
+	for _, id := range []string{"boot.t", "threads/tt1.t", "sync/lt1.t"} {
+		run := depGraphTestGroup(t)
+		for other, test := range run.Tests {
+			if other != id {
+				test.Result = TEST_RESULT_NONE
+			} else {
+				test.Result = TEST_RESULT_CORRECT
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(UpdateLastRunResults(path.Join(dir, "concurrent.json"), run, time.Now()))
+		}()
+	}
+	wg.Wait()
+	concurrent, err := LastRunResultsFromFile(path.Join(dir, "concurrent.json"))
+	assert.Nil(err)
+	assert.Equal(3, len(concurrent))
+
+	dg, err := tg.ExportDependencyGraph(loaded)
+	assert.Nil(err)
+	if dg == nil {
+		t.FailNow()
+	}
+
+	for _, node := range dg.Nodes {
+		switch node.ID {
+		case "boot.t", "threads/tt1.t", "sync/lt1.t":
+			assert.NotNil(node.LastRun)
+		default:
+			assert.Nil(node.LastRun)
+		}
+	}
+
+	dot := dg.DOT()
+	assert.True(strings.Contains(dot, `"sync/lt1.t" [label="sync/lt1.t\nskip (0/10)", style=filled, fillcolor=lightblue];`))
+	assert.True(strings.Contains(dot, `"threads/tt1.t" [label="threads/tt1.t\nincorrect", style="filled,dashed", fillcolor=lightcoral];`))
+}
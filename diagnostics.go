@@ -0,0 +1,277 @@
+package test161
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This file handles compiler diagnostics. We parse the gcc and bmake output
+// from the build commands into structured diagnostics, which are saved with
+// the build test. Targets can have a warning policy that deducts points for
+// warnings, or fails the build if there are warnings in specific files.
+
+// Diagnostic severities
+const (
+	DIAG_SEVERITY_ERROR   = "error"
+	DIAG_SEVERITY_WARNING = "warning"
+	DIAG_SEVERITY_NOTE    = "note"
+)
+
+// A BuildDiagnostic is a single error, warning, or note from the build. File
+// is relative to the root of the source tree when possible.
+type BuildDiagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+var (
+	// ../../thread/thread.c:42:5: warning: unused variable 'x' [-Wunused-variable]
+	gccDiagExp = regexp.MustCompile(`^([^:\s][^:]*):(\d+):(?:(\d+):)?\s+(warning|error|fatal error|note):\s+(.*)$`)
+
+	// thread.c:42: undefined reference to `foo'
+	linkerDiagExp = regexp.MustCompile(`^([^:\s][^:]*):(\d+):\s+((?:undefined reference|multiple definition).*)$`)
+
+	// bmake: "../../conf/conf.kern" line 12: Unknown directive
+	bmakeDiagExp = regexp.MustCompile(`^bmake(?:\[\d+\])?: "([^"]+)" line (\d+): (.*)$`)
+
+	// *** Error code 1
+	bmakeErrorExp = regexp.MustCompile(`^\*\*\* (Error code \d+.*)$`)
+
+	// bmake[2]: Entering directory `/build/src/userland/bin/cat'
+	makeDirExp = regexp.MustCompile("^\\S*make(?:\\[\\d+\\])?: (Entering|Leaving) directory [`']?(.*?)'?$")
+)
+
+// Parse a line of build output into a diagnostic, if it is one. dir is the
+// directory the command ran in and srcDir is the root of the source tree,
+// which we use to normalize file names.
+func parseDiagnostic(line, dir, srcDir string) *BuildDiagnostic {
+	line = strings.TrimSpace(line)
+
+	var diag *BuildDiagnostic
+
+	if m := gccDiagExp.FindStringSubmatch(line); len(m) > 0 {
+		diag = &BuildDiagnostic{
+			File:     m[1],
+			Severity: m[4],
+			Message:  m[5],
+		}
+		diag.Line, _ = strconv.Atoi(m[2])
+		diag.Column, _ = strconv.Atoi(m[3])
+		if diag.Severity == "fatal error" {
+			diag.Severity = DIAG_SEVERITY_ERROR
+		}
+	} else if m := linkerDiagExp.FindStringSubmatch(line); len(m) > 0 {
+		diag = &BuildDiagnostic{
+			File:     m[1],
+			Severity: DIAG_SEVERITY_ERROR,
+			Message:  m[3],
+		}
+		diag.Line, _ = strconv.Atoi(m[2])
+	} else if m := bmakeDiagExp.FindStringSubmatch(line); len(m) > 0 {
+		diag = &BuildDiagnostic{
+			File:     m[1],
+			Severity: DIAG_SEVERITY_ERROR,
+			Message:  m[3],
+		}
+		diag.Line, _ = strconv.Atoi(m[2])
+	} else if m := bmakeErrorExp.FindStringSubmatch(line); len(m) > 0 {
+		return &BuildDiagnostic{
+			Severity: DIAG_SEVERITY_ERROR,
+			Message:  m[1],
+		}
+	} else {
+		return nil
+	}
+
+	diag.File = relativeSourcePath(diag.File, dir, srcDir)
+	return diag
+}
+
+// Get the path of a file relative to the source tree, if it's in it.
+func relativeSourcePath(file, dir, srcDir string) string {
+	if len(dir) == 0 || len(srcDir) == 0 {
+		return file
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	if rel, err := filepath.Rel(srcDir, file); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.Clean(file)
+}
+
+// Keep track of the directory a recursive make is in, so we can find the files
+// in its diagnostics. Returns true if the line was a directory change.
+func (cmd *BuildCommand) trackMakeDir(line string) bool {
+	m := makeDirExp.FindStringSubmatch(strings.TrimSpace(line))
+	if len(m) == 0 {
+		return false
+	}
+
+	dir := m[2]
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(cmd.makeDir(), dir)
+	}
+
+	if m[1] == "Entering" {
+		cmd.makeDirs = append(cmd.makeDirs, dir)
+	} else if len(cmd.makeDirs) > 0 {
+		cmd.makeDirs = cmd.makeDirs[:len(cmd.makeDirs)-1]
+	}
+	return true
+}
+
+// The directory the command's output is relative to right now.
+func (cmd *BuildCommand) makeDir() string {
+	if len(cmd.makeDirs) > 0 {
+		return cmd.makeDirs[len(cmd.makeDirs)-1]
+	}
+	return cmd.startDir
+}
+
+// Add a diagnostic from a command's output, skipping duplicates (e.g. headers
+// included from multiple files).
+func (t *BuildTest) addDiagnostic(cmd *BuildCommand, line string) {
+	if cmd.trackMakeDir(line) {
+		return
+	}
+
+	diag := parseDiagnostic(line, cmd.makeDir(), t.srcDir)
+	if diag == nil {
+		return
+	}
+
+	for _, d := range t.Diagnostics {
+		if *d == *diag {
+			return
+		}
+	}
+	t.Diagnostics = append(t.Diagnostics, diag)
+}
+
+// Count the diagnostics with the given severity.
+func (t *BuildTest) DiagnosticCount(severity string) int {
+	count := 0
+	for _, d := range t.Diagnostics {
+		if d.Severity == severity {
+			count += 1
+		}
+	}
+	return count
+}
+
+// A WarningPolicy says what to do about compiler warnings. File patterns are
+// matched (with path.Match) against paths relative to the source tree, e.g.
+// kern/synch/*.c.
+type WarningPolicy struct {
+	Ignore    []string `yaml:"ignore" bson:"ignore"`         // Warnings in these files don't count, e.g. known warnings in the base code
+	Fail      []string `yaml:"fail" bson:"fail"`             // Any warning in these files fails the build, like -Werror
+	Allowed   uint     `yaml:"allowed" bson:"allowed"`       // Warnings allowed before deducting points
+	Points    uint     `yaml:"points" bson:"points"`         // Points deducted for each additional warning
+	MaxPoints uint     `yaml:"max_points" bson:"max_points"` // The most we deduct (0 for no limit)
+}
+
+// Compare two warning policies. Policies can deduct points, so changing one
+// requires a new target version. No policy is the same as an empty one.
+func warningPolicyChanged(old, other *WarningPolicy) bool {
+	if old == nil {
+		old = &WarningPolicy{}
+	}
+	if other == nil {
+		other = &WarningPolicy{}
+	}
+
+	if old.Allowed != other.Allowed || old.Points != other.Points || old.MaxPoints != other.MaxPoints {
+		return true
+	}
+	return !stringListsEqual(old.Ignore, other.Ignore) || !stringListsEqual(old.Fail, other.Fail)
+}
+
+func stringListsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(patterns []string, file string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, file); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the warnings that count under this policy.
+func (p *WarningPolicy) warnings(diags []*BuildDiagnostic) []*BuildDiagnostic {
+	res := make([]*BuildDiagnostic, 0)
+	for _, d := range diags {
+		if d.Severity == DIAG_SEVERITY_WARNING && !matchesAny(p.Ignore, d.File) {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// Check returns an error if any of the warnings fail the build.
+func (p *WarningPolicy) Check(diags []*BuildDiagnostic) error {
+	if p == nil {
+		return nil
+	}
+
+	failed := make([]string, 0)
+	for _, d := range p.warnings(diags) {
+		if matchesAny(p.Fail, d.File) {
+			failed = append(failed, fmt.Sprintf("%v:%v: %v", d.File, d.Line, d.Message))
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New(fmt.Sprintf("Warnings are not allowed in these files:\n%v", strings.Join(failed, "\n")))
+	}
+	return nil
+}
+
+// Penalty returns the number of points to deduct for warnings.
+func (p *WarningPolicy) Penalty(diags []*BuildDiagnostic) uint {
+	if p == nil || p.Points == 0 {
+		return 0
+	}
+
+	count := uint(len(p.warnings(diags)))
+	if count <= p.Allowed {
+		return 0
+	}
+
+	penalty := (count - p.Allowed) * p.Points
+	if p.MaxPoints > 0 && penalty > p.MaxPoints {
+		penalty = p.MaxPoints
+	}
+	return penalty
+}
+
+// Set the submission's warning penalty from the build's diagnostics and the
+// target's warning policy.
+func (s *Submission) setWarningPenalty(target *Target) {
+	s.BuildWarnings, s.WarningPenalty = 0, 0
+	if s.BuildTest != nil && target.Build.Warnings != nil {
+		s.BuildWarnings = uint(len(target.Build.Warnings.warnings(s.BuildTest.Diagnostics)))
+		s.WarningPenalty = target.Build.Warnings.Penalty(s.BuildTest.Diagnostics)
+	}
+	s.Score = s.adjustedScore()
+}
@@ -0,0 +1,197 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDiagnosticsParse(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	srcDir := "/build/src"
+	compDir := "/build/src/kern/compile/ASST1"
+
+	tests := []struct {
+		line     string
+		dir      string
+		expected *BuildDiagnostic
+	}{
+		{
+			"../../thread/synch.c:42:5: warning: unused variable 'x' [-Wunused-variable]", compDir,
+			&BuildDiagnostic{"kern/thread/synch.c", 42, 5, DIAG_SEVERITY_WARNING, "unused variable 'x' [-Wunused-variable]"},
+		},
+		{
+			"../../thread/synch.c:100: error: 'lk' undeclared (first use in this function)", compDir,
+			&BuildDiagnostic{"kern/thread/synch.c", 100, 0, DIAG_SEVERITY_ERROR, "'lk' undeclared (first use in this function)"},
+		},
+		{
+			"../../include/synch.h:7:10: fatal error: foo.h: No such file or directory", compDir,
+			&BuildDiagnostic{"kern/include/synch.h", 7, 10, DIAG_SEVERITY_ERROR, "foo.h: No such file or directory"},
+		},
+		{
+			"../../main/menu.c:20:1: note: declared here", compDir,
+			&BuildDiagnostic{"kern/main/menu.c", 20, 1, DIAG_SEVERITY_NOTE, "declared here"},
+		},
+		{
+			"synch.c:12: undefined reference to `lock_do_i_hold'", "/build/src/kern/thread",
+			&BuildDiagnostic{"kern/thread/synch.c", 12, 0, DIAG_SEVERITY_ERROR, "undefined reference to `lock_do_i_hold'"},
+		},
+		{
+			`bmake: "../../conf/conf.kern" line 12: Unknown directive`, "/build/src/kern/conf/x",
+			&BuildDiagnostic{"kern/conf/conf.kern", 12, 0, DIAG_SEVERITY_ERROR, "Unknown directive"},
+		},
+		{
+			"*** Error code 1", compDir,
+			&BuildDiagnostic{"", 0, 0, DIAG_SEVERITY_ERROR, "Error code 1"},
+		},
+		{
+			"/usr/include/stdio.h:3:1: warning: outside", compDir,
+			&BuildDiagnostic{"/usr/include/stdio.h", 3, 1, DIAG_SEVERITY_WARNING, "outside"},
+		},
+		{"mips-harvard-os161-gcc -c ../../thread/synch.c", compDir, nil},
+		{"In file included from ../../thread/synch.c:3:", compDir, nil},
+		{"Exec: bmake depend", compDir, nil},
+	}
+
+	for _, test := range tests {
+		diag := parseDiagnostic(test.line, test.dir, srcDir)
+		assert.Equal(test.expected, diag, test.line)
+	}
+}
+
+func TestDiagnosticsPolicy(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	diags := []*BuildDiagnostic{
+		&BuildDiagnostic{"kern/thread/synch.c", 1, 1, DIAG_SEVERITY_WARNING, "a"},
+		&BuildDiagnostic{"kern/thread/synch.c", 2, 1, DIAG_SEVERITY_WARNING, "b"},
+		&BuildDiagnostic{"kern/vm/vm.c", 3, 1, DIAG_SEVERITY_WARNING, "c"},
+		&BuildDiagnostic{"kern/lib/kprintf.c", 4, 1, DIAG_SEVERITY_WARNING, "d"},
+		&BuildDiagnostic{"kern/vm/vm.c", 5, 1, DIAG_SEVERITY_NOTE, "e"},
+	}
+
+	var none *WarningPolicy
+	assert.Nil(none.Check(diags))
+	assert.Equal(uint(0), none.Penalty(diags))
+
+	policy := &WarningPolicy{
+		Ignore:    []string{"kern/lib/*"},
+		Allowed:   1,
+		Points:    2,
+		MaxPoints: 3,
+	}
+	assert.Equal(3, len(policy.warnings(diags)))
+	assert.Nil(policy.Check(diags))
+	assert.Equal(uint(3), policy.Penalty(diags))
+
+	policy.MaxPoints = 0
+	assert.Equal(uint(4), policy.Penalty(diags))
+
+	policy.Fail = []string{"kern/vm/*.c"}
+	assert.NotNil(policy.Check(diags))
+	policy.Fail = []string{"kern/lib/*.c"}
+	assert.Nil(policy.Check(diags))
+
+	// Penalties come off the raw score, before the late penalty
+	target := &Target{Build: TargetBuild{Warnings: policy}}
+	s := &Submission{
+		BuildTest:   &BuildTest{Diagnostics: diags},
+		RawScore:    20,
+		LatePenalty: 0.5,
+	}
+	s.setWarningPenalty(target)
+	assert.Equal(uint(3), s.BuildWarnings)
+	assert.Equal(uint(4), s.WarningPenalty)
+	assert.Equal(uint(8), s.Score)
+
+	s.RawScore = 3
+	s.setWarningPenalty(target)
+	assert.Equal(uint(0), s.Score)
+}
+
+func TestDiagnosticsDuplicates(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	test := &BuildTest{srcDir: "/build/src"}
+	cmd := test.newCommand("bmake", "/build/src/kern/compile/ASST1")
+	test.addDiagnostic(cmd, "../../include/lib.h:3:1: warning: x")
+	test.addDiagnostic(cmd, "../../include/lib.h:3:1: warning: x")
+	test.addDiagnostic(cmd, "cc -c foo.c")
+	test.addDiagnostic(cmd, "../../include/lib.h:4:1: warning: x")
+
+	assert.Equal(2, len(test.Diagnostics))
+	assert.Equal(2, test.DiagnosticCount(DIAG_SEVERITY_WARNING))
+	assert.Equal(0, test.DiagnosticCount(DIAG_SEVERITY_ERROR))
+}
+
+func TestDiagnosticsRecursiveMake(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	test := &BuildTest{srcDir: "/build/src"}
+	cmd := test.newCommand("bmake", "/build/src/userland")
+	test.addDiagnostic(cmd, "bmake[1]: Entering directory `/build/src/userland/bin'")
+	test.addDiagnostic(cmd, "bmake[2]: Entering directory `/build/src/userland/bin/cat'")
+	test.addDiagnostic(cmd, "cat.c:42:5: warning: unused variable 'x' [-Wunused-variable]")
+	test.addDiagnostic(cmd, "bmake[2]: Leaving directory `/build/src/userland/bin/cat'")
+	test.addDiagnostic(cmd, "bmake[2]: Entering directory `/build/src/userland/bin/cp'")
+	test.addDiagnostic(cmd, "../../../userland/include/err.h:3:1: warning: x")
+	test.addDiagnostic(cmd, "bmake[2]: Leaving directory `/build/src/userland/bin/cp'")
+	test.addDiagnostic(cmd, "bmake[1]: Leaving directory `/build/src/userland/bin'")
+	test.addDiagnostic(cmd, "bin/true.c:1:1: warning: y")
+
+	if assert.Equal(3, len(test.Diagnostics)) {
+		assert.Equal("userland/bin/cat/cat.c", test.Diagnostics[0].File)
+		assert.Equal(42, test.Diagnostics[0].Line)
+		assert.Equal("userland/include/err.h", test.Diagnostics[1].File)
+		assert.Equal("userland/bin/true.c", test.Diagnostics[2].File)
+	}
+}
+
+func TestDiagnosticsPolicyVersion(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	target, err := TargetFromString(`---
+name: asst1
+points: 10
+type: asst
+tests:
+  - id: boot.t
+    points: 10
+build:
+  warnings:
+    ignore: [kern/lib/*]
+    allowed: 2
+    points: 1
+`)
+	assert.Nil(err)
+	if target == nil {
+		t.FailNow()
+	}
+
+	other := *target
+	policy := *target.Build.Warnings
+	other.Build.Warnings = &policy
+	assert.Nil(target.isChangeAllowed(&other))
+
+	// Other build settings aren't versioned
+	other.Build.Timeout = 600
+	assert.Nil(target.isChangeAllowed(&other))
+
+	policy.Points = 2
+	assert.NotNil(target.isChangeAllowed(&other))
+
+	policy.Points = 1
+	policy.Ignore = []string{"kern/lib/*", "kern/test/*"}
+	assert.NotNil(target.isChangeAllowed(&other))
+
+	other.Build.Warnings = nil
+	assert.NotNil(target.isChangeAllowed(&other))
+
+	// No policy is the same as an empty one
+	assert.False(warningPolicyChanged(nil, &WarningPolicy{}))
+}
@@ -22,6 +22,9 @@ type TestEnvironment struct {
 	// Optional - added in version 1.2.6
 	Tags map[string]*TagDescription
 
+	// Optional build recipes
+	Recipes map[string]*BuildRecipe
+
 	manager *manager
 
 	CacheDir    string
@@ -29,11 +32,31 @@ type TestEnvironment struct {
 	KeyDir      string
 	Persistence PersistenceManager
 
+	// A clone of the handout repository, for resolving tag commit
+	// requirements (see commits.go)
+	HandoutDir string
+
+	// Where to save secure output keys for auditing (see secure.go), or empty
+	// to only save their digests
+	SecureKeyDir string
+
+	// Limits for build commands, or nil to run them without a sandbox
+	BuildSandbox *BuildSandbox
+
+	// Wall time estimates for scheduling, for servers that don't have a last
+	// run file (see schedule.go)
+	Estimates *TestEstimates
+
 	Log *log.Logger
 
 	// These depend on the TestGroup/Target
 	keyMap  map[string]string
 	RootDir string
+
+	// Identifies what's in RootDir, for workers that cache root directories.
+	// Builds that miss the build cache reuse the same RootDir, so the path
+	// isn't enough. Empty means RootDir.
+	rootKey string
 }
 
 // Create a new TestEnvironment by copying the global state from an existing
@@ -46,6 +69,7 @@ func (env *TestEnvironment) CopyEnvironment() *TestEnvironment {
 	// Local
 	copy.keyMap = make(map[string]string)
 	copy.RootDir = ""
+	copy.rootKey = ""
 
 	return &copy
 }
@@ -136,6 +160,7 @@ func NewEnvironment(test161Dir string, pm PersistenceManager) (*TestEnvironment,
 	testDir := path.Join(test161Dir, "tests")
 	targetDir := path.Join(test161Dir, "targets")
 	tagDir := path.Join(test161Dir, "tags")
+	recipeDir := path.Join(test161Dir, "recipes")
 
 	env := &TestEnvironment{
 		TestDir:     testDir,
@@ -143,6 +168,7 @@ func NewEnvironment(test161Dir string, pm PersistenceManager) (*TestEnvironment,
 		Commands:    make(map[string]*CommandTemplate),
 		Targets:     make(map[string]*Target),
 		Tags:        make(map[string]*TagDescription),
+		Recipes:     make(map[string]*BuildRecipe),
 		keyMap:      make(map[string]string),
 		Log:         log.New(os.Stderr, "test161: ", log.Ldate|log.Ltime|log.Lshortfile),
 		Persistence: pm,
@@ -167,6 +193,14 @@ func NewEnvironment(test161Dir string, pm PersistenceManager) (*TestEnvironment,
 		}()
 	}
 
+	// So are recipes
+	if _, err := os.Stat(recipeDir); err == nil {
+		numExpected += 1
+		go func() {
+			resChan <- env.envReadLoop(recipeDir, ".tr", envRecipeHandler)
+		}()
+	}
+
 	// Get the results
 	var err error = nil
 	for i := 0; i < numExpected; i++ {
@@ -180,6 +214,9 @@ func NewEnvironment(test161Dir string, pm PersistenceManager) (*TestEnvironment,
 	if err == nil {
 		err = env.linkMetaTargets()
 	}
+	if err == nil {
+		err = env.checkTargetRecipes()
+	}
 
 	return env, err
 }
@@ -0,0 +1,172 @@
+package test161
+
+import (
+	"sort"
+	"strings"
+)
+
+// fairShareQueue holds the submissions waiting for the SubmissionManager.
+// Submissions are grouped by the set of users that submitted them, groups take
+// turns (round-robin), and submissions within a group run in the order they
+// were submitted. This keeps one group submitting over and over from starving
+// everyone else.
+//
+// Groups can also be limited in how many submissions they have running at
+// once. The limit applies to each user, so a user can't get around it by
+// submitting with different partners.
+type fairShareQueue struct {
+	groups  map[string][]*Submission // Group key -> waiting submissions
+	order   []string                 // Groups with waiting submissions, in turn order
+	running map[string]uint          // User -> running (or on deck) submissions
+	limit   uint                     // Max running submissions per user, 0 for unlimited
+}
+
+func newFairShareQueue() *fairShareQueue {
+	return &fairShareQueue{
+		groups:  make(map[string][]*Submission),
+		order:   make([]string, 0),
+		running: make(map[string]uint),
+	}
+}
+
+// The group key is the sorted list of users, so the order users are listed in
+// doesn't matter.
+func submissionGroupKey(s *Submission) string {
+	users := make([]string, len(s.Users))
+	copy(users, s.Users)
+	sort.Strings(users)
+	return strings.Join(users, ",")
+}
+
+func (q *fairShareQueue) len() int {
+	count := 0
+	for _, waiting := range q.groups {
+		count += len(waiting)
+	}
+	return count
+}
+
+func (q *fairShareQueue) contains(s *Submission) bool {
+	for _, other := range q.groups[submissionGroupKey(s)] {
+		if other == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a submission to the back of its group's queue.
+func (q *fairShareQueue) push(s *Submission) {
+	key := submissionGroupKey(s)
+	if len(q.groups[key]) == 0 {
+		q.order = append(q.order, key)
+	}
+	q.groups[key] = append(q.groups[key], s)
+}
+
+// Returns true if none of the users are at their limit.
+func (q *fairShareQueue) canRun(s *Submission) bool {
+	if q.limit == 0 {
+		return true
+	}
+	for _, user := range s.Users {
+		if q.running[user] >= q.limit {
+			return false
+		}
+	}
+	return true
+}
+
+// Find the group whose turn it is, given how many submissions have already
+// been taken from each group. Higher priority classes go first; otherwise, the
+// first group in turn order wins.
+func (q *fairShareQueue) nextGroup(order []string, taken map[string]int, checkLimit bool) string {
+	best := ""
+	for _, key := range order {
+		s := q.groups[key][taken[key]]
+		if checkLimit && !q.canRun(s) {
+			continue
+		}
+		if best == "" || s.Priority > q.groups[best][taken[best]].Priority {
+			best = key
+		}
+	}
+	return best
+}
+
+// Get the submission whose turn it is to run, which is the first submission of
+// the first group (in turn order) that isn't at its limit, unless another
+// group has a submission with a higher priority. Returns nil if there is
+// nothing that can run.
+func (q *fairShareQueue) next() *Submission {
+	if key := q.nextGroup(q.order, nil, true); key != "" {
+		return q.groups[key][0]
+	}
+	return nil
+}
+
+// Remove the submission returned by next() from the queue and count it as
+// running. Its group goes to the back of the line.
+func (q *fairShareQueue) pop(s *Submission) {
+	key := submissionGroupKey(s)
+
+	for i, k := range q.order {
+		if k == key {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+
+	q.groups[key] = q.groups[key][1:]
+	if len(q.groups[key]) > 0 {
+		q.order = append(q.order, key)
+	} else {
+		delete(q.groups, key)
+	}
+
+	for _, user := range s.Users {
+		q.running[user] += 1
+	}
+}
+
+// Mark a popped submission as finished.
+func (q *fairShareQueue) done(s *Submission) {
+	for _, user := range s.Users {
+		if q.running[user] <= 1 {
+			delete(q.running, user)
+		} else {
+			q.running[user] -= 1
+		}
+	}
+}
+
+// Compute the queue position (starting at 1) of each waiting submission,
+// assuming groups keep taking turns. Since this ignores the running limits and
+// later higher priority submissions, the positions are estimates.
+func (q *fairShareQueue) positions() map[*Submission]uint {
+	res := make(map[*Submission]uint)
+
+	// Simulate taking turns
+	order := make([]string, len(q.order))
+	copy(order, q.order)
+	taken := make(map[string]int)
+
+	for pos := uint(1); len(order) > 0; pos++ {
+		key := q.nextGroup(order, taken, false)
+		for i, k := range order {
+			if k == key {
+				order = append(order[:i], order[i+1:]...)
+				break
+			}
+		}
+
+		res[q.groups[key][taken[key]]] = pos
+		taken[key] += 1
+
+		if taken[key] < len(q.groups[key]) {
+			order = append(order, key)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,172 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func fairShareSubmission(id string, users ...string) *Submission {
+	return &Submission{
+		ID:    id,
+		Users: users,
+	}
+}
+
+// Pop everything that can run, returning the IDs in run order.
+func fairShareDrain(q *fairShareQueue) []string {
+	ids := make([]string, 0)
+	for s := q.next(); s != nil; s = q.next() {
+		q.pop(s)
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+func TestFairShareRoundRobin(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	q := newFairShareQueue()
+
+	// One group spams before anyone else gets a chance
+	q.push(fairShareSubmission("a1", "alice@buffalo.edu", "bob@buffalo.edu"))
+	q.push(fairShareSubmission("a2", "bob@buffalo.edu", "alice@buffalo.edu"))
+	q.push(fairShareSubmission("a3", "alice@buffalo.edu", "bob@buffalo.edu"))
+	q.push(fairShareSubmission("c1", "carol@buffalo.edu"))
+	q.push(fairShareSubmission("d1", "dave@buffalo.edu"))
+	q.push(fairShareSubmission("c2", "carol@buffalo.edu"))
+
+	assert.Equal(6, q.len())
+
+	positions := make(map[string]uint)
+	for s, pos := range q.positions() {
+		positions[s.ID] = pos
+	}
+	assert.Equal(map[string]uint{
+		"a1": 1, "c1": 2, "d1": 3, "a2": 4, "c2": 5, "a3": 6,
+	}, positions)
+
+	assert.Equal([]string{"a1", "c1", "d1", "a2", "c2", "a3"}, fairShareDrain(q))
+	assert.Equal(0, q.len())
+	assert.Equal(uint(3), q.running["alice@buffalo.edu"])
+}
+
+func TestFairShareUserLimit(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	q := newFairShareQueue()
+	q.limit = 1
+
+	a1 := fairShareSubmission("a1", "alice@buffalo.edu", "bob@buffalo.edu")
+	a2 := fairShareSubmission("a2", "alice@buffalo.edu", "bob@buffalo.edu")
+	b1 := fairShareSubmission("b1", "bob@buffalo.edu")
+	c1 := fairShareSubmission("c1", "carol@buffalo.edu")
+
+	for _, s := range []*Submission{a1, a2, b1, c1} {
+		q.push(s)
+	}
+	assert.True(q.contains(b1))
+
+	// Bob is running a1, so neither a2 nor b1 can run
+	assert.Equal([]string{"a1", "c1"}, fairShareDrain(q))
+	assert.Nil(q.next())
+	assert.False(q.contains(a1))
+
+	// b1's group had its turn first
+	q.done(a1)
+	assert.Equal([]string{"b1"}, fairShareDrain(q))
+
+	q.done(b1)
+	assert.Equal([]string{"a2"}, fairShareDrain(q))
+
+	q.done(a2)
+	q.done(c1)
+	assert.Equal(0, len(q.running))
+}
+
+type queuePersistence struct {
+	DoNothingPersistence
+	queued []*Submission
+}
+
+func (p *queuePersistence) Notify(entity interface{}, msg, what int) error {
+	if s, ok := entity.(*Submission); ok && msg == MSG_PERSIST_UPDATE && what == MSG_FIELD_QUEUE {
+		p.queued = append(p.queued, s)
+	}
+	return nil
+}
+
+func TestSubmissionManagerQueue(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	env := defaultEnv.CopyEnvironment()
+	persist := &queuePersistence{}
+	env.Persistence = persist
+	sm := NewSubmissionManager(env)
+
+	a1 := fairShareSubmission("a1", "alice@buffalo.edu")
+	a2 := fairShareSubmission("a2", "alice@buffalo.edu")
+	b1 := fairShareSubmission("b1", "bob@buffalo.edu")
+
+	// Positions when each is submitted
+	expected := []uint{1, 2, 2}
+	for i, s := range []*Submission{a1, a2, b1} {
+		pos, err := sm.Enqueue(s)
+		assert.Nil(err)
+		assert.Equal(expected[i], pos)
+	}
+
+	// b1 moves ahead of a2
+	assert.Equal(uint(1), sm.QueuePosition(a1))
+	assert.Equal(uint(3), sm.QueuePosition(a2))
+	assert.Equal(uint(2), sm.QueuePosition(b1))
+	assert.Equal(uint(3), a2.QueuePosition)
+	assert.Equal(uint(3), sm.Stats().Queued)
+
+	// Queue positions are persisted on their own, from copies
+	positions := make(map[string]uint)
+	for _, s := range persist.queued {
+		positions[s.ID] = s.QueuePosition
+		assert.False(s == a1 || s == a2 || s == b1)
+	}
+	assert.Equal(map[string]uint{"a1": 1, "a2": 3, "b1": 2}, positions)
+
+	// Closed for business
+	sm.Pause()
+	c1 := fairShareSubmission("c1", "carol@buffalo.edu")
+	_, err := sm.Enqueue(c1)
+	assert.NotNil(err)
+	assert.Equal(SUBMISSION_ABORTED, c1.Status)
+	assert.Equal(uint(0), sm.QueuePosition(c1))
+}
+
+func TestFairSharePriority(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	q := newFairShareQueue()
+
+	a1 := fairShareSubmission("a1", "alice@buffalo.edu")
+	b1 := fairShareSubmission("b1", "bob@buffalo.edu")
+	s1 := fairShareSubmission("s1", "staff@buffalo.edu")
+	s1.Priority = JOB_PRIORITY_STAFF
+	s2 := fairShareSubmission("s2", "staff@buffalo.edu")
+	s2.Priority = JOB_PRIORITY_STAFF
+
+	for _, s := range []*Submission{a1, b1, s1, s2} {
+		q.push(s)
+	}
+
+	positions := make(map[string]uint)
+	for s, pos := range q.positions() {
+		positions[s.ID] = pos
+	}
+	assert.Equal(map[string]uint{
+		"s1": 1, "s2": 2, "a1": 3, "b1": 4,
+	}, positions)
+
+	// Staff go first, then everyone else takes turns
+	assert.Equal([]string{"s1", "s2", "a1", "b1"}, fairShareDrain(q))
+}
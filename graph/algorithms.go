@@ -0,0 +1,287 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CycleError is returned by operations that require an acyclic graph. It
+// contains one cycle for each strongly connected component of the graph. Each
+// cycle starts and ends with the same node name, i.e. [a b c a] means there
+// are edges a -> b -> c -> a.
+type CycleError struct {
+	Cycles [][]string
+}
+
+func (e *CycleError) Error() string {
+	cycles := make([]string, 0, len(e.Cycles))
+	for _, cycle := range e.Cycles {
+		cycles = append(cycles, strings.Join(cycle, " -> "))
+	}
+	return "Cycle detected: " + strings.Join(cycles, "; ")
+}
+
+type cyclesByStart [][]string
+
+func (c cyclesByStart) Len() int           { return len(c) }
+func (c cyclesByStart) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c cyclesByStart) Less(i, j int) bool { return c[i][0] < c[j][0] }
+
+// Get the names of a node map in sorted order so the algorithms below are
+// deterministic.
+func sortedNames(nodes map[string]*Node) []string {
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Find the strongly connected components of the graph using Tarjan's
+// algorithm. The nodes of each component are sorted by name.
+func (g *Graph) stronglyConnectedComponents() [][]string {
+	index := 0
+	indices := make(map[string]int)
+	lowlink := make(map[string]int)
+	onStack := make(map[string]bool)
+	stack := make([]string, 0)
+	components := make([][]string, 0)
+
+	var strongConnect func(n *Node)
+	strongConnect = func(n *Node) {
+		indices[n.Name] = index
+		lowlink[n.Name] = index
+		index += 1
+		stack = append(stack, n.Name)
+		onStack[n.Name] = true
+
+		for _, name := range sortedNames(n.EdgesOut) {
+			if _, visited := indices[name]; !visited {
+				strongConnect(n.EdgesOut[name])
+				if lowlink[name] < lowlink[n.Name] {
+					lowlink[n.Name] = lowlink[name]
+				}
+			} else if onStack[name] && indices[name] < lowlink[n.Name] {
+				lowlink[n.Name] = indices[name]
+			}
+		}
+
+		// n is the root of a component, so pop it off the stack
+		if lowlink[n.Name] == indices[n.Name] {
+			component := make([]string, 0)
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				component = append(component, top)
+				if top == n.Name {
+					break
+				}
+			}
+			sort.Strings(component)
+			components = append(components, component)
+		}
+	}
+
+	for _, name := range sortedNames(g.NodeMap) {
+		if _, visited := indices[name]; !visited {
+			strongConnect(g.NodeMap[name])
+		}
+	}
+
+	return components
+}
+
+// Find the shortest cycle through start, using only the member nodes.
+func (g *Graph) cycleThrough(start string, members map[string]bool) []string {
+	prev := make(map[string]string)
+	queue := []string{start}
+
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		for _, name := range sortedNames(g.NodeMap[cur].EdgesOut) {
+			if !members[name] {
+				continue
+			} else if name == start {
+				// Walk back to the start, then reverse
+				path := []string{start}
+				for n := cur; n != start; n = prev[n] {
+					path = append(path, n)
+				}
+				path = append(path, start)
+				for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+					path[i], path[j] = path[j], path[i]
+				}
+				return path
+			} else if _, seen := prev[name]; !seen {
+				prev[name] = cur
+				queue = append(queue, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// FindCycles returns the cycles in the graph, one for each strongly connected
+// component, or nil if the graph is acyclic. The cycle returned for a
+// component is the shortest cycle through the component's first node (by
+// name), so the result is deterministic.
+func (g *Graph) FindCycles() [][]string {
+	var cycles [][]string
+
+	for _, component := range g.stronglyConnectedComponents() {
+		start := component[0]
+		if len(component) == 1 {
+			if _, ok := g.NodeMap[start].EdgesOut[start]; !ok {
+				continue
+			}
+		}
+
+		members := make(map[string]bool)
+		for _, name := range component {
+			members[name] = true
+		}
+
+		if cycle := g.cycleThrough(start, members); cycle != nil {
+			cycles = append(cycles, cycle)
+		}
+	}
+
+	sort.Sort(cyclesByStart(cycles))
+
+	return cycles
+}
+
+// Returns the set of nodes reachable from node by following edges in the given
+// direction.
+func reachable(node *Node, out bool) map[string]bool {
+	visited := make(map[string]bool)
+	stack := []*Node{node}
+
+	for len(stack) > 0 {
+		cur := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		edges := cur.EdgesOut
+		if !out {
+			edges = cur.EdgesIn
+		}
+
+		for name, next := range edges {
+			if !visited[name] {
+				visited[name] = true
+				stack = append(stack, next)
+			}
+		}
+	}
+
+	return visited
+}
+
+func (g *Graph) reachableNames(name string, out bool) ([]string, error) {
+	node, ok := g.NodeMap[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Node not found: %v", name))
+	}
+
+	names := make([]string, 0)
+	for n := range reachable(node, out) {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Descendants returns the sorted names of all nodes reachable from the named
+// node by following outgoing edges. The node itself is only included if it is
+// part of a cycle.
+func (g *Graph) Descendants(name string) ([]string, error) {
+	return g.reachableNames(name, true)
+}
+
+// Ancestors returns the sorted names of all nodes from which the named node
+// is reachable. The node itself is only included if it is part of a cycle.
+func (g *Graph) Ancestors(name string) ([]string, error) {
+	return g.reachableNames(name, false)
+}
+
+// HasPath returns true if there is a path of one or more edges from <from> to
+// <to>.
+func (g *Graph) HasPath(from, to string) bool {
+	node, ok := g.NodeMap[from]
+	if !ok {
+		return false
+	}
+	return reachable(node, true)[to]
+}
+
+// Levels partitions the nodes of an acyclic graph into levels. Level 0
+// contains the nodes without outgoing edges, and every other node is one
+// level above the highest of the nodes it has edges to. For dependency graphs,
+// where A -> B means A depends on B, the levels can be run in order with all
+// nodes in a level run in parallel. The nodes of each level are sorted by name.
+func (g *Graph) Levels() ([][]string, error) {
+	if cycles := g.FindCycles(); len(cycles) > 0 {
+		return nil, &CycleError{cycles}
+	}
+
+	levels := make(map[string]int)
+
+	var levelOf func(n *Node) int
+	levelOf = func(n *Node) int {
+		if level, ok := levels[n.Name]; ok {
+			return level
+		}
+		level := 0
+		for _, out := range n.EdgesOut {
+			if l := levelOf(out) + 1; l > level {
+				level = l
+			}
+		}
+		levels[n.Name] = level
+		return level
+	}
+
+	res := make([][]string, 0)
+	for _, name := range sortedNames(g.NodeMap) {
+		level := levelOf(g.NodeMap[name])
+		for len(res) <= level {
+			res = append(res, make([]string, 0))
+		}
+		res[level] = append(res[level], name)
+	}
+
+	return res, nil
+}
+
+// TransitiveReduction returns a new graph with the same reachability as this
+// (acyclic) graph, but with the fewest edges. An edge A -> C is removed if C
+// is also reachable through some other path, e.g. A -> B -> C.
+func (g *Graph) TransitiveReduction() (*Graph, error) {
+	if cycles := g.FindCycles(); len(cycles) > 0 {
+		return nil, &CycleError{cycles}
+	}
+
+	reduced := g.copy()
+
+	for name, node := range g.NodeMap {
+		for _, child := range node.EdgesOut {
+			for descendant := range reachable(child, true) {
+				if _, ok := node.EdgesOut[descendant]; ok {
+					from, to := reduced.NodeMap[name], reduced.NodeMap[descendant]
+					from.removeEdgeOut(to)
+					to.removeEdgeIn(from)
+				}
+			}
+		}
+	}
+
+	return reduced, nil
+}
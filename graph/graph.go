@@ -51,7 +51,7 @@ func (n *Node) removeEdgeOut(edgeNode *Node) {
 }
 
 // TopSort creates a topological sort of the Nodes of a Graph.
-// If there is a cycle, an error is returned, otherwise the
+// If there is a cycle, a *CycleError is returned, otherwise the
 // topological sort is returned as a list of node names.
 func (g *Graph) TopSort() ([]string, error) {
 	sorted := make([]string, 0)
@@ -82,7 +82,7 @@ func (g *Graph) TopSort() ([]string, error) {
 	// if there are any edges left, we have a cycle
 	for _, n := range copy.NodeMap {
 		if len(n.EdgesIn) > 0 || len(n.EdgesOut) > 0 {
-			return nil, errors.New("Cycle!")
+			return nil, &CycleError{g.FindCycles()}
 		}
 	}
 	return sorted, nil
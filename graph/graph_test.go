@@ -82,3 +82,152 @@ func TestGraphForest(t *testing.T) {
 	assert.NotNil(err)
 	t.Log(err)
 }
+
+// Build a graph from a list of nodes and a map of node -> outgoing edges.
+func buildGraph(t *testing.T, names []string, edges map[string][]string) *Graph {
+	nodes := make([]Keyer, 0, len(names))
+	for _, name := range names {
+		nodes = append(nodes, StringNode(name))
+	}
+
+	graph := New(nodes)
+	for from, tos := range edges {
+		for _, to := range tos {
+			assert.Nil(t, graph.AddEdge(StringNode(from), StringNode(to)))
+		}
+	}
+	return graph
+}
+
+func TestGraphFindCycles(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	names := []string{"a", "b", "c", "d", "e", "f", "g"}
+
+	// Acyclic
+	graph := buildGraph(t, names, map[string][]string{
+		"a": []string{"b", "c"},
+		"b": []string{"d"},
+		"c": []string{"d"},
+	})
+	assert.Nil(graph.FindCycles())
+
+	// Two independent cycles, one of which has a shortcut
+	graph = buildGraph(t, names, map[string][]string{
+		"a": []string{"b"},
+		"b": []string{"c"},
+		"c": []string{"d", "a"},
+		"d": []string{"a"},
+		"e": []string{"f"},
+		"f": []string{"e", "g"},
+	})
+	cycles := graph.FindCycles()
+	assert.Equal([][]string{
+		[]string{"a", "b", "c", "a"},
+		[]string{"e", "f", "e"},
+	}, cycles)
+
+	_, err := graph.TopSort()
+	assert.NotNil(err)
+	if cerr, ok := err.(*CycleError); assert.True(ok) {
+		assert.Equal(cycles, cerr.Cycles)
+		assert.Equal("Cycle detected: a -> b -> c -> a; e -> f -> e", cerr.Error())
+	}
+}
+
+func TestGraphReachability(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	graph := buildGraph(t, []string{"a", "b", "c", "d", "e"}, map[string][]string{
+		"a": []string{"b", "c"},
+		"b": []string{"d"},
+		"c": []string{"d"},
+	})
+
+	desc, err := graph.Descendants("a")
+	assert.Nil(err)
+	assert.Equal([]string{"b", "c", "d"}, desc)
+
+	desc, err = graph.Descendants("d")
+	assert.Nil(err)
+	assert.Equal([]string{}, desc)
+
+	anc, err := graph.Ancestors("d")
+	assert.Nil(err)
+	assert.Equal([]string{"a", "b", "c"}, anc)
+
+	_, err = graph.Ancestors("z")
+	assert.NotNil(err)
+
+	assert.True(graph.HasPath("a", "d"))
+	assert.False(graph.HasPath("d", "a"))
+	assert.False(graph.HasPath("a", "e"))
+	assert.False(graph.HasPath("a", "a"))
+	assert.False(graph.HasPath("z", "a"))
+}
+
+func TestGraphLevels(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	graph := buildGraph(t, []string{"boot", "tt1", "tt2", "lt1", "cvt1", "shell"}, map[string][]string{
+		"tt1":   []string{"boot"},
+		"tt2":   []string{"boot"},
+		"lt1":   []string{"tt1", "tt2"},
+		"cvt1":  []string{"lt1", "boot"},
+		"shell": []string{"boot"},
+	})
+
+	levels, err := graph.Levels()
+	assert.Nil(err)
+	assert.Equal([][]string{
+		[]string{"boot"},
+		[]string{"shell", "tt1", "tt2"},
+		[]string{"lt1"},
+		[]string{"cvt1"},
+	}, levels)
+
+	graph.AddEdge(StringNode("boot"), StringNode("cvt1"))
+	_, err = graph.Levels()
+	assert.NotNil(err)
+}
+
+func TestGraphTransitiveReduction(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	graph := buildGraph(t, []string{"a", "b", "c", "d"}, map[string][]string{
+		"a": []string{"b", "c", "d"},
+		"b": []string{"c", "d"},
+		"c": []string{"d"},
+	})
+
+	reduced, err := graph.TransitiveReduction()
+	assert.Nil(err)
+
+	edges := make(map[string][]string)
+	for name, node := range reduced.NodeMap {
+		edges[name] = sortedNames(node.EdgesOut)
+	}
+	assert.Equal(map[string][]string{
+		"a": []string{"b"},
+		"b": []string{"c"},
+		"c": []string{"d"},
+		"d": []string{},
+	}, edges)
+
+	// Reachability is unchanged, and the original graph is untouched
+	for _, from := range []string{"a", "b", "c", "d"} {
+		for _, to := range []string{"a", "b", "c", "d"} {
+			assert.Equal(graph.HasPath(from, to), reduced.HasPath(from, to))
+		}
+	}
+	assert.Equal(3, len(graph.NodeMap["a"].EdgesOut))
+	assert.Equal(1, len(reduced.NodeMap["d"].EdgesIn))
+
+	graph.AddEdge(StringNode("d"), StringNode("a"))
+	_, err = graph.TransitiveReduction()
+	assert.NotNil(err)
+}
@@ -11,11 +11,13 @@ import (
 )
 
 // GroupConfig specifies how a group of tests should be created and run.
+// Tests may contain test files/globs, tags, and tag expressions.
 type GroupConfig struct {
-	Name    string           `json:"name"`
-	UseDeps bool             `json:"usedeps"`
-	Tests   []string         `json:"tests"`
-	Env     *TestEnvironment `json:"-" bson:"-"`
+	Name     string           `json:"name"`
+	UseDeps  bool             `json:"usedeps"`
+	Tests    []string         `json:"tests"`
+	Priority int              `json:"priority"` // Test manager priority class, JOB_PRIORITY_*
+	Env      *TestEnvironment `json:"-" bson:"-"`
 }
 
 // A group of tests to be run, which is the result of expanding a GroupConfig.
@@ -41,12 +43,17 @@ type testMap struct {
 	TestDir string
 	Tests   map[string]*Test
 	Tags    TagMap
+
+	// File id -> test instances. Parameterized tests have multiple instances
+	// per file, everything else has one.
+	Files map[string][]*Test
 }
 
-// Result type for loading a test from a file
+// Result type for loading the tests from a file
 type testLoadResult struct {
-	Test *Test
-	Err  error
+	FileID string
+	Tests  []*Test
+	Err    error
 }
 
 func newTestMap(testDir string) (*testMap, []error) {
@@ -55,7 +62,7 @@ func newTestMap(testDir string) (*testMap, []error) {
 		return nil, []error{err}
 	}
 	abs = path.Clean(abs)
-	tm := &testMap{abs, make(map[string]*Test), make(TagMap)}
+	tm := &testMap{abs, make(map[string]*Test), make(TagMap), make(map[string][]*Test)}
 	errs := tm.load()
 	if len(errs) > 0 {
 		return nil, errs
@@ -108,11 +115,16 @@ func (tm *testMap) load() []error {
 	// Spawn a bunch of workers to load the tests
 	for _, file := range files {
 		go func(f string) {
-			test, err := TestFromFile(f)
+			var id string
+			tests, err := TestsFromFile(f)
 			if err == nil {
-				test.DependencyID, err = idFromFile(f, tm.TestDir)
+				if id, err = idFromFile(f, tm.TestDir); err == nil {
+					for _, test := range tests {
+						test.DependencyID = id + test.instanceSuffix()
+					}
+				}
 			}
-			res := testLoadResult{test, err}
+			res := testLoadResult{id, tests, err}
 			resChan <- res
 		}(file)
 	}
@@ -123,7 +135,10 @@ func (tm *testMap) load() []error {
 		if res.Err != nil {
 			errs = append(errs, res.Err)
 		} else {
-			tm.Tests[res.Test.DependencyID] = res.Test
+			tm.Files[res.FileID] = res.Tests
+			for _, test := range res.Tests {
+				tm.Tests[test.DependencyID] = test
+			}
 		}
 	}
 
@@ -131,10 +146,16 @@ func (tm *testMap) load() []error {
 }
 
 // Get a slice of tests from a single search expression, which can be a glob
-// or single file.
+// or single file, optionally followed by a parameter selector that restricts
+// which instances of parameterized tests are included.
 func (tm *testMap) testsFromGlob(search, startDir string) ([]*Test, error) {
 	var glob string
 
+	search, selector, err := splitTestSpec(search)
+	if err != nil {
+		return nil, err
+	}
+
 	if strings.HasPrefix(search, "/") {
 		// Relative to the test directory
 		glob = path.Join(tm.TestDir, search)
@@ -169,14 +190,24 @@ func (tm *testMap) testsFromGlob(search, startDir string) ([]*Test, error) {
 		if id, err := idFromFile(file, tm.TestDir); err != nil {
 			return nil, err
 		} else {
-			if test, ok := tm.Tests[id]; ok {
-				tests = append(tests, test)
+			if instances, ok := tm.Files[id]; ok {
+				for _, test := range instances {
+					if test.matchesParams(selector) {
+						tests = append(tests, test)
+					}
+				}
 			} else {
 				return nil,
 					errors.New(fmt.Sprintf("Cannot find test: %v.  Is testMap initialized?", id))
 			}
 		}
 	}
+
+	if len(tests) == 0 {
+		return nil, errors.New(fmt.Sprintf("Cannot find a test instance matching %v%v",
+			glob, formatParams(selector)))
+	}
+
 	return tests, nil
 }
 
@@ -190,7 +221,7 @@ func (t *Test) expandTestDeps(tests *testMap, done chan error) {
 		var ok bool = false
 		var err error = nil
 
-		if strings.HasSuffix(dep, ".t") {
+		if IsTestSpec(dep) {
 			// it's a file/glob
 			startDir := path.Dir(path.Join(tests.TestDir, t.DependencyID))
 			if deps, err = tests.testsFromGlob(dep, startDir); err != nil {
@@ -319,14 +350,11 @@ func (tg *TestGroup) expandTests(tm *testMap) []error {
 		go func(test string) {
 			var tests []*Test = nil
 			var err error = nil
-			if strings.HasSuffix(test, ".t") {
+			if IsTestSpec(test) {
 				tests, err = tm.testsFromGlob(test, tg.Config.Env.TestDir)
 			} else {
-				if res, ok := tm.Tags[test]; ok {
-					tests = res
-				} else {
-					err = errors.New(fmt.Sprintf("Cannot find tag: %v", test))
-				}
+				// A single tag, or a boolean expression of tags
+				tests, err = tm.testsFromTagExpr(test)
 			}
 			resChan <- &expandRes{err, tests}
 		}(t)
@@ -418,9 +446,14 @@ func GroupFromConfig(config *GroupConfig) (*TestGroup, []error) {
 		return nil, errs
 	}
 
-	// topsort returns an error if there's a cycle
-	if _, err := g.TopSort(); err != nil {
-		return nil, []error{err}
+	// Report every cycle, since there may be more than one circular depends
+	if cycles := g.FindCycles(); len(cycles) > 0 {
+		errs = make([]error, 0, len(cycles))
+		for _, cycle := range cycles {
+			errs = append(errs, errors.New(fmt.Sprintf("Circular test dependency: %v (-> means depends on)",
+				strings.Join(cycle, " -> "))))
+		}
+		return nil, errs
 	}
 
 	// Get the dependencies for everything already in the test group
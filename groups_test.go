@@ -279,6 +279,34 @@ func TestDependencyCycle(t *testing.T) {
 	assert.NotNil(g)
 	_, err = g.TopSort()
 	assert.NotNil(err)
+
+	// The shortest cycle through the first test in the cycle
+	assert.Equal([][]string{
+		[]string{"boot.t", "sync/sy4.t", "threads/tt1.t", "boot.t"},
+	}, g.FindCycles())
+}
+
+func TestGroupCycleError(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	env := defaultEnv.CopyEnvironment()
+	env.TestDir = CYCLE_DIR
+
+	config := &GroupConfig{
+		Name:    "Test",
+		UseDeps: true,
+		Tests:   []string{"sync/sy1.t"},
+		Env:     env,
+	}
+
+	tg, errs := GroupFromConfig(config)
+	assert.Nil(tg)
+	assert.Equal(1, len(errs))
+	if len(errs) == 1 {
+		assert.Equal("Circular test dependency: boot.t -> sync/sy4.t -> threads/tt1.t -> boot.t (-> means depends on)",
+			errs[0].Error())
+	}
 }
 
 func TestGroupFromConfg(t *testing.T) {
@@ -0,0 +1,317 @@
+package test161
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This file handles invariant checks, which compare a value reported by a
+// command each time it runs in a test. For example, khu prints the kernel heap
+// usage, which should be the same every time if the tests in between didn't
+// leak memory. The same goes for open file descriptors, vnodes, and coremap
+// pages.
+//
+// The value comes from the first trusted line of the command's output that
+// matches Pattern (the first group is the value), or from a measure message
+// called Metric (see securemsg.go). If a check fails, or an instance of the
+// command doesn't report the value, Points are deducted from the test.
+//
+// Targets declare invariant checks for all of their tests, or for a single
+// test. The memory leak check is the built-in khu check.
+
+// Invariant check types
+const (
+	INVARIANT_EQUAL          = "equal"          // The same value every time
+	INVARIANT_NON_INCREASING = "non-increasing" // Never more than the last value
+	INVARIANT_TOLERANCE      = "tolerance"      // Within Tolerance of the first value
+)
+
+// An InvariantCheck compares a value across a test's instances of a command.
+type InvariantCheck struct {
+	Name      string  `yaml:"name" json:"name" bson:"name"`                // e.g. "vnode leak"
+	Command   string  `yaml:"command" json:"command" bson:"command"`       // Command id, e.g. khu
+	Pattern   string  `yaml:"pattern" json:"pattern" bson:"pattern"`       // Regexp whose first group is the value
+	Metric    string  `yaml:"metric" json:"metric" bson:"metric"`          // Or, the name of a measure message
+	Check     string  `yaml:"check" json:"check" bson:"check"`             // INVARIANT_*, equal by default
+	Tolerance float64 `yaml:"tolerance" json:"tolerance" bson:"tolerance"` // For INVARIANT_TOLERANCE
+	Units     string  `yaml:"units" json:"units" bson:"units"`             // For status messages
+	Points    uint    `yaml:"points" json:"points" bson:"points"`          // Deduction if the check fails
+
+	// Set during evaluation
+	Checked   bool      `yaml:"-" json:"checked" bson:"checked"`       // Did the test run the command?
+	Values    []float64 `yaml:"-" json:"values" bson:"values"`         // The values we found
+	Failed    bool      `yaml:"-" json:"failed" bson:"failed"`         // Did the check fail?
+	BadOutput bool      `yaml:"-" json:"bad_output" bson:"bad_output"` // Failed because the value was missing
+	Change    float64   `yaml:"-" json:"change" bson:"change"`         // The change that failed the check
+	Deducted  uint      `yaml:"-" json:"deducted" bson:"deducted"`     // Points deducted
+
+	patternExp *regexp.Regexp
+}
+
+// The built-in memory leak check
+func memLeakCheck(points uint) *InvariantCheck {
+	return &InvariantCheck{
+		Name:    "memory leak",
+		Command: "khu",
+		Pattern: `^khu: (\d+)$`,
+		Check:   INVARIANT_EQUAL,
+		Units:   "bytes",
+		Points:  points,
+	}
+}
+
+// Validate the check and fill in the defaults.
+func (ic *InvariantCheck) init() error {
+	if len(ic.Name) == 0 {
+		return errors.New("Invariant checks must have a name")
+	}
+	if len(ic.Command) == 0 {
+		return fmt.Errorf("Invariant check %v needs a command", ic.Name)
+	}
+	if (len(ic.Pattern) == 0) == (len(ic.Metric) == 0) {
+		return fmt.Errorf("Invariant check %v needs either a pattern or a metric", ic.Name)
+	}
+	if len(ic.Pattern) > 0 {
+		exp, err := regexp.Compile(ic.Pattern)
+		if err != nil {
+			return fmt.Errorf("Invariant check %v: %v", ic.Name, err)
+		}
+		if exp.NumSubexp() < 1 {
+			return fmt.Errorf("Invariant check %v: the pattern needs a group for the value", ic.Name)
+		}
+		ic.patternExp = exp
+	}
+
+	switch ic.Check {
+	case "":
+		ic.Check = INVARIANT_EQUAL
+	case INVARIANT_EQUAL, INVARIANT_NON_INCREASING, INVARIANT_TOLERANCE:
+	default:
+		return fmt.Errorf("Invalid check for invariant check %v: %v", ic.Name, ic.Check)
+	}
+	return nil
+}
+
+func checkInvariants(checks []*InvariantCheck) error {
+	names := make(map[string]bool)
+	for _, ic := range checks {
+		if err := ic.init(); err != nil {
+			return err
+		}
+		if names[ic.Name] {
+			return fmt.Errorf("Duplicate invariant check: %v", ic.Name)
+		}
+		names[ic.Name] = true
+	}
+	return nil
+}
+
+// Copy the configuration of the check, without any results.
+func (ic *InvariantCheck) copy() *InvariantCheck {
+	return &InvariantCheck{
+		Name:      ic.Name,
+		Command:   ic.Command,
+		Pattern:   ic.Pattern,
+		Metric:    ic.Metric,
+		Check:     ic.Check,
+		Tolerance: ic.Tolerance,
+		Units:     ic.Units,
+		Points:    ic.Points,
+	}
+}
+
+// Get the value from a command's output.
+func (ic *InvariantCheck) value(c *Command, trusted func(*OutputLine) bool) (float64, bool) {
+	for _, line := range c.Output {
+		if !trusted(line) {
+			continue
+		}
+		if len(ic.Metric) > 0 {
+			if line.isSecureMessage(SECURE_MSG_MEASURE) && line.Message.Name == ic.Metric {
+				return line.Message.Value, true
+			}
+		} else if res := ic.patternExp.FindStringSubmatch(line.Line); len(res) > 1 {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(res[1]), 64); err == nil {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Compare value to the previous values, and return the change if it fails
+// the check.
+func (ic *InvariantCheck) compare(value float64) (float64, bool) {
+	if len(ic.Values) == 0 {
+		return 0, true
+	}
+	first := ic.Values[0]
+	last := ic.Values[len(ic.Values)-1]
+
+	switch ic.Check {
+	case INVARIANT_NON_INCREASING:
+		return value - last, value <= last
+	case INVARIANT_TOLERANCE:
+		return value - first, math.Abs(value-first) <= ic.Tolerance
+	default:
+		return value - first, value == first
+	}
+}
+
+// Run the check on the test's output. The first failure ends the check.
+func (ic *InvariantCheck) evaluate(t *Test) {
+	ic.Checked, ic.Failed, ic.BadOutput = false, false, false
+	ic.Values = make([]float64, 0)
+	ic.Change, ic.Deducted = 0, 0
+
+	if ic.patternExp == nil && len(ic.Pattern) > 0 {
+		if err := ic.init(); err != nil {
+			t.env.Log.Printf("Test ID %v  %v\n", t.ID, err)
+			return
+		}
+	}
+
+	_, hasKey := t.env.keyMap[ic.Command]
+	trusted := func(line *OutputLine) bool {
+		// The output needs to be trusted
+		return !hasKey || (line.Trusted && line.KeyName == ic.Command)
+	}
+
+	for _, c := range t.Commands {
+		if c.Id() != ic.Command {
+			continue
+		}
+		ic.Checked = true
+
+		// Either the output was supressed, or wrong. We check this per
+		// command instance.
+		value, ok := ic.value(c, trusted)
+		if !ok {
+			ic.Failed = true
+			ic.BadOutput = true
+			return
+		}
+
+		change, ok := ic.compare(value)
+		ic.Values = append(ic.Values, value)
+		if !ok {
+			ic.Failed = true
+			ic.Change = change
+			return
+		}
+	}
+}
+
+// Deduct points for a failed check, if applicable
+func (t *Test) deductInvariantPoints(ic *InvariantCheck) {
+	if t.PointsAvailable > 0 && ic.Points > 0 {
+		if t.PointsEarned < ic.Points {
+			ic.Deducted = t.PointsEarned
+			t.PointsEarned = 0
+		} else {
+			t.PointsEarned -= ic.Points
+			ic.Deducted = ic.Points
+		}
+	}
+}
+
+// Add a status to the test for a failed check. If there was a point
+// deduction, show it; otherwise, give a warning.
+func (t *Test) addInvariantStatus(ic *InvariantCheck) {
+	title := strings.ToUpper(ic.Name[:1]) + ic.Name[1:]
+	change := strconv.FormatFloat(ic.Change, 'f', -1, 64)
+	if len(ic.Units) > 0 {
+		change += " " + ic.Units
+	}
+
+	if ic.BadOutput {
+		if ic.Deducted > 0 {
+			t.addStatus(ic.Name, fmt.Sprintf("Unable to determine %v, corrupted output. %v deduction: %v points",
+				ic.Name, title, ic.Deducted))
+		} else {
+			t.addStatus(ic.Name, fmt.Sprintf("Unable to determine %v, corrupted output", ic.Name))
+		}
+	} else if t.PointsAvailable > 0 && ic.Points > 0 {
+		t.addStatus(ic.Name, fmt.Sprintf("%v deduction (%v): %v points", title, change, ic.Deducted))
+	} else {
+		t.addStatus(ic.Name, fmt.Sprintf("Warning: %v detected (%v)", ic.Name, change))
+	}
+}
+
+// Run the test's invariant checks, including the memory leak check.
+func (t *Test) evaluateInvariants() {
+	t.evaluateMemLeaks()
+
+	for _, ic := range t.Invariants {
+		ic.evaluate(t)
+		if ic.Failed {
+			t.deductInvariantPoints(ic)
+			t.addInvariantStatus(ic)
+		}
+	}
+}
+
+// The memory leak check is the khu invariant check, but it keeps its own
+// fields in the test.
+func (t *Test) evaluateMemLeaks() {
+	ic := memLeakCheck(t.MemLeakPoints)
+	ic.init()
+	ic.evaluate(t)
+
+	t.MemLeakChecked = ic.Checked
+	if ic.Failed {
+		t.MemLeakBytes = int(ic.Change)
+		t.deductInvariantPoints(ic)
+		t.MemLeakDeducted = ic.Deducted
+		t.addInvariantStatus(ic)
+	}
+}
+
+// Set up the invariant checks for a test in the target. Checks for commands
+// the test doesn't run are left out.
+func (t *Target) applyInvariants(tt *TargetTest, test *Test) {
+	commands := make(map[string]bool)
+	for _, c := range test.Commands {
+		commands[c.Id()] = true
+	}
+
+	test.Invariants = make([]*InvariantCheck, 0)
+	for _, checks := range [][]*InvariantCheck{t.Invariants, tt.Invariants} {
+		for _, ic := range checks {
+			if commands[ic.Command] {
+				test.Invariants = append(test.Invariants, ic.copy())
+			}
+		}
+	}
+}
+
+// Check the target's invariant checks.
+func (t *Target) checkInvariants() error {
+	if err := checkInvariants(t.Invariants); err != nil {
+		return err
+	}
+	for _, tt := range t.Tests {
+		if err := checkInvariants(tt.Invariants); err != nil {
+			return fmt.Errorf("Test %v: %v", tt.Id, err)
+		}
+	}
+	return nil
+}
+
+// Compare the configuration of two lists of invariant checks.
+func invariantsChanged(old, other []*InvariantCheck) bool {
+	if len(old) != len(other) {
+		return true
+	}
+	for i := range old {
+		if !reflect.DeepEqual(old[i].copy(), other[i].copy()) {
+			return true
+		}
+	}
+	return false
+}
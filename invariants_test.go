@@ -0,0 +1,242 @@
+package test161
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func invariantTest(env *TestEnvironment, outputs ...[]string) *Test {
+	test := &Test{
+		env:             env,
+		L:               &sync.Mutex{},
+		PointsAvailable: 10,
+		PointsEarned:    10,
+		Status:          make([]Status, 0),
+	}
+	for _, output := range outputs {
+		cmd := &Command{Input: InputLine{Line: output[0]}}
+		for _, line := range output[1:] {
+			cmd.Output = append(cmd.Output, &OutputLine{Line: line})
+		}
+		test.Commands = append(test.Commands, cmd)
+	}
+	return test
+}
+
+func TestInvariantMemLeaks(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	env := defaultEnv.CopyEnvironment()
+
+	test := invariantTest(env,
+		[]string{"khu", "khu: 1024"},
+		[]string{"sy1", "sy1: SUCCESS"},
+		[]string{"khu", "khu: 1024"},
+	)
+	test.MemLeakPoints = 3
+	test.evaluateInvariants()
+	assert.True(test.MemLeakChecked)
+	assert.Equal(0, test.MemLeakBytes)
+	assert.Equal(uint(10), test.PointsEarned)
+	assert.Equal(0, len(test.Status))
+
+	test = invariantTest(env,
+		[]string{"khu", "khu: 1024"},
+		[]string{"khu", "khu: 2048"},
+	)
+	test.MemLeakPoints = 3
+	test.evaluateInvariants()
+	assert.Equal(1024, test.MemLeakBytes)
+	assert.Equal(uint(3), test.MemLeakDeducted)
+	assert.Equal(uint(7), test.PointsEarned)
+	if assert.Equal(1, len(test.Status)) {
+		assert.Equal("Memory leak deduction (1024 bytes): 3 points", test.Status[0].Message)
+	}
+
+	test = invariantTest(env,
+		[]string{"khu", "khu: 1024"},
+		[]string{"khu", "garbage"},
+	)
+	test.evaluateInvariants()
+	assert.Equal(uint(10), test.PointsEarned)
+	if assert.Equal(1, len(test.Status)) {
+		assert.Equal("Unable to determine memory leak, corrupted output", test.Status[0].Message)
+	}
+}
+
+func TestInvariantChecks(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	env := defaultEnv.CopyEnvironment()
+	key, _ := newKey(KEYBYTES)
+	env.keyMap["fdstat"] = key
+
+	checks := []*InvariantCheck{
+		&InvariantCheck{Name: "vnode leak", Command: "vnstat", Pattern: `^vnodes: (\d+)$`, Units: "vnodes", Points: 2},
+		&InvariantCheck{Name: "coremap leak", Command: "cmstat", Pattern: `^pages: (\d+)$`,
+			Check: INVARIANT_TOLERANCE, Tolerance: 2},
+		&InvariantCheck{Name: "fd leak", Command: "fdstat", Pattern: `^fds: (\d+)$`,
+			Check: INVARIANT_NON_INCREASING, Points: 20},
+	}
+	assert.Nil(checkInvariants(checks))
+	assert.Equal(INVARIANT_EQUAL, checks[0].Check)
+
+	test := invariantTest(env,
+		[]string{"vnstat", "vnodes: 10"},
+		[]string{"cmstat", "pages: 100"},
+		[]string{"vnstat", "vnodes: 13"},
+		[]string{"cmstat", "pages: 102"},
+		[]string{"cmstat", "pages: 99"},
+		[]string{"fdstat", "fds: 3"},
+	)
+	for _, ic := range checks {
+		test.Invariants = append(test.Invariants, ic.copy())
+	}
+	test.evaluateInvariants()
+
+	vnodes, coremap, fds := test.Invariants[0], test.Invariants[1], test.Invariants[2]
+
+	assert.True(vnodes.Failed)
+	assert.Equal(3.0, vnodes.Change)
+	assert.Equal(uint(2), vnodes.Deducted)
+
+	assert.True(coremap.Checked)
+	assert.False(coremap.Failed)
+	assert.Equal([]float64{100, 102, 99}, coremap.Values)
+
+	// fdstat has a key, so the untrusted output doesn't count
+	assert.True(fds.Failed)
+	assert.True(fds.BadOutput)
+	assert.Equal(uint(8), fds.Deducted)
+	assert.Equal(uint(0), test.PointsEarned)
+
+	if assert.Equal(2, len(test.Status)) {
+		assert.Equal("Vnode leak deduction (3 vnodes): 2 points", test.Status[0].Message)
+		assert.Equal("Unable to determine fd leak, corrupted output. Fd leak deduction: 8 points",
+			test.Status[1].Message)
+	}
+
+	ic := &InvariantCheck{Name: "fd leak", Command: "fdstat", Pattern: `^fds: (\d+)$`,
+		Check: INVARIANT_NON_INCREASING}
+	ic.init()
+	test = invariantTest(env, []string{"fdstat"}, []string{"fdstat"}, []string{"fdstat"})
+	test.salts = make(map[string]bool)
+	test.Salts = make([]string, 0)
+	for i, fds := range []string{"05", "04", "06"} {
+		test.Commands[i].Output = []*OutputLine{
+			secureTestLine(test, fmt.Sprintf("(fdstat, %v, %v, fds: %v)", secureMAC(key, fds, "fds: "+fds), fds, fds)),
+		}
+	}
+	ic.evaluate(test)
+	assert.True(ic.Failed)
+	assert.False(ic.BadOutput)
+	assert.Equal([]float64{5, 4, 6}, ic.Values)
+	assert.Equal(2.0, ic.Change)
+}
+
+func TestInvariantConfig(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	bad := []*InvariantCheck{
+		&InvariantCheck{Command: "khu", Pattern: `(\d+)`},
+		&InvariantCheck{Name: "leak", Pattern: `(\d+)`},
+		&InvariantCheck{Name: "leak", Command: "khu"},
+		&InvariantCheck{Name: "leak", Command: "khu", Pattern: `(\d+)`, Metric: "bytes"},
+		&InvariantCheck{Name: "leak", Command: "khu", Pattern: `\d+`},
+		&InvariantCheck{Name: "leak", Command: "khu", Pattern: `(\d+`},
+		&InvariantCheck{Name: "leak", Command: "khu", Pattern: `(\d+)`, Check: "bogus"},
+	}
+	for _, ic := range bad {
+		assert.NotNil(ic.init())
+	}
+
+	target, err := TargetFromString(`---
+name: asst1
+points: 10
+type: asst
+invariants:
+  - name: vnode leak
+    command: khu
+    pattern: '^vnodes: (\d+)$'
+  - name: fd leak
+    command: fdstat
+    metric: open fds
+    check: non-increasing
+tests:
+  - id: sync/sy1.t
+    points: 10
+    invariants:
+      - name: coremap leak
+        command: khu
+        metric: pages
+        check: tolerance
+        tolerance: 4
+        points: 2
+`)
+	if assert.Nil(err) {
+		assert.Equal(2, len(target.Invariants))
+		assert.Equal(INVARIANT_EQUAL, target.Invariants[0].Check)
+
+		// Only the checks for commands in the test
+		test := &Test{Commands: []*Command{&Command{Input: InputLine{Line: "khu"}}}}
+		target.applyInvariants(target.Tests[0], test)
+		if assert.Equal(2, len(test.Invariants)) {
+			assert.Equal("vnode leak", test.Invariants[0].Name)
+			assert.Equal("coremap leak", test.Invariants[1].Name)
+			assert.Equal(4.0, test.Invariants[1].Tolerance)
+		}
+
+		// Changing the checks needs a new version
+		other, _ := TargetFromString(`---
+name: asst1
+points: 10
+type: asst
+invariants:
+  - name: vnode leak
+    command: khu
+    pattern: '^vnodes: (\d+)$'
+  - name: fd leak
+    command: fdstat
+    metric: open fds
+    check: non-increasing
+tests:
+  - id: sync/sy1.t
+    points: 10
+    invariants:
+      - name: coremap leak
+        command: khu
+        metric: pages
+        check: tolerance
+        tolerance: 4
+        points: 2
+`)
+		assert.Nil(target.isChangeAllowed(other))
+		other.Tests[0].Invariants[0].Points = 3
+		assert.NotNil(target.isChangeAllowed(other))
+		other.Tests[0].Invariants[0].Points = 2
+		other.Invariants = other.Invariants[:1]
+		assert.NotNil(target.isChangeAllowed(other))
+	}
+
+	_, err = TargetFromString(`---
+name: asst1
+points: 10
+type: asst
+tests:
+  - id: sync/sy1.t
+    points: 10
+    invariants:
+      - name: leak
+        command: khu
+        pattern: '(\d+)'
+      - name: leak
+        command: khu
+        pattern: '(\d+)'
+`)
+	assert.NotNil(err)
+}
@@ -1,6 +1,7 @@
 package test161
 
 import (
+	"container/heap"
 	"errors"
 	"fmt"
 	"sync"
@@ -9,7 +10,9 @@ import (
 
 // This file defines test161's test manager.  The manager is responsible for
 // keeping track of the number of running tests and limiting that number to
-// a configurable capacity.
+// a configurable capacity. The manager can also limit the resources used by
+// running tests (see resources.go), and send tests to remote workers (see
+// workerpool.go).
 //
 // There is a global test manager (testManager) that listens for new job
 // requests on its SubmitChan.  In the current implementation, this can
@@ -21,6 +24,64 @@ type test161Job struct {
 	Test     *Test
 	Env      *TestEnvironment
 	DoneChan chan *Test161JobResult
+
+	// When the manager is at capacity, jobs run in order of priority class
+	// (JOB_PRIORITY_*), then the order their groups started, then critical
+	// path length within the group, then submission order. Critical paths are
+	// only comparable within a group, and comparing them across groups would
+	// let a new submission with long chains jump ahead of older ones.
+	Priority     int
+	Group        uint64
+	CriticalPath float64
+
+	seq       uint64        // Submission order
+	resources TestResources // What the test needs while it runs
+}
+
+// Job priority classes. Higher priority jobs run first.
+const (
+	JOB_PRIORITY_SUBMISSION = 0 // Normal submissions (the default)
+	JOB_PRIORITY_STAFF      = 1 // Staff, e.g. testing a hotfix
+)
+
+// Names for the priority classes, used in stats.
+var jobPriorityNames = map[int]string{
+	JOB_PRIORITY_SUBMISSION: "submission",
+	JOB_PRIORITY_STAFF:      "staff",
+}
+
+func jobPriorityName(priority int) string {
+	if name, ok := jobPriorityNames[priority]; ok {
+		return name
+	}
+	return fmt.Sprintf("%v", priority)
+}
+
+// jobQueue is a priority queue (heap) of the jobs waiting for the manager.
+type jobQueue []*test161Job
+
+func (q jobQueue) Len() int      { return len(q) }
+func (q jobQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q jobQueue) Less(i, j int) bool {
+	if q[i].Priority != q[j].Priority {
+		return q[i].Priority > q[j].Priority
+	} else if q[i].Group != q[j].Group {
+		return q[i].Group < q[j].Group
+	} else if q[i].CriticalPath != q[j].CriticalPath {
+		return q[i].CriticalPath > q[j].CriticalPath
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q *jobQueue) Push(x interface{}) {
+	*q = append(*q, x.(*test161Job))
+}
+
+func (q *jobQueue) Pop() interface{} {
+	old := *q
+	job := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return job
 }
 
 // A Test161JobResult consists of the completed test and any error that
@@ -38,6 +99,13 @@ type manager struct {
 	statsCond *sync.Cond
 	queueCond *sync.Cond
 	isRunning bool
+	queue     jobQueue
+	nextSeq   uint64
+	limits    TestResources // Resource budget, zero fields are unlimited
+	inUse     TestResources // Resources used by running jobs
+	tuned     uint          // Auto-tuned capacity, if tuning
+	tuneStop  chan bool     // Stops auto-tuning, nil if not tuning
+	workers   *WorkerPool   // Remote workers, if any
 
 	stats ManagerStats
 }
@@ -53,13 +121,36 @@ type ManagerStats struct {
 	AvgWait     int64 `json:"avg_wait_ms"`
 	StartTime   time.Time
 	total       int64 // denominator for avg
+
+	// Test manager only
+	QueuedByPriority map[string]uint `json:"queued_by_priority,omitempty"` // Queued jobs by priority class name
+	Capacity         uint            `json:"capacity,omitempty"`           // Current (possibly tuned) capacity
+	ResourcesInUse   *TestResources  `json:"resources_in_use,omitempty"`
+}
+
+// Make a copy of the stats that doesn't share the priority map
+func (stats *ManagerStats) copy() *ManagerStats {
+	res := *stats
+	if stats.QueuedByPriority != nil {
+		res.QueuedByPriority = make(map[string]uint)
+		for k, v := range stats.QueuedByPriority {
+			res.QueuedByPriority[k] = v
+		}
+	}
+	if stats.ResourcesInUse != nil {
+		inUse := *stats.ResourcesInUse
+		res.ResourcesInUse = &inUse
+	}
+	return &res
 }
 
 // Combined submission and tests statistics since the service started
 type Test161Stats struct {
-	Status          string       `json:"status"`
-	SubmissionStats ManagerStats `json:"submission_stats"`
-	TestStats       ManagerStats `json:"test_stats"`
+	Status          string           `json:"status"`
+	SubmissionStats ManagerStats     `json:"submission_stats"`
+	TestStats       ManagerStats     `json:"test_stats"`
+	Workers         []*WorkerInfo    `json:"workers,omitempty"`
+	BuildLocks      []*BuildLockInfo `json:"build_locks,omitempty"`
 }
 
 const DEFAULT_MGR_CAPACITY uint = 0
@@ -90,8 +181,12 @@ func (m *manager) start() {
 		return
 	}
 
+	m.inUse = TestResources{}
 	m.stats = ManagerStats{
-		StartTime: time.Now(),
+		StartTime:        time.Now(),
+		QueuedByPriority: make(map[string]uint),
+		Capacity:         m.capacity(),
+		ResourcesInUse:   &TestResources{},
 	}
 	m.SubmitChan = make(chan *test161Job)
 	m.isRunning = true
@@ -105,33 +200,91 @@ func (m *manager) start() {
 	}()
 }
 
+// The current capacity, which is the tuned capacity if we're auto-tuning.
+// Must hold statsCond.L.
+func (m *manager) capacity() uint {
+	if m.workers != nil && m.workers.active() {
+		return m.workers.capacity()
+	} else if m.tuneStop != nil {
+		return m.tuned
+	}
+	return m.Capacity
+}
+
+// Returns true if there's room for the job to run now. Must hold statsCond.L.
+func (m *manager) canRun(job *test161Job) bool {
+	// A job that needs more than the whole budget can still run by itself.
+	if m.stats.Running == 0 {
+		return true
+	} else if capacity := m.capacity(); capacity > 0 && m.stats.Running >= capacity {
+		return false
+	} else if m.workers != nil && m.workers.active() {
+		// The budget is for this host
+		return true
+	}
+	return m.limits.fits(m.inUse, job.resources)
+}
+
+// Run the job on a worker if we have any, otherwise run it here.
+func (m *manager) runJob(job *test161Job) error {
+	m.statsCond.L.Lock()
+	pool := m.workers
+	m.statsCond.L.Unlock()
+
+	if pool != nil && pool.active() {
+		if err := pool.run(job); err != errNoWorkers {
+			return err
+		}
+	}
+	return job.Test.Run(job.Env)
+}
+
 // Queue the job if we're at capacity, and run it once we're under.
 func (m *manager) runOrQueueJob(job *test161Job) {
 
+	job.resources = job.Test.Resources()
+
 	m.statsCond.L.Lock()
 	queued := false
 	start := time.Now()
 
-	for m.Capacity > 0 && m.stats.Running >= m.Capacity {
-		if !queued {
-			queued = true
+	m.nextSeq += 1
+	job.seq = m.nextSeq
 
-			// Update queued stats
-			m.stats.Queued += 1
-			if m.stats.Queued > m.stats.HighQueued {
-				m.stats.HighQueued = m.stats.Queued
-			}
+	// Get in line if we're at capacity, or if other jobs are already waiting
+	if !m.canRun(job) || len(m.queue) > 0 {
+		queued = true
+		heap.Push(&m.queue, job)
+
+		// Update queued stats
+		m.stats.Queued += 1
+		if m.stats.Queued > m.stats.HighQueued {
+			m.stats.HighQueued = m.stats.Queued
 		}
+		m.stats.QueuedByPriority[jobPriorityName(job.Priority)] += 1
+	}
 
+	// Only the highest priority job gets to leave the queue
+	for queued && (!m.canRun(job) || m.queue[0] != job) {
 		// Wait for a finished test to signal us
 		m.statsCond.Wait()
 	}
 
 	// We've got the green light... (and the stats lock)
 	if queued {
+		heap.Pop(&m.queue)
+
+		// The next job in line may be able to run too
+		m.statsCond.Broadcast()
+
 		// Update the queue count and signal the submission manager (if there is one)
 		m.queueCond.L.Lock()
 		m.stats.Queued -= 1
+		if name := jobPriorityName(job.Priority); m.stats.QueuedByPriority[name] <= 1 {
+			delete(m.stats.QueuedByPriority, name)
+		} else {
+			m.stats.QueuedByPriority[name] -= 1
+		}
 		m.queueCond.Signal()
 		m.queueCond.L.Unlock()
 		queued = false
@@ -149,11 +302,13 @@ func (m *manager) runOrQueueJob(job *test161Job) {
 	if m.stats.Running > m.stats.HighRunning {
 		m.stats.HighRunning = m.stats.Running
 	}
+	m.inUse = m.inUse.add(job.resources)
+	*m.stats.ResourcesInUse = m.inUse
 
 	m.statsCond.L.Unlock()
 
 	// Go!
-	err := job.Test.Run(job.Env)
+	err := m.runJob(job)
 
 	// And... we're done.
 
@@ -161,8 +316,11 @@ func (m *manager) runOrQueueJob(job *test161Job) {
 	m.statsCond.L.Lock()
 	m.stats.Running -= 1
 	m.stats.Finished += 1
+	m.inUse = m.inUse.sub(job.resources)
+	*m.stats.ResourcesInUse = m.inUse
 
-	m.statsCond.Signal()
+	// Wake everyone up so the highest priority job can run
+	m.statsCond.Broadcast()
 	m.statsCond.L.Unlock()
 
 	// Pass the completed test back to the caller
@@ -181,6 +339,23 @@ func (m *manager) stop() {
 
 	m.isRunning = false
 	close(m.SubmitChan)
+
+	if m.tuneStop != nil {
+		close(m.tuneStop)
+		m.tuneStop = nil
+	}
+}
+
+func (m *manager) stopAutoTune() {
+	m.statsCond.L.Lock()
+	defer m.statsCond.L.Unlock()
+
+	if m.tuneStop != nil {
+		close(m.tuneStop)
+		m.tuneStop = nil
+		m.stats.Capacity = m.capacity()
+		m.statsCond.Broadcast()
+	}
 }
 
 // Exported shared test manger functions
@@ -196,7 +371,19 @@ func StopManager() {
 }
 
 func SetManagerCapacity(capacity uint) {
+	testManager.statsCond.L.Lock()
+	defer testManager.statsCond.L.Unlock()
+
 	testManager.Capacity = capacity
+
+	// Keep the tuned capacity under the new limit
+	if capacity > 0 && testManager.tuned > capacity {
+		testManager.tuned = capacity
+	}
+	testManager.stats.Capacity = testManager.capacity()
+
+	// Queued jobs may be able to run now
+	testManager.statsCond.Broadcast()
 }
 
 func ManagerCapacity() uint {
@@ -208,9 +395,7 @@ func (m *manager) Stats() *ManagerStats {
 	testManager.statsCond.L.Lock()
 	defer testManager.statsCond.L.Unlock()
 
-	// copy
-	var res ManagerStats = testManager.stats
-	return &res
+	return testManager.stats.copy()
 }
 
 // Return a copy of the current shared test manager stats
@@ -226,6 +411,10 @@ func GetManagerStats() *ManagerStats {
 // if we have queued tests.  This just wastes cycles and I/O that the tests could use.
 // Plus, the student will see the status go from building to running, but the boot test
 // will just get queued.
+//
+// Waiting submissions are released one at a time from a fair-share queue (see
+// fairshare.go), so groups of users take turns instead of running in arrival
+// order.
 
 const (
 	SM_ACCEPTING = iota
@@ -234,32 +423,95 @@ const (
 )
 
 type SubmissionManager struct {
-	env     *TestEnvironment
-	runlock *sync.Mutex // Block everything from running
-	l       *sync.Mutex // Synchronize other state
-	status  int
-	stats   ManagerStats
+	env    *TestEnvironment
+	l      *sync.Mutex // Synchronize other state
+	cond   *sync.Cond  // Broadcast (using l) when the next turn may have changed
+	status int
+	stats  ManagerStats
+	queue  *fairShareQueue // Protected by l
+	onDeck bool            // A submission is waiting for the test manager. Protected by l
 }
 
 func NewSubmissionManager(env *TestEnvironment) *SubmissionManager {
+	l := &sync.Mutex{}
 	mgr := &SubmissionManager{
-		env:     env,
-		runlock: &sync.Mutex{},
-		l:       &sync.Mutex{},
-		status:  SM_ACCEPTING,
+		env:    env,
+		l:      l,
+		cond:   sync.NewCond(l),
+		status: SM_ACCEPTING,
 		stats: ManagerStats{
 			StartTime: time.Now(),
 		},
+		queue: newFairShareQueue(),
 	}
 	return mgr
 }
 
+// SetUserConcurrency limits the number of submissions each user can have
+// running at once. 0 means unlimited.
+func (sm *SubmissionManager) SetUserConcurrency(limit uint) {
+	sm.l.Lock()
+	defer sm.l.Unlock()
+	sm.queue.limit = limit
+	sm.cond.Broadcast()
+}
+
+// QueuePosition returns the (estimated) position of the submission in the
+// queue, starting at 1, or 0 if it isn't waiting.
+func (sm *SubmissionManager) QueuePosition(s *Submission) uint {
+	sm.l.Lock()
+	defer sm.l.Unlock()
+	return sm.queue.positions()[s]
+}
+
+// Update the queue positions of the waiting submissions (and the one that
+// just left the queue, if any). This returns the positions that changed, so
+// the caller can persist them after releasing the lock. These are copies with
+// just the ID and position, since the submissions belong to their own Run
+// goroutines once we let go of the lock.
+// Must hold sm.l.
+func (sm *SubmissionManager) updateQueuePositions(left *Submission) []*Submission {
+	changed := make([]*Submission, 0)
+
+	if left != nil && left.QueuePosition != 0 {
+		left.QueuePosition = 0
+		changed = append(changed, &Submission{ID: left.ID})
+	}
+
+	for s, pos := range sm.queue.positions() {
+		if s.QueuePosition != pos {
+			s.QueuePosition = pos
+			changed = append(changed, &Submission{ID: s.ID, QueuePosition: pos})
+		}
+	}
+
+	return changed
+}
+
+// Persist the queue positions from updateQueuePositions. This only updates
+// the position (MSG_FIELD_QUEUE), not the rest of the submission.
+func (sm *SubmissionManager) persistQueuePositions(changed []*Submission) {
+	for _, s := range changed {
+		sm.env.notifyAndLogErr("Submission Queue Position", s, MSG_PERSIST_UPDATE, MSG_FIELD_QUEUE)
+	}
+}
+
 func (sm *SubmissionManager) CombinedStats() *Test161Stats {
 	stats := &Test161Stats{
 		SubmissionStats: *sm.Stats(),
 		TestStats:       *sm.env.manager.Stats(),
 	}
 
+	sm.env.manager.statsCond.L.Lock()
+	pool := sm.env.manager.workers
+	sm.env.manager.statsCond.L.Unlock()
+
+	if pool != nil {
+		stats.Workers = pool.Workers()
+	}
+
+	stats.BuildLocks = BuildLocks()
+
 	switch sm.Status() {
 	case SM_ACCEPTING:
 		stats.Status = "accepting submissions"
@@ -279,11 +531,10 @@ func (sm *SubmissionManager) Stats() *ManagerStats {
 	return &copy
 }
 
-func (sm *SubmissionManager) Run(s *Submission) error {
-
-	// The test manager we're associated with
-	mgr := sm.env.manager
-
+// Enqueue adds the submission to the fair-share queue and returns its queue
+// position. Run waits for the submission's turn and runs it, and enqueues it
+// first if necessary.
+func (sm *SubmissionManager) Enqueue(s *Submission) (uint, error) {
 	sm.l.Lock()
 
 	// Check to see if we've been paused or stopped. The server checks too, but there's delay.
@@ -304,29 +555,70 @@ func (sm *SubmissionManager) Run(s *Submission) error {
 
 	if abort {
 		sm.l.Unlock()
+		s.unlockStudents()
 		s.Status = SUBMISSION_ABORTED
 		err := errors.New(abortMsg)
 		s.Errors = append(s.Errors, fmt.Sprintf("%v", err))
 		sm.env.notifyAndLogErr("Submissions Closed", s, MSG_PERSIST_COMPLETE, 0)
-		return err
+		return 0, err
 	}
 
 	// Update Queued
 	sm.stats.Queued += 1
-	start := time.Now()
 	if sm.stats.HighQueued < sm.stats.Queued {
 		sm.stats.HighQueued = sm.stats.Queued
 	}
+
+	s.queuedAt = time.Now()
+	sm.queue.push(s)
+	changed := sm.updateQueuePositions(nil)
+	pos := s.QueuePosition
+
+	sm.l.Unlock()
+
+	sm.persistQueuePositions(changed)
+
+	return pos, nil
+}
+
+func (sm *SubmissionManager) Run(s *Submission) error {
+
+	// The test manager we're associated with
+	mgr := sm.env.manager
+
+	sm.l.Lock()
+	queued := sm.queue.contains(s)
 	sm.l.Unlock()
 
+	if !queued {
+		if _, err := sm.Enqueue(s); err != nil {
+			return err
+		}
+	}
+
+	// Staff submissions don't wait for the test manager's queue to drain,
+	// since their tests jump to the front of it anyway.
+	urgent := s.Priority >= JOB_PRIORITY_STAFF
+
 	///////////
-	// Queued here
-	sm.runlock.Lock()
+	// Queued here, until it's our turn and nobody else is on deck.
+	sm.l.Lock()
+	for (sm.onDeck && !urgent) || sm.queue.next() != s {
+		sm.cond.Wait()
+	}
+	sm.queue.pop(s)
+	if !urgent {
+		sm.onDeck = true
+	}
+	changed := sm.updateQueuePositions(s)
+	sm.l.Unlock()
+
+	sm.persistQueuePositions(changed)
 
 	// Still queued, but on deck. Wait on the manager's queue condition variable so we
 	// get notifications when the count changes.
 	mgr.queueCond.L.Lock()
-	for mgr.stats.Queued > 0 {
+	for mgr.stats.Queued > 0 && !urgent {
 		mgr.queueCond.Wait()
 	}
 	mgr.queueCond.L.Unlock()
@@ -337,6 +629,11 @@ func (sm *SubmissionManager) Run(s *Submission) error {
 
 	// Update run stats
 	sm.l.Lock()
+	if !urgent {
+		sm.onDeck = false
+	}
+	sm.cond.Broadcast()
+
 	sm.stats.Queued -= 1
 	sm.stats.Running += 1
 	if sm.stats.HighRunning < sm.stats.Running {
@@ -344,7 +641,7 @@ func (sm *SubmissionManager) Run(s *Submission) error {
 	}
 
 	// Max and average waits
-	curWait := int64(time.Now().Sub(start).Nanoseconds() / 1e6)
+	curWait := int64(time.Now().Sub(s.queuedAt).Nanoseconds() / 1e6)
 	if sm.stats.MaxWait < curWait {
 		sm.stats.MaxWait = curWait
 	}
@@ -354,13 +651,15 @@ func (sm *SubmissionManager) Run(s *Submission) error {
 	sm.l.Unlock()
 
 	// Run the submission
-	sm.runlock.Unlock()
 	err := s.Run()
 
-	// Update stats
+	// Update stats, and let the next submission from this group go if it was
+	// waiting on the user limit.
 	sm.l.Lock()
 	sm.stats.Running -= 1
 	sm.stats.Finished += 1
+	sm.queue.done(s)
+	sm.cond.Broadcast()
 	sm.l.Unlock()
 
 	return err
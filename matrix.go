@@ -0,0 +1,309 @@
+package test161
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// This file handles parameterized tests. A test file can declare a parameter
+// matrix in its front matter, which expands the single file into one test
+// instance per combination of parameter values. For example:
+//
+//	matrix:
+//	  cpus: [1, 2, 8]
+//	  ram: [1M, 4M]
+//
+// expands into 6 test instances. Each instance gets a derived ID consisting of
+// the file ID and its parameters in sorted key order, e.g.
+// sync/lt1.t[cpus=2,ram=4M], which can be used anywhere a test file can be
+// used: on the command line, in depends, and in Targets.
+//
+// The test file itself is treated as a golang template with the instance
+// parameters as data, so parameters can be used in the commands (e.g. argument
+// lists), tags, description, etc. A few well-known parameters (cpus, ram) are
+// also applied directly to the sys161 configuration.
+
+// Don't let a typo in a matrix spawn an unbounded number of tests.
+const MAX_MATRIX_INSTANCES = 256
+
+// Matrix parameters with special meaning
+const (
+	MATRIX_PARAM_CPUS = "cpus"
+	MATRIX_PARAM_RAM  = "ram"
+)
+
+// Parameter names and values end up in test IDs, so keep them simple.
+var matrixParamExp = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// The front matter, and the matrix declaration within it. The matrix is
+// everything from the top-level matrix key to the next top-level key.
+var frontMatterExp = regexp.MustCompile(`(?s)^---\r?\n(.*?)\r?\n---(\r?\n|$)`)
+var matrixKeyExp = regexp.MustCompile(`^matrix\s*:`)
+var topLevelKeyExp = regexp.MustCompile(`^[^\s#]`)
+
+// A test instance specifier is a test file (or glob) followed by an optional
+// parameter selector, i.e. sync/lt1.t or sync/lt1.t[cpus=2,ram=4M].
+var testSpecExp = regexp.MustCompile(`^(.*\.t)(\[([^\[\]]*)\])?$`)
+
+// IsTestSpec returns true if the string refers to test files (or instances
+// of them) rather than to a tag.
+func IsTestSpec(spec string) bool {
+	return testSpecExp.MatchString(spec)
+}
+
+// Split a test specifier into the file/glob part and the parameter selector.
+// The selector is nil if none was given.
+func splitTestSpec(spec string) (string, map[string]string, error) {
+	res := testSpecExp.FindStringSubmatch(spec)
+	if len(res) == 0 {
+		return "", nil, fmt.Errorf("Invalid test specifier: %v", spec)
+	} else if len(res[2]) == 0 {
+		return res[1], nil, nil
+	}
+
+	selector := make(map[string]string)
+	for _, pair := range strings.Split(res[3], ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return "", nil, fmt.Errorf("Invalid test parameter '%v' in %v", pair, spec)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if _, ok := selector[key]; ok {
+			return "", nil, fmt.Errorf("Duplicate test parameter '%v' in %v", key, spec)
+		}
+		selector[key] = value
+	}
+
+	return res[1], selector, nil
+}
+
+// Format a set of parameters as they appear in test IDs. Keys are sorted so
+// the result is canonical.
+func formatParams(params map[string]string) string {
+	if len(params) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+params[key])
+	}
+
+	return "[" + strings.Join(pairs, ",") + "]"
+}
+
+// instanceSuffix is appended to the file ID to create the test's DependencyID.
+func (t *Test) instanceSuffix() string {
+	return formatParams(t.Params)
+}
+
+// matchesParams returns true if every parameter in the selector has the same
+// value in this test instance.
+func (t *Test) matchesParams(selector map[string]string) bool {
+	for key, value := range selector {
+		if actual, ok := t.Params[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Expand the matrix into a list of parameter combinations (the cartesian
+// product of the parameter values).
+func expandMatrix(matrix map[string][]string) ([]map[string]string, error) {
+	keys := make([]string, 0, len(matrix))
+	total := 1
+
+	for key, values := range matrix {
+		if !matrixParamExp.MatchString(key) {
+			return nil, fmt.Errorf("test161: invalid matrix parameter name '%v'", key)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("test161: matrix parameter '%v' has no values", key)
+		}
+		seen := make(map[string]bool)
+		for _, value := range values {
+			if !matrixParamExp.MatchString(value) {
+				return nil, fmt.Errorf("test161: invalid value '%v' for matrix parameter '%v'", value, key)
+			} else if seen[value] {
+				return nil, fmt.Errorf("test161: duplicate value '%v' for matrix parameter '%v'", value, key)
+			}
+			seen[value] = true
+		}
+		keys = append(keys, key)
+		total *= len(values)
+		if total > MAX_MATRIX_INSTANCES {
+			return nil, fmt.Errorf("test161: matrix expands to more than %v test instances", MAX_MATRIX_INSTANCES)
+		}
+	}
+	sort.Strings(keys)
+
+	combos := []map[string]string{map[string]string{}}
+
+	for _, key := range keys {
+		next := make([]map[string]string, 0, len(combos)*len(matrix[key]))
+		for _, combo := range combos {
+			for _, value := range matrix[key] {
+				params := make(map[string]string, len(combo)+1)
+				for k, v := range combo {
+					params[k] = v
+				}
+				params[key] = value
+				next = append(next, params)
+			}
+		}
+		combos = next
+	}
+
+	return combos, nil
+}
+
+// Get the parameter matrix from the test file, if it has one. The front matter
+// is a template, so it may not be valid YAML until it's been executed with
+// the instance parameters. We need the matrix to get those, so we only parse
+// the matrix itself, which can't be templated.
+func matrixFromString(data string) (map[string][]string, error) {
+	res := frontMatterExp.FindStringSubmatch(data)
+	if len(res) == 0 {
+		return nil, nil
+	}
+
+	lines := make([]string, 0)
+	for _, line := range strings.Split(res[1], "\n") {
+		if len(lines) == 0 {
+			if matrixKeyExp.MatchString(line) {
+				lines = append(lines, line)
+			}
+		} else if topLevelKeyExp.MatchString(line) {
+			break
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	conf := struct {
+		Matrix map[string][]string `yaml:"matrix"`
+	}{}
+	if err := yaml.Unmarshal([]byte(strings.Join(lines, "\n")), &conf); err != nil {
+		return nil, fmt.Errorf("test161: invalid matrix: %v", err)
+	}
+	return conf.Matrix, nil
+}
+
+// Create a single test instance by executing the test file template with the
+// instance parameters.
+func testInstanceFromString(data string, params map[string]string) (*Test, error) {
+	tmpl, err := template.New("TestInstance").Funcs(funcMap).Option("missingkey=error").Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	bb := &bytes.Buffer{}
+	if err = tmpl.Execute(bb, params); err != nil {
+		return nil, err
+	}
+
+	t, err := confFromString(bb.String())
+	if err != nil {
+		return nil, err
+	}
+
+	t.Params = params
+	if err = t.applyParams(); err != nil {
+		return nil, err
+	}
+
+	if err = t.initTest(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Apply the well-known parameters to the test configuration.
+func (t *Test) applyParams() error {
+	if cpus, ok := t.Params[MATRIX_PARAM_CPUS]; ok {
+		val, err := strconv.ParseUint(cpus, 10, 32)
+		if err != nil || val == 0 {
+			return fmt.Errorf("test161: invalid cpus parameter '%v'", cpus)
+		}
+		t.Sys161.CPUs = uint(val)
+	}
+
+	if ram, ok := t.Params[MATRIX_PARAM_RAM]; ok {
+		t.Sys161.RAM = ram
+	}
+
+	// Keep instance names distinct
+	t.Name += " " + t.instanceSuffix()
+
+	return nil
+}
+
+// TestsFromFile parses the test file, expanding its parameter matrix (if any)
+// into test instances.
+func TestsFromFile(filename string) ([]*Test, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file %v: %v", filename, err)
+	}
+	tests, err := TestsFromString(string(data))
+	if err != nil {
+		err = fmt.Errorf("Error loading test file %v: %v", filename, err)
+	}
+	return tests, err
+}
+
+// TestsFromString parses the test string, expanding its parameter matrix (if
+// any) into test instances. Tests without a matrix result in a single test.
+func TestsFromString(data string) ([]*Test, error) {
+	matrix, err := matrixFromString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matrix) == 0 {
+		base, err := confFromString(data)
+		if err != nil {
+			return nil, err
+		}
+		if err = base.initTest(); err != nil {
+			return nil, err
+		}
+		return []*Test{base}, nil
+	}
+
+	combos, err := expandMatrix(matrix)
+	if err != nil {
+		return nil, err
+	}
+
+	tests := make([]*Test, 0, len(combos))
+	for _, params := range combos {
+		if t, err := testInstanceFromString(data, params); err != nil {
+			return nil, errors.New(fmt.Sprintf("%v: %v", formatParams(params), err))
+		} else {
+			tests = append(tests, t)
+		}
+	}
+
+	return tests, nil
+}
@@ -0,0 +1,206 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const MATRIX_DIR string = "fixtures/tests/matrix"
+
+func TestMatrixExpand(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tests, err := TestsFromString(`---
+name: matrix
+tags: ["ncpu{{.cpus}}"]
+matrix:
+  cpus: [1, 2]
+  ram: [1M, 4M]
+  args: [16, 32]
+---
+lt1 {{.args}}
+`)
+	assert.Nil(err)
+	assert.Equal(8, len(tests))
+
+	seen := make(map[string]bool)
+	for _, test := range tests {
+		suffix := test.instanceSuffix()
+		assert.False(seen[suffix])
+		seen[suffix] = true
+
+		assert.Equal(3, len(test.Params))
+		assert.Equal(test.Params["ram"], test.Sys161.RAM)
+		assert.Equal([]string{"ncpu" + test.Params["cpus"]}, test.Tags)
+		assert.Equal("matrix "+suffix, test.Name)
+
+		// boot, lt1, q
+		assert.Equal(3, len(test.Commands))
+		if len(test.Commands) == 3 {
+			assert.Equal("lt1 "+test.Params["args"], test.Commands[1].Input.Line)
+		}
+	}
+	assert.True(seen["[args=16,cpus=2,ram=4M]"])
+
+	// The single test loader won't expand the matrix
+	_, err = TestFromString(`---
+matrix:
+  cpus: [1, 2]
+---
+q
+`)
+	assert.NotNil(err)
+}
+
+func TestMatrixTemplatedConf(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// The front matter isn't valid YAML until it's expanded
+	tests, err := TestsFromString(`---
+name: matrix
+{{if eq .cpus "2"}}tags: [smp]{{end}}
+matrix:
+  cpus: [1, 2]
+misc:
+  prompttimeout: 30
+---
+q
+`)
+	if assert.Nil(err) && assert.Equal(2, len(tests)) {
+		for _, test := range tests {
+			if test.Params["cpus"] == "2" {
+				assert.Equal([]string{"smp"}, test.Tags)
+			} else {
+				assert.Equal(0, len(test.Tags))
+			}
+			assert.Equal(float32(30), test.Misc.PromptTimeout)
+		}
+	}
+}
+
+func TestMatrixInvalid(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	invalid := []string{
+		"matrix:\n  cpus: []\n",
+		"matrix:\n  cpus: [1, 1]\n",
+		"matrix:\n  cpus: [zero]\n",
+		"matrix:\n  \"bad key\": [1]\n",
+		"matrix:\n  ram: [\"1M,2M\"]\n",
+	}
+
+	for _, conf := range invalid {
+		tests, err := TestsFromString("---\n" + conf + "---\nq\n")
+		assert.NotNil(err)
+		assert.Nil(tests)
+	}
+
+	// Missing template parameter
+	tests, err := TestsFromString("---\nmatrix:\n  cpus: [1]\n---\nlt1 {{.args}}\n")
+	assert.NotNil(err)
+	assert.Nil(tests)
+}
+
+func TestMatrixSpec(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	assert.True(IsTestSpec("sync/lt1.t"))
+	assert.True(IsTestSpec("sync/*.t[cpus=2]"))
+	assert.False(IsTestSpec("sync"))
+	assert.False(IsTestSpec("sync/lt1.t[cpus=2"))
+
+	glob, selector, err := splitTestSpec("sync/lt1.t[ram=4M, cpus=2]")
+	assert.Nil(err)
+	assert.Equal("sync/lt1.t", glob)
+	assert.Equal(map[string]string{"cpus": "2", "ram": "4M"}, selector)
+	assert.Equal("[cpus=2,ram=4M]", formatParams(selector))
+
+	_, _, err = splitTestSpec("sync/lt1.t[cpus]")
+	assert.NotNil(err)
+	_, _, err = splitTestSpec("sync/lt1.t[cpus=1,cpus=2]")
+	assert.NotNil(err)
+}
+
+func TestMatrixTestMap(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tm, errs := newTestMap(MATRIX_DIR)
+	assert.NotNil(tm)
+	assert.Equal(0, len(errs))
+	if tm == nil {
+		t.FailNow()
+	}
+
+	// boot + sem1 + 6 lt1 instances
+	assert.Equal(8, len(tm.Tests))
+	assert.Equal(6, len(tm.Files["sync/lt1.t"]))
+	_, ok := tm.Tests["sync/lt1.t[cpus=8,ram=1M]"]
+	assert.True(ok)
+	assert.Equal(2, len(tm.Tags["cpus2"]))
+
+	// Globs and selectors
+	tests, err := tm.testsFromGlob("/sync/lt1.t", tm.TestDir)
+	assert.Nil(err)
+	assert.Equal(6, len(tests))
+
+	tests, err = tm.testsFromGlob("/sync/*.t[ram=4M]", tm.TestDir)
+	assert.Nil(err)
+	assert.Equal([]string{
+		"sync/lt1.t[cpus=1,ram=4M]",
+		"sync/lt1.t[cpus=2,ram=4M]",
+		"sync/lt1.t[cpus=8,ram=4M]",
+	}, testsToSortedSlice(tests))
+
+	tests, err = tm.testsFromGlob("/sync/lt1.t[cpus=4]", tm.TestDir)
+	assert.NotNil(err)
+	assert.Equal(0, len(tests))
+
+	// Dependencies on instances
+	errs = tm.expandAllDeps()
+	assert.Equal(0, len(errs))
+	sem := tm.Tests["sync/sem1.t"]
+	assert.Equal(2, len(sem.ExpandedDeps))
+	_, ok = sem.ExpandedDeps["sync/lt1.t[cpus=2,ram=1M]"]
+	assert.True(ok)
+}
+
+func TestMatrixGroup(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	env := defaultEnv.CopyEnvironment()
+	env.TestDir = MATRIX_DIR
+
+	config := &GroupConfig{
+		Name:    "Test",
+		UseDeps: true,
+		Tests:   []string{"sync/sem1.t", "sync/lt1.t[cpus=8,ram=4M]"},
+		Env:     env,
+	}
+
+	tg, errs := GroupFromConfig(config)
+	assert.Equal(0, len(errs))
+	assert.NotNil(tg)
+	if tg == nil {
+		t.FailNow()
+	}
+
+	expected := []string{
+		"boot.t",
+		"sync/lt1.t[cpus=2,ram=1M]",
+		"sync/lt1.t[cpus=2,ram=4M]",
+		"sync/lt1.t[cpus=8,ram=4M]",
+		"sync/sem1.t",
+	}
+
+	actual := make([]*Test, 0)
+	for _, test := range tg.Tests {
+		actual = append(actual, test)
+	}
+	assert.Equal(expected, testsToSortedSlice(actual))
+}
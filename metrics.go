@@ -0,0 +1,106 @@
+package test161
+
+import (
+	"math"
+)
+
+// This file collects the metrics tests report through secure output (measure
+// messages, see securemsg.go), e.g. pages swapped or operations per second.
+// Each command keeps a Metric per name, and the test aggregates them across
+// its commands.
+
+// A Metric summarizes the values reported for a named measurement.
+type Metric struct {
+	Name  string  `json:"name" bson:"name"`
+	Units string  `json:"units" bson:"units"`
+	Count uint    `json:"count" bson:"count"`
+	Last  float64 `json:"last" bson:"last"`
+	Min   float64 `json:"min" bson:"min"`
+	Max   float64 `json:"max" bson:"max"`
+	Sum   float64 `json:"sum" bson:"sum"`
+}
+
+func (m *Metric) Mean() float64 {
+	if m.Count == 0 {
+		return 0
+	}
+	return m.Sum / float64(m.Count)
+}
+
+func (m *Metric) add(value float64) {
+	if m.Count == 0 {
+		m.Min, m.Max = value, value
+	} else {
+		m.Min = math.Min(m.Min, value)
+		m.Max = math.Max(m.Max, value)
+	}
+	m.Count += 1
+	m.Last = value
+	m.Sum += value
+}
+
+func (m *Metric) merge(other *Metric) {
+	if other.Count == 0 {
+		return
+	}
+	if m.Count == 0 {
+		m.Min, m.Max = other.Min, other.Max
+	} else {
+		m.Min = math.Min(m.Min, other.Min)
+		m.Max = math.Max(m.Max, other.Max)
+	}
+	m.Count += other.Count
+	m.Last = other.Last
+	m.Sum += other.Sum
+}
+
+// Find the metric called name, adding it if we don't have it.  The first
+// units reported for a name win.
+func findMetric(metrics []*Metric, name, units string) ([]*Metric, *Metric) {
+	for _, m := range metrics {
+		if m.Name == name {
+			return metrics, m
+		}
+	}
+	m := &Metric{Name: name, Units: units}
+	return append(metrics, m), m
+}
+
+// Collect the metrics from the command's output. Like partial credit, only
+// lines signed with the command's key count, unless we don't have the key.
+func (c *Command) collectMetrics(keyMap map[string]string) {
+	c.Metrics = make([]*Metric, 0)
+
+	id := c.Id()
+	_, hasKey := keyMap[id]
+
+	for _, line := range c.Output {
+		if !line.isSecureMessage(SECURE_MSG_MEASURE) {
+			continue
+		}
+		if !hasKey || (line.Trusted && line.KeyName == id) {
+			var m *Metric
+			c.Metrics, m = findMetric(c.Metrics, line.Message.Name, line.Message.Units)
+			m.add(line.Message.Value)
+		}
+	}
+}
+
+// Add a command's metrics to the test's.
+func (t *Test) addMetrics(c *Command) {
+	for _, cm := range c.Metrics {
+		var m *Metric
+		t.Metrics, m = findMetric(t.Metrics, cm.Name, cm.Units)
+		m.merge(cm)
+	}
+}
+
+// Metric returns the test's metric called name, or nil if it wasn't reported.
+func (t *Test) Metric(name string) *Metric {
+	for _, m := range t.Metrics {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
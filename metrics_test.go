@@ -0,0 +1,78 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	env := defaultEnv.CopyEnvironment()
+	key, _ := newKey(KEYBYTES)
+	env.keyMap["vm1"] = key
+
+	test := &Test{
+		env:     env,
+		salts:   make(map[string]bool),
+		Salts:   make([]string, 0),
+		Metrics: make([]*Metric, 0),
+	}
+
+	measure := func(key, salt, payload string) *OutputLine {
+		return secureTestLine(test, structuredTestLine(key, "vm1", salt, payload))
+	}
+
+	cmd1 := &Command{Input: InputLine{Line: "vm1"}}
+	cmd1.Output = []*OutputLine{
+		measure(key, "01", `{"type": "measure", "name": "pages swapped", "value": 10, "units": "pages"}`),
+		measure(key, "02", `{"type": "measure", "name": "pages swapped", "value": 30, "units": "pages"}`),
+		measure(key, "03", `{"type": "measure", "name": "ops/sec", "value": 2.5}`),
+		// Not ours
+		measure("1234", "04", `{"type": "measure", "name": "pages swapped", "value": 1000, "units": "pages"}`),
+		measure(key, "05", `{"type": "success"}`),
+	}
+	cmd1.collectMetrics(env.keyMap)
+	test.addMetrics(cmd1)
+
+	if assert.Equal(2, len(cmd1.Metrics)) {
+		m := cmd1.Metrics[0]
+		assert.Equal("pages swapped", m.Name)
+		assert.Equal("pages", m.Units)
+		assert.Equal(uint(2), m.Count)
+		assert.Equal(10.0, m.Min)
+		assert.Equal(30.0, m.Max)
+		assert.Equal(30.0, m.Last)
+		assert.Equal(20.0, m.Mean())
+		assert.Equal("ops/sec", cmd1.Metrics[1].Name)
+	}
+
+	cmd2 := &Command{Input: InputLine{Line: "vm1"}}
+	cmd2.Output = []*OutputLine{
+		measure(key, "06", `{"type": "measure", "name": "pages swapped", "value": 5, "units": "pages"}`),
+	}
+	cmd2.collectMetrics(env.keyMap)
+	test.addMetrics(cmd2)
+
+	m := test.Metric("pages swapped")
+	if assert.NotNil(m) {
+		assert.Equal(uint(3), m.Count)
+		assert.Equal(5.0, m.Min)
+		assert.Equal(30.0, m.Max)
+		assert.Equal(5.0, m.Last)
+		assert.Equal(45.0, m.Sum)
+	}
+	assert.Nil(test.Metric("vnodes"))
+
+	// Without the key (i.e. the client), we take what we get
+	cmd1.collectMetrics(map[string]string{})
+	if assert.Equal(2, len(cmd1.Metrics)) {
+		assert.Equal(uint(3), cmd1.Metrics[0].Count)
+		assert.Equal(1000.0, cmd1.Metrics[0].Max)
+	}
+
+	// Metrics are in the usage stats
+	stat := newTestStat(test)
+	assert.Equal(test.Metrics, stat.Metrics)
+}
@@ -144,9 +144,16 @@ func (m *MongoPersistence) Notify(t interface{}, msg, what int) (err error) {
 			case MSG_PERSIST_CREATE:
 				err = m.insertDocument(session, COLLECTION_SUBMISSIONS, submission)
 			case MSG_PERSIST_COMPLETE:
-				fallthrough
-			case MSG_PERSIST_UPDATE:
 				err = m.updateDocumentByID(session, COLLECTION_SUBMISSIONS, submission.ID, submission)
+			case MSG_PERSIST_UPDATE:
+				if what == MSG_FIELD_QUEUE {
+					// The queue position changes while the submission is
+					// waiting, so don't write anything else.
+					changes := bson.M{"queue_position": submission.QueuePosition}
+					err = m.updateDocumentByID(session, COLLECTION_SUBMISSIONS, submission.ID, bson.M{"$set": changes})
+				} else {
+					err = m.updateDocumentByID(session, COLLECTION_SUBMISSIONS, submission.ID, submission)
+				}
 			}
 		}
 	case *BuildTest:
@@ -162,6 +169,10 @@ func (m *MongoPersistence) Notify(t interface{}, msg, what int) (err error) {
 				if what&MSG_FIELD_STATUS == MSG_FIELD_STATUS {
 					changes["result"] = test.Result
 				}
+				if what&MSG_FIELD_COMMANDS == MSG_FIELD_COMMANDS {
+					// Remote builds run the worker's commands
+					changes["commands"] = test.Commands
+				}
 				if len(changes) > 0 {
 					err = m.updateDocumentByID(session, COLLECTION_TESTS, test.ID, bson.M{"$set": changes})
 				}
@@ -188,6 +199,15 @@ func (m *MongoPersistence) Notify(t interface{}, msg, what int) (err error) {
 
 				err = m.updateDocument(session, COLLECTION_TESTS, selector, bson.M{"$set": changes})
 
+			case MSG_PERSIST_OUTPUT:
+				// Streaming output, just add the new line
+				selector := bson.M{
+					"_id":          cmd.test.ID,
+					"commands._id": cmd.ID,
+				}
+				line := cmd.Output[len(cmd.Output)-1]
+				err = m.updateDocument(session, COLLECTION_TESTS, selector,
+					bson.M{"$push": bson.M{"commands.$.output": line}})
 			}
 		}
 	case *Student:
@@ -272,6 +292,12 @@ func (m *MongoPersistence) Retrieve(what int, who map[string]interface{}, filter
 		collection = COLLECTION_STUDENTS
 	case PERSIST_TYPE_USERS:
 		collection = COLLECTION_USERS
+	case PERSIST_TYPE_SUBMISSIONS:
+		collection = COLLECTION_SUBMISSIONS
+	case PERSIST_TYPE_TESTS:
+		collection = COLLECTION_TESTS
+	case PERSIST_TYPE_USAGE:
+		collection = COLLECTION_USAGE
 	default:
 		return errors.New("Persistence: Invalid data type")
 	}
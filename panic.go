@@ -0,0 +1,286 @@
+package test161
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file handles kernel panic analysis. When sys161 shuts down in the middle
+// of a command, we look through the command's output for what happened: the
+// kernel's panic message, which may be a failed assertion or a fatal exception,
+// and what sys161 had to say about it. OS/161 panics look like:
+//
+//	panic: Assertion failed: lk != NULL, at ../../thread/synch.c:242 (lock_acquire)
+//
+//	panic: Fatal exception 2 (TLB miss on load) in kernel mode
+//	panic: EPC 0x8001a2b4, exception vaddr 0x0
+//	panic: I can't handle this... I think I'll just die now...
+//
+// Each panic has a site, which is the same for the same bug in different
+// submissions (i.e. no addresses), so we can group panics across the class.
+
+// Kinds of panics
+const (
+	PANIC_KIND_ASSERTION = "assertion" // A failed KASSERT
+	PANIC_KIND_EXCEPTION = "exception" // A fatal exception in kernel mode
+	PANIC_KIND_PANIC     = "panic"     // Any other call to panic()
+	PANIC_KIND_SHUTDOWN  = "shutdown"  // sys161 stopped without a kernel panic
+)
+
+// PanicInfo describes why sys161 shut down unexpectedly.
+type PanicInfo struct {
+	Kind    string   `json:"kind" bson:"kind"`
+	Message string   `json:"message" bson:"message"` // The first panic line
+	Details []string `json:"details" bson:"details"` // Any other panic lines
+	Site    string   `json:"site" bson:"site"`       // For grouping panics
+
+	// Failed assertions
+	Assertion string `json:"assertion" bson:"assertion"`
+	File      string `json:"file" bson:"file"`
+	Line      int    `json:"line" bson:"line"`
+	Function  string `json:"function" bson:"function"`
+
+	// Fatal exceptions
+	Exception     string `json:"exception" bson:"exception"`
+	ExceptionCode int    `json:"exception_code" bson:"exception_code"`
+	EPC           string `json:"epc" bson:"epc"`
+	VAddr         string `json:"vaddr" bson:"vaddr"`
+
+	// What sys161 said, not including its statistics
+	Trace []string `json:"trace" bson:"trace"` // sys161: trace: lines
+	Exit  string   `json:"exit" bson:"exit"`   // The last other sys161 message
+}
+
+var panicExp = regexp.MustCompile(`^panic: (.*)$`)
+var assertionExp = regexp.MustCompile(`^Assertion failed: (.*), at (.+):([0-9]+) \((.*)\)$`)
+var fatalExceptionExp = regexp.MustCompile(`^Fatal exception ([0-9]+) \((.*)\) in kernel mode$`)
+var exceptionAddrExp = regexp.MustCompile(`^EPC (0x[0-9a-fA-F]+), exception vaddr (0x[0-9a-fA-F]+)$`)
+var hexExp = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+
+var sys161Exp = regexp.MustCompile(`^sys161: (.*)$`)
+var sys161TraceExp = regexp.MustCompile(`^trace: (.*)$`)
+
+// sys161 statistics and banners, which aren't exit reasons
+var sys161StatsExp = regexp.MustCompile(`^(System/161 |[0-9]+ cycles|\s*cpu[0-9]+:|[0-9]+ irqs|Elapsed )`)
+
+// Source files are relative to the kernel's compile directory
+func panicSourceFile(file string) string {
+	for {
+		if strings.HasPrefix(file, "../") {
+			file = file[3:]
+		} else if strings.HasPrefix(file, "./") {
+			file = file[2:]
+		} else {
+			return file
+		}
+	}
+}
+
+// Find out why sys161 stopped in the middle of the output, if it says.
+func parsePanic(output []*OutputLine) *PanicInfo {
+	info := &PanicInfo{
+		Details: make([]string, 0),
+		Trace:   make([]string, 0),
+	}
+	found := false
+
+	for _, line := range output {
+		text := strings.TrimSpace(line.Line)
+
+		if res := panicExp.FindStringSubmatch(text); len(res) == 2 {
+			found = true
+			msg := strings.TrimSpace(res[1])
+			if len(info.Message) == 0 {
+				info.Message = msg
+				info.parseMessage()
+			} else {
+				info.Details = append(info.Details, msg)
+				if res := exceptionAddrExp.FindStringSubmatch(msg); len(res) == 3 {
+					info.EPC, info.VAddr = res[1], res[2]
+				}
+			}
+		} else if res := sys161Exp.FindStringSubmatch(text); len(res) == 2 {
+			msg := res[1]
+			if res := sys161TraceExp.FindStringSubmatch(msg); len(res) == 2 {
+				found = true
+				info.Trace = append(info.Trace, res[1])
+			} else if !sys161StatsExp.MatchString(msg) {
+				found = true
+				info.Exit = msg
+			}
+		}
+	}
+
+	if !found {
+		return nil
+	}
+
+	if len(info.Message) == 0 {
+		info.Kind = PANIC_KIND_SHUTDOWN
+		if len(info.Exit) > 0 {
+			info.Site = "sys161: " + info.Exit
+		} else {
+			info.Site = "sys161: trace: " + info.Trace[0]
+		}
+	}
+
+	return info
+}
+
+// Classify the panic from its message.
+func (info *PanicInfo) parseMessage() {
+	if res := assertionExp.FindStringSubmatch(info.Message); len(res) == 5 {
+		info.Kind = PANIC_KIND_ASSERTION
+		info.Assertion = res[1]
+		info.File = panicSourceFile(res[2])
+		info.Line, _ = strconv.Atoi(res[3])
+		info.Function = res[4]
+		info.Site = fmt.Sprintf("%v:%v (%v)", info.File, info.Line, info.Function)
+	} else if res := fatalExceptionExp.FindStringSubmatch(info.Message); len(res) == 3 {
+		info.Kind = PANIC_KIND_EXCEPTION
+		info.ExceptionCode, _ = strconv.Atoi(res[1])
+		info.Exception = res[2]
+		info.Site = "Fatal exception: " + info.Exception
+	} else {
+		info.Kind = PANIC_KIND_PANIC
+		info.Site = hexExp.ReplaceAllString(info.Message, "0x?")
+	}
+}
+
+func (info *PanicInfo) String() string {
+	var res string
+	switch info.Kind {
+	case PANIC_KIND_ASSERTION:
+		res = fmt.Sprintf("Assertion failed at %v: %v", info.Site, info.Assertion)
+	case PANIC_KIND_EXCEPTION:
+		res = fmt.Sprintf("Fatal exception %v (%v) in kernel mode", info.ExceptionCode, info.Exception)
+		if len(info.EPC) > 0 {
+			res += fmt.Sprintf(", EPC %v, vaddr %v", info.EPC, info.VAddr)
+		}
+	case PANIC_KIND_PANIC:
+		res = "panic: " + info.Message
+	default:
+		res = info.Site
+	}
+	if info.Kind != PANIC_KIND_SHUTDOWN && len(info.Exit) > 0 {
+		res += " (sys161: " + info.Exit + ")"
+	}
+	return res
+}
+
+// Look for a panic in the current command's output, after sys161 shut down
+// unexpectedly. The panic is recorded in the command and the test. Expected
+// panics (e.g. from the panic tests) aren't recorded, since they aren't bugs.
+func (t *Test) recordPanic() *PanicInfo {
+	t.L.Lock()
+	defer t.L.Unlock()
+
+	// Whatever sys161 printed last may not have had a newline
+	output := t.currentCommand.Output
+	if t.currentOutput != nil && t.currentOutput.Buffer.Len() > 0 {
+		output = append(output, &OutputLine{Line: t.currentOutput.Buffer.String()})
+	}
+
+	info := parsePanic(output)
+	t.currentCommand.PanicInfo = info
+	t.PanicInfo = info
+	return info
+}
+
+// A PanicGroup is the set of tests that panicked at the same site.
+type PanicGroup struct {
+	Site        string   `json:"site"`
+	Kind        string   `json:"kind"`
+	Message     string   `json:"message"` // From the first test with the panic
+	Count       int      `json:"count"`
+	Tests       []string `json:"tests"`
+	Submissions []string `json:"submissions"`
+}
+
+type panicGroupsByCount []*PanicGroup
+
+func (a panicGroupsByCount) Len() int      { return len(a) }
+func (a panicGroupsByCount) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a panicGroupsByCount) Less(i, j int) bool {
+	if a[i].Count != a[j].Count {
+		return a[i].Count > a[j].Count
+	}
+	return a[i].Site < a[j].Site
+}
+
+// GroupPanics groups the tests that panicked by panic site, most common first.
+func GroupPanics(tests []*Test) []*PanicGroup {
+	groups := make(map[string]*PanicGroup)
+	seenTests := make(map[string]map[string]bool)
+	seenSubmissions := make(map[string]map[string]bool)
+
+	for _, test := range tests {
+		info := test.PanicInfo
+		if info == nil {
+			continue
+		}
+
+		group, ok := groups[info.Site]
+		if !ok {
+			group = &PanicGroup{
+				Site:        info.Site,
+				Kind:        info.Kind,
+				Message:     info.Message,
+				Tests:       make([]string, 0),
+				Submissions: make([]string, 0),
+			}
+			groups[info.Site] = group
+			seenTests[info.Site] = make(map[string]bool)
+			seenSubmissions[info.Site] = make(map[string]bool)
+		}
+
+		group.Count += 1
+		if !seenTests[info.Site][test.Name] {
+			seenTests[info.Site][test.Name] = true
+			group.Tests = append(group.Tests, test.Name)
+		}
+		if len(test.SubmissionID) > 0 && !seenSubmissions[info.Site][test.SubmissionID] {
+			seenSubmissions[info.Site][test.SubmissionID] = true
+			group.Submissions = append(group.Submissions, test.SubmissionID)
+		}
+	}
+
+	res := make([]*PanicGroup, 0, len(groups))
+	for _, group := range groups {
+		sort.Strings(group.Tests)
+		res = append(res, group)
+	}
+	sort.Sort(panicGroupsByCount(res))
+	return res
+}
+
+// RetrievePanics gets the tests that panicked from persistence, optionally
+// only for one target.
+func RetrievePanics(persist PersistenceManager, targetName string) ([]*Test, error) {
+	if persist == nil || !persist.CanRetrieve() {
+		return nil, errors.New("Unable to retrieve tests")
+	}
+
+	who := map[string]interface{}{
+		"panic_info": map[string]interface{}{"$ne": nil},
+	}
+	if len(targetName) > 0 {
+		who["target_name"] = targetName
+	}
+	filter := map[string]interface{}{
+		"name":          1,
+		"submission_id": 1,
+		"target_name":   1,
+		"panic_info":    1,
+	}
+
+	tests := make([]*Test, 0)
+	if err := persist.Retrieve(PERSIST_TYPE_TESTS, who, filter, &tests); err != nil {
+		return nil, err
+	}
+	return tests, nil
+}
@@ -0,0 +1,137 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func panicTestOutput(output string) []*OutputLine {
+	lines := make([]*OutputLine, 0)
+	for _, line := range strings.Split(output, "\n") {
+		lines = append(lines, &OutputLine{Line: line})
+	}
+	return lines
+}
+
+func TestPanicParse(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	info := parsePanic(panicTestOutput(`Operation took 0.000 seconds
+panic: Assertion failed: lk != NULL, at ../../thread/synch.c:242 (lock_acquire)
+sys161: trace: software-requested debugger stop
+sys161: 1203939 cycles (1079287 run, 124652 global-idle)
+sys161:   cpu0: 405123 kern, 0 user, 0 idle; 1204 ll, 1204/0 sc, 3929 sync
+sys161: 1578 irqs 0 exns 0r/0w disk 12r/917w console 0r/0w/1m emufs 0r/0w net
+sys161: Elapsed real time: 0.126532 seconds (9.51495 mhz)`))
+	if assert.NotNil(info) {
+		assert.Equal(PANIC_KIND_ASSERTION, info.Kind)
+		assert.Equal("lk != NULL", info.Assertion)
+		assert.Equal("thread/synch.c", info.File)
+		assert.Equal(242, info.Line)
+		assert.Equal("lock_acquire", info.Function)
+		assert.Equal("thread/synch.c:242 (lock_acquire)", info.Site)
+		assert.Equal([]string{"software-requested debugger stop"}, info.Trace)
+		assert.Equal("", info.Exit)
+		assert.Equal("Assertion failed at thread/synch.c:242 (lock_acquire): lk != NULL", info.String())
+	}
+
+	info = parsePanic(panicTestOutput(`panic: Fatal exception 2 (TLB miss on load) in kernel mode
+panic: EPC 0x8001a2b4, exception vaddr 0x0
+panic: I can't handle this... I think I'll just die now...
+sys161: -X set; exiting`))
+	if assert.NotNil(info) {
+		assert.Equal(PANIC_KIND_EXCEPTION, info.Kind)
+		assert.Equal(2, info.ExceptionCode)
+		assert.Equal("TLB miss on load", info.Exception)
+		assert.Equal("0x8001a2b4", info.EPC)
+		assert.Equal("0x0", info.VAddr)
+		assert.Equal(2, len(info.Details))
+		assert.Equal("-X set; exiting", info.Exit)
+		assert.Equal("Fatal exception: TLB miss on load", info.Site)
+		assert.Equal("Fatal exception 2 (TLB miss on load) in kernel mode, EPC 0x8001a2b4, vaddr 0x0 (sys161: -X set; exiting)",
+			info.String())
+	}
+
+	info = parsePanic(panicTestOutput(`panic: Out of memory at 0x80044000`))
+	if assert.NotNil(info) {
+		assert.Equal(PANIC_KIND_PANIC, info.Kind)
+		assert.Equal("Out of memory at 0x?", info.Site)
+	}
+
+	info = parsePanic(panicTestOutput(`sys161: trace: watchdog timer expired`))
+	if assert.NotNil(info) {
+		assert.Equal(PANIC_KIND_SHUTDOWN, info.Kind)
+		assert.Equal("sys161: trace: watchdog timer expired", info.Site)
+	}
+
+	// Nothing to go on
+	assert.Nil(parsePanic(panicTestOutput(`sy1: SUCCESS
+sys161: Elapsed real time: 0.126532 seconds (9.51495 mhz)`)))
+}
+
+func TestPanicRecord(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	cmd := &Command{
+		Input:  InputLine{Line: "sy2"},
+		Output: panicTestOutput(`panic: Assertion failed: lock_do_i_hold(lk), at ../../thread/synch.c:280 (lock_release)`),
+	}
+	test := &Test{
+		L:              &sync.Mutex{},
+		Commands:       []*Command{cmd},
+		currentCommand: cmd,
+		currentOutput:  &OutputLine{},
+	}
+	test.currentOutput.Buffer.WriteString("sys161: Kernel panic")
+
+	info := test.recordPanic()
+	if assert.NotNil(info) {
+		assert.Equal(info, cmd.PanicInfo)
+		assert.Equal(info, test.PanicInfo)
+		assert.Equal("Kernel panic", info.Exit)
+	}
+
+	// Persisted with the usage stats
+	assert.Equal(info, newTestStat(test).PanicInfo)
+}
+
+func TestPanicGroups(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	panicTest := func(name, submission, output string) *Test {
+		return &Test{
+			Name:         name,
+			SubmissionID: submission,
+			PanicInfo:    parsePanic(panicTestOutput(output)),
+		}
+	}
+
+	lockPanic := `panic: Assertion failed: lk != NULL, at ../../thread/synch.c:242 (lock_acquire)`
+	tlbPanic := `panic: Fatal exception 3 (TLB miss on store) in kernel mode
+panic: EPC 0x80012345, exception vaddr 0x4`
+
+	groups := GroupPanics([]*Test{
+		panicTest("sync/sy2.t", "s1", lockPanic),
+		panicTest("sync/sy3.t", "s1", lockPanic),
+		panicTest("sync/sy2.t", "s2", lockPanic),
+		panicTest("sync/sy1.t", "s3", "sy1: SUCCESS"),
+		panicTest("vm/km1.t", "s3", tlbPanic),
+		&Test{Name: "sync/sy2.t", SubmissionID: "s4"},
+	})
+
+	if assert.Equal(2, len(groups)) {
+		assert.Equal("thread/synch.c:242 (lock_acquire)", groups[0].Site)
+		assert.Equal(3, groups[0].Count)
+		assert.Equal([]string{"sync/sy2.t", "sync/sy3.t"}, groups[0].Tests)
+		assert.Equal([]string{"s1", "s2"}, groups[0].Submissions)
+
+		assert.Equal("Fatal exception: TLB miss on store", groups[1].Site)
+		assert.Equal(PANIC_KIND_EXCEPTION, groups[1].Kind)
+		assert.Equal(1, groups[1].Count)
+	}
+}
@@ -15,11 +15,16 @@ const (
 	MSG_FIELD_TESTS
 	MSG_FIELD_OUTPUT
 	MSG_FIELD_STATUSES
+	MSG_FIELD_QUEUE
+	MSG_FIELD_COMMANDS
 )
 
 const (
 	PERSIST_TYPE_STUDENTS = 1 << iota
 	PERSIST_TYPE_USERS
+	PERSIST_TYPE_SUBMISSIONS
+	PERSIST_TYPE_TESTS
+	PERSIST_TYPE_USAGE
 )
 
 // Each Submission has at most one PersistenceManager, and it is pinged when a
@@ -0,0 +1,322 @@
+package test161
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	yaml "gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// This file handles build recipes, which say how to build OS/161 once the
+// source has been checked out and overlaid. Targets can use a recipe from the
+// recipes directory in the test161 root (*.tr files), or declare their own
+// steps. Otherwise, we use the default recipe, which is the standard OS/161
+// configure/bmake sequence.
+//
+// Commands, directories, and environment variables are Go templates, with
+// these fields:
+//
+//	.SrcDir   The source directory
+//	.RootDir  The root (install) directory
+//	.KConfig  The kernel config
+//	.Userland Whether userland is built
+//
+// Relative step and clean directories are relative to the source directory, and
+// artifacts are relative to the root directory.
+
+// A BuildRecipe is the sequence of steps that builds OS/161.
+type BuildRecipe struct {
+	Name      string       `yaml:"name" bson:"name" json:"name"`
+	Env       []string     `yaml:"env" bson:"env" json:"env"`                   // KEY=value, for every step
+	Clean     []string     `yaml:"clean" bson:"clean" json:"clean"`             // Directories removed before building
+	Steps     []*BuildStep `yaml:"steps" bson:"steps" json:"steps"`             // Commands to run, in order
+	Artifacts []string     `yaml:"artifacts" bson:"artifacts" json:"artifacts"` // Files the build must produce
+}
+
+// A BuildStep is a single command in a build recipe.
+type BuildStep struct {
+	Command  string   `yaml:"cmd" bson:"cmd" json:"cmd"`
+	Dir      string   `yaml:"dir" bson:"dir" json:"dir"`                // Directory to run the command in
+	Env      []string `yaml:"env" bson:"env" json:"env"`                // KEY=value, for this step
+	Shell    bool     `yaml:"shell" bson:"shell" json:"shell"`          // Run the command with /bin/sh -c
+	Userland bool     `yaml:"userland" bson:"userland" json:"userland"` // Only run if userland is built
+}
+
+// BuildRecipe collection, for loading recipe files.
+type BuildRecipes struct {
+	Recipes []*BuildRecipe `yaml:"recipes"`
+}
+
+// The standard OS/161 build
+var DefaultBuildRecipe = &BuildRecipe{
+	Name:  "default",
+	Clean: []string{"kern/compile/{{.KConfig}}"},
+	Steps: []*BuildStep{
+		&BuildStep{Command: "./configure --ostree={{.RootDir}}"},
+		&BuildStep{Command: "bmake clean", Userland: true},
+		&BuildStep{Command: "bmake", Userland: true},
+		&BuildStep{Command: "bmake install", Userland: true},
+		&BuildStep{Command: "./config {{.KConfig}}", Dir: "kern/conf"},
+		&BuildStep{Command: "bmake clean", Dir: "kern/compile/{{.KConfig}}"},
+		&BuildStep{Command: "bmake depend", Dir: "kern/compile/{{.KConfig}}"},
+		&BuildStep{Command: "bmake", Dir: "kern/compile/{{.KConfig}}"},
+		&BuildStep{Command: "bmake install", Dir: "kern/compile/{{.KConfig}}"},
+	},
+}
+
+func BuildRecipesFromFile(file string) (*BuildRecipes, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading recipe file %v: %v", file, err)
+	}
+
+	recipes, err := BuildRecipesFromString(string(data))
+	if err != nil {
+		err = fmt.Errorf("Error loading recipe file %v: %v", file, err)
+	}
+	return recipes, err
+}
+
+func BuildRecipesFromString(text string) (*BuildRecipes, error) {
+	recipes := &BuildRecipes{}
+	if err := yaml.Unmarshal([]byte(text), recipes); err != nil {
+		return nil, err
+	}
+
+	for _, recipe := range recipes.Recipes {
+		if len(recipe.Name) == 0 {
+			return nil, errors.New("Build recipes must have a name")
+		}
+		if err := recipe.Check(); err != nil {
+			return nil, fmt.Errorf("Recipe %v: %v", recipe.Name, err)
+		}
+	}
+
+	return recipes, nil
+}
+
+// Handle a single recipe file (.tr) and load it into the TestEnvironment.
+func envRecipeHandler(env *TestEnvironment, f string) error {
+	if recipes, err := BuildRecipesFromFile(f); err != nil {
+		return err
+	} else {
+		// If we already know about the recipe, it's an error
+		for _, recipe := range recipes.Recipes {
+			if _, ok := env.Recipes[recipe.Name]; ok {
+				return fmt.Errorf("Duplicate recipe (%v) in file %v", recipe.Name, f)
+			}
+			env.Recipes[recipe.Name] = recipe
+		}
+		return nil
+	}
+}
+
+// Check that the recipe has steps and that its templates parse.
+func (r *BuildRecipe) Check() error {
+	if len(r.Steps) == 0 {
+		return errors.New("No build steps")
+	}
+
+	lines := make([]string, 0)
+	lines = append(lines, r.Env...)
+	lines = append(lines, r.Clean...)
+	lines = append(lines, r.Artifacts...)
+	for _, step := range r.Steps {
+		if len(strings.TrimSpace(step.Command)) == 0 {
+			return errors.New("Empty build step")
+		}
+		lines = append(lines, step.Command, step.Dir)
+		lines = append(lines, step.Env...)
+	}
+
+	for _, line := range lines {
+		if _, err := template.New("BuildRecipe").Parse(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A hash of the recipe, for the build cache key.
+func (r *BuildRecipe) hash() string {
+	data, _ := json.Marshal(r)
+	hashbytes := sha256.Sum256(data)
+	return strings.ToLower(hex.EncodeToString(hashbytes[:]))
+}
+
+// The template data for recipes
+type recipeData struct {
+	SrcDir   string
+	RootDir  string
+	KConfig  string
+	Userland bool
+}
+
+func expandRecipeLine(line string, data *recipeData) (string, error) {
+	tmpl, err := template.New("BuildRecipe").Parse(line)
+	if err != nil {
+		return "", err
+	}
+	bb := &bytes.Buffer{}
+	if err = tmpl.Execute(bb, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(bb.String()), nil
+}
+
+func expandRecipeLines(lines []string, data *recipeData) ([]string, error) {
+	res := make([]string, 0, len(lines))
+	for _, line := range lines {
+		expanded, err := expandRecipeLine(line, data)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, expanded)
+	}
+	return res, nil
+}
+
+// Get a directory for the recipe, relative to base if it isn't absolute.
+func recipePath(base, dir string) string {
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return path.Join(base, dir)
+}
+
+// Figure out which recipe the build uses.
+func (t *BuildTest) initRecipe() error {
+	if t.conf.Recipe != nil {
+		t.recipe = t.conf.Recipe
+	} else if len(t.conf.RecipeName) > 0 {
+		recipe, ok := t.env.Recipes[t.conf.RecipeName]
+		if !ok {
+			return fmt.Errorf("Unknown build recipe: %v", t.conf.RecipeName)
+		}
+		t.recipe = recipe
+	} else {
+		t.recipe = DefaultBuildRecipe
+	}
+	return nil
+}
+
+func (t *BuildTest) recipeData() *recipeData {
+	return &recipeData{
+		SrcDir:   t.srcDir,
+		RootDir:  t.rootDir,
+		KConfig:  t.conf.KConfig,
+		Userland: t.conf.RequiresUserland,
+	}
+}
+
+// Add the chunk of commands needed to build OS/161
+func (t *BuildTest) addBuildCommands() error {
+	data := t.recipeData()
+
+	recipeEnv, err := expandRecipeLines(t.recipe.Env, data)
+	if err != nil {
+		return err
+	}
+
+	for _, step := range t.recipe.Steps {
+		if step.Userland && !t.conf.RequiresUserland {
+			continue
+		}
+
+		line, err := expandRecipeLine(step.Command, data)
+		if err != nil {
+			return err
+		}
+		dir, err := expandRecipeLine(step.Dir, data)
+		if err != nil {
+			return err
+		}
+		stepEnv, err := expandRecipeLines(step.Env, data)
+		if err != nil {
+			return err
+		}
+
+		cmd := t.addCommand(line, recipePath(t.srcDir, dir))
+		cmd.shell = step.Shell
+		cmd.env = append(append([]string{}, recipeEnv...), stepEnv...)
+	}
+
+	return nil
+}
+
+// Remove the recipe's clean directories before building.
+func (t *BuildTest) cleanRecipeDirs() {
+	dirs, err := expandRecipeLines(t.recipe.Clean, t.recipeData())
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if len(dir) > 0 {
+			os.RemoveAll(recipePath(t.srcDir, dir))
+		}
+	}
+}
+
+// Make sure the build produced the recipe's artifacts.
+func (t *BuildTest) checkArtifacts() error {
+	artifacts, err := expandRecipeLines(t.recipe.Artifacts, t.recipeData())
+	if err != nil {
+		return err
+	}
+
+	missing := make([]string, 0)
+	for _, artifact := range artifacts {
+		if _, err := os.Stat(recipePath(t.rootDir, artifact)); err != nil {
+			missing = append(missing, artifact)
+		}
+	}
+
+	if len(missing) > 0 {
+		t.Result = TEST_RESULT_INCORRECT
+		return errors.New(fmt.Sprintf("The build did not produce: %v", strings.Join(missing, ", ")))
+	}
+	return nil
+}
+
+// Get the target's own recipe, or nil if it doesn't declare steps.
+func (b *TargetBuild) recipe(name string) *BuildRecipe {
+	if len(b.Steps) == 0 {
+		return nil
+	}
+	return &BuildRecipe{
+		Name:      name,
+		Env:       b.Env,
+		Clean:     b.Clean,
+		Steps:     b.Steps,
+		Artifacts: b.Artifacts,
+	}
+}
+
+// Make sure the targets' recipes exist and are valid.
+func (env *TestEnvironment) checkTargetRecipes() error {
+	for _, target := range env.Targets {
+		recipe := target.Build.recipe(target.Name)
+		if recipe != nil {
+			if len(target.Build.Recipe) > 0 {
+				return fmt.Errorf("Target %v has both a build recipe and build steps", target.Name)
+			}
+			if err := recipe.Check(); err != nil {
+				return fmt.Errorf("Target %v build steps: %v", target.Name, err)
+			}
+		} else if len(target.Build.Recipe) > 0 {
+			if _, ok := env.Recipes[target.Build.Recipe]; !ok {
+				return fmt.Errorf("Target %v uses unknown build recipe: %v", target.Name, target.Build.Recipe)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func buildCommandLines(test *BuildTest) ([]string, []string) {
+	lines := make([]string, 0)
+	dirs := make([]string, 0)
+	for _, cmd := range test.Commands {
+		lines = append(lines, cmd.Input.Line)
+		dirs = append(dirs, cmd.startDir)
+	}
+	return lines, dirs
+}
+
+func TestRecipeDefault(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	conf := &BuildConf{
+		Repo:             "https://github.com/ops-class/os161.git",
+		CommitID:         "HEAD",
+		KConfig:          "ASST2",
+		RequiresUserland: true,
+	}
+
+	env := defaultEnv.CopyEnvironment()
+	test, err := conf.ToBuildTest(env)
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(test.dir)
+
+	assert.Equal(DefaultBuildRecipe, test.recipe)
+
+	src := test.srcDir
+	comp := path.Join(src, "kern/compile/ASST2")
+	lines, dirs := buildCommandLines(test)
+
+	// The same commands we've always run, after git
+	assert.Equal([]string{
+		"./configure --ostree=" + test.rootDir,
+		"bmake clean",
+		"bmake",
+		"bmake install",
+		"./config ASST2",
+		"bmake clean",
+		"bmake depend",
+		"bmake",
+		"bmake install",
+	}, lines[2:])
+	assert.Equal([]string{
+		src, src, src, src, path.Join(src, "kern/conf"), comp, comp, comp, comp,
+	}, dirs[2:])
+
+	// No userland
+	conf.RequiresUserland = false
+	test, err = conf.ToBuildTest(env)
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(test.dir)
+	lines, _ = buildCommandLines(test)
+	assert.Equal(8, len(lines))
+}
+
+func TestRecipeCustom(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	recipe, ok := defaultEnv.Recipes["extra_credit"]
+	if !assert.True(ok) {
+		t.FailNow()
+	}
+
+	target := &Target{
+		Name:    "ec",
+		KConfig: "ASST3",
+		Build:   TargetBuild{Recipe: "extra_credit"},
+	}
+	conf := target.BuildConf()
+	conf.Repo = "https://github.com/ops-class/os161.git"
+	conf.CommitID = "HEAD"
+
+	env := defaultEnv.CopyEnvironment()
+	test, err := conf.ToBuildTest(env)
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(test.dir)
+	assert.Equal(recipe, test.recipe)
+
+	comp := path.Join(test.srcDir, "kern/compile/ASST3-EC")
+	cmds := test.Commands[2:]
+	if assert.Equal(3, len(cmds)) {
+		assert.Equal("./configure --ostree="+test.rootDir+" --variant=ec", cmds[0].Input.Line)
+		assert.Equal([]string{"OS161_VARIANT=ec"}, cmds[0].env)
+		assert.Equal("./config ASST3-EC", cmds[1].Input.Line)
+		assert.Equal("bmake depend && bmake && bmake install", cmds[2].Input.Line)
+		assert.Equal(comp, cmds[2].startDir)
+		assert.True(cmds[2].shell)
+		assert.Equal([]string{"OS161_VARIANT=ec", "WERROR=1"}, cmds[2].env)
+	}
+
+	// Artifacts
+	assert.NotNil(test.checkArtifacts())
+	assert.Nil(os.MkdirAll(path.Join(test.rootDir, "bin"), 0770))
+	assert.Nil(ioutil.WriteFile(path.Join(test.rootDir, "kernel"), []byte{}, 0660))
+	assert.NotNil(test.checkArtifacts())
+	assert.Nil(ioutil.WriteFile(path.Join(test.rootDir, "bin/sh"), []byte{}, 0660))
+	assert.Nil(test.checkArtifacts())
+
+	// Inline steps
+	target.Build = TargetBuild{
+		Steps: []*BuildStep{&BuildStep{Command: "make KCONF={{.KConfig}}"}},
+	}
+	conf = target.BuildConf()
+	conf.Repo = "https://github.com/ops-class/os161.git"
+	test, err = conf.ToBuildTest(env)
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(test.dir)
+	lines, dirs := buildCommandLines(test)
+	assert.Equal("make KCONF=ASST3", lines[len(lines)-1])
+	assert.Equal(test.srcDir, dirs[len(dirs)-1])
+
+	// Unknown recipe
+	conf = &BuildConf{Repo: "https://github.com/ops-class/os161.git", RecipeName: "nope"}
+	_, err = conf.ToBuildTest(env)
+	assert.NotNil(err)
+}
+
+func TestRecipeLoad(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	_, err := BuildRecipesFromString("recipes:\n  - name: empty\n")
+	assert.NotNil(err)
+
+	_, err = BuildRecipesFromString("recipes:\n  - steps:\n      - cmd: bmake\n")
+	assert.NotNil(err)
+
+	_, err = BuildRecipesFromString("recipes:\n  - name: bad\n    steps:\n      - cmd: bmake {{.KConfig\n")
+	assert.NotNil(err)
+
+	recipes, err := BuildRecipesFromString("recipes:\n  - name: ok\n    steps:\n      - cmd: bmake\n")
+	if assert.Nil(err) && assert.Equal(1, len(recipes.Recipes)) {
+		assert.Equal("ok", recipes.Recipes[0].Name)
+	}
+
+	// Targets must use recipes that exist
+	env := defaultEnv.CopyEnvironment()
+	env.Targets = map[string]*Target{
+		"t": &Target{Name: "t", Build: TargetBuild{Recipe: "nope"}},
+	}
+	assert.NotNil(env.checkTargetRecipes())
+	env.Targets["t"].Build.Recipe = "extra_credit"
+	assert.Nil(env.checkTargetRecipes())
+	env.Targets["t"].Build.Steps = []*BuildStep{&BuildStep{Command: "bmake"}}
+	assert.NotNil(env.checkTargetRecipes())
+}
+
+func TestRecipeShellCommand(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	env := defaultEnv.CopyEnvironment()
+	persist := &outputPersistence{}
+	env.Persistence = persist
+
+	test := &BuildTest{
+		env:    env,
+		conf:   &BuildConf{},
+		cmdEnv: os.Environ(),
+	}
+	cmd := test.addCommand("echo $VARIANT && echo done", "/tmp")
+	cmd.shell = true
+	cmd.env = []string{"VARIANT=ec"}
+	assert.Nil(cmd.Run(env))
+	assert.Equal([]string{"Exec: echo $VARIANT && echo done", "ec", "done", "OK"}, persist.lines)
+}
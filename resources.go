@@ -0,0 +1,351 @@
+package test161
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/imdario/mergo"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file handles resource-aware admission for the test manager. A job
+// count alone doesn't work well for mixed workloads: a handful of tests with
+// lots of RAM and big disk images can overload a host that could easily run
+// dozens of boot tests. Each test's needs are taken from its sys161
+// configuration (CPUs, RAM, disks) and its expected wall time, and the
+// manager only starts a test if it fits in what's left of the host's budget.
+//
+// The manager can also tune its job capacity from the host's measured load
+// average and free memory. Capacity backs off quickly when the host is
+// overloaded and grows slowly while tests are waiting.
+
+// TestResources are the resources a test needs while it runs, or the total
+// in use by running tests.
+type TestResources struct {
+	CPUs     uint           `json:"cpus"`
+	RAM      uint64         `json:"ram"`
+	Disk     uint64         `json:"disk"`
+	WallTime TimeFixedPoint `json:"walltime"`
+}
+
+// ResourceBudget is the (configured) amount of each resource the manager can
+// hand out to running tests. RAM and Disk are sizes like "512M" or "4G", and
+// WallTime is the total expected wall time (seconds) of the running tests.
+// Zero or empty means unlimited.
+type ResourceBudget struct {
+	CPUs     uint    `yaml:"cpus" json:"cpus"`
+	RAM      string  `yaml:"ram" json:"ram"`
+	Disk     string  `yaml:"disk" json:"disk"`
+	WallTime float64 `yaml:"walltime" json:"walltime"`
+}
+
+// AutoTuneConf configures tuning the manager's capacity from host load.
+type AutoTuneConf struct {
+	Enabled    bool    `yaml:"enabled" json:"enabled"`
+	MaxLoad    float64 `yaml:"maxload" json:"maxload"`       // 1 minute load average per host CPU
+	MinFreeRAM string  `yaml:"minfreeram" json:"minfreeram"` // Available memory, e.g. "1G"
+	Interval   uint    `yaml:"interval" json:"interval"`     // Seconds between checks
+}
+
+const DEFAULT_AUTOTUNE_INTERVAL uint = 10
+
+// ParseByteSize parses sizes like the ones sys161 uses (1M, 32M, 512K) into
+// bytes. A plain number is a number of bytes.
+func ParseByteSize(size string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(s, "B")
+
+	multiplier := uint64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid size: %v", size))
+	}
+	return n * multiplier, nil
+}
+
+// Limits converts the budget into the resources available to the manager.
+func (b ResourceBudget) Limits() (TestResources, error) {
+	limits := TestResources{
+		CPUs:     b.CPUs,
+		WallTime: TimeFixedPoint(b.WallTime),
+	}
+
+	var err error
+	if b.RAM != "" {
+		if limits.RAM, err = ParseByteSize(b.RAM); err != nil {
+			return limits, err
+		}
+	}
+	if b.Disk != "" {
+		if limits.Disk, err = ParseByteSize(b.Disk); err != nil {
+			return limits, err
+		}
+	}
+
+	return limits, nil
+}
+
+// Resources returns the resources the test needs, based on its sys161
+// configuration and estimated wall time. Jobs are scheduled before the test
+// merges in the defaults, so anything the test leaves out comes from
+// CONF_DEFAULTS, just like it will when the test runs.
+func (t *Test) Resources() TestResources {
+	conf := t.Sys161
+	if err := mergo.Merge(&conf, CONF_DEFAULTS.Sys161); err != nil {
+		conf = t.Sys161
+	}
+
+	res := TestResources{
+		CPUs:     conf.CPUs,
+		WallTime: t.estimate(),
+	}
+	if res.CPUs == 0 {
+		res.CPUs = 1
+	}
+
+	// Bad sizes are caught by sys161, don't count them here.
+	if ram, err := ParseByteSize(conf.RAM); err == nil {
+		res.RAM = ram
+	}
+	for _, disk := range []DiskConf{conf.Disk1, conf.Disk2} {
+		if disk.Enabled != "true" {
+			continue
+		}
+		if bytes, err := ParseByteSize(disk.Bytes); err == nil {
+			res.Disk += bytes
+		}
+	}
+
+	return res
+}
+
+func (r TestResources) add(other TestResources) TestResources {
+	return TestResources{
+		CPUs:     r.CPUs + other.CPUs,
+		RAM:      r.RAM + other.RAM,
+		Disk:     r.Disk + other.Disk,
+		WallTime: r.WallTime + other.WallTime,
+	}
+}
+
+func (r TestResources) sub(other TestResources) TestResources {
+	return TestResources{
+		CPUs:     r.CPUs - other.CPUs,
+		RAM:      r.RAM - other.RAM,
+		Disk:     r.Disk - other.Disk,
+		WallTime: r.WallTime - other.WallTime,
+	}
+}
+
+// Returns true if need fits in limits along with inUse. Zero limits are
+// unlimited.
+func (limits TestResources) fits(inUse, need TestResources) bool {
+	if limits.CPUs > 0 && inUse.CPUs+need.CPUs > limits.CPUs {
+		return false
+	} else if limits.RAM > 0 && inUse.RAM+need.RAM > limits.RAM {
+		return false
+	} else if limits.Disk > 0 && inUse.Disk+need.Disk > limits.Disk {
+		return false
+	} else if limits.WallTime > 0 && inUse.WallTime+need.WallTime > limits.WallTime {
+		return false
+	}
+	return true
+}
+
+// Host load, as measured by readHostLoad
+type hostLoad struct {
+	Load1      float64 // 1 minute load average
+	CPUs       int
+	FreeRAM    uint64 // Available memory (bytes)
+	HasFreeRAM bool   // False if the kernel doesn't report MemAvailable
+}
+
+func readHostLoad() (*hostLoad, error) {
+	load := &hostLoad{CPUs: runtime.NumCPU()}
+
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return nil, errors.New("Unable to parse /proc/loadavg")
+	}
+	if load.Load1, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	load.FreeRAM, load.HasFreeRAM, err = parseMemAvailable(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return load, nil
+}
+
+// Get MemAvailable (bytes) from /proc/meminfo. Older kernels don't have it, in
+// which case found is false.
+func parseMemAvailable(r io.Reader) (avail uint64, found bool, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, false, err
+			}
+			return kb << 10, true, nil
+		}
+	}
+
+	return 0, false, scanner.Err()
+}
+
+// Compute the next tuned capacity. If the host is overloaded, capacity drops
+// by a quarter. Otherwise, if tests are waiting, it grows by one, up to limit
+// (0 for no limit). Capacity never goes below 1.
+func tuneCapacity(current, limit uint, queued bool, load *hostLoad, maxLoad float64, minFree uint64) uint {
+	overloaded := false
+	if maxLoad > 0 && load.CPUs > 0 && load.Load1/float64(load.CPUs) > maxLoad {
+		overloaded = true
+	} else if minFree > 0 && load.HasFreeRAM && load.FreeRAM < minFree {
+		overloaded = true
+	}
+
+	if overloaded {
+		drop := current / 4
+		if drop == 0 {
+			drop = 1
+		}
+		if current <= drop {
+			return 1
+		}
+		return current - drop
+	} else if queued && (limit == 0 || current < limit) {
+		return current + 1
+	}
+
+	return current
+}
+
+// Exported shared test manager functions
+
+// SetManagerBudget sets the resources the shared test manager can use for
+// running tests.
+func SetManagerBudget(budget ResourceBudget) error {
+	limits, err := budget.Limits()
+	if err != nil {
+		return err
+	}
+
+	testManager.statsCond.L.Lock()
+	testManager.limits = limits
+	testManager.statsCond.Broadcast()
+	testManager.statsCond.L.Unlock()
+
+	return nil
+}
+
+// StartManagerAutoTune starts tuning the shared test manager's capacity from
+// the host's load. The configured capacity (SetManagerCapacity) becomes the
+// upper limit.
+func StartManagerAutoTune(conf AutoTuneConf) error {
+	if !conf.Enabled {
+		return nil
+	}
+
+	var minFree uint64
+	if conf.MinFreeRAM != "" {
+		var err error
+		if minFree, err = ParseByteSize(conf.MinFreeRAM); err != nil {
+			return err
+		}
+	}
+
+	// Make sure we can actually measure the load
+	if load, err := readHostLoad(); err != nil {
+		return errors.New(fmt.Sprintf("Unable to read host load: %v", err))
+	} else if minFree > 0 && !load.HasFreeRAM {
+		return errors.New("Unable to use minfreeram: /proc/meminfo has no MemAvailable")
+	}
+
+	interval := conf.Interval
+	if interval == 0 {
+		interval = DEFAULT_AUTOTUNE_INTERVAL
+	}
+
+	m := testManager
+
+	m.statsCond.L.Lock()
+	defer m.statsCond.L.Unlock()
+
+	if m.tuneStop != nil {
+		return errors.New("Auto-tuning is already running")
+	}
+
+	// Start at the configured capacity, or one test per host CPU
+	m.tuned = m.Capacity
+	if m.tuned == 0 {
+		m.tuned = uint(runtime.NumCPU())
+	}
+	m.tuneStop = make(chan bool)
+
+	go func(stop chan bool) {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			load, err := readHostLoad()
+			if err != nil {
+				continue
+			}
+
+			m.statsCond.L.Lock()
+			if m.tuneStop == stop {
+				m.tuned = tuneCapacity(m.tuned, m.Capacity, len(m.queue) > 0, load, conf.MaxLoad, minFree)
+				m.stats.Capacity = m.capacity()
+				m.statsCond.Broadcast()
+			}
+			m.statsCond.L.Unlock()
+		}
+	}(m.tuneStop)
+
+	return nil
+}
+
+// StopManagerAutoTune stops tuning the shared test manager's capacity.
+func StopManagerAutoTune() {
+	testManager.stopAutoTune()
+}
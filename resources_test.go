@@ -0,0 +1,169 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestResourcesParseByteSize(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	sizes := map[string]uint64{
+		"512":   512,
+		"512K":  512 << 10,
+		"1M":    1 << 20,
+		"32m":   32 << 20,
+		"2G":    2 << 30,
+		" 4MB ": 4 << 20,
+	}
+	for size, expected := range sizes {
+		actual, err := ParseByteSize(size)
+		assert.Nil(err, size)
+		assert.Equal(expected, actual, size)
+	}
+
+	for _, size := range []string{"", "M", "1T", "-1M", "lots"} {
+		_, err := ParseByteSize(size)
+		assert.NotNil(err, size)
+	}
+}
+
+func TestResourcesTest(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	test, err := TestFromString(`---
+sys161:
+  cpus: 4
+  ram: 16M
+  disk1:
+    enabled: true
+    bytes: 32M
+  disk2:
+    bytes: 8M
+---
+sy1`)
+	assert.Nil(err)
+	if test == nil {
+		t.FailNow()
+	}
+	test.EstimatedTime = 5.0
+
+	assert.Equal(TestResources{
+		CPUs:     4,
+		RAM:      16 << 20,
+		Disk:     32 << 20,
+		WallTime: 5.0,
+	}, test.Resources())
+
+	// Anything left out comes from the defaults
+	test, err = TestFromString(`---
+sys161:
+  ram: 4M
+  disk2:
+    enabled: true
+---
+sy1`)
+	assert.Nil(err)
+	if test == nil {
+		t.FailNow()
+	}
+	test.EstimatedTime = 2.0
+
+	assert.Equal(TestResources{
+		CPUs:     8,
+		RAM:      4 << 20,
+		Disk:     32 << 20,
+		WallTime: 2.0,
+	}, test.Resources())
+
+	// The test's own configuration isn't changed
+	assert.Equal(uint(0), test.Sys161.CPUs)
+	assert.Equal("", test.Sys161.Disk2.Bytes)
+}
+
+func TestResourcesBudget(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	limits, err := ResourceBudget{CPUs: 16, RAM: "64M"}.Limits()
+	assert.Nil(err)
+	assert.Equal(TestResources{CPUs: 16, RAM: 64 << 20}, limits)
+
+	_, err = ResourceBudget{Disk: "big"}.Limits()
+	assert.NotNil(err)
+
+	small := TestResources{CPUs: 1, RAM: 1 << 20, WallTime: 1.0}
+	big := TestResources{CPUs: 8, RAM: 16 << 20, Disk: 64 << 20, WallTime: 60.0}
+
+	// Lots of small tests fit, but not many big ones
+	inUse := TestResources{}
+	count := 0
+	for limits.fits(inUse, small) {
+		inUse = inUse.add(small)
+		count += 1
+	}
+	assert.Equal(16, count)
+
+	inUse = TestResources{}
+	count = 0
+	for limits.fits(inUse, big) {
+		inUse = inUse.add(big)
+		count += 1
+	}
+	assert.Equal(2, count)
+	assert.Equal(big, inUse.sub(big))
+
+	// No limits
+	assert.True(TestResources{}.fits(big, big))
+}
+
+func TestResourcesTuneCapacity(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	idle := &hostLoad{Load1: 1.0, CPUs: 8, FreeRAM: 8 << 30, HasFreeRAM: true}
+	busy := &hostLoad{Load1: 20.0, CPUs: 8, FreeRAM: 8 << 30, HasFreeRAM: true}
+	lowMem := &hostLoad{Load1: 1.0, CPUs: 8, FreeRAM: 256 << 20, HasFreeRAM: true}
+	noMem := &hostLoad{Load1: 1.0, CPUs: 8}
+
+	// Grow while tests are waiting, up to the limit
+	assert.Equal(uint(9), tuneCapacity(8, 10, true, idle, 1.5, 1<<30))
+	assert.Equal(uint(10), tuneCapacity(10, 10, true, idle, 1.5, 1<<30))
+	assert.Equal(uint(11), tuneCapacity(10, 0, true, idle, 1.5, 1<<30))
+	assert.Equal(uint(8), tuneCapacity(8, 10, false, idle, 1.5, 1<<30))
+
+	// Back off when overloaded
+	assert.Equal(uint(30), tuneCapacity(40, 40, true, busy, 1.5, 1<<30))
+	assert.Equal(uint(3), tuneCapacity(4, 40, true, lowMem, 1.5, 1<<30))
+	assert.Equal(uint(1), tuneCapacity(1, 40, true, busy, 1.5, 1<<30))
+
+	// Unset thresholds are ignored
+	assert.Equal(uint(41), tuneCapacity(40, 0, true, busy, 0, 0))
+
+	// As is the memory threshold if we can't measure it
+	assert.Equal(uint(9), tuneCapacity(8, 10, true, noMem, 1.5, 1<<30))
+}
+
+func TestResourcesMemAvailable(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	avail, found, err := parseMemAvailable(strings.NewReader(
+		"MemTotal:       16318412 kB\nMemFree:         1220480 kB\nMemAvailable:    9437184 kB\n"))
+	assert.Nil(err)
+	assert.True(found)
+	assert.Equal(uint64(9<<30), avail)
+
+	// Older kernels
+	avail, found, err = parseMemAvailable(strings.NewReader(
+		"MemTotal:       16318412 kB\nMemFree:         1220480 kB\n"))
+	assert.Nil(err)
+	assert.False(found)
+	assert.Equal(uint64(0), avail)
+
+	_, _, err = parseMemAvailable(strings.NewReader("MemAvailable:    lots kB\n"))
+	assert.NotNil(err)
+}
@@ -7,9 +7,6 @@ package test161
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/kr/pty"
@@ -21,7 +18,6 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -43,6 +39,11 @@ type Test struct {
 	Tags        []string `yaml:"tags" json:"tags"`
 	Depends     []string `yaml:"depends" json:"depends"`
 
+	// Parameterized tests. The matrix is expanded into one test instance per
+	// combination of values, and Params holds this instance's values.
+	Matrix map[string][]string `yaml:"matrix" json:"-" bson:"-"`
+	Params map[string]string   `yaml:"-" json:"params" bson:"params"`
+
 	// Configuration chunks
 	Sys161           Sys161Conf         `yaml:"sys161" json:"sys161"`
 	Stat             StatConf           `yaml:"stat" json:"stat"`
@@ -71,6 +72,9 @@ type Test struct {
 	ExpandedDeps map[string]*Test `json:"-" bson:"-"`
 	IsDependency bool             `json:"isdependency"`
 
+	// Expected wall time, based on previous runs. Used for scheduling.
+	EstimatedTime TimeFixedPoint `json:"-" bson:"-"`
+
 	// Grading.  These are set when the test is being run as part of a Target.
 	PointsAvailable uint   `json:"points_avail" bson:"points_avail"`
 	PointsEarned    uint   `json:"points_earned" bson:"points_earned"`
@@ -86,6 +90,18 @@ type Test struct {
 	MemLeakPoints   uint `json:"mem_leak_points" bson:"mem_leak_points"`     // potential point hit
 	MemLeakDeducted uint `json:"mem_leak_deducted" bson:"mem_leak_deducted"` // actual point hit
 
+	// Secure output salts, in the order we saw them (see secure.go)
+	Salts []string `json:"salts" bson:"salts"`
+
+	// Metrics reported by the commands, aggregated (see metrics.go)
+	Metrics []*Metric `json:"metrics" bson:"metrics"`
+
+	// Invariant checks from the target (see invariants.go)
+	Invariants []*InvariantCheck `json:"invariants" bson:"invariants"`
+
+	// Why sys161 shut down, if it did so in the middle of a command (see panic.go)
+	PanicInfo *PanicInfo `json:"panic_info" bson:"panic_info"`
+
 	// Unproctected Private fields
 	tempDir     string           // Only set once
 	startTime   int64            // Only set once
@@ -154,8 +170,15 @@ type Command struct {
 	// Set during testing
 	Output       []*OutputLine `json:"output"`
 	SummaryStats Stat          `json:"summarystats"`
+	Metrics      []*Metric     `json:"metrics" bson:"metrics"` // Reported by the test (see metrics.go)
 	AllStats     []Stat        `json:"stats"`
 
+	// Partial credit sub-checks, from the target or command template
+	SubChecks []*SubCheck `json:"subchecks" bson:"subchecks"`
+
+	// Why sys161 shut down during the command, if it did (see panic.go)
+	PanicInfo *PanicInfo `json:"panic_info" bson:"panic_info"`
+
 	StartTime TimeFixedPoint `json:"starttime"`
 	EndTime   TimeFixedPoint `json:"endtime"`
 	TimedOut  bool           `json:"timedout"`
@@ -180,6 +203,15 @@ type OutputLine struct {
 	Line     string         `json:"line"`
 	Trusted  bool           `json:"trusted"`
 	KeyName  string         `json:"keyname"`
+
+	// The secprintf salt and MAC, so trusted lines can be checked later
+	Salt string `json:"salt,omitempty" bson:"salt,omitempty"`
+	MAC  string `json:"mac,omitempty" bson:"mac,omitempty"`
+
+	// Structured secure output (see securemsg.go). Line is the plain text
+	// version of Message, and Payload is what was signed.
+	Message *SecureMessage `json:"message,omitempty" bson:"message,omitempty"`
+	Payload string         `json:"payload,omitempty" bson:"payload,omitempty"`
 }
 
 type Status struct {
@@ -200,6 +232,7 @@ const (
 	TEST_RESULT_INCORRECT TestResult = "incorrect" // Possibly some partial points, but didn't complete everything successfully
 	TEST_RESULT_ABORT     TestResult = "abort"     // Aborted - internal error
 	TEST_RESULT_SKIP      TestResult = "skip"      // Skipped (dependency not met)
+	TEST_RESULT_TIMEOUT   TestResult = "timeout"   // Timed out (builds only)
 )
 
 // MarshalJSON prints our TimeFixedPoint type as a fixed point float for JSON.
@@ -248,6 +281,8 @@ func (t *Test) Run(env *TestEnvironment) (err error) {
 	t.env = env
 
 	t.salts = make(map[string]bool)
+	t.Salts = make([]string, 0)
+	t.Metrics = make([]*Metric, 0)
 
 	defer func() {
 		env.notifyAndLogErr("Test Complete", t, MSG_PERSIST_COMPLETE, 0)
@@ -448,7 +483,11 @@ func (t *Test) Run(env *TestEnvironment) (err error) {
 			}
 
 			if !expected {
+				// Find out what happened
 				t.addStatus("shutdown", "unexpected shutdown")
+				if info := t.recordPanic(); info != nil {
+					t.addStatus("panic", info.String())
+				}
 				t.currentCommand.Status = COMMAND_STATUS_INCORRECT
 				t.allCorrect = false
 				t.currentCommand.PointsEarned = 0
@@ -526,6 +565,8 @@ func (t *Test) finishCurCommand(env *TestEnvironment, eof bool) *Command {
 
 	cur := t.currentCommand
 	cur.evaluate(env.keyMap, eof)
+	cur.collectMetrics(env.keyMap)
+	t.addMetrics(cur)
 
 	if env.Persistence != nil {
 		env.notifyAndLogErr("Command Status", cur, MSG_PERSIST_UPDATE,
@@ -555,8 +596,9 @@ func (t *Test) finishAndEvaluate() {
 		t.Result = TEST_RESULT_INCORRECT
 	}
 
-	// Always look for mem leaks, even if they aren't worth any points
-	t.evaluateMemLeaks()
+	// Always look for mem leaks and check the other invariants, even if they
+	// aren't worth any points
+	t.evaluateInvariants()
 }
 
 // sendCommand sends a command persistently. All the retry logic to deal with
@@ -760,10 +802,6 @@ func (l *InputLine) replaceArgs(args []string) {
 	}
 }
 
-// Partial credit regular expression. We don't care that the id isn't prefixed,
-// as long as it is signed by the right key.
-var partialCreditExp *regexp.Regexp = regexp.MustCompile(`^.*PARTIAL CREDIT ([0-9]+) OF ([0-9]+)$`)
-
 // Evaluate a single command, setting its status and points
 func (c *Command) evaluate(keyMap map[string]string, eof bool) {
 	c.PointsEarned = 0
@@ -813,34 +851,42 @@ func (c *Command) evaluate(keyMap map[string]string, eof bool) {
 		actualIndex++
 	}
 
+	// Only check trusted lines signed with our key
+	id := c.Id()
+	_, hasKey := keyMap[id]
+	trusted := func(line *OutputLine) bool {
+		return !hasKey || (line.Trusted && line.KeyName == id)
+	}
+
 	// If we've matched all expected lines, the command succeeded and full
 	// points are awarded (if there are any).
 	if expectedIndex == len(c.ExpectedOutput) {
 		c.Status = COMMAND_STATUS_CORRECT
 		c.PointsEarned = c.PointsAvailable
+		c.recordSubChecks(trusted)
+	} else if len(c.SubChecks) > 0 {
+		// The points come from the sub-checks (see subchecks.go)
+		c.Status = COMMAND_STATUS_INCORRECT
+		c.PointsEarned = 0
+		c.evaluateSubChecks(trusted)
 	} else {
 		// The result is incorrect, but there still be some partial credit
 		c.Status = COMMAND_STATUS_INCORRECT
 		c.PointsEarned = 0
 
-		totalEarned, totalAvail := 0, 0
-
-		id := c.Id()
-		_, hasKey := keyMap[id]
+		var totalEarned, totalAvail uint
 
 		for _, line := range c.Output {
-			// Only check trusted lines signed with our key
-			if !hasKey || (line.Trusted && line.KeyName == id) {
-				if res := partialCreditExp.FindStringSubmatch(line.Line); len(res) == 3 {
-					if earned, err := strconv.Atoi(res[1]); err == nil && earned > 0 {
-						if avail, err := strconv.Atoi(res[2]); err == nil && avail > 0 {
-							totalAvail += avail
-							totalEarned += earned
-						}
-					}
-					// Only one partial credit line allowed.
-					break
+			if !trusted(line) {
+				continue
+			}
+			if _, earned, avail, ok := partialCredit(line); ok {
+				if earned > 0 && avail > 0 {
+					totalAvail += avail
+					totalEarned += earned
 				}
+				// Only one partial credit line allowed.
+				break
 			}
 		}
 
@@ -886,28 +932,16 @@ func (t *Test) outputLineComplete() {
 	line.Line = strings.Replace(line.Line, "\x00", "", -1)
 
 	// Next, check if this is a secure line
-	if res := os161Secure.FindStringSubmatch(line.Line); len(res) == 5 {
+	if res := secureMsgExp.FindStringSubmatch(line.Line); len(res) == 6 {
+		t.structuredLineComplete(line, res)
+	} else if res := os161Secure.FindStringSubmatch(line.Line); len(res) == 5 {
 		// The message has the secprintf form, now verify that we trust this message.
 		//If we do, note the key and only output the payload.
 		id := res[1]
 		hash := res[2]
 		salt := res[3]
-		key := t.env.keyMap[id] + salt
-
-		// Check if we've already seen that salt during this test. If so, it's suspicious.
-		if ok, _ := t.salts[salt]; ok {
-			t.env.Log.Printf("Test ID %v  Salt value failed uniqueness requirement\n", t.ID)
-			line.Trusted = false
-			return
-		}
-
-		t.salts[salt] = true
-
-		mac := hmac.New(sha256.New, []byte(key))
-		mac.Write([]byte(res[4]))
-		expected := strings.ToLower(hex.EncodeToString(mac.Sum(nil)))
 
-		if expected == hash {
+		if t.checkSecureLine(line, id, hash, salt, res[4]) {
 			line.Trusted = true
 			line.KeyName = id
 			line.Line = res[4]
@@ -915,82 +949,3 @@ func (t *Test) outputLineComplete() {
 	}
 
 }
-
-var memLeakRegex *regexp.Regexp = regexp.MustCompile(`^khu: (\d+)$`)
-
-func (t *Test) evaluateMemLeaks() {
-
-	expectedMem := 0
-
-	for _, c := range t.Commands {
-		if c.Id() == "khu" {
-			t.MemLeakChecked = true
-			badOutput := true
-
-			// Check each output line for "khu: <number>"
-			for _, line := range c.Output {
-				_, hasKey := t.env.keyMap["khu"]
-
-				// The output needs to be trusted
-				if !hasKey || (line.Trusted && line.KeyName == "khu") {
-					if res := memLeakRegex.FindStringSubmatch(line.Line); len(res) == 2 {
-						// The regex takes care of the error
-						usedMem, _ := strconv.Atoi(res[1])
-						if expectedMem == 0 {
-							// First instance
-							expectedMem = usedMem
-						} else if expectedMem != usedMem {
-							// Leak!
-							t.deductMemLeakPoints()
-							t.MemLeakBytes = usedMem - expectedMem
-							t.addMemLeakStatus(false)
-							return
-						}
-
-						// There is only one line we're interested in
-						badOutput = false
-						break
-					}
-				}
-			}
-
-			// Either the output was supressed, or wrong. We check this per-khu
-			// command instance.
-			if badOutput {
-				t.deductMemLeakPoints()
-				t.addMemLeakStatus(true)
-				return
-			}
-		}
-	}
-}
-
-// Deduct points for leaking memory, if applicable
-func (t *Test) deductMemLeakPoints() {
-	if t.PointsAvailable > 0 && t.MemLeakPoints > 0 {
-		if t.PointsEarned < t.MemLeakPoints {
-			t.MemLeakDeducted = t.PointsEarned
-			t.PointsEarned = 0
-		} else {
-			t.PointsEarned -= t.MemLeakPoints
-			t.MemLeakDeducted = t.MemLeakPoints
-		}
-	}
-}
-
-// Add a status to the test indicating that a memory leak has occurred.
-// If there was a point deduction, show it; otherwise, give a warning.
-func (t *Test) addMemLeakStatus(badOutput bool) {
-	if badOutput {
-		if t.MemLeakDeducted > 0 {
-			t.addStatus("memory leak", fmt.Sprintf("Unable to determine memory leak, corrupted output. Memory leak deduction: %v points",
-				t.MemLeakDeducted))
-		} else {
-			t.addStatus("memory leak", "Unable to determine memory leak, corrupted output")
-		}
-	} else if t.PointsAvailable > 0 && t.MemLeakPoints > 0 {
-		t.addStatus("memory leak", fmt.Sprintf("Memory leak deduction (%v bytes): %v points", t.MemLeakBytes, t.MemLeakDeducted))
-	} else {
-		t.addStatus("memory leak", fmt.Sprintf("Warning: memory leak detected (%v bytes)", t.MemLeakBytes))
-	}
-}
@@ -1,5 +1,9 @@
 package test161
 
+import (
+	"sync/atomic"
+)
+
 // A TestRunner is responsible for running a TestGroup and sending the
 // results back on a read-only channel. test161 runners close the results
 // channel when finished so clients can range over it. test161 runners also
@@ -21,6 +25,14 @@ func TestRunnerFromConfig(config *GroupConfig) (TestRunner, []error) {
 	}
 }
 
+// Each run of a group gets the next group number, so the manager can run the
+// jobs of older groups first.
+var lastGroupSeq uint64
+
+func nextGroupSeq() uint64 {
+	return atomic.AddUint64(&lastGroupSeq, 1)
+}
+
 // Factory function to create a new SimpleRunner.
 func NewSimpleRunner(group *TestGroup) TestRunner {
 	return &SimpleRunner{group}
@@ -56,10 +68,17 @@ func (r *SimpleRunner) Run() <-chan *Test161JobResult {
 	callbackChan := make(chan *Test161JobResult, len(r.group.Tests))
 
 	env := r.group.Config.Env
+	group := nextGroupSeq()
 
 	// Spawn every job at once (no dependency tracking)
 	for _, test := range r.group.Tests {
-		job := &test161Job{test, env, resChan}
+		job := &test161Job{
+			Test:     test,
+			Env:      env,
+			DoneChan: resChan,
+			Priority: r.group.Config.Priority,
+			Group:    group,
+		}
 		env.manager.SubmitChan <- job
 	}
 
@@ -155,6 +174,12 @@ func (r *DependencyRunner) Run() <-chan *Test161JobResult {
 		}
 	}
 
+	// Tests on the longest remaining path through the dependency graph run
+	// first when the manager is at capacity. If the graph is broken, all tests
+	// get the same priority.
+	priorities, _ := r.group.CriticalPaths()
+	group := nextGroupSeq()
+
 	// Spawn all the tests and put them in a waiting pattern
 	for id, test := range r.group.Tests {
 		// Buffer this so we eliminate races during setup
@@ -188,7 +213,14 @@ func (r *DependencyRunner) Run() <-chan *Test161JobResult {
 			case test := <-readyChan:
 				// We have a test that can run.
 				delete(waiting, test.DependencyID)
-				job := &test161Job{test, env, resChan}
+				job := &test161Job{
+					Test:         test,
+					Env:          env,
+					DoneChan:     resChan,
+					Priority:     r.group.Config.Priority,
+					Group:        group,
+					CriticalPath: float64(priorities[test.DependencyID]),
+				}
 				env.manager.SubmitChan <- job
 			}
 		}
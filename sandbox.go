@@ -0,0 +1,282 @@
+package test161
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Build commands run students' Makefiles, which are arbitrary code, so the
+// server runs them in a sandbox. Each command runs in its own process group
+// under resource limits (set with ulimit by /bin/sh), with a wall clock
+// timeout and a cap on its output. Optionally, commands other than the git
+// commands that need the network run in new user and network namespaces so
+// they have no network access.
+
+// Statuses for build commands that exceeded a sandbox limit
+const (
+	COMMAND_STATUS_TIMEOUT      = "timeout"      // Exceeded the wall clock timeout
+	COMMAND_STATUS_CPU_LIMIT    = "cpu_limit"    // Exceeded the CPU time limit
+	COMMAND_STATUS_FILE_LIMIT   = "file_limit"   // Tried to write a file that was too large
+	COMMAND_STATUS_OUTPUT_LIMIT = "output_limit" // Produced too much output
+)
+
+// BuildSandbox specifies the limits for each build command. Zero values mean
+// no limit.
+type BuildSandbox struct {
+	CPUTime   uint   `yaml:"cpu_time"`   // Seconds
+	WallTime  uint   `yaml:"wall_time"`  // Seconds
+	Memory    string `yaml:"memory"`     // Virtual memory, e.g. 2G
+	FileSize  string `yaml:"file_size"`  // Largest file that can be written
+	Processes uint   `yaml:"processes"`  // Max processes, only with Isolate
+	MaxOutput string `yaml:"max_output"` // Combined stdout/stderr
+
+	// Run commands in new user and network namespaces so they can't use the
+	// network. This requires unshare(1) and unprivileged user namespaces.
+	Isolate bool `yaml:"isolate"`
+}
+
+// DefaultBuildSandbox is generous enough for any OS/161 build. It isolates
+// commands, which servers turn off (with a warning) if the host can't.
+var DefaultBuildSandbox = BuildSandbox{
+	CPUTime:   600,
+	WallTime:  900,
+	Memory:    "4G",
+	FileSize:  "256M",
+	Processes: 512,
+	MaxOutput: "4M",
+	Isolate:   true,
+}
+
+// Check the sandbox configuration, and that we can isolate commands if asked.
+func (sb *BuildSandbox) Check() error {
+	for _, size := range []string{sb.Memory, sb.FileSize, sb.MaxOutput} {
+		if len(size) > 0 {
+			if _, err := ParseByteSize(size); err != nil {
+				return err
+			}
+		}
+	}
+
+	if sb.Isolate {
+		args := sb.isolate([]string{"true"})
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			return errors.New(fmt.Sprintf("Unable to isolate build commands: %v %v", err, strings.TrimSpace(string(out))))
+		}
+	}
+
+	return nil
+}
+
+// Get the byte size, or 0 if it's not set. Sizes are validated by Check.
+func sandboxSize(size string) uint64 {
+	if len(size) == 0 {
+		return 0
+	}
+	n, _ := ParseByteSize(size)
+	return n
+}
+
+// Get the ulimit commands for the sandbox. /bin/sh uses 512 byte blocks for
+// file sizes, and dash and bash disagree on the process limit flag. The
+// process limit counts every process the user has, including the server, so
+// it's only set for isolated commands, which have their own user namespace.
+func (sb *BuildSandbox) ulimits(isolated bool) []string {
+	limits := make([]string, 0)
+
+	if sb.CPUTime > 0 {
+		// The soft limit sends SIGXCPU, which is how we know what happened.
+		// The hard limit sends SIGKILL, in case that's ignored.
+		limits = append(limits, fmt.Sprintf("ulimit -H -t %v", sb.CPUTime+5))
+		limits = append(limits, fmt.Sprintf("ulimit -S -t %v", sb.CPUTime))
+	}
+	if mem := sandboxSize(sb.Memory); mem > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -v %v", (mem+1023)/1024))
+	}
+	if size := sandboxSize(sb.FileSize); size > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -f %v", (size+511)/512))
+	}
+	if sb.Processes > 0 && isolated {
+		limits = append(limits, fmt.Sprintf("{ ulimit -u %v 2>/dev/null || ulimit -p %v; }", sb.Processes, sb.Processes))
+	}
+
+	return limits
+}
+
+func (sb *BuildSandbox) isolate(args []string) []string {
+	return append([]string{"unshare", "--user", "--map-root-user", "--net", "--"}, args...)
+}
+
+// Wrap the command line so it runs under the sandbox's limits.
+func (sb *BuildSandbox) wrap(args []string, network bool) []string {
+	isolated := sb.Isolate && !network
+	if limits := sb.ulimits(isolated); len(limits) > 0 {
+		script := strings.Join(limits, " && ") + ` && exec "$@"`
+		args = append([]string{"/bin/sh", "-c", script, "sh"}, args...)
+	}
+	if isolated {
+		args = sb.isolate(args)
+	}
+	return args
+}
+
+// sandboxOutput splits a command's output into lines, up to a limit, and
+// kills the command when it goes over.
+type sandboxOutput struct {
+	l        sync.Mutex
+	partial  bytes.Buffer
+	total    uint64
+	max      uint64
+	exceeded bool
+	kill     func()
+	onLine   func(string)
+}
+
+func (o *sandboxOutput) Write(p []byte) (int, error) {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	n := len(p)
+	if o.exceeded {
+		return n, nil
+	}
+
+	if o.max > 0 && o.total+uint64(len(p)) > o.max {
+		p = p[:o.max-o.total]
+		o.exceeded = true
+		o.kill()
+	}
+	o.total += uint64(len(p))
+
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			o.partial.Write(p)
+			break
+		}
+		o.partial.Write(p[:i])
+		o.onLine(o.partial.String())
+		o.partial.Reset()
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
+
+// Send whatever is left over once the command is done.
+func (o *sandboxOutput) flush() {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	if o.partial.Len() > 0 {
+		o.onLine(o.partial.String())
+		o.partial.Reset()
+	}
+}
+
+// Run the command in the sandbox, sending its combined output to onLine one
+// line at a time. The command is killed after timeout (if > 0), or the
+// sandbox's wall time, whichever is first. Returns the status and error if the
+// command failed. Without a sandbox, commands still run in their own process
+// group so we can time them out.
+func (cmd *BuildCommand) execute(env *TestEnvironment, args []string, timeout time.Duration,
+	onLine func(string)) (string, error) {
+
+	sb := env.BuildSandbox
+	if sb == nil {
+		sb = &BuildSandbox{}
+	}
+
+	limit := ""
+	if sb.WallTime > 0 {
+		wall := time.Duration(sb.WallTime) * time.Second
+		if timeout <= 0 || wall < timeout {
+			timeout = wall
+			limit = " (sandbox limit)"
+		}
+	}
+
+	args = sb.wrap(args, cmd.network)
+	c := exec.Command(args[0], args[1:]...)
+	c.Dir = cmd.startDir
+	c.Env = append(append([]string{}, cmd.test.cmdEnv...), cmd.env...)
+
+	// Use a process group so we can kill everything the command started
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	var killOnce sync.Once
+	kill := func() {
+		killOnce.Do(func() {
+			if c.Process != nil {
+				syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+			}
+		})
+	}
+
+	output := &sandboxOutput{
+		max:    sandboxSize(sb.MaxOutput),
+		kill:   kill,
+		onLine: onLine,
+	}
+	c.Stdout = output
+	c.Stderr = output
+
+	if err := c.Start(); err != nil {
+		return COMMAND_STATUS_INCORRECT, err
+	}
+
+	timedOut := false
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			output.l.Lock()
+			timedOut = true
+			output.l.Unlock()
+			kill()
+		})
+	}
+
+	err := c.Wait()
+	if timer != nil {
+		timer.Stop()
+	}
+	output.flush()
+
+	// Clean up anything left in the process group
+	kill()
+
+	output.l.Lock()
+	exceeded, timeoutExceeded := output.exceeded, timedOut
+	output.l.Unlock()
+
+	switch {
+	case timeoutExceeded:
+		return COMMAND_STATUS_TIMEOUT,
+			errors.New(fmt.Sprintf("Build command timed out after %v%v", timeout, limit))
+	case exceeded:
+		return COMMAND_STATUS_OUTPUT_LIMIT,
+			errors.New(fmt.Sprintf("Build command output exceeded %v", sb.MaxOutput))
+	case err == nil:
+		return "", nil
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			switch status.Signal() {
+			case syscall.SIGXCPU:
+				return COMMAND_STATUS_CPU_LIMIT,
+					errors.New(fmt.Sprintf("Build command exceeded the CPU time limit (%v seconds)", sb.CPUTime))
+			case syscall.SIGXFSZ:
+				return COMMAND_STATUS_FILE_LIMIT,
+					errors.New(fmt.Sprintf("Build command exceeded the file size limit (%v)", sb.FileSize))
+			}
+		}
+	}
+
+	return COMMAND_STATUS_INCORRECT, err
+}
@@ -0,0 +1,197 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runSandboxed(t *testing.T, sb *BuildSandbox, line string) (*BuildCommand, error) {
+	return runBuildCommand(t, sb, &BuildConf{}, line)
+}
+
+func runBuildCommand(t *testing.T, sb *BuildSandbox, conf *BuildConf, line string) (*BuildCommand, error) {
+	dir, err := ioutil.TempDir("", "test161-sandbox")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	env := defaultEnv.CopyEnvironment()
+	env.BuildSandbox = sb
+	env.Persistence = &DoNothingPersistence{}
+
+	test := &BuildTest{
+		env:       env,
+		conf:      conf,
+		cmdEnv:    os.Environ(),
+		startTime: time.Now(),
+	}
+	cmd := test.addCommand(line, dir)
+	err = cmd.Run(env)
+	return cmd, err
+}
+
+func TestSandboxWrap(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	sb := &BuildSandbox{}
+	assert.Equal([]string{"bmake"}, sb.wrap([]string{"bmake"}, false))
+
+	sb = &BuildSandbox{
+		CPUTime:   10,
+		Memory:    "1M",
+		FileSize:  "1K",
+		Processes: 20,
+	}
+	args := sb.wrap([]string{"bmake", "depend"}, false)
+	if assert.Equal(6, len(args)) {
+		assert.Equal("/bin/sh", args[0])
+		assert.Equal("ulimit -H -t 15 && ulimit -S -t 10 && ulimit -v 1024 && ulimit -f 2 && "+
+			"exec \"$@\"", args[2])
+		assert.Equal([]string{"bmake", "depend"}, args[4:])
+	}
+
+	// The process limit only applies in a separate user namespace
+	sb.Isolate = true
+	args = sb.wrap([]string{"bmake"}, false)
+	if assert.Equal(10, len(args)) {
+		assert.Equal("unshare", args[0])
+		assert.Equal("ulimit -H -t 15 && ulimit -S -t 10 && ulimit -v 1024 && ulimit -f 2 && "+
+			"{ ulimit -u 20 2>/dev/null || ulimit -p 20; } && exec \"$@\"", args[7])
+	}
+	args = sb.wrap([]string{"git", "fetch"}, true)
+	if assert.Equal(6, len(args)) {
+		assert.Equal("/bin/sh", args[0])
+		assert.NotContains(args[2], "ulimit -u")
+	}
+
+	assert.Nil((&BuildSandbox{Memory: "2G", MaxOutput: "1M"}).Check())
+	assert.NotNil((&BuildSandbox{FileSize: "lots"}).Check())
+}
+
+func TestSandboxLimits(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// OK
+	cmd, err := runSandboxed(t, &BuildSandbox{WallTime: 10, MaxOutput: "1K"}, "echo hello")
+	assert.Nil(err)
+	assert.Equal(COMMAND_STATUS_RUNNING, cmd.Status)
+
+	// Regular failure
+	cmd, err = runSandboxed(t, &BuildSandbox{WallTime: 10}, "false")
+	assert.NotNil(err)
+	assert.Equal(COMMAND_STATUS_INCORRECT, cmd.Status)
+
+	// Timeout
+	start := time.Now()
+	cmd, err = runSandboxed(t, &BuildSandbox{WallTime: 1}, "sleep 30")
+	assert.NotNil(err)
+	assert.Equal(COMMAND_STATUS_TIMEOUT, cmd.Status)
+	assert.True(time.Now().Sub(start) < 10*time.Second)
+
+	// Output
+	cmd, err = runSandboxed(t, &BuildSandbox{MaxOutput: "1K"}, "yes")
+	assert.NotNil(err)
+	assert.Equal(COMMAND_STATUS_OUTPUT_LIMIT, cmd.Status)
+
+	// File size
+	cmd, err = runSandboxed(t, &BuildSandbox{FileSize: "1K"}, "dd if=/dev/zero of=big bs=1024 count=4")
+	assert.NotNil(err)
+	assert.Equal(COMMAND_STATUS_FILE_LIMIT, cmd.Status)
+	if assert.True(len(cmd.Output) > 0) {
+		assert.True(strings.Contains(cmd.Output[len(cmd.Output)-1].Line, "file size"))
+	}
+}
+
+type outputPersistence struct {
+	DoNothingPersistence
+	lines []string
+}
+
+func (p *outputPersistence) Notify(entity interface{}, msg, what int) error {
+	if cmd, ok := entity.(*BuildCommand); ok && msg == MSG_PERSIST_OUTPUT {
+		p.lines = append(p.lines, cmd.Output[len(cmd.Output)-1].Line)
+	}
+	return nil
+}
+
+func TestBuildOutputStreaming(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	env := defaultEnv.CopyEnvironment()
+	persist := &outputPersistence{}
+	env.Persistence = persist
+
+	test := &BuildTest{
+		env:       env,
+		conf:      &BuildConf{},
+		cmdEnv:    os.Environ(),
+		startTime: time.Now(),
+	}
+	cmd := test.addCommand("printf one\\ntwo\\nthree", "/tmp")
+	assert.Nil(cmd.Run(env))
+
+	assert.Equal([]string{"Exec: printf one\\ntwo\\nthree", "one", "two", "three", "OK"}, persist.lines)
+	assert.Equal(5, len(cmd.Output))
+	for i := 1; i < len(cmd.Output); i++ {
+		assert.True(cmd.Output[i].WallTime >= cmd.Output[i-1].WallTime)
+	}
+
+	// Commands with handlers don't stream unless they fail
+	persist.lines = nil
+	cmd = test.addCommand("printf abc", "/tmp")
+	cmd.handler = overlayCommitHandler
+	assert.Nil(cmd.Run(env))
+	assert.Equal([]string{"Exec: printf abc", "OK"}, persist.lines)
+	assert.Equal("abc", test.overlayCommitID)
+
+	persist.lines = nil
+	cmd = test.addCommand("printf xyz", "/tmp")
+	cmd.handler = overlayCommitHandler
+	assert.NotNil(cmd.Run(env))
+	assert.Equal([]string{"Exec: printf xyz", "xyz", "Unable to get commit ID of overlay directory"}, persist.lines)
+	assert.Equal(COMMAND_STATUS_INCORRECT, cmd.Status)
+}
+
+func TestBuildTimeouts(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// Command timeout
+	cmd, err := runBuildCommand(t, nil, &BuildConf{CommandTimeout: 1}, "sleep 30")
+	assert.NotNil(err)
+	assert.Equal(COMMAND_STATUS_TIMEOUT, cmd.Status)
+
+	// The sandbox's limit still applies
+	cmd, err = runBuildCommand(t, &BuildSandbox{WallTime: 1}, &BuildConf{CommandTimeout: 60}, "sleep 30")
+	assert.NotNil(err)
+	assert.Equal(COMMAND_STATUS_TIMEOUT, cmd.Status)
+
+	// Build timeout
+	cmd, err = runBuildCommand(t, nil, &BuildConf{Timeout: 1, CommandTimeout: 60}, "sleep 30")
+	assert.NotNil(err)
+	assert.Equal(COMMAND_STATUS_TIMEOUT, cmd.Status)
+	assert.Equal("Build timed out after 1 seconds", err.Error())
+
+	// Out of time before it starts
+	test := &BuildTest{
+		conf:      &BuildConf{Timeout: 1},
+		startTime: time.Now().Add(-2 * time.Second),
+	}
+	timeout, buildLimit := test.commandTimeout()
+	assert.True(timeout < 0)
+	assert.True(buildLimit)
+
+	test.conf = &BuildConf{Timeout: 100, CommandTimeout: 10}
+	timeout, buildLimit = test.commandTimeout()
+	assert.Equal(10*time.Second, timeout)
+	assert.False(buildLimit)
+}
@@ -0,0 +1,267 @@
+package test161
+
+import (
+	"errors"
+	"github.com/ops-class/test161/graph"
+	"sort"
+	"sync"
+	"time"
+)
+
+// This file implements critical-path scheduling for groups with dependencies.
+// Each test is prioritized by the estimated time from when it starts until
+// everything waiting on it (transitively) can finish. When the test manager is
+// at capacity, the tests that hold up the most work run first, which shortens
+// the total time (makespan) for large targets.
+//
+// Estimates come from the wall times of previous runs: the last run file for
+// test161, and the usage stats and finished submissions for the server (see
+// TestEstimates). Tests without history get the average of the known
+// estimates, or DEFAULT_TEST_ESTIMATE if there is no history at all, in which
+// case tests are effectively prioritized by the length of their dependency
+// chains.
+
+// Estimated wall time (seconds) for tests without history.
+const DEFAULT_TEST_ESTIMATE TimeFixedPoint = 10.0
+
+func (t *Test) estimate() TimeFixedPoint {
+	if t.EstimatedTime > 0 {
+		return t.EstimatedTime
+	}
+	return DEFAULT_TEST_ESTIMATE
+}
+
+// SetEstimatedTimes sets each test's EstimatedTime from the wall time of its
+// last run.
+func (tg *TestGroup) SetEstimatedTimes(lastRun LastRunResults) {
+	var total TimeFixedPoint
+	known := 0
+
+	for id, test := range tg.Tests {
+		if res, ok := lastRun[id]; ok && res.WallTime > 0 {
+			test.EstimatedTime = res.WallTime
+			total += res.WallTime
+			known += 1
+		}
+	}
+
+	average := DEFAULT_TEST_ESTIMATE
+	if known > 0 {
+		average = total / TimeFixedPoint(known)
+	}
+
+	for id, test := range tg.Tests {
+		if res, ok := lastRun[id]; !ok || res.WallTime <= 0 {
+			test.EstimatedTime = average
+		}
+	}
+}
+
+// TestEstimates keeps the most recent wall time of each test for the server,
+// which has no last run file. It's seeded from the usage stats that clients
+// upload, and updated as submissions finish.
+type TestEstimates struct {
+	l       sync.Mutex
+	lastRun LastRunResults
+}
+
+func NewTestEstimates() *TestEstimates {
+	return &TestEstimates{
+		lastRun: make(LastRunResults),
+	}
+}
+
+// LoadTestEstimates creates the estimates from the persisted usage stats.
+func LoadTestEstimates(persist PersistenceManager) (*TestEstimates, error) {
+	if persist == nil || !persist.CanRetrieve() {
+		return nil, errors.New("Unable to retrieve usage stats")
+	}
+
+	filter := map[string]interface{}{
+		"group_info.completion_time": 1,
+		"group_info.tests.id":        1,
+		"group_info.tests.walltime":  1,
+	}
+	stats := make([]*UsageStat, 0)
+	if err := persist.Retrieve(PERSIST_TYPE_USAGE, map[string]interface{}{}, filter, &stats); err != nil {
+		return nil, err
+	}
+
+	e := NewTestEstimates()
+	for _, stat := range stats {
+		e.AddUsage(stat)
+	}
+	return e, nil
+}
+
+// AddUsage records the wall times from a usage stat, unless we already have a
+// more recent time for the test.
+func (e *TestEstimates) AddUsage(stat *UsageStat) {
+	if stat.GroupInfo == nil {
+		return
+	}
+
+	e.l.Lock()
+	defer e.l.Unlock()
+
+	when := stat.GroupInfo.CompletionTime
+	for _, test := range stat.GroupInfo.Tests {
+		if len(test.DependencyID) == 0 || test.WallTime <= 0 {
+			continue
+		}
+		if prev, ok := e.lastRun[test.DependencyID]; ok && prev.Timestamp.After(when) {
+			continue
+		}
+		e.lastRun[test.DependencyID] = &LastRunResult{
+			Result:    test.Result,
+			WallTime:  test.WallTime,
+			Timestamp: when,
+		}
+	}
+}
+
+// Update records the wall times of the group's finished tests.
+func (e *TestEstimates) Update(tg *TestGroup) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	e.lastRun.Update(tg, time.Now())
+}
+
+// Apply sets the estimated times of the group's tests.
+func (e *TestEstimates) Apply(tg *TestGroup) {
+	e.l.Lock()
+	defer e.l.Unlock()
+	tg.SetEstimatedTimes(e.lastRun)
+}
+
+// Get the dependency graph, making sure it can be scheduled.
+func (tg *TestGroup) scheduleGraph() (*graph.Graph, error) {
+	g, err := tg.DependencyGraph()
+	if err != nil {
+		return nil, err
+	} else if cycles := g.FindCycles(); len(cycles) > 0 {
+		return nil, &graph.CycleError{Cycles: cycles}
+	}
+	return g, nil
+}
+
+func criticalPaths(tg *TestGroup, g *graph.Graph) map[string]TimeFixedPoint {
+	paths := make(map[string]TimeFixedPoint)
+
+	var pathFrom func(n *graph.Node) TimeFixedPoint
+	pathFrom = func(n *graph.Node) TimeFixedPoint {
+		if p, ok := paths[n.Name]; ok {
+			return p
+		}
+
+		// Edges into a node come from the tests that depend on it
+		var longest TimeFixedPoint
+		for _, dependent := range n.EdgesIn {
+			if p := pathFrom(dependent); p > longest {
+				longest = p
+			}
+		}
+
+		paths[n.Name] = tg.Tests[n.Name].estimate() + longest
+		return paths[n.Name]
+	}
+
+	for _, node := range g.NodeMap {
+		pathFrom(node)
+	}
+
+	return paths
+}
+
+// CriticalPaths returns, for each test in the group, the estimated time from
+// when the test starts until every test that depends on it can finish.
+func (tg *TestGroup) CriticalPaths() (map[string]TimeFixedPoint, error) {
+	g, err := tg.scheduleGraph()
+	if err != nil {
+		return nil, err
+	}
+	return criticalPaths(tg, g), nil
+}
+
+// A test scheduled by EstimateMakespan
+type scheduledTest struct {
+	id     string
+	finish TimeFixedPoint
+}
+
+// EstimateMakespan estimates how long the group takes to run with a given
+// test manager capacity (0 is unlimited) using critical-path scheduling. The
+// estimate assumes every test passes, so no dependents are skipped.
+func (tg *TestGroup) EstimateMakespan(capacity uint) (TimeFixedPoint, error) {
+	g, err := tg.scheduleGraph()
+	if err != nil {
+		return 0, err
+	}
+
+	paths := criticalPaths(tg, g)
+
+	if capacity == 0 {
+		capacity = uint(len(tg.Tests))
+	}
+
+	// Number of unfinished dependencies for each test
+	waitingOn := make(map[string]int)
+	ready := make([]string, 0)
+
+	for id, node := range g.NodeMap {
+		waitingOn[id] = len(node.EdgesOut)
+		if waitingOn[id] == 0 {
+			ready = append(ready, id)
+		}
+	}
+
+	var now TimeFixedPoint
+	running := make([]*scheduledTest, 0)
+
+	for len(ready) > 0 || len(running) > 0 {
+		// Start as many of the ready tests as we can, longest path first
+		sort.Sort(idsByPath{ready, paths})
+		for uint(len(running)) < capacity && len(ready) > 0 {
+			id := ready[0]
+			ready = ready[1:]
+			running = append(running, &scheduledTest{id, now + tg.Tests[id].estimate()})
+		}
+
+		// Advance to the next test to finish
+		next := 0
+		for i, st := range running {
+			if st.finish < running[next].finish {
+				next = i
+			}
+		}
+		done := running[next]
+		running = append(running[:next], running[next+1:]...)
+		now = done.finish
+
+		for id := range g.NodeMap[done.id].EdgesIn {
+			waitingOn[id] -= 1
+			if waitingOn[id] == 0 {
+				ready = append(ready, id)
+			}
+		}
+	}
+
+	return now, nil
+}
+
+// Sort test IDs by critical path, longest first. Ties are broken by ID so the
+// schedule is deterministic.
+type idsByPath struct {
+	ids   []string
+	paths map[string]TimeFixedPoint
+}
+
+func (s idsByPath) Len() int      { return len(s.ids) }
+func (s idsByPath) Swap(i, j int) { s.ids[i], s.ids[j] = s.ids[j], s.ids[i] }
+func (s idsByPath) Less(i, j int) bool {
+	pi, pj := s.paths[s.ids[i]], s.paths[s.ids[j]]
+	if pi != pj {
+		return pi > pj
+	}
+	return s.ids[i] < s.ids[j]
+}
@@ -0,0 +1,211 @@
+package test161
+
+import (
+	"container/heap"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func scheduleTestGroup(t *testing.T) *TestGroup {
+	config := &GroupConfig{
+		Name:    "Test",
+		UseDeps: true,
+		Tests:   []string{"sync/cvt1.t"},
+		Env:     defaultEnv,
+	}
+
+	tg, errs := GroupFromConfig(config)
+	assert.Equal(t, 0, len(errs))
+	if tg == nil {
+		t.FailNow()
+	}
+	return tg
+}
+
+func TestScheduleCriticalPaths(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// Without history, every test gets the default estimate
+	tg := scheduleTestGroup(t)
+	paths, err := tg.CriticalPaths()
+	assert.Nil(err)
+
+	expected := map[string]TimeFixedPoint{
+		"boot.t":        4 * DEFAULT_TEST_ESTIMATE,
+		"threads/tt1.t": 3 * DEFAULT_TEST_ESTIMATE,
+		"threads/tt2.t": 3 * DEFAULT_TEST_ESTIMATE,
+		"threads/tt3.t": 3 * DEFAULT_TEST_ESTIMATE,
+		"sync/lt1.t":    2 * DEFAULT_TEST_ESTIMATE,
+		"sync/lt2.t":    2 * DEFAULT_TEST_ESTIMATE,
+		"sync/lt3.t":    2 * DEFAULT_TEST_ESTIMATE,
+		"sync/cvt1.t":   DEFAULT_TEST_ESTIMATE,
+	}
+	assert.Equal(expected, paths)
+
+	// Makespan for different capacities
+	makespans := map[uint]TimeFixedPoint{
+		0: 4 * DEFAULT_TEST_ESTIMATE,
+		1: 8 * DEFAULT_TEST_ESTIMATE,
+		2: 6 * DEFAULT_TEST_ESTIMATE,
+		3: 4 * DEFAULT_TEST_ESTIMATE,
+	}
+	for capacity, expected := range makespans {
+		makespan, err := tg.EstimateMakespan(capacity)
+		assert.Nil(err)
+		assert.Equal(expected, makespan, "capacity: %v", capacity)
+	}
+}
+
+func TestScheduleEstimatedTimes(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tg := scheduleTestGroup(t)
+
+	lastRun := LastRunResults{
+		"boot.t":        &LastRunResult{Result: TEST_RESULT_CORRECT, WallTime: 2.0},
+		"threads/tt1.t": &LastRunResult{Result: TEST_RESULT_CORRECT, WallTime: 4.0},
+		"threads/tt2.t": &LastRunResult{Result: TEST_RESULT_SKIP},
+	}
+	tg.SetEstimatedTimes(lastRun)
+
+	// Tests without a time get the average
+	assert.Equal(TimeFixedPoint(2.0), tg.Tests["boot.t"].EstimatedTime)
+	assert.Equal(TimeFixedPoint(4.0), tg.Tests["threads/tt1.t"].EstimatedTime)
+	assert.Equal(TimeFixedPoint(3.0), tg.Tests["threads/tt2.t"].EstimatedTime)
+	assert.Equal(TimeFixedPoint(3.0), tg.Tests["sync/cvt1.t"].EstimatedTime)
+
+	paths, err := tg.CriticalPaths()
+	assert.Nil(err)
+	assert.Equal(TimeFixedPoint(12.0), paths["boot.t"])
+	assert.Equal(TimeFixedPoint(10.0), paths["threads/tt1.t"])
+	assert.Equal(TimeFixedPoint(9.0), paths["threads/tt2.t"])
+
+	makespan, err := tg.EstimateMakespan(0)
+	assert.Nil(err)
+	assert.Equal(TimeFixedPoint(12.0), makespan)
+}
+
+func TestScheduleJobQueue(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	q := &jobQueue{}
+	priorities := []float64{1.0, 5.0, 1.0, 3.0, 5.0}
+	for i, p := range priorities {
+		heap.Push(q, &test161Job{CriticalPath: p, seq: uint64(i)})
+	}
+
+	// Longest critical path first, FIFO for ties
+	expected := []uint64{1, 4, 3, 0, 2}
+	for _, seq := range expected {
+		job := heap.Pop(q).(*test161Job)
+		assert.Equal(seq, job.seq)
+	}
+	assert.Equal(0, q.Len())
+}
+
+func TestScheduleJobGroups(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// An older submission's tail tests run before a newer submission's long
+	// chains
+	q := &jobQueue{}
+	jobs := []*test161Job{
+		&test161Job{Group: 2, CriticalPath: 100.0},
+		&test161Job{Group: 1, CriticalPath: 1.0},
+		&test161Job{Group: 2, CriticalPath: 200.0},
+		&test161Job{Group: 1, CriticalPath: 5.0},
+	}
+	for i, job := range jobs {
+		job.seq = uint64(i)
+		heap.Push(q, job)
+	}
+
+	expected := []uint64{3, 1, 2, 0}
+	for _, seq := range expected {
+		job := heap.Pop(q).(*test161Job)
+		assert.Equal(seq, job.seq)
+	}
+
+	assert.True(nextGroupSeq() < nextGroupSeq())
+}
+
+func TestScheduleJobPriority(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	q := &jobQueue{}
+	jobs := []*test161Job{
+		&test161Job{Priority: JOB_PRIORITY_SUBMISSION, CriticalPath: 50.0},
+		&test161Job{Priority: JOB_PRIORITY_SUBMISSION, CriticalPath: 10.0},
+		&test161Job{Priority: JOB_PRIORITY_STAFF, CriticalPath: 1.0},
+		&test161Job{Priority: JOB_PRIORITY_SUBMISSION, CriticalPath: 20.0},
+		&test161Job{Priority: JOB_PRIORITY_STAFF, CriticalPath: 5.0},
+	}
+	for i, job := range jobs {
+		job.seq = uint64(i)
+		heap.Push(q, job)
+	}
+
+	// Priority class first, then critical path
+	expected := []uint64{4, 2, 0, 3, 1}
+	for _, seq := range expected {
+		job := heap.Pop(q).(*test161Job)
+		assert.Equal(seq, job.seq)
+	}
+
+	assert.Equal("staff", jobPriorityName(JOB_PRIORITY_STAFF))
+	assert.Equal("submission", jobPriorityName(JOB_PRIORITY_SUBMISSION))
+	assert.Equal("-1", jobPriorityName(-1))
+
+	// Stats copies don't share the per-priority counts
+	stats := &ManagerStats{QueuedByPriority: map[string]uint{"staff": 1}}
+	copied := stats.copy()
+	copied.QueuedByPriority["staff"] += 1
+	assert.Equal(uint(1), stats.QueuedByPriority["staff"])
+}
+
+func TestScheduleServerEstimates(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	now := time.Now()
+	usage := func(when time.Time, id string, wallTime TimeFixedPoint) *UsageStat {
+		return &UsageStat{GroupInfo: &GroupStat{
+			CompletionTime: when,
+			Tests: []*TestStat{
+				&TestStat{DependencyID: id, Result: TEST_RESULT_CORRECT, WallTime: wallTime},
+			},
+		}}
+	}
+
+	e := NewTestEstimates()
+	e.AddUsage(usage(now, "boot.t", 2.0))
+	e.AddUsage(usage(now.Add(-time.Hour), "boot.t", 8.0))
+	e.AddUsage(usage(now, "threads/tt1.t", 4.0))
+	e.AddUsage(usage(now, "threads/tt2.t", 0))
+	e.AddUsage(&UsageStat{})
+
+	tg := scheduleTestGroup(t)
+	e.Apply(tg)
+	assert.Equal(TimeFixedPoint(2.0), tg.Tests["boot.t"].EstimatedTime)
+	assert.Equal(TimeFixedPoint(4.0), tg.Tests["threads/tt1.t"].EstimatedTime)
+	assert.Equal(TimeFixedPoint(3.0), tg.Tests["threads/tt2.t"].EstimatedTime)
+
+	// Finished tests update the estimates
+	tg.Tests["threads/tt2.t"].Result = TEST_RESULT_CORRECT
+	tg.Tests["threads/tt2.t"].WallTime = 6.0
+	e.Update(tg)
+
+	other := scheduleTestGroup(t)
+	e.Apply(other)
+	assert.Equal(TimeFixedPoint(6.0), other.Tests["threads/tt2.t"].EstimatedTime)
+	assert.Equal(TimeFixedPoint(4.0), other.Tests["sync/cvt1.t"].EstimatedTime)
+
+	_, err := LoadTestEstimates(&DoNothingPersistence{})
+	assert.NotNil(err)
+}
@@ -0,0 +1,309 @@
+package test161
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// This file handles the audit trail for secure output. The per-command keys
+// only live as long as the submission, so we keep enough around to check a
+// submission's trusted output later (e.g. for an academic integrity review):
+//
+//   - The build test stores a salted digest of each key. The digest doesn't
+//     reveal the key, but it lets us tell if a key we're given is the right one.
+//   - Each test stores the salts it saw, and each secure output line keeps
+//     its salt and MAC.
+//   - If the environment has a SecureKeyDir, the keys themselves are saved
+//     there, one file per submission. This should not be anywhere the
+//     database or the students can get to.
+//
+// AuditSecureOutput uses all of this to re-check OutputLine.Trusted.
+
+// KeyDigest is a salted digest of a secure output key.
+type KeyDigest struct {
+	ID     string `json:"id" bson:"id"`
+	Salt   string `json:"salt" bson:"salt"`
+	Digest string `json:"digest" bson:"digest"` // sha256(salt + key)
+}
+
+const KEY_DIGEST_SALT_BYTES = 16
+
+func keyDigest(salt, key string) string {
+	hashbytes := sha256.Sum256([]byte(salt + key))
+	return strings.ToLower(hex.EncodeToString(hashbytes[:]))
+}
+
+func newKeyDigest(id, key string) (*KeyDigest, error) {
+	salt, err := newKey(KEY_DIGEST_SALT_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyDigest{
+		ID:     id,
+		Salt:   salt,
+		Digest: keyDigest(salt, key),
+	}, nil
+}
+
+// Matches returns true if key is the key the digest was created from.
+func (d *KeyDigest) Matches(key string) bool {
+	return hmac.Equal([]byte(d.Digest), []byte(keyDigest(d.Salt, key)))
+}
+
+type keyDigestsByID []*KeyDigest
+
+func (a keyDigestsByID) Len() int           { return len(a) }
+func (a keyDigestsByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a keyDigestsByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// The MAC secprintf computes for a message.
+func secureMAC(key, salt, msg string) string {
+	mac := hmac.New(sha256.New, []byte(key+salt))
+	mac.Write([]byte(msg))
+	return strings.ToLower(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Record the digests of the build's keys, and save the keys if we have
+// somewhere to put them. Errors are logged since the build itself is fine.
+func (t *BuildTest) saveKeys() {
+	t.KeyDigests = make([]*KeyDigest, 0, len(t.env.keyMap))
+	for id, key := range t.env.keyMap {
+		if d, err := newKeyDigest(id, key); err != nil {
+			t.env.Log.Println("Error creating key digest:", err)
+			return
+		} else {
+			t.KeyDigests = append(t.KeyDigests, d)
+		}
+	}
+	sort.Sort(keyDigestsByID(t.KeyDigests))
+
+	if len(t.env.SecureKeyDir) > 0 && len(t.SubmissionID) > 0 && len(t.env.keyMap) > 0 {
+		if err := SaveSecureKeys(t.env.SecureKeyDir, t.SubmissionID, t.env.keyMap); err != nil {
+			t.env.Log.Println("Error saving secure keys:", err)
+		}
+	}
+}
+
+func secureKeyFile(dir, submissionID string) string {
+	return path.Join(dir, submissionID+".json")
+}
+
+// SaveSecureKeys saves a submission's keys in dir.
+func SaveSecureKeys(dir, submissionID string, keys map[string]string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(secureKeyFile(dir, submissionID), data, 0600)
+}
+
+// LoadSecureKeys loads the keys for a submission that were saved in dir.
+func LoadSecureKeys(dir, submissionID string) (map[string]string, error) {
+	return SecureKeysFromFile(secureKeyFile(dir, submissionID))
+}
+
+// SecureKeysFromFile loads keys from a JSON file of id: key.
+func SecureKeysFromFile(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]string)
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("Error loading key file %v: %v", file, err)
+	}
+	return keys, nil
+}
+
+// Key audit status
+const (
+	KEY_AUDIT_OK        = "ok"        // The key matches its digest
+	KEY_AUDIT_MISSING   = "missing"   // We don't have the key
+	KEY_AUDIT_MISMATCH  = "mismatch"  // The key doesn't match its digest
+	KEY_AUDIT_UNCHECKED = "unchecked" // There's no digest, so we trust the key we were given
+)
+
+type KeyAudit struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// An AuditProblem is a trusted output line that doesn't check out.
+type AuditProblem struct {
+	TestName string `json:"test"`
+	Command  string `json:"command"`
+	Line     string `json:"line"`
+	Problem  string `json:"problem"`
+}
+
+// SecureAudit is the result of re-checking a submission's trusted output.
+type SecureAudit struct {
+	Keys         []*KeyAudit     `json:"keys"`
+	Verified     int             `json:"verified"`     // Trusted lines that check out
+	Unverifiable int             `json:"unverifiable"` // Trusted lines we can't check
+	Problems     []*AuditProblem `json:"problems"`
+}
+
+// OK returns true if nothing we checked failed.
+func (a *SecureAudit) OK() bool {
+	return len(a.Problems) == 0
+}
+
+// Figure out which keys we can use. If the build has digests, only keys that
+// match them are used.
+func (a *SecureAudit) checkKeys(build *BuildTest, keys map[string]string) map[string]string {
+	good := make(map[string]string)
+
+	if build == nil || len(build.KeyDigests) == 0 {
+		ids := make([]string, 0, len(keys))
+		for id := range keys {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			a.Keys = append(a.Keys, &KeyAudit{id, KEY_AUDIT_UNCHECKED})
+			good[id] = keys[id]
+		}
+		return good
+	}
+
+	for _, d := range build.KeyDigests {
+		status := KEY_AUDIT_MISSING
+		if key, ok := keys[d.ID]; ok {
+			if d.Matches(key) {
+				status = KEY_AUDIT_OK
+				good[d.ID] = key
+			} else {
+				status = KEY_AUDIT_MISMATCH
+				a.Problems = append(a.Problems, &AuditProblem{
+					Command: d.ID,
+					Problem: "Key does not match the stored digest",
+				})
+			}
+		}
+		a.Keys = append(a.Keys, &KeyAudit{d.ID, status})
+	}
+	return good
+}
+
+// AuditSecureOutput re-checks the trusted output of a submission's tests using
+// its keys. The build may be nil if it wasn't saved, in which case the keys
+// can't be checked against their digests.
+func AuditSecureOutput(build *BuildTest, tests []*Test, keys map[string]string) *SecureAudit {
+	audit := &SecureAudit{
+		Keys:     make([]*KeyAudit, 0),
+		Problems: make([]*AuditProblem, 0),
+	}
+
+	good := audit.checkKeys(build, keys)
+
+	for _, test := range tests {
+		// Tests that predate the audit trail don't have salts
+		recorded := make(map[string]bool)
+		for _, salt := range test.Salts {
+			recorded[salt] = true
+		}
+		seen := make(map[string]bool)
+
+		for _, cmd := range test.Commands {
+			for _, line := range cmd.Output {
+				if !line.Trusted {
+					continue
+				}
+
+				problem := func(msg string) {
+					audit.Problems = append(audit.Problems, &AuditProblem{
+						TestName: test.Name,
+						Command:  cmd.Input.Line,
+						Line:     line.Line,
+						Problem:  msg,
+					})
+				}
+
+				if len(line.MAC) == 0 || len(line.Salt) == 0 {
+					audit.Unverifiable += 1
+					continue
+				}
+
+				if seen[line.Salt] {
+					problem("Salt was reused")
+					continue
+				}
+				seen[line.Salt] = true
+
+				if test.Salts != nil && !recorded[line.Salt] {
+					problem("Salt was not recorded by the test")
+					continue
+				}
+
+				text, err := line.signedText()
+				if err != nil {
+					problem(err.Error())
+					continue
+				}
+
+				key, ok := good[line.KeyName]
+				if !ok {
+					audit.Unverifiable += 1
+					continue
+				}
+
+				if hmac.Equal([]byte(line.MAC), []byte(secureMAC(key, line.Salt, text))) {
+					audit.Verified += 1
+				} else {
+					problem("MAC does not match")
+				}
+			}
+		}
+	}
+
+	return audit
+}
+
+// Retrieve a submission's build and tests and audit them.
+func AuditSubmission(persist PersistenceManager, submissionID string, keys map[string]string) (*SecureAudit, error) {
+	if persist == nil || !persist.CanRetrieve() {
+		return nil, errors.New("Unable to retrieve submissions")
+	}
+
+	builds := make([]*BuildTest, 0)
+	who := map[string]interface{}{
+		"submission_id": submissionID,
+		"name":          "build",
+	}
+	if err := persist.Retrieve(PERSIST_TYPE_TESTS, who, nil, &builds); err != nil {
+		return nil, err
+	}
+
+	tests := make([]*Test, 0)
+	who = map[string]interface{}{
+		"submission_id": submissionID,
+		"name":          map[string]interface{}{"$ne": "build"},
+	}
+	if err := persist.Retrieve(PERSIST_TYPE_TESTS, who, nil, &tests); err != nil {
+		return nil, err
+	}
+
+	if len(builds) == 0 && len(tests) == 0 {
+		return nil, fmt.Errorf("Cannot find submission %v", submissionID)
+	}
+
+	var build *BuildTest
+	if len(builds) > 0 {
+		build = builds[0]
+	}
+
+	return AuditSecureOutput(build, tests, keys), nil
+}
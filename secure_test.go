@@ -0,0 +1,134 @@
+package test161
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func secureTestLine(t *Test, text string) *OutputLine {
+	t.currentOutput = &OutputLine{Line: text + "\r\n"}
+	t.outputLineComplete()
+	return t.currentOutput
+}
+
+func TestKeyDigest(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	key, err := newKey(KEYBYTES)
+	assert.Nil(err)
+
+	d, err := newKeyDigest("sy1", key)
+	if !assert.Nil(err) {
+		t.FailNow()
+	}
+	assert.Equal("sy1", d.ID)
+	assert.True(d.Matches(key))
+	assert.False(d.Matches(key + "0"))
+	assert.False(d.Matches(""))
+
+	// Same key, different salt
+	d2, err := newKeyDigest("sy1", key)
+	assert.Nil(err)
+	assert.NotEqual(d.Digest, d2.Digest)
+	assert.True(d2.Matches(key))
+}
+
+func TestSecureKeyArchive(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test161-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := map[string]string{"sy1": "1234", "sy2": "5678"}
+	assert.Nil(SaveSecureKeys(dir+"/keys", "abc", keys))
+
+	loaded, err := LoadSecureKeys(dir+"/keys", "abc")
+	assert.Nil(err)
+	assert.Equal(keys, loaded)
+
+	_, err = LoadSecureKeys(dir+"/keys", "def")
+	assert.NotNil(err)
+}
+
+func TestAuditSecureOutput(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	env := defaultEnv.CopyEnvironment()
+	key, _ := newKey(KEYBYTES)
+	env.keyMap["sy1"] = key
+
+	test := &Test{
+		Name:  "sync/sy1.t",
+		env:   env,
+		salts: make(map[string]bool),
+		Salts: make([]string, 0),
+	}
+	cmd := &Command{Input: InputLine{Line: "sy1"}}
+	test.Commands = []*Command{cmd}
+
+	for i, salt := range []string{"0a1b", "0a1c", "0a1b"} {
+		msg := fmt.Sprintf("Test message %v", i)
+		line := secureTestLine(test, fmt.Sprintf("(sy1, %v, %v, %v)", secureMAC(key, salt, msg), salt, msg))
+		cmd.Output = append(cmd.Output, line)
+	}
+	cmd.Output = append(cmd.Output, secureTestLine(test, "Not secure"))
+
+	// The reused salt isn't trusted
+	assert.True(cmd.Output[0].Trusted)
+	assert.True(cmd.Output[1].Trusted)
+	assert.False(cmd.Output[2].Trusted)
+	assert.Equal("Test message 0", cmd.Output[0].Line)
+	assert.Equal("0a1b", cmd.Output[0].Salt)
+	assert.Equal([]string{"0a1b", "0a1c"}, test.Salts)
+
+	build := &BuildTest{env: env}
+	build.saveKeys()
+	assert.Equal(1, len(build.KeyDigests))
+
+	audit := AuditSecureOutput(build, []*Test{test}, map[string]string{"sy1": key})
+	assert.True(audit.OK())
+	assert.Equal(2, audit.Verified)
+	assert.Equal(0, audit.Unverifiable)
+	assert.Equal([]*KeyAudit{&KeyAudit{"sy1", KEY_AUDIT_OK}}, audit.Keys)
+
+	// Without the key, we can't say either way
+	audit = AuditSecureOutput(build, []*Test{test}, nil)
+	assert.True(audit.OK())
+	assert.Equal(0, audit.Verified)
+	assert.Equal(2, audit.Unverifiable)
+	assert.Equal(KEY_AUDIT_MISSING, audit.Keys[0].Status)
+
+	// The wrong key
+	audit = AuditSecureOutput(build, []*Test{test}, map[string]string{"sy1": "1234"})
+	assert.False(audit.OK())
+	assert.Equal(KEY_AUDIT_MISMATCH, audit.Keys[0].Status)
+	assert.Equal(2, audit.Unverifiable)
+
+	// Someone changed a trusted line
+	cmd.Output[1].Line = "Test message 2"
+	audit = AuditSecureOutput(build, []*Test{test}, map[string]string{"sy1": key})
+	assert.Equal(1, audit.Verified)
+	if assert.Equal(1, len(audit.Problems)) {
+		assert.Equal("MAC does not match", audit.Problems[0].Problem)
+		assert.Equal("sy1", audit.Problems[0].Command)
+	}
+
+	// Or marked an untrusted line as trusted
+	cmd.Output[1].Line = "Test message 1"
+	cmd.Output[2].Trusted = true
+	cmd.Output[2].KeyName = "sy1"
+	audit = AuditSecureOutput(build, []*Test{test}, map[string]string{"sy1": key})
+	assert.Equal(2, audit.Verified)
+	if assert.Equal(1, len(audit.Problems)) {
+		assert.Equal("Salt was reused", audit.Problems[0].Problem)
+	}
+}
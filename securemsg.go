@@ -0,0 +1,198 @@
+package test161
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// This file defines the structured secure output protocol. The original
+// protocol (secprintf) signs a plain string, so results have to be encoded in
+// magic strings like "PARTIAL CREDIT 3 OF 5". Structured lines instead carry a
+// versioned, typed message:
+//
+//	@test161/<version> <id> <mac> <salt> <payload>
+//
+// The payload is a JSON object, and the MAC is computed over
+// "<version> <payload>" exactly like secprintf computes it over its message,
+// so the version can't be changed without the key. libtest161 emits these
+// with the t161_* functions, whose SECRET argument is replaced during key
+// injection like secprintf's, e.g.
+//
+//	t161_success(SECRET, "sy1");
+//	t161_partial(SECRET, "sy3", "phase 1", 3, 5);
+//	t161_measure(SECRET, "vm1", "pages swapped", 1234, "pages");
+//	t161_checkpoint(SECRET, "sy2", "locks created");
+//
+// Without a key (i.e. outside of the overlay), libtest161 prints "-" for the
+// MAC and salt. These lines are parsed but never trusted.
+//
+// The parsed message is exposed as OutputLine.Message, and OutputLine.Line is
+// set to a plain text version of it, so expected output and partial credit
+// work the same way they do for secprintf.
+
+// The newest version of the protocol we understand
+const SECURE_PROTOCOL_VERSION = 1
+
+// Secure message types
+const (
+	SECURE_MSG_TEXT       = "text"       // Text: a message, like secprintf
+	SECURE_MSG_SUCCESS    = "success"    // The command succeeded
+	SECURE_MSG_FAILURE    = "failure"    // The command failed; Text says why
+	SECURE_MSG_PARTIAL    = "partial"    // Partial credit: Earned of Avail, for an optional sub-check Name
+	SECURE_MSG_MEASURE    = "measure"    // A measured Value (in Units) called Name
+	SECURE_MSG_CHECKPOINT = "checkpoint" // The test reached checkpoint Name
+)
+
+// A SecureMessage is the payload of a structured secure output line.
+type SecureMessage struct {
+	Version int     `json:"version" bson:"version"` // From the line, not the payload
+	Type    string  `json:"type" bson:"type"`
+	Name    string  `json:"name,omitempty" bson:"name,omitempty"`
+	Text    string  `json:"text,omitempty" bson:"text,omitempty"`
+	Earned  uint    `json:"earned" bson:"earned"`
+	Avail   uint    `json:"avail" bson:"avail"`
+	Value   float64 `json:"value" bson:"value"`
+	Units   string  `json:"units,omitempty" bson:"units,omitempty"`
+}
+
+// The meaning is (version, id, hash, salt, payload).
+var secureMsgExp *regexp.Regexp = regexp.MustCompile(`^@test161/([0-9]+) (\S+) ([0-9a-f]+|-) ([0-9a-f]+|-) (\{.*\})$`)
+
+// Parse and validate a structured message payload.
+func parseSecureMessage(version int, payload string) (*SecureMessage, error) {
+	if version < 1 || version > SECURE_PROTOCOL_VERSION {
+		return nil, fmt.Errorf("Unsupported secure output version: %v", version)
+	}
+
+	msg := &SecureMessage{}
+	if err := json.Unmarshal([]byte(payload), msg); err != nil {
+		return nil, err
+	}
+	msg.Version = version
+
+	switch msg.Type {
+	case SECURE_MSG_TEXT, SECURE_MSG_SUCCESS, SECURE_MSG_FAILURE:
+	case SECURE_MSG_PARTIAL:
+		if msg.Avail == 0 || msg.Earned > msg.Avail {
+			return nil, fmt.Errorf("Invalid partial credit: %v of %v", msg.Earned, msg.Avail)
+		}
+	case SECURE_MSG_MEASURE, SECURE_MSG_CHECKPOINT:
+		if len(msg.Name) == 0 {
+			return nil, fmt.Errorf("Secure %v messages need a name", msg.Type)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid secure message type: %v", msg.Type)
+	}
+
+	return msg, nil
+}
+
+// The plain text version of the message, which is what we match against
+// expected output.
+func (msg *SecureMessage) render(id string) string {
+	switch msg.Type {
+	case SECURE_MSG_SUCCESS:
+		return id + ": SUCCESS"
+	case SECURE_MSG_FAILURE:
+		if len(msg.Text) > 0 {
+			return fmt.Sprintf("%v: FAIL (%v)", id, msg.Text)
+		}
+		return id + ": FAIL"
+	case SECURE_MSG_PARTIAL:
+		res := fmt.Sprintf("PARTIAL CREDIT %v OF %v", msg.Earned, msg.Avail)
+		if len(msg.Name) > 0 {
+			res = msg.Name + ": " + res
+		}
+		return res
+	case SECURE_MSG_MEASURE:
+		res := fmt.Sprintf("%v: %v", msg.Name, strconv.FormatFloat(msg.Value, 'g', -1, 64))
+		if len(msg.Units) > 0 {
+			res += " " + msg.Units
+		}
+		return res
+	case SECURE_MSG_CHECKPOINT:
+		return fmt.Sprintf("%v: CHECKPOINT %v", id, msg.Name)
+	default:
+		return msg.Text
+	}
+}
+
+// Check the salt and MAC of a secure output line, and return true if we
+// trust it.
+func (t *Test) checkSecureLine(line *OutputLine, id, hash, salt, text string) bool {
+	line.Salt = salt
+	line.MAC = hash
+
+	// Check if we've already seen that salt during this test. If so, it's suspicious.
+	if ok, _ := t.salts[salt]; ok {
+		t.env.Log.Printf("Test ID %v  Salt value failed uniqueness requirement\n", t.ID)
+		return false
+	}
+
+	t.salts[salt] = true
+	t.Salts = append(t.Salts, salt)
+
+	return secureMAC(t.env.keyMap[id], salt, text) == hash
+}
+
+// The text a structured line's MAC is computed over
+func secureSignedPayload(version int, payload string) string {
+	return strconv.Itoa(version) + " " + payload
+}
+
+// Handle a structured secure output line. res is the secureMsgExp match.
+func (t *Test) structuredLineComplete(line *OutputLine, res []string) {
+	version, _ := strconv.Atoi(res[1])
+	id := res[2]
+	hash := res[3]
+	salt := res[4]
+	payload := res[5]
+
+	msg, err := parseSecureMessage(version, payload)
+	if err != nil {
+		t.env.Log.Printf("Test ID %v  Invalid secure output: %v\n", t.ID, err)
+		return
+	}
+
+	line.Message = msg
+	line.Payload = payload
+	line.Line = msg.render(id)
+
+	if hash != "-" && salt != "-" && t.checkSecureLine(line, id, hash, salt, secureSignedPayload(version, payload)) {
+		line.Trusted = true
+		line.KeyName = id
+	}
+}
+
+// The text a secure output line's MAC was computed over, and an error if the
+// line's contents don't agree with it.
+func (line *OutputLine) signedText() (string, error) {
+	if len(line.Payload) == 0 {
+		return line.Line, nil
+	}
+
+	var version int
+	if line.Message != nil {
+		version = line.Message.Version
+	}
+	msg, err := parseSecureMessage(version, line.Payload)
+	if err != nil {
+		return "", err
+	}
+
+	if msg.render(line.KeyName) != line.Line {
+		return "", errors.New("Line does not match the signed message")
+	}
+	if line.Message == nil || *line.Message != *msg {
+		return "", errors.New("Message does not match the signed message")
+	}
+	return secureSignedPayload(version, line.Payload), nil
+}
+
+// Returns true if the line is a secure message of type msgType.
+func (line *OutputLine) isSecureMessage(msgType string) bool {
+	return line.Message != nil && line.Message.Type == msgType
+}
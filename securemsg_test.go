@@ -0,0 +1,165 @@
+package test161
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func structuredTestLine(key, id, salt, payload string) string {
+	mac := "-"
+	if len(key) > 0 {
+		mac = secureMAC(key, salt, secureSignedPayload(SECURE_PROTOCOL_VERSION, payload))
+	}
+	return fmt.Sprintf("@test161/%v %v %v %v %v", SECURE_PROTOCOL_VERSION, id, mac, salt, payload)
+}
+
+func TestSecureMessageParse(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tests := []struct {
+		payload  string
+		expected string
+	}{
+		{`{"type": "success"}`, "sy1: SUCCESS"},
+		{`{"type": "failure", "text": "deadlock"}`, "sy1: FAIL (deadlock)"},
+		{`{"type": "partial", "earned": 3, "avail": 5}`, "PARTIAL CREDIT 3 OF 5"},
+		{`{"type": "partial", "name": "phase 2", "earned": 0, "avail": 5}`, "phase 2: PARTIAL CREDIT 0 OF 5"},
+		{`{"type": "measure", "name": "pages swapped", "value": 1234, "units": "pages"}`, "pages swapped: 1234 pages"},
+		{`{"type": "measure", "name": "ops/sec", "value": 12.5}`, "ops/sec: 12.5"},
+		{`{"type": "checkpoint", "name": "locks created"}`, "sy1: CHECKPOINT locks created"},
+		{`{"type": "text", "text": "Hello"}`, "Hello"},
+	}
+
+	for _, test := range tests {
+		msg, err := parseSecureMessage(1, test.payload)
+		if assert.Nil(err, test.payload) {
+			assert.Equal(1, msg.Version)
+			assert.Equal(test.expected, msg.render("sy1"))
+		}
+	}
+
+	bad := []string{
+		`{"type": "partial", "earned": 6, "avail": 5}`,
+		`{"type": "partial", "earned": 0, "avail": 0}`,
+		`{"type": "measure", "value": 1}`,
+		`{"type": "checkpoint"}`,
+		`{"type": "bogus"}`,
+		`{"type": "success"`,
+	}
+	for _, payload := range bad {
+		_, err := parseSecureMessage(1, payload)
+		assert.NotNil(err, payload)
+	}
+
+	_, err := parseSecureMessage(SECURE_PROTOCOL_VERSION+1, `{"type": "success"}`)
+	assert.NotNil(err)
+}
+
+func TestSecureMessageOutput(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	env := defaultEnv.CopyEnvironment()
+	key, _ := newKey(KEYBYTES)
+	env.keyMap["sy3"] = key
+
+	test := &Test{
+		env:   env,
+		salts: make(map[string]bool),
+		Salts: make([]string, 0),
+	}
+
+	// Signed
+	line := secureTestLine(test, structuredTestLine(key, "sy3", "0a01", `{"type": "partial", "name": "phase 1", "earned": 2, "avail": 4}`))
+	assert.True(line.Trusted)
+	assert.Equal("sy3", line.KeyName)
+	assert.Equal("phase 1: PARTIAL CREDIT 2 OF 4", line.Line)
+	if assert.NotNil(line.Message) {
+		assert.Equal(SECURE_MSG_PARTIAL, line.Message.Type)
+		assert.Equal(uint(2), line.Message.Earned)
+		assert.Equal(uint(4), line.Message.Avail)
+	}
+
+	// Wrong key
+	line = secureTestLine(test, structuredTestLine("1234", "sy3", "0a02", `{"type": "success"}`))
+	assert.False(line.Trusted)
+	assert.Equal("sy3: SUCCESS", line.Line)
+
+	// The MAC covers the version, not just the payload
+	payload := `{"type": "success"}`
+	text := fmt.Sprintf("@test161/%v sy3 %v 0a03 %v", SECURE_PROTOCOL_VERSION, secureMAC(key, "0a03", payload), payload)
+	line = secureTestLine(test, text)
+	assert.False(line.Trusted)
+
+	// Unsigned, from outside the overlay
+	line = secureTestLine(test, structuredTestLine("", "sy3", "-", `{"type": "success"}`))
+	assert.False(line.Trusted)
+	assert.NotNil(line.Message)
+	assert.Equal("sy3: SUCCESS", line.Line)
+
+	// Unknown version, left alone
+	text = fmt.Sprintf("@test161/%v sy3 - - {\"type\": \"success\"}", SECURE_PROTOCOL_VERSION+1)
+	line = secureTestLine(test, text)
+	assert.False(line.Trusted)
+	assert.Nil(line.Message)
+	assert.Equal(text, line.Line)
+
+	// Partial credit comes from the message
+	cmd := &Command{
+		Input:           InputLine{Line: "sy3"},
+		PointsAvailable: 10,
+		Panic:           CMD_OPT_NO,
+		TimesOut:        CMD_OPT_NO,
+		ExpectedOutput:  []*ExpectedOutputLine{&ExpectedOutputLine{Text: "sy3: SUCCESS", Trusted: true, KeyName: "sy3"}},
+	}
+	cmd.Output = []*OutputLine{
+		secureTestLine(test, structuredTestLine("1234", "sy3", "0a03", `{"type": "partial", "earned": 4, "avail": 4}`)),
+		secureTestLine(test, structuredTestLine(key, "sy3", "0a04", `{"type": "partial", "earned": 3, "avail": 4}`)),
+	}
+	cmd.evaluate(env.keyMap, false)
+	assert.Equal(COMMAND_STATUS_INCORRECT, cmd.Status)
+	assert.Equal(uint(7), cmd.PointsEarned)
+
+	cmd.Output = append(cmd.Output, secureTestLine(test, structuredTestLine(key, "sy3", "0a05", `{"type": "success"}`)))
+	cmd.evaluate(env.keyMap, false)
+	assert.Equal(COMMAND_STATUS_CORRECT, cmd.Status)
+	assert.Equal(uint(10), cmd.PointsEarned)
+
+	// The audit checks the signed payload
+	test.Commands = []*Command{cmd}
+	keys := map[string]string{"sy3": key}
+	audit := AuditSecureOutput(nil, []*Test{test}, keys)
+	assert.True(audit.OK())
+	assert.Equal(2, audit.Verified)
+
+	cmd.Output[1].Message.Earned = 4
+	cmd.Output[2].Line = "sy3: SUCCESS!"
+	audit = AuditSecureOutput(nil, []*Test{test}, keys)
+	assert.Equal(0, audit.Verified)
+	if assert.Equal(2, len(audit.Problems)) {
+		assert.Equal("Message does not match the signed message", audit.Problems[0].Problem)
+		assert.Equal("Line does not match the signed message", audit.Problems[1].Problem)
+	}
+}
+
+func TestSecureOverlayExp(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	lines := map[string]string{
+		`	t161_success(SECRET, "sy1");`:                                 "sy1",
+		`	t161_partial(SECRET, "sy3", "phase 1", passed, total);`:       "sy3",
+		`	t161_measure(SECRET, "vm1", "pages swapped", n, "pages");`:    "vm1",
+		`	t161_checkpoint(SECRET, "sy2", "locks created"); /* hello */`: "sy2",
+	}
+	for line, id := range lines {
+		res := t161Exp.FindStringSubmatch(line)
+		if assert.Equal(2, len(res), line) {
+			assert.Equal(id, res[1])
+		}
+	}
+
+	assert.Nil(t161Exp.FindStringSubmatch(`t161_success(key, "sy1");`))
+}
@@ -0,0 +1,183 @@
+package test161
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This file handles partial credit sub-checks. Without sub-checks, a command
+// gets partial credit from the first PARTIAL CREDIT line it prints. Commands
+// can instead declare named sub-checks (e.g. the phases of a stress test),
+// each of which is reported with its own partial credit line:
+//
+//	phase 1: PARTIAL CREDIT 3 OF 5
+//
+// or with a structured partial message with the sub-check's name (see
+// securemsg.go). The command's points are the weighted sum of its sub-checks'
+// partial credit. Sub-checks are declared in the command template (or a test's
+// command override), and targets can replace them to change the weights.
+
+// A SubCheck is a named, weighted part of a command's partial credit.
+type SubCheck struct {
+	Name   string `yaml:"name" json:"name" bson:"name"`
+	Weight uint   `yaml:"weight" json:"weight" bson:"weight"` // Relative to the other sub-checks (default 1)
+
+	// Set during evaluation
+	Earned   uint `yaml:"-" json:"earned" bson:"earned"`
+	Avail    uint `yaml:"-" json:"avail" bson:"avail"`
+	Reported bool `yaml:"-" json:"reported" bson:"reported"`
+}
+
+// Partial credit regular expression. We don't care that the id isn't prefixed,
+// as long as it is signed by the right key. Whatever is before PARTIAL CREDIT
+// is the sub-check name, if the command has sub-checks.
+var partialCreditExp *regexp.Regexp = regexp.MustCompile(`^(.*)PARTIAL CREDIT ([0-9]+) OF ([0-9]+)$`)
+
+// Check that the sub-checks have unique names.
+func checkSubChecks(checks []*SubCheck) error {
+	names := make(map[string]bool)
+	for _, s := range checks {
+		if len(s.Name) == 0 {
+			return errors.New("Sub-checks must have a name")
+		}
+		if names[s.Name] {
+			return fmt.Errorf("Duplicate sub-check: %v", s.Name)
+		}
+		names[s.Name] = true
+	}
+	return nil
+}
+
+// Copy the configuration of the sub-checks, without any results, and with the
+// default weights filled in.
+func copySubChecks(checks []*SubCheck) []*SubCheck {
+	if len(checks) == 0 {
+		return nil
+	}
+	res := make([]*SubCheck, 0, len(checks))
+	for _, s := range checks {
+		res = append(res, &SubCheck{
+			Name:   s.Name,
+			Weight: s.weight(),
+		})
+	}
+	return res
+}
+
+// Compare the configuration of the sub-checks of two tests' commands. Commands
+// are matched by id and index, like they are when the target is instanced.
+func subChecksChanged(old, other []*TargetCommand) bool {
+	configs := func(commands []*TargetCommand) map[string][]*SubCheck {
+		res := make(map[string][]*SubCheck)
+		for _, cmd := range commands {
+			if len(cmd.SubChecks) > 0 {
+				res[fmt.Sprintf("%v/%v", cmd.Id, cmd.Index)] = copySubChecks(cmd.SubChecks)
+			}
+		}
+		return res
+	}
+	return !reflect.DeepEqual(configs(old), configs(other))
+}
+
+func (s *SubCheck) weight() uint {
+	if s.Weight == 0 {
+		return 1
+	}
+	return s.Weight
+}
+
+// Correct returns true if the sub-check got all of its partial credit.
+func (s *SubCheck) Correct() bool {
+	return s.Reported && s.Earned == s.Avail
+}
+
+func (s *SubCheck) String() string {
+	if !s.Reported {
+		return "not reported"
+	}
+	return fmt.Sprintf("%v/%v", s.Earned, s.Avail)
+}
+
+// Get the partial credit a line reports, if any.
+func partialCredit(line *OutputLine) (name string, earned, avail uint, ok bool) {
+	if line.isSecureMessage(SECURE_MSG_PARTIAL) {
+		return line.Message.Name, line.Message.Earned, line.Message.Avail, true
+	}
+
+	res := partialCreditExp.FindStringSubmatch(line.Line)
+	if len(res) != 4 {
+		return
+	}
+
+	name = strings.TrimSuffix(strings.TrimSpace(res[1]), ":")
+	if e, err := strconv.ParseUint(res[2], 10, 32); err == nil {
+		earned = uint(e)
+	}
+	if a, err := strconv.ParseUint(res[3], 10, 32); err == nil {
+		avail = uint(a)
+	}
+	ok = true
+	return
+}
+
+func (c *Command) subCheck(name string) *SubCheck {
+	for _, s := range c.SubChecks {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Record the partial credit reported for each sub-check. Only the first
+// report for a sub-check counts, and reports for sub-checks we don't know
+// about are ignored.
+func (c *Command) recordSubChecks(trusted func(*OutputLine) bool) {
+	for _, s := range c.SubChecks {
+		s.Earned, s.Avail, s.Reported = 0, 0, false
+	}
+
+	for _, line := range c.Output {
+		if !trusted(line) {
+			continue
+		}
+		name, earned, avail, ok := partialCredit(line)
+		if !ok || avail == 0 || earned > avail {
+			continue
+		}
+		if s := c.subCheck(name); s != nil && !s.Reported {
+			s.Earned, s.Avail, s.Reported = earned, avail, true
+		}
+	}
+}
+
+// Award points for the weighted sum of the sub-checks.
+func (c *Command) evaluateSubChecks(trusted func(*OutputLine) bool) {
+	c.recordSubChecks(trusted)
+
+	totalWeight, score := 0.0, 0.0
+	allCorrect := true
+
+	for _, s := range c.SubChecks {
+		w := float64(s.weight())
+		totalWeight += w
+		if s.Reported {
+			score += w * float64(s.Earned) / float64(s.Avail)
+		}
+		if !s.Correct() {
+			allCorrect = false
+		}
+	}
+
+	if allCorrect {
+		c.Status = COMMAND_STATUS_CORRECT
+		c.PointsEarned = c.PointsAvailable
+	} else if totalWeight > 0 {
+		// Integral points only
+		c.PointsEarned = uint(float64(c.PointsAvailable) * score / totalWeight)
+	}
+}
@@ -0,0 +1,186 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func subCheckCommand(output string, checks ...*SubCheck) *Command {
+	cmd := &Command{
+		Input:           InputLine{Line: "sy5"},
+		PointsAvailable: 12,
+		Panic:           CMD_OPT_NO,
+		TimesOut:        CMD_OPT_NO,
+		ExpectedOutput:  []*ExpectedOutputLine{&ExpectedOutputLine{Text: "sy5: SUCCESS"}},
+		SubChecks:       copySubChecks(checks),
+	}
+	for _, line := range strings.Split(output, "\n") {
+		cmd.Output = append(cmd.Output, &OutputLine{Line: line})
+	}
+	return cmd
+}
+
+func TestSubCheckEvaluate(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	checks := []*SubCheck{
+		&SubCheck{Name: "phase 1"},
+		&SubCheck{Name: "phase 2", Weight: 2},
+		&SubCheck{Name: "phase 3"},
+	}
+
+	// Every sub-check counts, weighted
+	cmd := subCheckCommand(`phase 1: PARTIAL CREDIT 4 OF 4
+phase 2: PARTIAL CREDIT 1 OF 2
+phase 2: PARTIAL CREDIT 2 OF 2
+bogus: PARTIAL CREDIT 10 OF 10`, checks...)
+	cmd.evaluate(nil, false)
+	assert.Equal(COMMAND_STATUS_INCORRECT, cmd.Status)
+	assert.Equal(uint(6), cmd.PointsEarned)
+	assert.Equal("4/4", cmd.SubChecks[0].String())
+	assert.Equal("1/2", cmd.SubChecks[1].String())
+	assert.Equal("not reported", cmd.SubChecks[2].String())
+	assert.Equal(uint(1), cmd.SubChecks[2].Weight)
+
+	cmd = subCheckCommand(`phase 1: PARTIAL CREDIT 4 OF 4
+phase 3: PARTIAL CREDIT 3 OF 3
+phase 2: PARTIAL CREDIT 2 OF 2`, checks...)
+	cmd.evaluate(nil, false)
+	assert.Equal(COMMAND_STATUS_CORRECT, cmd.Status)
+	assert.Equal(uint(12), cmd.PointsEarned)
+
+	// The expected output still gets full points, and we keep the results
+	cmd = subCheckCommand(`phase 1: PARTIAL CREDIT 0 OF 4
+sy5: SUCCESS`, checks...)
+	cmd.evaluate(nil, false)
+	assert.Equal(COMMAND_STATUS_CORRECT, cmd.Status)
+	assert.Equal(uint(12), cmd.PointsEarned)
+	assert.True(cmd.SubChecks[0].Reported)
+	assert.False(cmd.SubChecks[0].Correct())
+
+	// Without sub-checks, only the first line counts
+	cmd = subCheckCommand(`phase 1: PARTIAL CREDIT 2 OF 4
+phase 2: PARTIAL CREDIT 2 OF 2`)
+	cmd.evaluate(nil, false)
+	assert.Equal(uint(6), cmd.PointsEarned)
+}
+
+func TestSubCheckTrusted(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	env := defaultEnv.CopyEnvironment()
+	key, _ := newKey(KEYBYTES)
+	env.keyMap["sy5"] = key
+
+	test := &Test{
+		env:   env,
+		salts: make(map[string]bool),
+		Salts: make([]string, 0),
+	}
+
+	cmd := subCheckCommand("", &SubCheck{Name: "phase 1"}, &SubCheck{Name: "phase 2"})
+	cmd.Output = []*OutputLine{
+		secureTestLine(test, structuredTestLine(key, "sy5", "01", `{"type": "partial", "name": "phase 1", "earned": 1, "avail": 1}`)),
+		secureTestLine(test, structuredTestLine("1234", "sy5", "02", `{"type": "partial", "name": "phase 2", "earned": 1, "avail": 1}`)),
+		secureTestLine(test, structuredTestLine(key, "sy5", "03", `{"type": "partial", "name": "phase 2", "earned": 0, "avail": 1}`)),
+	}
+	cmd.evaluate(env.keyMap, false)
+	assert.Equal(COMMAND_STATUS_INCORRECT, cmd.Status)
+	assert.Equal(uint(6), cmd.PointsEarned)
+	assert.Equal("0/1", cmd.SubChecks[1].String())
+}
+
+func TestSubCheckConfig(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	cmds, err := CommandTemplatesFromString(`---
+templates:
+  - name: sy5
+    subchecks:
+      - name: phase 1
+      - name: phase 2
+        weight: 3
+`)
+	if assert.Nil(err) && assert.Equal(1, len(cmds.Templates)) {
+		checks := cmds.Templates[0].Clone().SubChecks
+		if assert.Equal(2, len(checks)) {
+			assert.Equal(uint(1), checks[0].Weight)
+			assert.Equal(uint(3), checks[1].Weight)
+		}
+	}
+
+	_, err = CommandTemplatesFromString(`---
+templates:
+  - name: sy5
+    subchecks:
+      - name: phase 1
+      - name: phase 1
+`)
+	assert.NotNil(err)
+
+	target, err := TargetFromString(`---
+name: asst1
+points: 10
+type: asst
+tests:
+  - id: sync/sy5.t
+    points: 10
+    commands:
+      - id: sy5
+        subchecks:
+          - name: phase 1
+            weight: 5
+`)
+	if assert.Nil(err) {
+		checks := target.Tests[0].Commands[0].SubChecks
+		if assert.Equal(1, len(checks)) {
+			assert.Equal("phase 1", checks[0].Name)
+			assert.Equal(uint(5), checks[0].Weight)
+		}
+
+		test := &Test{Commands: []*Command{&Command{Input: InputLine{Line: "sy5"}}}}
+		assert.Nil(target.Tests[0].applyTo(test))
+		assert.Equal(1, len(test.Commands[0].SubChecks))
+
+		// Changing the sub-checks requires a new version
+		other, _ := TargetFromString(`---
+name: asst1
+points: 10
+type: asst
+tests:
+  - id: sync/sy5.t
+    points: 10
+    commands:
+      - id: sy5
+        subchecks:
+          - name: phase 1
+            weight: 5
+`)
+		assert.Nil(target.isChangeAllowed(other))
+		other.Tests[0].Commands[0].SubChecks[0].Weight = 1
+		assert.NotNil(target.isChangeAllowed(other))
+		other.Tests[0].Commands[0].SubChecks[0].Weight = 5
+		other.Tests[0].Commands[0].SubChecks = append(other.Tests[0].Commands[0].SubChecks, &SubCheck{Name: "phase 2"})
+		assert.NotNil(target.isChangeAllowed(other))
+		other.Tests[0].Commands[0].SubChecks = nil
+		assert.NotNil(target.isChangeAllowed(other))
+	}
+
+	_, err = TargetFromString(`---
+name: asst1
+points: 10
+type: asst
+tests:
+  - id: sync/sy5.t
+    points: 10
+    commands:
+      - id: sy5
+        subchecks:
+          - weight: 5
+`)
+	assert.NotNil(err)
+}
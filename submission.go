@@ -36,6 +36,39 @@ type SubmissionRequest struct {
 	EstimatedScores map[string]uint       // The local score test161 computed
 }
 
+// SubmissionQuota is a user's remaining submission quota for a target, as
+// reported by the server during validation. Negative values are unlimited.
+type SubmissionQuota struct {
+	User      string
+	Target    string
+	Remaining int       // Submissions left in the current window
+	Window    uint      // Window length (minutes)
+	ResetTime time.Time // When the next submission in the window expires
+	InFlight  int       // Additional submissions that can be pending
+	Cooldown  time.Time // Can't submit until then, after a failed build
+}
+
+// A ValidateResponse is sent back to clients (VALIDATE_RESPONSE_VERSION and
+// later) during validation. Older clients just get the Keys.
+type ValidateResponse struct {
+	Keys   []*RequestKeyResonse
+	Quotas []*SubmissionQuota
+}
+
+// The first client version that understands ValidateResponse
+var VALIDATE_RESPONSE_VERSION = ProgramVersion{
+	Major:    1,
+	Minor:    3,
+	Revision: 3,
+}
+
+// A SubmissionResponse is sent back to the client when the server accepts a
+// submission.
+type SubmissionResponse struct {
+	ID            string // The submission ID
+	QueuePosition uint   // Position in the submission queue, 1 is next
+}
+
 // UploadRequests are created by clients and provide the form fields for
 // file uploads. Currently, we only support stats file uploads, but this
 // could change.
@@ -93,6 +126,23 @@ type Submission struct {
 	Errors         []string `bson:"errors"`
 	EstimatedScore uint     `bson:"estimated_score"`
 
+	// Late submissions. Score is RawScore less the late penalty.
+	RawScore    uint    `bson:"raw_score"`
+	LateHours   float64 `bson:"late_hours"`
+	LatePenalty float64 `bson:"late_penalty"` // Fraction of the score
+
+	// Compiler warnings that count under the target's warning policy, and
+	// the points deducted for them.
+	BuildWarnings  uint `bson:"build_warnings"`
+	WarningPenalty uint `bson:"warning_penalty"`
+
+	// Position in the submission queue while waiting to run (1 is next),
+	// or 0 once it has left the queue.
+	QueuePosition uint `bson:"queue_position"`
+
+	// Priority class (JOB_PRIORITY_*) for the submission and its tests
+	Priority int `bson:"priority"`
+
 	SubmissionTime time.Time `bson:"submission_time"`
 	CompletionTime time.Time `bson:"completion_time"`
 
@@ -113,6 +163,9 @@ type Submission struct {
 
 	// From the request, but we need it in case we split the submission.
 	estimatedScores map[string]uint
+
+	// When the submission was queued
+	queuedAt time.Time
 }
 
 type TargetStats struct {
@@ -145,6 +198,9 @@ type Student struct {
 	TotalSubmissions uint           `bson:"total_submissions"`
 	Stats            []*TargetStats `bson:"target_stats"`
 
+	// Deadline extensions
+	Extensions []*Extension `bson:"extensions"`
+
 	// Computed, cached.
 	// 0 == uncached, 1 == false, 2 == true
 	isStaff int
@@ -160,7 +216,29 @@ func (a StatsByName) Less(i, j int) bool { return a[i].TargetName < a[j].TargetN
 // Keep track of pending submissions.  Keep this out of the database in case there are
 // communication issues so that we don't need to manually reset things in the DB.
 var userLock = &sync.Mutex{}
-var pendingSubmissions = make(map[string]bool)
+var pendingSubmissions = make(map[string]uint)
+
+// The number of submissions each user can have pending (protected by userLock)
+var maxPendingSubmissions uint = 1
+
+// SetMaxPendingSubmissions sets the number of submissions each user can have
+// pending (queued or running) at once. 0 is treated as 1.
+func SetMaxPendingSubmissions(max uint) {
+	if max == 0 {
+		max = 1
+	}
+	userLock.Lock()
+	maxPendingSubmissions = max
+	userLock.Unlock()
+}
+
+// PendingSubmissions returns the number of pending submissions for a user,
+// and how many they're allowed.
+func PendingSubmissions(email string) (pending, max uint) {
+	userLock.Lock()
+	defer userLock.Unlock()
+	return pendingSubmissions[email], maxPendingSubmissions
+}
 
 // Check users against users database.  Don't lock them until we run though
 func validateUserRecords(users []*SubmissionUserInfo, env *TestEnvironment) ([]*Student, error) {
@@ -281,14 +359,10 @@ func NewSubmission(request *SubmissionRequest, origenv *TestEnvironment) (*Submi
 
 	// Create the build configuration.  This is a combination of
 	// the environment, target, and request.
-	conf := &BuildConf{}
+	conf := target.BuildConf()
 	conf.Repo = request.Repository
 	conf.CommitID = request.CommitID
 	conf.CacheDir = env.CacheDir
-	conf.KConfig = target.KConfig
-	conf.RequiredCommit = target.RequiredCommit
-	conf.RequiresUserland = target.RequiresUserland
-	conf.Overlay = target.Name
 
 	conf.Users = make([]string, 0, len(request.Users))
 	for _, u := range request.Users {
@@ -379,6 +453,18 @@ func NewSubmission(request *SubmissionRequest, origenv *TestEnvironment) (*Submi
 		s.IsStaff, _ = students[0].IsStaff(env)
 	}
 
+	// Staff submissions (e.g. testing a hotfix) go to the front of the line
+	if s.IsStaff {
+		s.SetPriority(JOB_PRIORITY_STAFF)
+	} else {
+		s.SetPriority(JOB_PRIORITY_SUBMISSION)
+	}
+
+	// The late penalty uses the deadline of the target that was submitted. If
+	// this is a metatarget submission, each subtarget's submission gets its
+	// own penalty when it's split off (see cloneAndUpdate).
+	s.setLatePenalty(target, students)
+
 	// Try and lock students now so we don't allow multiple submissions.
 	// This enforces NewSubmission() can only return successfully if none
 	// of the students has a pending submission. We need to do this
@@ -388,8 +474,13 @@ func NewSubmission(request *SubmissionRequest, origenv *TestEnvironment) (*Submi
 
 	// First pass - just check
 	for _, student := range students {
-		if running := pendingSubmissions[student.Email]; running {
-			msg := fmt.Sprintf("Cannot submit at this time: User %v has a submission pending.", student.Email)
+		if pending := pendingSubmissions[student.Email]; pending >= maxPendingSubmissions {
+			var msg string
+			if maxPendingSubmissions == 1 {
+				msg = fmt.Sprintf("Cannot submit at this time: User %v has a submission pending.", student.Email)
+			} else {
+				msg = fmt.Sprintf("Cannot submit at this time: User %v has %v submissions pending.", student.Email, pending)
+			}
 			env.Log.Println(msg)
 			return nil, []error{errors.New(msg)}
 		}
@@ -397,7 +488,7 @@ func NewSubmission(request *SubmissionRequest, origenv *TestEnvironment) (*Submi
 
 	// Now lock
 	for _, student := range students {
-		pendingSubmissions[student.Email] = true
+		pendingSubmissions[student.Email] += 1
 	}
 
 	if env.Persistence != nil {
@@ -413,7 +504,7 @@ func NewSubmission(request *SubmissionRequest, origenv *TestEnvironment) (*Submi
 	// Unlock so they can resubmit
 	if err != nil {
 		for _, student := range students {
-			delete(pendingSubmissions, student.Email)
+			unlockStudent(student.Email)
 		}
 		return nil, []error{err}
 	}
@@ -591,10 +682,24 @@ func (s *Submission) unlockStudents() {
 
 	// Unblock the students from resubmitting
 	for _, student := range s.students {
-		delete(pendingSubmissions, student.Email)
+		unlockStudent(student.Email)
 	}
 }
 
+// Must hold userLock
+func unlockStudent(email string) {
+	if pendingSubmissions[email] <= 1 {
+		delete(pendingSubmissions, email)
+	} else {
+		pendingSubmissions[email] -= 1
+	}
+}
+
+// BuildFailed returns true if the submission's build didn't succeed.
+func (s *Submission) BuildFailed() bool {
+	return s.BuildTest != nil && s.BuildTest.Result != TEST_RESULT_CORRECT
+}
+
 func (s *Submission) finish() {
 
 	s.CompletionTime = time.Now()
@@ -628,6 +733,7 @@ func (s *Submission) cloneAndUpdate(target *Target) *Submission {
 
 	// Results/tests
 	copy.Score = uint(0)
+	copy.RawScore = uint(0)
 	copy.EstimatedScore = uint(0)
 	copy.TestIDs = make([]string, 0)
 
@@ -648,6 +754,11 @@ func (s *Submission) cloneAndUpdate(target *Target) *Submission {
 		copy.EstimatedScore = est
 	}
 
+	// Each subtarget has its own deadline and warning policy, so the penalties
+	// are recomputed for it rather than copied from the metatarget submission.
+	copy.setLatePenalty(target, s.students)
+	copy.setWarningPenalty(target)
+
 	return &copy
 }
 
@@ -682,11 +793,22 @@ func (s *Submission) split() []*Submission {
 func (s *Submission) abort() {
 	s.Status = SUBMISSION_ABORTED
 	s.Score = 0
+	s.RawScore = 0
 	s.Performance = float64(0)
 }
 
+// SetPriority sets the priority class (JOB_PRIORITY_*) of the submission and
+// its tests. This must be called before the submission runs.
+func (s *Submission) SetPriority(priority int) {
+	s.Priority = priority
+	if s.Tests != nil && s.Tests.Config != nil {
+		s.Tests.Config.Priority = priority
+	}
+}
+
 func (s *Submission) updateScore(test *Test) {
-	s.Score += test.PointsEarned
+	s.RawScore += test.PointsEarned
+	s.Score = s.adjustedScore()
 	s.Env.Persistence.Notify(s, MSG_PERSIST_UPDATE, MSG_FIELD_SCORE)
 }
 
@@ -722,13 +844,13 @@ func (s *Submission) Run() error {
 
 		// Build output
 		s.Env.RootDir = res.RootDir
+		s.Env.rootKey = res.RootKey
 
-		// Clean up temp build directory
-		if len(res.TempDir) > 0 {
-			defer os.RemoveAll(res.TempDir)
-		}
+		// Clean up the temp build directory, or release the cached build
+		defer res.Release()
 
 		s.OverlayCommitID = s.BuildTest.overlayCommitID
+		s.setWarningPenalty(s.origTarget)
 	}
 
 	// Build succeeded, update things accordingly
@@ -753,6 +875,12 @@ func (s *Submission) Run() error {
 	s.Status = SUBMISSION_RUNNING
 	s.Env.notifyAndLogErr("Submission Status (Running) ", s, MSG_PERSIST_UPDATE, MSG_FIELD_TESTS|MSG_FIELD_STATUS)
 
+	// Schedule using the times from previous runs, and learn from this one
+	if s.Env.Estimates != nil {
+		s.Env.Estimates.Apply(s.Tests)
+		defer s.Env.Estimates.Update(s.Tests)
+	}
+
 	runner := NewDependencyRunner(s.Tests)
 	done := runner.Run()
 
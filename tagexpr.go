@@ -0,0 +1,295 @@
+package test161
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tag expressions select tests using boolean combinations of tags, e.g.
+//
+//	syscalls and not slow
+//	(sync or threads) and stress
+//
+// The operators, in order of increasing precedence, are 'or', 'and', and
+// 'not'. Parentheses can be used for grouping. A tag expression consisting of
+// a single tag selects the same tests as the tag itself.
+
+// Tag expression node types
+const (
+	TAG_EXPR_TAG = iota
+	TAG_EXPR_NOT
+	TAG_EXPR_AND
+	TAG_EXPR_OR
+)
+
+// Tag expression keywords
+const (
+	TAG_EXPR_KW_AND = "and"
+	TAG_EXPR_KW_OR  = "or"
+	TAG_EXPR_KW_NOT = "not"
+)
+
+// A TagExpr is a parsed tag expression. Tag nodes have a Tag, Not nodes only
+// have a Left operand, and And/Or nodes have both operands.
+type TagExpr struct {
+	Type  int
+	Tag   string
+	Left  *TagExpr
+	Right *TagExpr
+}
+
+// IsTagExprKeyword returns true if the word is a tag expression operator
+// rather than a tag.
+func IsTagExprKeyword(word string) bool {
+	switch strings.ToLower(word) {
+	case TAG_EXPR_KW_AND, TAG_EXPR_KW_OR, TAG_EXPR_KW_NOT:
+		return true
+	default:
+		return false
+	}
+}
+
+// Split a tag expression into words and parentheses.
+func tokenizeTagExpr(expr string) []string {
+	tokens := make([]string, 0)
+	cur := ""
+
+	flush := func() {
+		if len(cur) > 0 {
+			tokens = append(tokens, cur)
+			cur = ""
+		}
+	}
+
+	for _, r := range expr {
+		switch r {
+		case '(', ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case ' ', '\t', '\n', '\r':
+			flush()
+		default:
+			cur += string(r)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// Recursive descent parser state
+type tagExprParser struct {
+	expr   string
+	tokens []string
+	pos    int
+}
+
+func (p *tagExprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *tagExprParser) isKeyword(kw string) bool {
+	return strings.ToLower(p.peek()) == kw
+}
+
+func (p *tagExprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid tag expression '%v': %v", p.expr, fmt.Sprintf(format, args...))
+}
+
+// expr := term { 'or' term }
+func (p *tagExprParser) parseOr() (*TagExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword(TAG_EXPR_KW_OR) {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &TagExpr{Type: TAG_EXPR_OR, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// term := factor { 'and' factor }
+func (p *tagExprParser) parseAnd() (*TagExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword(TAG_EXPR_KW_AND) {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &TagExpr{Type: TAG_EXPR_AND, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// factor := 'not' factor | '(' expr ')' | tag
+func (p *tagExprParser) parseNot() (*TagExpr, error) {
+	tok := p.peek()
+
+	switch {
+	case tok == "":
+		return nil, p.errorf("unexpected end of expression")
+	case p.isKeyword(TAG_EXPR_KW_NOT):
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &TagExpr{Type: TAG_EXPR_NOT, Left: operand}, nil
+	case tok == "(":
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, p.errorf("missing ')'")
+		}
+		p.pos++
+		return inner, nil
+	case tok == ")" || IsTagExprKeyword(tok):
+		return nil, p.errorf("unexpected '%v'", tok)
+	default:
+		p.pos++
+		return &TagExpr{Type: TAG_EXPR_TAG, Tag: tok}, nil
+	}
+}
+
+// ParseTagExpr parses a boolean tag expression.
+func ParseTagExpr(expr string) (*TagExpr, error) {
+	p := &tagExprParser{
+		expr:   expr,
+		tokens: tokenizeTagExpr(expr),
+	}
+
+	if len(p.tokens) == 0 {
+		return nil, errors.New("Empty tag expression")
+	}
+
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	} else if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected '%v'", p.peek())
+	}
+
+	return e, nil
+}
+
+func (e *TagExpr) String() string {
+	switch e.Type {
+	case TAG_EXPR_TAG:
+		return e.Tag
+	case TAG_EXPR_NOT:
+		return "not " + e.Left.String()
+	case TAG_EXPR_AND:
+		return "(" + e.Left.String() + " and " + e.Right.String() + ")"
+	case TAG_EXPR_OR:
+		return "(" + e.Left.String() + " or " + e.Right.String() + ")"
+	default:
+		return "?"
+	}
+}
+
+// Evaluate the expression against the tag map, returning the selected tests
+// as a map of id -> test. Negation is relative to all tests.
+func (e *TagExpr) eval(tags TagMap, all map[string]*Test) (map[string]*Test, error) {
+	res := make(map[string]*Test)
+
+	switch e.Type {
+	case TAG_EXPR_TAG:
+		tests, ok := tags[e.Tag]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Cannot find tag: %v", e.Tag))
+		}
+		for _, test := range tests {
+			res[test.DependencyID] = test
+		}
+
+	case TAG_EXPR_NOT:
+		operand, err := e.Left.eval(tags, all)
+		if err != nil {
+			return nil, err
+		}
+		for id, test := range all {
+			if _, ok := operand[id]; !ok {
+				res[id] = test
+			}
+		}
+
+	case TAG_EXPR_AND, TAG_EXPR_OR:
+		left, err := e.Left.eval(tags, all)
+		if err != nil {
+			return nil, err
+		}
+		right, err := e.Right.eval(tags, all)
+		if err != nil {
+			return nil, err
+		}
+		for id, test := range left {
+			if _, ok := right[id]; ok || e.Type == TAG_EXPR_OR {
+				res[id] = test
+			}
+		}
+		if e.Type == TAG_EXPR_OR {
+			for id, test := range right {
+				res[id] = test
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// Select returns the tests from the tag map that are selected by the
+// expression, sorted by id. all is the set of tests that negation applies to.
+// Every tag in the expression must exist in the tag map.
+func (tags TagMap) Select(e *TagExpr, all map[string]*Test) ([]*Test, error) {
+	selected, err := e.eval(tags, all)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(selected))
+	for id := range selected {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	tests := make([]*Test, 0, len(ids))
+	for _, id := range ids {
+		tests = append(tests, selected[id])
+	}
+
+	return tests, nil
+}
+
+// Get a slice of tests from a tag or tag expression.
+func (tm *testMap) testsFromTagExpr(expr string) ([]*Test, error) {
+	e, err := ParseTagExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	tests, err := tm.Tags.Select(e, tm.Tests)
+	if err != nil {
+		return nil, err
+	} else if len(tests) == 0 {
+		return nil, errors.New(fmt.Sprintf("No tests match tag expression: %v", expr))
+	}
+
+	return tests, nil
+}
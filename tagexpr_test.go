@@ -0,0 +1,128 @@
+package test161
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTagExprParse(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	valid := map[string]string{
+		"sync":                         "sync",
+		"sync and not cv":              "(sync and not cv)",
+		"a or b and c":                 "(a or (b and c))",
+		"(a or b) and c":               "((a or b) and c)",
+		"not not a":                    "not not a",
+		"(sync OR threads) AND stress": "((sync or threads) and stress)",
+		"a and b and c":                "((a and b) and c)",
+	}
+
+	for expr, expected := range valid {
+		e, err := ParseTagExpr(expr)
+		assert.Nil(err)
+		if err == nil {
+			assert.Equal(expected, e.String())
+		} else {
+			t.Log(err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"   ",
+		"and",
+		"sync and",
+		"sync cv",
+		"(sync or cv",
+		"sync or cv)",
+		"not",
+		"()",
+	}
+
+	for _, expr := range invalid {
+		e, err := ParseTagExpr(expr)
+		assert.NotNil(err)
+		assert.Nil(e)
+	}
+}
+
+func TestTagExprSelect(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	tm, errs := newTestMap(TEST_DIR)
+	assert.NotNil(tm)
+	assert.Equal(0, len(errs))
+	if tm == nil {
+		t.FailNow()
+	}
+
+	tests, err := tm.testsFromTagExpr("sync and not cv and not locks")
+	assert.Nil(err)
+	assert.Equal([]string{
+		"sync/all.t",
+		"sync/fail.t",
+		"sync/multi.t",
+		"sync/sem1.t",
+		"sync/semu1.t",
+	}, testsToSortedSlice(tests))
+
+	tests, err = tm.testsFromTagExpr("boot or (threads and not sync)")
+	assert.Nil(err)
+	assert.Equal([]string{
+		"boot.t",
+		"threads/tt1.t",
+		"threads/tt2.t",
+		"threads/tt3.t",
+	}, testsToSortedSlice(tests))
+
+	tests, err = tm.testsFromTagExpr("not sync")
+	assert.Nil(err)
+	assert.Equal(len(tm.Tests)-len(tm.Tags["sync"]), len(tests))
+
+	// Single tags behave like tag lookups
+	tests, err = tm.testsFromTagExpr("cv")
+	assert.Nil(err)
+	assert.Equal(testsToSortedSlice(tm.Tags["cv"]), testsToSortedSlice(tests))
+
+	// Unknown tags and empty results are errors
+	_, err = tm.testsFromTagExpr("sync and not slow")
+	assert.NotNil(err)
+	_, err = tm.testsFromTagExpr("cv and locks")
+	assert.NotNil(err)
+}
+
+func TestTagExprGroup(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	config := &GroupConfig{
+		Name:    "Test",
+		UseDeps: false,
+		Tests:   []string{"locks or sem", "boot.t"},
+		Env:     defaultEnv,
+	}
+
+	tg, errs := GroupFromConfig(config)
+	assert.Equal(0, len(errs))
+	assert.NotNil(tg)
+	if tg == nil {
+		t.FailNow()
+	}
+
+	tests := make([]*Test, 0)
+	for _, test := range tg.Tests {
+		tests = append(tests, test)
+	}
+
+	assert.Equal([]string{
+		"boot.t",
+		"sync/lt1.t",
+		"sync/lt2.t",
+		"sync/lt3.t",
+		"sync/sem1.t",
+		"sync/semu1.t",
+	}, testsToSortedSlice(tests))
+}
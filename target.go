@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 )
 
 // For simple cases, it is annoying to have to specify the points for the test
@@ -41,18 +42,20 @@ const (
 //           are runable, whereas metatargets are not.
 type Target struct {
 	// Make sure to update isChangeAllowed with any new fields that need to be versioned.
-	ID               string        `yaml:"-" bson:"_id"`
-	Name             string        `yaml:"name"`
-	Active           string        `yaml:"active"`
-	Version          uint          `yaml:"version"`
-	Type             string        `yaml:"type"`
-	Points           uint          `yaml:"points"`
-	KConfig          string        `yaml:"kconfig"`
-	RequiredCommit   string        `yaml:"required_commit" bson:"required_commit"`
-	RequiresUserland bool          `yaml:"userland" bson:"userland"`
-	Tests            []*TargetTest `yaml:"tests"`
-	FileHash         string        `yaml:"-" bson:"file_hash"`
-	FileName         string        `yaml:"-" bson:"file_name"`
+	ID               string              `yaml:"-" bson:"_id"`
+	Name             string              `yaml:"name"`
+	Active           string              `yaml:"active"`
+	Version          uint                `yaml:"version"`
+	Type             string              `yaml:"type"`
+	Points           uint                `yaml:"points"`
+	KConfig          string              `yaml:"kconfig"`
+	RequiredCommit   string              `yaml:"required_commit" bson:"required_commit"`
+	Commits          *CommitRequirements `yaml:"commits" bson:"commits"`
+	RequiresUserland bool                `yaml:"userland" bson:"userland"`
+	Tests            []*TargetTest       `yaml:"tests"`
+	Invariants       []*InvariantCheck   `yaml:"invariants" bson:"invariants"`
+	FileHash         string              `yaml:"-" bson:"file_hash"`
+	FileName         string              `yaml:"-" bson:"file_name"`
 
 	// MetaTarget info
 	IsMetaTarget   bool     `yaml:"is_meta_target" bson:"is_meta_target"`
@@ -65,6 +68,19 @@ type Target struct {
 	Link        string `yaml:"link" bson:"link"`
 	Leaderboard string `yaml:"leaderboard" bson:"leaderboard"`
 
+	// Deadlines (see deadlines.go). These aren't versioned, so they can be
+	// changed (e.g. to extend the deadline) without bumping the version.
+	Opens  string      `yaml:"opens" bson:"opens"`
+	Closes string      `yaml:"closes" bson:"closes"`
+	Late   *LatePolicy `yaml:"late" bson:"late"`
+
+	// Build settings, which also aren't versioned, except for the warning
+	// policy, which can deduct points
+	Build TargetBuild `yaml:"build" bson:"build"`
+
+	opensAt  time.Time
+	closesAt time.Time
+
 	// Parent and siblings if this is a subtarget of a metatarget.
 	metaTarget         *Target
 	previousSubTargets []*Target
@@ -78,6 +94,9 @@ type TargetTest struct {
 	Points        uint             `yaml:"points"`
 	MemLeakPoints uint             `yaml:"mem_leak_points"`
 	Commands      []*TargetCommand `yaml:"commands"`
+
+	// Invariant checks for this test only (see invariants.go)
+	Invariants []*InvariantCheck `yaml:"invariants" bson:"invariants"`
 }
 
 // TargetCommands (optionally) specify information about the commands contained
@@ -88,6 +107,9 @@ type TargetCommand struct {
 	Index  int      `yaml:"index"`            // Index > 0 => match to index in test
 	Points uint     `yaml:"points"`           // Points for this command
 	Args   []string `yaml:"args"`             // Argument overrides
+
+	// Sub-checks, replacing the command's (see subchecks.go)
+	SubChecks []*SubCheck `yaml:"subchecks" bson:"subchecks"`
 }
 
 // TargetListItem is the target detail we send to remote clients about a target
@@ -170,6 +192,26 @@ func TargetFromString(text string) (*Target, error) {
 
 	t.fixDefaults()
 
+	if err = t.initDeadlines(); err != nil {
+		return nil, err
+	}
+
+	if err = t.Commits.Validate(); err != nil {
+		return nil, err
+	}
+
+	for _, tt := range t.Tests {
+		for _, cmd := range tt.Commands {
+			if err = checkSubChecks(cmd.SubChecks); err != nil {
+				return nil, fmt.Errorf("Command %v in test %v: %v", cmd.Id, tt.Id, err)
+			}
+		}
+	}
+
+	if err = t.checkInvariants(); err != nil {
+		return nil, err
+	}
+
 	return t, nil
 }
 
@@ -243,6 +285,9 @@ func (tt *TargetTest) applyTo(test *Test) error {
 				if len(cmd.Args) > 0 {
 					instance.command.Input.replaceArgs(cmd.Args)
 				}
+				if len(cmd.SubChecks) > 0 {
+					instance.command.SubChecks = copySubChecks(cmd.SubChecks)
+				}
 
 				if tt.Scoring == TEST_SCORING_PARTIAL {
 					instance.command.PointsAvailable = cmd.Points
@@ -439,6 +484,7 @@ func (t *Target) Instance(env *TestEnvironment) (*TestGroup, []error) {
 			if err := tt.applyTo(test); err != nil {
 				return nil, []error{err}
 			}
+			target.applyInvariants(tt, test)
 			// This is used for scoring later
 			test.TargetName = target.Name
 
@@ -500,9 +546,21 @@ func (old *Target) isChangeAllowed(other *Target) error {
 			return fmt.Errorf("The scoring method for %v changed in the new target, which requires a version change", t.Id)
 		} else if oldVer.MemLeakPoints != t.MemLeakPoints {
 			return errors.New("The memory leak points for %v changed in the new target, which requires a version change")
+		} else if invariantsChanged(oldVer.Invariants, t.Invariants) {
+			return fmt.Errorf("The invariant checks for %v changed in the new target, which requires a version change", t.Id)
+		} else if subChecksChanged(oldVer.Commands, t.Commands) {
+			return fmt.Errorf("The sub-checks for %v changed in the new target, which requires a version change", t.Id)
 		}
 	}
 
+	if invariantsChanged(old.Invariants, other.Invariants) {
+		return errors.New("Changing the invariant checks requires a version change")
+	}
+
+	if warningPolicyChanged(old.Build.Warnings, other.Build.Warnings) {
+		return errors.New("Changing the build warning policy requires a version change")
+	}
+
 	// Subtarget names
 	if len(old.SubTargetNames) != len(other.SubTargetNames) {
 		return errors.New("Changing the number of subtargets requiers a version change")
@@ -2,12 +2,16 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/ops-class/test161"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
 	"strconv"
+	"text/tabwriter"
+	"time"
 )
 
 const (
@@ -17,11 +21,14 @@ const (
 	CTRL_SETCAPACITY
 	CTRL_GETCAPACITY
 	CTRL_STAFF_ONLY
+	CTRL_DRAIN_WORKER
+	CTRL_REMOVE_WORKER
 )
 
 type ControlRequest struct {
 	Message     int
 	NewCapacity uint
+	Worker      string // Worker name or ID
 }
 
 type ServerCtrl int
@@ -57,11 +64,34 @@ func (sc *ServerCtrl) Control(msg *ControlRequest, reply *int) error {
 		test161.SetManagerCapacity(msg.NewCapacity)
 		*reply = 0
 		return nil
+	case CTRL_DRAIN_WORKER, CTRL_REMOVE_WORKER:
+		if workerPool == nil {
+			return errors.New("The server is not accepting workers")
+		}
+		if msg.Message == CTRL_DRAIN_WORKER {
+			*reply = workerPool.Drain(msg.Worker)
+		} else {
+			*reply = workerPool.Remove(msg.Worker)
+		}
+		if *reply == 0 {
+			return errors.New("No such worker: " + msg.Worker)
+		}
+		return nil
 	default:
 		return errors.New("Unrecongnized control message")
 	}
 }
 
+// Workers returns the registered workers.
+func (sc *ServerCtrl) Workers(msg *ControlRequest, reply *[]*test161.WorkerInfo) error {
+	if workerPool == nil {
+		*reply = []*test161.WorkerInfo{}
+	} else {
+		*reply = workerPool.Workers()
+	}
+	return nil
+}
+
 type ControlServer struct {
 }
 
@@ -143,3 +173,46 @@ func CtrlSetCapacity(argCap string) error {
 
 	return err
 }
+
+func CtrlWorker(command, worker string) error {
+	req := ControlRequest{Worker: worker}
+	if command == "drain-worker" {
+		req.Message = CTRL_DRAIN_WORKER
+	} else {
+		req.Message = CTRL_REMOVE_WORKER
+	}
+
+	var reply int
+	return doCtrlRequest(req, &reply)
+}
+
+func CtrlWorkers() ([]*test161.WorkerInfo, error) {
+	client, err := rpc.DialHTTPPath("tcp", "127.0.0.1:4001", "/test161/control")
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var workers []*test161.WorkerInfo
+	err = client.Call("ServerCtrl.Workers", &ControlRequest{}, &workers)
+	return workers, err
+}
+
+func printWorkers(workers []*test161.WorkerInfo) {
+	if len(workers) == 0 {
+		fmt.Println("No workers")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Name\tID\tCapacity\tRunning\tFinished\tStatus\tLast Seen")
+	for _, worker := range workers {
+		status := "active"
+		if worker.Draining {
+			status = "draining"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", worker.Name, worker.ID, worker.Capacity,
+			worker.Running, worker.Finished, status, worker.LastSeen.Format(time.Stamp))
+	}
+	w.Flush()
+}
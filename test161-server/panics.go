@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ops-class/test161"
+	"os"
+	"text/tabwriter"
+)
+
+// Group the kernel panics in persisted test results by panic site, i.e.
+// test161-server panics [-target name] [-json]
+func runPanics(args []string) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("panics", flag.ContinueOnError)
+	target := flags.String("target", "", "only include tests run for this target")
+	asJSON := flags.Bool("json", false, "print the panic groups as JSON")
+
+	if err = flags.Parse(args); err != nil {
+		return err
+	} else if len(flags.Args()) != 0 {
+		return errors.New("panics doesn't take any arguments")
+	}
+
+	mongo, err := connectMongo(conf)
+	if err != nil {
+		return err
+	}
+	defer mongo.Close()
+
+	tests, err := test161.RetrievePanics(mongo, *target)
+	if err != nil {
+		return err
+	}
+	groups := test161.GroupPanics(tests)
+
+	if *asJSON {
+		data, err := json.MarshalIndent(groups, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		printPanicGroups(groups)
+	}
+	return nil
+}
+
+func printPanicGroups(groups []*test161.PanicGroup) {
+	if len(groups) == 0 {
+		fmt.Println("No panics found")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Count\tSubmissions\tKind\tSite\tTests")
+	for _, g := range groups {
+		tests := g.Tests
+		if len(tests) > 3 {
+			tests = append(tests[:3:3], fmt.Sprintf("(%v more)", len(g.Tests)-3))
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", g.Count, len(g.Submissions), g.Kind, g.Site, tests)
+	}
+	w.Flush()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ops-class/test161"
+	"sync"
+	"time"
+)
+
+// Submission quotas. Staff aren't subject to any of these.
+type QuotaConfig struct {
+	// Max submissions per user per target in each window (0 for no limit)
+	MaxSubmissions uint `yaml:"max_submissions"`
+	Window         uint `yaml:"window"` // Minutes
+
+	// Max submissions each user can have queued or running (defaults to 1)
+	MaxInFlight uint `yaml:"max_in_flight"`
+
+	// Minutes users have to wait after a submission's build fails (0 for none)
+	AbortCooldown uint `yaml:"abort_cooldown"`
+}
+
+const DEFAULT_QUOTA_WINDOW uint = 60
+
+// quotaTracker keeps track of recent submissions and cooldowns. Like pending
+// submissions, this is kept in memory, so it resets when the server restarts.
+type quotaTracker struct {
+	l         sync.Mutex
+	conf      QuotaConfig
+	history   map[string][]time.Time // user/target -> submission times
+	cooldowns map[string]time.Time   // user -> end of cooldown
+}
+
+func newQuotaTracker(conf QuotaConfig) *quotaTracker {
+	if conf.Window == 0 {
+		conf.Window = DEFAULT_QUOTA_WINDOW
+	}
+	test161.SetMaxPendingSubmissions(conf.MaxInFlight)
+
+	return &quotaTracker{
+		conf:      conf,
+		history:   make(map[string][]time.Time),
+		cooldowns: make(map[string]time.Time),
+	}
+}
+
+func (q *quotaTracker) window() time.Duration {
+	return time.Duration(q.conf.Window) * time.Minute
+}
+
+func quotaKey(user, target string) string {
+	return user + "/" + target
+}
+
+// Get the user's submissions to the target within the window, oldest first,
+// dropping the ones that have expired. Must hold q.l.
+func (q *quotaTracker) recent(user, target string, now time.Time) []time.Time {
+	key := quotaKey(user, target)
+	times := q.history[key]
+	for len(times) > 0 && now.Sub(times[0]) >= q.window() {
+		times = times[1:]
+	}
+	if len(times) == 0 {
+		delete(q.history, key)
+	} else {
+		q.history[key] = times
+	}
+	return times
+}
+
+// Round up to the minute for messages
+func quotaWait(d time.Duration) string {
+	minutes := (d + time.Minute - 1) / time.Minute
+	if minutes <= 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%v minutes", int64(minutes))
+}
+
+// Get the user's remaining quota for the target. Must hold q.l.
+func (q *quotaTracker) quota(user, target string, now time.Time) *test161.SubmissionQuota {
+	res := &test161.SubmissionQuota{
+		User:      user,
+		Target:    target,
+		Remaining: -1,
+		Window:    q.conf.Window,
+	}
+
+	if q.conf.MaxSubmissions > 0 {
+		times := q.recent(user, target, now)
+		res.Remaining = int(q.conf.MaxSubmissions) - len(times)
+		if res.Remaining < 0 {
+			res.Remaining = 0
+		}
+		if len(times) > 0 {
+			res.ResetTime = times[0].Add(q.window())
+		}
+	}
+
+	pending, max := test161.PendingSubmissions(user)
+	res.InFlight = int(max) - int(pending)
+	if res.InFlight < 0 {
+		res.InFlight = 0
+	}
+
+	if end, ok := q.cooldowns[user]; ok {
+		if now.Before(end) {
+			res.Cooldown = end
+		} else {
+			delete(q.cooldowns, user)
+		}
+	}
+
+	return res
+}
+
+// A quotaReservation is a submission counted against the users' quotas
+// before the submission is created, so concurrent requests can't both take the
+// last one.
+type quotaReservation struct {
+	users  []string
+	target string
+	when   time.Time
+}
+
+// Check the users' quotas for the target, returning the quotas and an error
+// if any of them can't submit. If reserve is set and they can, the submission
+// is counted right away, and the reservation must be released if the
+// submission isn't created.
+func (q *quotaTracker) check(students []*test161.Student, target string, env *test161.TestEnvironment,
+	reserve bool) ([]*test161.SubmissionQuota, *quotaReservation, error) {
+
+	users := make([]string, 0, len(students))
+	for _, student := range students {
+		if isStaff, _ := student.IsStaff(env); !isStaff {
+			users = append(users, student.Email)
+		}
+	}
+
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	now := time.Now()
+	quotas := make([]*test161.SubmissionQuota, 0, len(users))
+	var err error
+
+	for _, user := range users {
+		quota := q.quota(user, target, now)
+		quotas = append(quotas, quota)
+
+		if err != nil {
+			continue
+		} else if !quota.Cooldown.IsZero() {
+			err = fmt.Errorf("The last build for %v failed. Please fix it and wait %v before submitting again.",
+				user, quotaWait(quota.Cooldown.Sub(now)))
+		} else if quota.InFlight == 0 {
+			err = fmt.Errorf("%v already has the maximum number of submissions (%v) in progress. Please wait for one to finish.",
+				user, q.conf.inFlight())
+		} else if quota.Remaining == 0 {
+			err = fmt.Errorf("%v has reached the limit of %v submissions to %v every %v. Please try again in %v.",
+				user, q.conf.MaxSubmissions, target, quotaWait(q.window()), quotaWait(quota.ResetTime.Sub(now)))
+		}
+	}
+
+	if err != nil || !reserve || q.conf.MaxSubmissions == 0 || len(users) == 0 {
+		return quotas, nil, err
+	}
+
+	res := &quotaReservation{
+		users:  users,
+		target: target,
+		when:   now,
+	}
+	for _, user := range users {
+		times := q.recent(user, target, now)
+		q.history[quotaKey(user, target)] = append(times, now)
+	}
+
+	return quotas, res, nil
+}
+
+func (conf QuotaConfig) inFlight() uint {
+	if conf.MaxInFlight == 0 {
+		return 1
+	}
+	return conf.MaxInFlight
+}
+
+// Give back a reservation for a submission that wasn't created.
+func (q *quotaTracker) release(res *quotaReservation) {
+	if res == nil {
+		return
+	}
+
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	for _, user := range res.users {
+		key := quotaKey(user, res.target)
+		times := q.history[key]
+		for i, t := range times {
+			if t.Equal(res.when) {
+				times = append(times[:i], times[i+1:]...)
+				break
+			}
+		}
+		if len(times) == 0 {
+			delete(q.history, key)
+		} else {
+			q.history[key] = times
+		}
+	}
+}
+
+// Start the cooldown if the submission's build failed.
+func (q *quotaTracker) finished(submission *test161.Submission) {
+	if q.conf.AbortCooldown == 0 || submission.IsStaff || !submission.BuildFailed() {
+		return
+	}
+
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	end := time.Now().Add(time.Duration(q.conf.AbortCooldown) * time.Minute)
+	for _, user := range submission.Users {
+		q.cooldowns[user] = end
+	}
+}
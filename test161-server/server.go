@@ -78,6 +78,24 @@ func main() {
 			if err == nil {
 				fmt.Println("Current test capacity:", capacity)
 			}
+		case "workers":
+			var workers []*test161.WorkerInfo
+			workers, err = CtrlWorkers()
+			if err == nil {
+				printWorkers(workers)
+			}
+		case "drain-worker", "remove-worker":
+			if len(os.Args) != 3 {
+				err = fmt.Errorf("Wrong number of arguments to %v", os.Args[1])
+			} else {
+				err = CtrlWorker(os.Args[1], os.Args[2])
+			}
+		case "worker":
+			err = runWorker(os.Args[2:])
+		case "verify":
+			err = runVerify(os.Args[2:])
+		case "panics":
+			err = runPanics(os.Args[2:])
 		case "version":
 			fmt.Printf("test161-server version: %v\n", test161.Version)
 			err = nil
@@ -107,6 +125,10 @@ func main() {
 	ctrl := &ControlServer{}
 	servers = append(servers, ctrl)
 
+	if conf := submissionServer.conf; conf.WorkerPort > 0 || conf.LocalWorkers > 0 {
+		servers = append(servers, NewWorkerServer(conf))
+	}
+
 	for _, s := range servers {
 		go s.Start()
 	}
@@ -23,7 +23,9 @@ type SubmissionServerConfig struct {
 	CacheDir         string                 `yaml:"cachedir"`
 	Test161Dir       string                 `yaml:"test161dir"`
 	OverlayDir       string                 `yaml:"overlaydir"`
+	HandoutDir       string                 `yaml:"handoutdir"`
 	KeyDir           string                 `yaml:"keydir"`
+	SecureKeyDir     string                 `yaml:"secure_keydir"`
 	UsageDir         string                 `yaml:"usagedir"`
 	MaxTests         uint                   `yaml:"max_tests"`
 	Database         string                 `yaml:"db_name"`
@@ -37,6 +39,18 @@ type SubmissionServerConfig struct {
 	MinClient        test161.ProgramVersion `yaml:"min_client"`
 	StaffOnlyTargets []string               `yaml:"staff_only_targets"`
 	DisabledTargets  []string               `yaml:"disabled_targets"`
+	UserConcurrency  uint                   `yaml:"user_concurrency"`
+	Resources        test161.ResourceBudget `yaml:"resources"`
+	AutoTune         test161.AutoTuneConf   `yaml:"autotune"`
+	WorkerPort       uint                   `yaml:"worker_port"`
+	WorkerToken      string                 `yaml:"worker_token"`
+	WorkerCapacity   uint                   `yaml:"worker_capacity"`
+	LocalWorkers     uint                   `yaml:"local_workers"`
+	WorkerCert       string                 `yaml:"worker_cert"`
+	WorkerKey        string                 `yaml:"worker_key"`
+	WorkerCA         string                 `yaml:"worker_ca"`
+	Quotas           QuotaConfig            `yaml:"quotas"`
+	BuildSandbox     *test161.BuildSandbox  `yaml:"build_sandbox"`
 }
 
 const CONF_FILE = ".test161-server.conf"
@@ -62,6 +76,7 @@ type SubmissionServer struct {
 	conf          *SubmissionServerConfig
 	env           *test161.TestEnvironment
 	submissionMgr *test161.SubmissionManager
+	quotas        *quotaTracker
 }
 
 var submissionServer *SubmissionServer
@@ -138,7 +153,11 @@ func submissionRequestFromHttp(w http.ResponseWriter, r *http.Request, validateO
 	return &request
 }
 
-func (s *SubmissionServer) validateRequest(request *test161.SubmissionRequest) (int, error) {
+// Validate the request, returning the users' remaining quotas if it's OK. If
+// reserve is set, the submission is counted against their quotas, and the
+// reservation must be released if the submission isn't created.
+func (s *SubmissionServer) validateRequest(request *test161.SubmissionRequest,
+	reserve bool) (int, []*test161.SubmissionQuota, *quotaReservation, error) {
 
 	var err error
 
@@ -146,7 +165,7 @@ func (s *SubmissionServer) validateRequest(request *test161.SubmissionRequest) (
 	if request.ClientVersion.CompareTo(s.conf.MinClient) < 0 {
 		logger.Printf("Old request (version %v)\n", request.ClientVersion)
 		err = errors.New("test161 version too old, test161-server requires version " + s.conf.MinClient.String())
-		return http.StatusNotAcceptable, err
+		return http.StatusNotAcceptable, nil, nil, err
 	}
 
 	// Check to see if we're accepting submissions
@@ -154,20 +173,29 @@ func (s *SubmissionServer) validateRequest(request *test161.SubmissionRequest) (
 		// We're trying to shut down
 		logger.Println("Rejecting due to SM_NOT_ACCEPTING")
 		err = errors.New("The submission server is currently not accepting new submissions")
-		return http.StatusServiceUnavailable, err
+		return http.StatusServiceUnavailable, nil, nil, err
 	}
 
 	// Validate the students and check if we're accepting staff-only submissions
-	if students, err := request.Validate(s.env); err != nil {
+	students, err := request.Validate(s.env)
+	if err != nil {
 		// Unprocessable entity
-		return 422, err
+		return 422, nil, nil, err
 	} else if err = s.checkStaffOnlySubmission(students); err != nil {
-		return http.StatusServiceUnavailable, err
+		return http.StatusServiceUnavailable, nil, nil, err
 	} else if err = s.checkTargetBlacklists(students, request.Target); err != nil {
-		return http.StatusServiceUnavailable, err
+		return http.StatusServiceUnavailable, nil, nil, err
+	} else if err = s.checkDeadlines(students, request.Target); err != nil {
+		return http.StatusForbidden, nil, nil, err
+	}
+
+	// Finally, make sure they haven't used up their quotas
+	quotas, res, err := s.quotas.check(students, request.Target, s.env, reserve)
+	if err != nil {
+		return http.StatusTooManyRequests, quotas, nil, err
 	}
 
-	return http.StatusOK, nil
+	return http.StatusOK, quotas, res, nil
 }
 
 func (s *SubmissionServer) GetEnv() *test161.TestEnvironment {
@@ -211,16 +239,38 @@ func (s *SubmissionServer) checkTargetBlacklists(students []*test161.Student, ta
 	return nil
 }
 
+// Make sure the target is open and the deadline (including any extensions and
+// late window) hasn't passed. Staff can submit at any time.
+func (s *SubmissionServer) checkDeadlines(students []*test161.Student, targetName string) error {
+	target, ok := s.env.Targets[targetName]
+	if !ok {
+		return nil
+	}
+
+	for _, student := range students {
+		if isStaff, _ := student.IsStaff(s.env); isStaff {
+			return nil
+		}
+	}
+
+	return target.CheckSubmissionTime(students, time.Now())
+}
+
 func (s *SubmissionServer) NewSubmission(request *test161.SubmissionRequest) (*test161.Submission, []error) {
 	return test161.NewSubmission(request, s.env)
 }
 
+func (s *SubmissionServer) Enqueue(submission *test161.Submission) (uint, error) {
+	return s.submissionMgr.Enqueue(submission)
+}
+
 func (s *SubmissionServer) RunAsync(submission *test161.Submission) {
 	// Run it!
 	go func() {
 		if err := s.submissionMgr.Run(submission); err != nil {
 			logger.Println("Error running submission:", err)
 		}
+		s.quotas.finished(submission)
 	}()
 }
 
@@ -236,9 +286,10 @@ func createSubmission(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate with the submission server
-	if response, err := submissionServer.validateRequest(request); err != nil {
-		sendErrorCode(w, response, err)
+	// Validate with the submission server, which reserves the submission
+	status, _, reservation, err := submissionServer.validateRequest(request, true)
+	if err != nil {
+		sendErrorCode(w, status, err)
 		return
 	}
 
@@ -246,6 +297,8 @@ func createSubmission(w http.ResponseWriter, r *http.Request) {
 	submission, errs := submissionServer.NewSubmission(request)
 
 	if len(errs) > 0 {
+		submissionServer.quotas.release(reservation)
+
 		w.Header().Set("Content-Type", JsonHeader)
 		w.WriteHeader(422) // unprocessable entity
 
@@ -261,7 +314,25 @@ func createSubmission(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Get in line, and let the client know where they are
+	pos, err := submissionServer.Enqueue(submission)
+	if err != nil {
+		submissionServer.quotas.release(reservation)
+		sendErrorCode(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", JsonHeader)
 	w.WriteHeader(http.StatusCreated)
+
+	response := &test161.SubmissionResponse{
+		ID:            submission.ID,
+		QueuePosition: pos,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logger.Println("Encoding error (Submission Response):", err)
+	}
+
 	submissionServer.RunAsync(submission)
 }
 
@@ -274,7 +345,8 @@ func validateSubmission(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate with the submission server
-	if response, err := submissionServer.validateRequest(request); err != nil {
+	response, quotas, _, err := submissionServer.validateRequest(request, false)
+	if err != nil {
 		sendErrorCode(w, response, err)
 		return
 	}
@@ -283,7 +355,16 @@ func validateSubmission(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", JsonHeader)
 	w.WriteHeader(http.StatusOK)
 
-	if len(keyInfo) > 0 {
+	// Older clients only understand the key info
+	if request.ClientVersion.CompareTo(test161.VALIDATE_RESPONSE_VERSION) >= 0 {
+		validateResponse := &test161.ValidateResponse{
+			Keys:   keyInfo,
+			Quotas: quotas,
+		}
+		if err := json.NewEncoder(w).Encode(validateResponse); err != nil {
+			logger.Println("Encoding error (Validate Response):", err)
+		}
+	} else if len(keyInfo) > 0 {
 		if err := json.NewEncoder(w).Encode(keyInfo); err != nil {
 			logger.Println("Encoding error (Validate Response):", err)
 		}
@@ -388,18 +469,18 @@ func loadServerConfig() (*SubmissionServerConfig, error) {
 	return conf, nil
 }
 
-func (s *SubmissionServer) setUpEnvironment() error {
-	// MongoDB connection
+// Connect to MongoDB using the server config
+func connectMongo(conf *SubmissionServerConfig) (test161.PersistenceManager, error) {
 	mongoTestDialInfo := &mgo.DialInfo{
-		Username:       s.conf.DBUser,
-		Password:       s.conf.DBPassword,
-		Database:       s.conf.Database,
-		Addrs:          s.conf.DBServers,
-		ReplicaSetName: s.conf.DBReplicaSet,
-		Timeout:        time.Duration(s.conf.DBTimeout) * time.Second,
+		Username:       conf.DBUser,
+		Password:       conf.DBPassword,
+		Database:       conf.Database,
+		Addrs:          conf.DBServers,
+		ReplicaSetName: conf.DBReplicaSet,
+		Timeout:        time.Duration(conf.DBTimeout) * time.Second,
 	}
 
-	if s.conf.DBSSL {
+	if conf.DBSSL {
 		logger.Println("Initializing SSL...")
 		mongoTestDialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
 			return tls.Dial("tcp", addr.String(), &tls.Config{})
@@ -409,9 +490,37 @@ func (s *SubmissionServer) setUpEnvironment() error {
 	logger.Println("Initializing connection to MongoDB...")
 	mongo, err := test161.NewMongoPersistence(mongoTestDialInfo)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	logger.Println("Connected to MongoDB.")
+	return mongo, nil
+}
+
+// The sandbox for student builds, which always run in one. Workers build with
+// the same sandbox as the server. The default sandbox isolates commands if
+// this host can, since without isolation Makefiles have the network and no
+// process limit.
+func buildSandbox(conf *SubmissionServerConfig) (*test161.BuildSandbox, error) {
+	if conf.BuildSandbox == nil {
+		sandbox := test161.DefaultBuildSandbox
+		if err := sandbox.Check(); err != nil && sandbox.Isolate {
+			logger.Println("Warning: build commands will not be isolated:", err)
+			sandbox.Isolate = false
+		}
+		conf.BuildSandbox = &sandbox
+	}
+	if err := conf.BuildSandbox.Check(); err != nil {
+		return nil, err
+	}
+	return conf.BuildSandbox, nil
+}
+
+func (s *SubmissionServer) setUpEnvironment() error {
+	// MongoDB connection
+	mongo, err := connectMongo(s.conf)
+	if err != nil {
+		return err
+	}
 
 	// Submission environment
 	env, err := test161.NewEnvironment(s.conf.Test161Dir, mongo)
@@ -421,9 +530,31 @@ func (s *SubmissionServer) setUpEnvironment() error {
 
 	env.CacheDir = s.conf.CacheDir
 	env.OverlayRoot = s.conf.OverlayDir
+	env.HandoutDir = s.conf.HandoutDir
 	env.KeyDir = s.conf.KeyDir
+	env.SecureKeyDir = s.conf.SecureKeyDir
 	env.Log = logger
 
+	// Tag requirements are resolved against our handout repository, never
+	// the student's, so we can't check them without one.
+	if len(env.HandoutDir) == 0 {
+		for _, target := range env.Targets {
+			if target.Commits.HasTags() {
+				return fmt.Errorf("Target %v has tag commit requirements, which need a handoutdir", target.Name)
+			}
+		}
+	}
+
+	if env.BuildSandbox, err = buildSandbox(s.conf); err != nil {
+		return err
+	}
+
+	// Scheduling estimates, which we can live without
+	if env.Estimates, err = test161.LoadTestEstimates(mongo); err != nil {
+		logger.Println("Error loading test estimates:", err)
+		env.Estimates = test161.NewTestEstimates()
+	}
+
 	usageFailDir = s.conf.UsageDir
 
 	logger.Println("Min client ver:", s.conf.MinClient)
@@ -431,6 +562,12 @@ func (s *SubmissionServer) setUpEnvironment() error {
 	// OK, we're good to go
 	s.env = env
 	s.submissionMgr = test161.NewSubmissionManager(s.env)
+	s.submissionMgr.SetUserConcurrency(s.conf.UserConcurrency)
+	s.quotas = newQuotaTracker(s.conf.Quotas)
+
+	if err = test161.SetManagerBudget(s.conf.Resources); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -439,6 +576,9 @@ func (s *SubmissionServer) Start() {
 	// Kick off test161 submission server
 	test161.SetManagerCapacity(s.conf.MaxTests)
 	test161.StartManager()
+	if err := test161.StartManagerAutoTune(s.conf.AutoTune); err != nil {
+		logger.Println("Unable to auto-tune capacity:", err)
+	}
 
 	// Init upload handlers
 	initUploadManagers()
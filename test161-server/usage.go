@@ -58,6 +58,9 @@ func (handler *UsageStatsFileHandler) HandleFile(header *multipart.FileHeader,
 				if err = usageStat.Persist(env); err != nil {
 					logger.Println("Error saving stat:", err)
 				}
+				if env.Estimates != nil {
+					env.Estimates.AddUsage(&usageStat)
+				}
 			}
 		}
 	}()
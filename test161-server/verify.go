@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ops-class/test161"
+	"os"
+	"text/tabwriter"
+)
+
+// Re-check a submission's trusted output, i.e.
+// test161-server verify [-keys file] [-json] submission_id
+func runVerify(args []string) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	keyFile := flags.String("keys", "", "JSON file of the submission's keys (defaults to the secure key directory)")
+	asJSON := flags.Bool("json", false, "print the audit as JSON")
+
+	if err = flags.Parse(args); err != nil {
+		return err
+	} else if len(flags.Args()) != 1 {
+		return errors.New("verify needs exactly one submission ID")
+	}
+	id := flags.Arg(0)
+
+	var keys map[string]string
+	if len(*keyFile) > 0 {
+		keys, err = test161.SecureKeysFromFile(*keyFile)
+	} else if len(conf.SecureKeyDir) > 0 {
+		keys, err = test161.LoadSecureKeys(conf.SecureKeyDir, id)
+		if os.IsNotExist(err) {
+			logger.Printf("No saved keys for submission %v\n", id)
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	mongo, err := connectMongo(conf)
+	if err != nil {
+		return err
+	}
+	defer mongo.Close()
+
+	audit, err := test161.AuditSubmission(mongo, id, keys)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		data, err := json.MarshalIndent(audit, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		printAudit(audit)
+	}
+
+	if !audit.OK() {
+		return fmt.Errorf("%v trusted output problem(s) in submission %v", len(audit.Problems), id)
+	}
+	return nil
+}
+
+func printAudit(audit *test161.SecureAudit) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Key\tStatus")
+	for _, key := range audit.Keys {
+		fmt.Fprintf(w, "%v\t%v\n", key.ID, key.Status)
+	}
+	w.Flush()
+
+	fmt.Println()
+	fmt.Println("Verified lines:    ", audit.Verified)
+	fmt.Println("Unverifiable lines:", audit.Unverifiable)
+	fmt.Println("Problems:          ", len(audit.Problems))
+
+	if len(audit.Problems) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "Test\tCommand\tProblem\tLine")
+		for _, p := range audit.Problems {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", p.TestName, p.Command, p.Problem, p.Line)
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ops-class/test161"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Workers read the shared token from here, so it doesn't show up in ps.
+const WORKER_TOKEN_ENV = "TEST161_WORKER_TOKEN"
+
+// The pool of remote workers, if the server accepts them
+var workerPool *test161.WorkerPool
+
+// WorkerServer accepts connections from test161 workers and starts any local
+// worker processes.
+type WorkerServer struct {
+	conf *SubmissionServerConfig
+
+	l      sync.Mutex
+	locals []*exec.Cmd
+}
+
+func NewWorkerServer(conf *SubmissionServerConfig) *WorkerServer {
+	return &WorkerServer{
+		conf:   conf,
+		locals: make([]*exec.Cmd, 0),
+	}
+}
+
+func (ws *WorkerServer) Start() {
+	token := ws.conf.WorkerToken
+
+	// Local workers don't need a configured token
+	if len(token) == 0 && ws.conf.LocalWorkers > 0 {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err != nil {
+			logger.Println("Error generating worker token:", err)
+			return
+		}
+		token = hex.EncodeToString(buf)
+	}
+
+	workerPool = test161.NewWorkerPool(token)
+	test161.SetManagerWorkers(workerPool)
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("WorkerHub", workerPool.Hub()); err != nil {
+		logger.Println("Error registering worker hub:", err)
+		return
+	}
+
+	// Use our own mux so the control RPC isn't exposed on the worker port
+	mux := http.NewServeMux()
+	mux.Handle(test161.WORKER_RPC_PATH, server)
+
+	// Local workers get their own loopback port, so they never need TLS
+	if ws.conf.LocalWorkers > 0 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			logger.Println("Error listening for local workers:", err)
+			return
+		}
+		go func() {
+			logger.Println(http.Serve(l, mux))
+		}()
+
+		port := l.Addr().(*net.TCPAddr).Port
+		for i := uint(0); i < ws.conf.LocalWorkers; i++ {
+			ws.startLocalWorker(fmt.Sprintf("local-%v", i), fmt.Sprintf("127.0.0.1:%v", port), token)
+		}
+	}
+
+	if ws.conf.WorkerPort == 0 {
+		return
+	}
+
+	l, err := ws.listen()
+	if err != nil {
+		logger.Println("Error listening for workers:", err)
+		return
+	}
+	logger.Println("Listening for workers on", l.Addr())
+
+	logger.Println(http.Serve(l, mux))
+}
+
+// Listen on the worker port. Workers are sent the token, secure output keys,
+// and root directories, so remote workers must use TLS. Without a certificate,
+// we only listen on the loopback interface.
+func (ws *WorkerServer) listen() (net.Listener, error) {
+	if len(ws.conf.WorkerCert) == 0 || len(ws.conf.WorkerKey) == 0 {
+		logger.Println("No worker_cert/worker_key, only accepting workers on the loopback interface")
+		return net.Listen("tcp", fmt.Sprintf("127.0.0.1:%v", ws.conf.WorkerPort))
+	}
+
+	cert, err := tls.LoadX509KeyPair(ws.conf.WorkerCert, ws.conf.WorkerKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return tls.Listen("tcp", fmt.Sprintf(":%v", ws.conf.WorkerPort), tlsConf)
+}
+
+func (ws *WorkerServer) startLocalWorker(name, addr, token string) {
+	cmd := exec.Command(os.Args[0], "worker",
+		"-server", addr,
+		"-name", name,
+		"-capacity", fmt.Sprintf("%v", ws.conf.WorkerCapacity),
+	)
+	cmd.Env = append(os.Environ(), WORKER_TOKEN_ENV+"="+token)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		logger.Printf("Error starting local worker %v: %v\n", name, err)
+		return
+	}
+
+	ws.l.Lock()
+	ws.locals = append(ws.locals, cmd)
+	ws.l.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		logger.Printf("Local worker %v exited: %v\n", name, err)
+	}()
+}
+
+func (ws *WorkerServer) Stop() {
+	ws.l.Lock()
+	defer ws.l.Unlock()
+
+	for _, cmd := range ws.locals {
+		cmd.Process.Kill()
+	}
+	ws.locals = ws.locals[:0]
+}
+
+// Run as a worker, i.e. test161-server worker [-server host:port] ...
+func runWorker(args []string) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("worker", flag.ContinueOnError)
+	server := flags.String("server", fmt.Sprintf("localhost:%v", conf.WorkerPort), "host:port of the server's worker endpoint")
+	name := flags.String("name", "", "worker name (defaults to the host name)")
+	capacity := flags.Uint("capacity", conf.WorkerCapacity, "number of builds and tests to run at once")
+	cacheDir := flags.String("cachedir", "", "where to keep root directories")
+
+	if err = flags.Parse(args); err != nil {
+		return err
+	} else if len(flags.Args()) > 0 {
+		return errors.New("Unexpected arguments: " + strings.Join(flags.Args(), " "))
+	}
+
+	if *capacity == 0 {
+		*capacity = 1
+	}
+
+	token := os.Getenv(WORKER_TOKEN_ENV)
+	if len(token) == 0 {
+		token = conf.WorkerToken
+	}
+
+	if len(*name) == 0 {
+		if *name, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	env, err := test161.NewEnvironment(conf.Test161Dir, nil)
+	if err != nil {
+		return err
+	}
+	env.Log = logger
+
+	if env.BuildSandbox, err = buildSandbox(conf); err != nil {
+		return err
+	}
+
+	tlsConf, err := workerTLSConfig(conf, *server)
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Worker %v connecting to %v\n", *name, *server)
+
+	return test161.RunWorker(env, &test161.WorkerConfig{
+		Server:   *server,
+		Token:    token,
+		Name:     *name,
+		Capacity: *capacity,
+		CacheDir: *cacheDir,
+		TLS:      tlsConf,
+	})
+}
+
+// The server only accepts plain connections on the loopback interface, so we
+// use TLS for anything else. worker_ca verifies a self-signed certificate.
+func workerTLSConfig(conf *SubmissionServerConfig, server string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	if host == "localhost" {
+		return nil, nil
+	} else if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil, nil
+	}
+
+	tlsConf := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(conf.WorkerCA) > 0 {
+		data, err := ioutil.ReadFile(conf.WorkerCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("No certificates found in " + conf.WorkerCA)
+		}
+	}
+	return tlsConf, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ops-class/test161"
+	"os"
+)
+
+var (
+	buildDebug      bool
+	buildNoCache    bool
+	buildRemote     bool
+	buildTargetName string
+	buildCommit     string
+)
+
+// The kernel config we build if no target is given
+const BUILD_DEFAULT_KCONFIG = "DUMBVM"
+
+func getBuildArgs() error {
+	buildFlags := flag.NewFlagSet("test161 build", flag.ExitOnError)
+	buildFlags.Usage = usage
+
+	buildFlags.BoolVar(&buildDebug, "debug", false, "")
+	buildFlags.BoolVar(&buildNoCache, "no-cache", false, "")
+	buildFlags.BoolVar(&buildRemote, "remote", false, "")
+	buildFlags.StringVar(&buildTargetName, "target", "", "")
+	buildFlags.Parse(os.Args[2:]) // this may exit
+
+	args := buildFlags.Args()
+	if len(args) > 1 {
+		return errors.New("test161 build: Too many arguments. run test161 help for detailed usage")
+	} else if len(args) == 1 {
+		buildCommit = args[0]
+	}
+
+	return nil
+}
+
+// Get the build configuration for the target, or the default configuration
+// if there isn't one.
+func getBuildConf() (*test161.BuildConf, error) {
+	if len(buildTargetName) == 0 {
+		return &test161.BuildConf{
+			KConfig:          BUILD_DEFAULT_KCONFIG,
+			RequiresUserland: true,
+		}, nil
+	}
+
+	target, ok := env.Targets[buildTargetName]
+	if !ok {
+		return nil, fmt.Errorf("Target '%v' does not exist locally", buildTargetName)
+	}
+	return target.BuildConf(), nil
+}
+
+// test161 build ...
+func doBuild() (exitcode int) {
+	exitcode = 1
+
+	if err := getBuildArgs(); err != nil {
+		printRunError(err)
+		return
+	}
+
+	if ok, err := checkGitVersionAndComplain(); err != nil {
+		err = fmt.Errorf("Unable to check Git version: %v", err)
+		printRunError(err)
+		return
+	} else if !ok {
+		return
+	}
+
+	conf, err := getBuildConf()
+	if err != nil {
+		printRunError(err)
+		return
+	}
+
+	git, err := gitRepoFromDir(clientConf.SrcDir, buildDebug)
+	if err != nil {
+		printRunError(err)
+		return
+	}
+
+	// Build the commit, like the server does, so we only get committed changes
+	treeish := "HEAD"
+	if len(buildCommit) > 0 {
+		treeish = buildCommit
+	}
+	commitCmd := &gitCmdSpec{
+		cmdline: "git rev-parse --verify " + treeish + "^{commit}",
+		debug:   buildDebug,
+	}
+	if conf.CommitID, err = git.doOneCommand(commitCmd); err != nil {
+		printRunError(fmt.Errorf("Cannot find commit '%v': %v", treeish, err))
+		return
+	}
+
+	if dirty, err := git.isLocalDirty(buildDebug); err == nil && dirty {
+		fmt.Fprintf(os.Stderr, "Warning: Your working directory has changes that are not committed, and will not be built\n")
+	}
+
+	// Clone from the remote, like the server, or the local repo
+	if buildRemote {
+		if !git.canSubmit() {
+			// This prints its own message
+			return
+		}
+		conf.Repo = git.remoteURL
+	} else {
+		conf.Repo = clientConf.SrcDir
+	}
+
+	conf.Users = make([]string, 0, len(clientConf.Users))
+	for _, u := range clientConf.Users {
+		conf.Users = append(conf.Users, u.Email)
+	}
+
+	// Cache the repo for performance, unless we're told not to
+	if !buildNoCache {
+		conf.CacheDir = CACHE_DIR
+	}
+
+	env.KeyDir = KEYS_DIR
+	env.Persistence = &ConsolePersistence{}
+
+	fmt.Printf("Building %v (%v) from %v\n", treeish, conf.CommitID, conf.Repo)
+
+	buildTest, err := conf.ToBuildTest(env)
+	if err != nil {
+		printRunError(err)
+		return
+	}
+
+	res, err := buildTest.Run(env)
+	printBuildDiagnostics(buildTest, conf)
+	if err != nil {
+		printRunError(err)
+		return
+	}
+
+	// Keep the scratch directory so they can look at the build
+	if len(res.TempDir) == 0 {
+		defer res.Release()
+	}
+
+	fmt.Println()
+	fmt.Println("Build succeeded. The kernel and userland binaries are in", res.RootDir)
+	exitcode = 0
+	return
+}
+
+// Summarize the compiler warnings and errors, and what the target's warning
+// policy would cost.
+func printBuildDiagnostics(buildTest *test161.BuildTest, conf *test161.BuildConf) {
+	errCount := buildTest.DiagnosticCount(test161.DIAG_SEVERITY_ERROR)
+	warnCount := buildTest.DiagnosticCount(test161.DIAG_SEVERITY_WARNING)
+	if errCount == 0 && warnCount == 0 {
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("%v error(s), %v warning(s)\n", errCount, warnCount)
+	for _, d := range buildTest.Diagnostics {
+		if d.Severity == test161.DIAG_SEVERITY_NOTE {
+			continue
+		}
+		if len(d.File) > 0 {
+			fmt.Printf("    %v:%v: %v: %v\n", d.File, d.Line, d.Severity, d.Message)
+		} else {
+			fmt.Printf("    %v: %v\n", d.Severity, d.Message)
+		}
+	}
+
+	if penalty := conf.Warnings.Penalty(buildTest.Diagnostics); penalty > 0 {
+		fmt.Printf("The server will deduct %v point(s) for warnings\n", penalty)
+	}
+}
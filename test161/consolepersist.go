@@ -33,13 +33,16 @@ func (c *ConsolePersistence) Notify(entity interface{}, msg, what int) error {
 				output := fmt.Sprintf(lineFmt, c.width, cmd.Test.DependencyID, line.SimTime, line.Line)
 				fmt.Println(output)
 			}
+		}
+	} else if msg == test161.MSG_PERSIST_OUTPUT {
+		switch entity.(type) {
 		case *test161.BuildCommand:
 			{
+				// Build output is streamed one line at a time
 				cmd := entity.(*test161.BuildCommand)
-				for _, line := range cmd.Output {
-					output := fmt.Sprintf("%.6f\t%s", line.SimTime, line.Line)
-					fmt.Println(output)
-				}
+				line := cmd.Output[len(cmd.Output)-1]
+				output := fmt.Sprintf("%.6f\t%s", line.SimTime, line.Line)
+				fmt.Println(output)
 			}
 		}
 	} else if msg == test161.MSG_PERSIST_UPDATE && what == test161.MSG_FIELD_STATUSES {
@@ -21,6 +21,14 @@ var (
 	listTagsList  []string
 )
 
+var listTestsExpr string
+
+var (
+	listDepsFormat  string
+	listDepsResults bool
+	listDepsNames   []string
+)
+
 func doListCommand() int {
 	if len(os.Args) < 3 {
 		fmt.Fprintf(os.Stderr, "Missing argument to list command\n")
@@ -38,8 +46,10 @@ func doListCommand() int {
 		return doListAll()
 	case "tagnames":
 		return doListTagnames()
+	case "deps":
+		return doListDeps()
 	default:
-		fmt.Fprintf(os.Stderr, "Invalid option to 'test161 list'.  Must be one of (targets, tags, tests)\n")
+		fmt.Fprintf(os.Stderr, "Invalid option to 'test161 list'.  Must be one of (targets, tags, tests, deps)\n")
 		return 1
 	}
 }
@@ -174,9 +184,55 @@ func getTagArgs() error {
 
 }
 
+func getTestsArgs() error {
+	flags := flag.NewFlagSet("test161 list-tests", flag.ExitOnError)
+	flags.Usage = usage
+
+	flags.Parse(os.Args[3:]) // this may exit
+
+	// Everything else is a tag expression, which may have been split up by
+	// the shell.
+	listTestsExpr = strings.Join(flags.Args(), " ")
+
+	return nil
+}
+
+func getDepsArgs() error {
+	flags := flag.NewFlagSet("test161 list-deps", flag.ExitOnError)
+	flags.Usage = usage
+	flags.StringVar(&listDepsFormat, "format", test161.DEP_GRAPH_FORMAT_DOT, "")
+	flags.StringVar(&listDepsFormat, "f", test161.DEP_GRAPH_FORMAT_DOT, "")
+	flags.BoolVar(&listDepsResults, "results", false, "")
+	flags.BoolVar(&listDepsResults, "r", false, "")
+
+	flags.Parse(os.Args[3:]) // this may exit
+
+	switch listDepsFormat {
+	case test161.DEP_GRAPH_FORMAT_DOT:
+	case test161.DEP_GRAPH_FORMAT_JSON:
+	default:
+		return errors.New("format flag must be one of 'dot' or 'json'")
+	}
+
+	listDepsNames = flags.Args()
+	if len(listDepsNames) == 0 {
+		return errors.New("test161 list deps requires a target, tests, or tags")
+	}
+
+	listDepsNames = joinTagExpr(listDepsNames)
+
+	return nil
+}
+
 func getAllTests() ([]*test161.Test, []error) {
+	return getTestsMatching("**/*.t")
+}
+
+// Get the tests matching a test161 test specification, i.e. a glob or tag
+// expression, sorted by ID.
+func getTestsMatching(spec string) ([]*test161.Test, []error) {
 	conf := &test161.GroupConfig{
-		Tests: []string{"**/*.t"},
+		Tests: []string{spec},
 		Env:   env,
 	}
 
@@ -321,6 +377,11 @@ func doListTags() int {
 }
 
 func doListTests() int {
+	if err := getTestsArgs(); err != nil {
+		printRunError(err)
+		return 1
+	}
+
 	pd := &PrintData{
 		Headings: []*Heading{
 			&Heading{
@@ -337,8 +398,16 @@ func doListTests() int {
 		Config: defaultPrintConf,
 	}
 
-	// Load every test file
-	tests, errs := getAllTests()
+	// Load every test file, or just the ones matching the tag expression
+	var tests []*test161.Test
+	var errs []error
+
+	if len(listTestsExpr) > 0 {
+		tests, errs = getTestsMatching(listTestsExpr)
+	} else {
+		tests, errs = getAllTests()
+	}
+
 	if len(errs) > 0 {
 		printRunErrors(errs)
 		return 1
@@ -389,3 +458,59 @@ func doListAll() int {
 	}
 	return 0
 }
+
+func doListDeps() int {
+	if err := getDepsArgs(); err != nil {
+		printRunError(err)
+		return 1
+	}
+
+	var tg *test161.TestGroup
+	var errs []error
+
+	// Targets first, like 'test161 run'
+	if target, ok := env.Targets[listDepsNames[0]]; ok && len(listDepsNames) == 1 {
+		tg, errs = target.Instance(env)
+	} else {
+		conf := &test161.GroupConfig{
+			Name:    strings.Join(listDepsNames, ", "),
+			UseDeps: true,
+			Tests:   listDepsNames,
+			Env:     env,
+		}
+		tg, errs = test161.GroupFromConfig(conf)
+	}
+
+	if len(errs) > 0 {
+		printRunErrors(errs)
+		return 1
+	}
+
+	var lastRun test161.LastRunResults
+	if listDepsResults {
+		var err error
+		if lastRun, err = test161.LastRunResultsFromFile(LAST_RUN_FILE); err != nil {
+			printRunError(err)
+			return 1
+		}
+	}
+
+	dg, err := tg.ExportDependencyGraph(lastRun)
+	if err != nil {
+		printRunError(err)
+		return 1
+	}
+
+	if listDepsFormat == test161.DEP_GRAPH_FORMAT_JSON {
+		if text, err := dg.JSON(); err != nil {
+			printRunError(err)
+			return 1
+		} else {
+			fmt.Println(text)
+		}
+	} else {
+		fmt.Print(dg.DOT())
+	}
+
+	return 0
+}
@@ -72,9 +72,12 @@ func usage() {
 
     test161 submit [-debug] [-verify] [-no-cache] <target> <commit>
 
+    test161 build [-target <target>] [-remote] [-debug] [-no-cache] [commit]
+
     test161 list tags [-s | -short] [tags]
     test161 list targets [-remote | -r]
-    test161 list tests
+    test161 list tests [tag expression]
+    test161 list deps [-format | -f (dot*|json)] [-results | -r] <names>
 
     test161 config [-debug] [(add-user|del-user|change-token)] <username> <token>
     test161 config test161dir <dir>
@@ -101,6 +104,11 @@ targets, adding the -tag flag forces test161 to interpet a single positional
 argument as a tag. This flag can be safely omitted as long there as there are no
 conflicts between tag and target name.
 
+Tag Expressions: Tags can be combined using 'and', 'or', 'not', and parentheses,
+e.g. "syscalls and not stress" or "(sync or threads) and stress". Quote the
+expression, or use -tag so the remaining arguments are treated as one
+expression.
+
 Output: Unless specified by -sequential, all output is interleaved with a
 summary at the end.  You can disable test output lines with -v quiet, and hide
 everything except pass/fail with -v whisper. Specifying -dry-run will show you
@@ -129,12 +137,28 @@ repository.  Adding -no-cache will clone the repo locally instead of using a
 previously cached copy.
 
 
+'test161 build' builds your kernel and userland the same way the server does:
+it clones your repository into a scratch directory, checks out the commit,
+applies the target's overlay (if TEST161_OVERLAY is set), and runs configure and
+bmake. Use this to check what the server will build before submitting. The
+commit defaults to HEAD, and may be a commit id, branch, or tag.
+Uncommitted changes are not built. Adding -target builds with the target's
+kernel config and settings instead of DUMBVM with userland, and reports the
+target's warning penalty. Adding -remote clones from your Git remote using your
+deployment key, like the server, instead of your local repository. Adding
+-no-cache builds in a new temp directory, which is left for you to inspect.
+
+
 'test161 list' prints a variety of useful information. 'test161 list targets'
 shows the local targets available to test161; adding -r will show the remote
 targets instead. 'test161 list tags' shows a listing of tags, their
 descriptions, and tests for each tag. Adding -shprt will print the tests for a
 concise table of tag names and descriptions. 'test161 list tests' lists all
-tests available to test161 along with their descriptions.
+tests available to test161 along with their descriptions. Adding a tag
+expression only lists the tests it selects. 'test161 list deps' prints the
+dependency graph of a target, tests, or tags in Graphviz dot (default) or json
+format. Adding -results annotates each test with the result and points from the
+last time it was run.
 
 
 'test161 config' is used to view and change test161 configuration. When run with
@@ -179,6 +203,12 @@ var cmdTable = map[string]*test161Command{
 		reqSource: true,
 		reqTests:  true,
 	},
+	"build": &test161Command{
+		cmd:       doBuild,
+		reqEnv:    true,
+		reqSource: true,
+		reqTests:  true,
+	},
 	"list": &test161Command{
 		cmd:      doListCommand,
 		reqEnv:   true,
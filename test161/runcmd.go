@@ -90,6 +90,11 @@ func getRunArgs() error {
 		return errors.New("At least one test or target must be specified")
 	}
 
+	// Allow unquoted tag expressions, e.g. -tag sync and not cv
+	if runCommandVars.isTag {
+		runCommandVars.tests = joinTagExpr(runCommandVars.tests)
+	}
+
 	switch runCommandVars.verbose {
 	case VERBOSE_LOUD:
 	case VERBOSE_QUIET:
@@ -101,6 +106,17 @@ func getRunArgs() error {
 	return nil
 }
 
+// If the arguments contain tag expression operators, they were meant as a
+// single expression and the shell split them up.
+func joinTagExpr(args []string) []string {
+	for _, arg := range args {
+		if test161.IsTagExprKeyword(arg) || strings.ContainsAny(arg, "()") {
+			return []string{strings.Join(args, " ")}
+		}
+	}
+	return args
+}
+
 func runTestGroup(tg *test161.TestGroup, useDeps bool, desc string) int {
 	var r test161.TestRunner
 	if useDeps {
@@ -127,11 +143,23 @@ func runTestGroup(tg *test161.TestGroup, useDeps bool, desc string) int {
 		env.Persistence = &ConsolePersistence{max}
 	}
 
+	// Estimate how long this will take based on previous runs. The
+	// dependency runner also uses the estimates to prioritize tests.
+	times := &runTimes{}
+	if useDeps {
+		if lastRun, err := test161.LastRunResultsFromFile(LAST_RUN_FILE); err == nil {
+			tg.SetEstimatedTimes(lastRun)
+		}
+		if est, err := tg.EstimateMakespan(test161.ManagerCapacity()); err == nil {
+			times.Estimated = float64(est)
+			times.HaveEstimate = true
+		}
+	}
+
 	// Run it
 	test161.StartManager()
 	startTime := time.Now()
 	done := r.Run()
-	endTime := time.Now()
 
 	// For reurn val
 	allCorrect := true
@@ -145,10 +173,14 @@ func runTestGroup(tg *test161.TestGroup, useDeps bool, desc string) int {
 		}
 	}
 
+	endTime := time.Now()
+	times.Actual = endTime.Sub(startTime).Seconds()
+
 	test161.StopManager()
 
-	printRunSummary(tg, runCommandVars.verbose, useDeps)
+	printRunSummary(tg, runCommandVars.verbose, useDeps, times)
 	logUsageStat(tg, desc, startTime, endTime)
+	saveLastRunResults(tg, endTime)
 
 	if allCorrect {
 		return 0
@@ -157,7 +189,22 @@ func runTestGroup(tg *test161.TestGroup, useDeps bool, desc string) int {
 	}
 }
 
-func printRunSummary(tg *test161.TestGroup, verbosity string, tryDependOrder bool) {
+// Remember the results of this run so 'test161 list deps -results' can show
+// them later.
+func saveLastRunResults(tg *test161.TestGroup, when time.Time) {
+	if err := test161.UpdateLastRunResults(LAST_RUN_FILE, tg, when); err != nil {
+		printRunError(err)
+	}
+}
+
+// Estimated and actual wall clock time (seconds) to run a group
+type runTimes struct {
+	Estimated    float64
+	HaveEstimate bool
+	Actual       float64
+}
+
+func printRunSummary(tg *test161.TestGroup, verbosity string, tryDependOrder bool, times *runTimes) {
 	pd := &PrintData{
 		Headings: []*Heading{
 			&Heading{
@@ -262,6 +309,9 @@ func printRunSummary(tg *test161.TestGroup, verbosity string, tryDependOrder boo
 		}
 		fmt.Println()
 		pd.Print()
+		printPanics(tests)
+		printSubChecks(tests)
+		printMetrics(tests)
 	}
 
 	// Print totals
@@ -276,6 +326,14 @@ func printRunSummary(tg *test161.TestGroup, verbosity string, tryDependOrder boo
 
 	fmt.Println()
 
+	if times != nil {
+		if times.HaveEstimate {
+			fmt.Printf("%-15v: %.1fs\n", "Estimated Time", times.Estimated)
+		}
+		fmt.Printf("%-15v: %.1fs\n", "Actual Time", times.Actual)
+		fmt.Println()
+	}
+
 	bold := color.New(color.Bold).SprintFunc()
 
 	if len(scores) > 0 {
@@ -293,6 +351,149 @@ func printRunSummary(tg *test161.TestGroup, verbosity string, tryDependOrder boo
 	fmt.Println()
 }
 
+// Print the partial credit sub-check results, if any
+func printSubChecks(tests []*test161.Test) {
+	pd := &PrintData{
+		Headings: []*Heading{
+			&Heading{
+				Text:     "Test",
+				MinWidth: 30,
+			},
+			&Heading{
+				Text: "Command",
+			},
+			&Heading{
+				Text: "Sub-check",
+			},
+			&Heading{
+				Text:           "Weight",
+				RightJustified: true,
+			},
+			&Heading{
+				Text:           "Result",
+				RightJustified: true,
+			},
+		},
+		Config: defaultPrintConf,
+		Rows:   make(Rows, 0),
+	}
+
+	for _, test := range tests {
+		for _, cmd := range test.Commands {
+			for _, s := range cmd.SubChecks {
+				var paint *color.Color = COLOR_FAIL
+				if s.Correct() {
+					paint = COLOR_SUCCESS
+				}
+				pd.Rows = append(pd.Rows, []*Cell{
+					&Cell{Text: test.DependencyID},
+					&Cell{Text: cmd.Input.Line},
+					&Cell{Text: s.Name},
+					&Cell{Text: fmt.Sprintf("%v", s.Weight)},
+					&Cell{Text: s.String(), CellColor: paint},
+				})
+			}
+		}
+	}
+
+	if len(pd.Rows) > 0 {
+		fmt.Println()
+		pd.Print()
+	}
+}
+
+// Print the metrics the tests reported, if any
+func printMetrics(tests []*test161.Test) {
+	pd := &PrintData{
+		Headings: []*Heading{
+			&Heading{
+				Text:     "Test",
+				MinWidth: 30,
+			},
+			&Heading{
+				Text: "Metric",
+			},
+			&Heading{
+				Text:           "Mean",
+				RightJustified: true,
+			},
+			&Heading{
+				Text:           "Min",
+				RightJustified: true,
+			},
+			&Heading{
+				Text:           "Max",
+				RightJustified: true,
+			},
+			&Heading{
+				Text:           "Count",
+				RightJustified: true,
+			},
+		},
+		Config: defaultPrintConf,
+		Rows:   make(Rows, 0),
+	}
+
+	for _, test := range tests {
+		for _, m := range test.Metrics {
+			name := m.Name
+			if len(m.Units) > 0 {
+				name += " (" + m.Units + ")"
+			}
+			pd.Rows = append(pd.Rows, []*Cell{
+				&Cell{Text: test.DependencyID},
+				&Cell{Text: name},
+				&Cell{Text: fmt.Sprintf("%.6g", m.Mean())},
+				&Cell{Text: fmt.Sprintf("%.6g", m.Min)},
+				&Cell{Text: fmt.Sprintf("%.6g", m.Max)},
+				&Cell{Text: fmt.Sprintf("%v", m.Count)},
+			})
+		}
+	}
+
+	if len(pd.Rows) > 0 {
+		fmt.Println()
+		pd.Print()
+	}
+}
+
+// Print why sys161 shut down in the tests that crashed, if any
+func printPanics(tests []*test161.Test) {
+	pd := &PrintData{
+		Headings: []*Heading{
+			&Heading{
+				Text:     "Test",
+				MinWidth: 30,
+			},
+			&Heading{
+				Text: "Command",
+			},
+			&Heading{
+				Text: "Panic",
+			},
+		},
+		Config: defaultPrintConf,
+		Rows:   make(Rows, 0),
+	}
+
+	for _, test := range tests {
+		for _, cmd := range test.Commands {
+			if cmd.PanicInfo != nil && cmd.Status == test161.COMMAND_STATUS_INCORRECT {
+				pd.Rows = append(pd.Rows, []*Cell{
+					&Cell{Text: test.DependencyID},
+					&Cell{Text: cmd.Input.Line},
+					&Cell{Text: cmd.PanicInfo.String(), CellColor: COLOR_FAIL},
+				})
+			}
+		}
+	}
+
+	if len(pd.Rows) > 0 {
+		fmt.Println()
+		pd.Print()
+	}
+}
+
 func runTests() (int, []error) {
 
 	var target *test161.Target
@@ -331,7 +532,7 @@ func runTests() (int, []error) {
 	} else {
 		desc := ""
 		for _, t := range runCommandVars.tests {
-			if !strings.HasSuffix(t, ".t") {
+			if !test161.IsTestSpec(t) {
 				if len(desc) == 0 {
 					desc = t
 				} else {
@@ -66,7 +66,7 @@ func localSubmitTest(req *test161.SubmissionRequest) (scores []*scoreMapEntry, e
 		return
 	}
 
-	printRunSummary(submission.Tests, VERBOSE_LOUD, true)
+	printRunSummary(submission.Tests, VERBOSE_LOUD, true, nil)
 
 	scores = splitScores(submission.Tests)
 
@@ -239,8 +239,11 @@ func doSubmit() (exitcode int) {
 	}
 
 	// Finally, submit
-	if err := submit(req); err == nil {
+	if resp, err := submit(req); err == nil {
 		fmt.Println("Your submission has been created and is being processed by the test161 server")
+		if resp != nil && resp.QueuePosition > 1 {
+			fmt.Printf("Your submission is number %v in the queue\n", resp.QueuePosition)
+		}
 		exitcode = 0
 	} else {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
@@ -264,9 +267,14 @@ func validateSubmission(req *test161.SubmissionRequest) error {
 	}
 
 	// Handle the response from the server, specifically, handle
-	// the test161 private keys that are returned.
+	// the test161 private keys that are returned. Older servers only send
+	// the keys.
 	keyData := make([]*test161.RequestKeyResonse, 0)
-	if err := json.Unmarshal([]byte(body), &keyData); err != nil {
+	resp := &test161.ValidateResponse{}
+	if err := json.Unmarshal([]byte(body), resp); err == nil {
+		keyData = resp.Keys
+		printQuotas(resp.Quotas)
+	} else if err := json.Unmarshal([]byte(body), &keyData); err != nil {
 		return fmt.Errorf("Unable to parse server response (validate): %v", err)
 	}
 
@@ -301,9 +309,35 @@ login to https://test161.ops-class.org and go to your settings page.`)
 	return nil
 }
 
-func submit(req *test161.SubmissionRequest) error {
-	_, err := submitOrValidate(req, false)
-	return err
+// Let users know when they're getting close to their submission limits.
+func printQuotas(quotas []*test161.SubmissionQuota) {
+	for _, quota := range quotas {
+		if quota.Remaining < 0 {
+			continue
+		}
+		// This submission counts too
+		left := quota.Remaining - 1
+		if left < 0 {
+			left = 0
+		}
+		fmt.Printf("%v can submit to %v %v more time(s) in the current %v minute window\n",
+			quota.User, quota.Target, left, quota.Window)
+	}
+}
+
+// Submit the request. The response is nil if the server didn't send one.
+func submit(req *test161.SubmissionRequest) (*test161.SubmissionResponse, error) {
+	body, err := submitOrValidate(req, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Older servers don't send anything back
+	resp := &test161.SubmissionResponse{}
+	if err := json.Unmarshal([]byte(body), resp); err != nil {
+		return nil, nil
+	}
+	return resp, nil
 }
 
 // Return true if OK, false otherwise
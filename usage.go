@@ -30,13 +30,19 @@ type GroupStat struct {
 }
 
 type TestStat struct {
-	Name            string     `json:"name" bson:"name"`
-	Result          TestResult `json:"result" bson:"result"`
-	PointsAvailable uint       `json:"points_avail" bson:"points_avail"`
-	PointsEarned    uint       `json:"points_earned" bson:"points_earned"`
-	MemLeakBytes    int        `json:"mem_leak_bytes" bson:"mem_leak_bytes"`
-	MemLeakPoints   uint       `json:"mem_leak_points" bson:"mem_leak_points"`
-	MemLeakDeducted uint       `json:"mem_leak_deducted" bson:"mem_leak_deducted"`
+	Name            string         `json:"name" bson:"name"`
+	DependencyID    string         `json:"id,omitempty" bson:"id,omitempty"`
+	Result          TestResult     `json:"result" bson:"result"`
+	WallTime        TimeFixedPoint `json:"walltime,omitempty" bson:"walltime,omitempty"`
+	PointsAvailable uint           `json:"points_avail" bson:"points_avail"`
+	PointsEarned    uint           `json:"points_earned" bson:"points_earned"`
+	MemLeakBytes    int            `json:"mem_leak_bytes" bson:"mem_leak_bytes"`
+	MemLeakPoints   uint           `json:"mem_leak_points" bson:"mem_leak_points"`
+	MemLeakDeducted uint           `json:"mem_leak_deducted" bson:"mem_leak_deducted"`
+	Metrics         []*Metric      `json:"metrics,omitempty" bson:"metrics,omitempty"`
+
+	Invariants []*InvariantCheck `json:"invariants,omitempty" bson:"invariants,omitempty"`
+	PanicInfo  *PanicInfo        `json:"panic_info,omitempty" bson:"panic_info,omitempty"`
 }
 
 func (stat *UsageStat) JSON() (string, error) {
@@ -95,12 +101,17 @@ func testStatsFromGroup(group *TestGroup) []*TestStat {
 func newTestStat(t *Test) *TestStat {
 	stat := &TestStat{
 		Name:            t.Name,
+		DependencyID:    t.DependencyID,
 		Result:          t.Result,
+		WallTime:        t.WallTime,
 		PointsAvailable: t.PointsAvailable,
 		PointsEarned:    t.PointsEarned,
 		MemLeakBytes:    t.MemLeakBytes,
 		MemLeakPoints:   t.MemLeakPoints,
 		MemLeakDeducted: t.MemLeakDeducted,
+		Metrics:         t.Metrics,
+		Invariants:      t.Invariants,
+		PanicInfo:       t.PanicInfo,
 	}
 	return stat
 }
@@ -0,0 +1,531 @@
+package test161
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/rpc"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements the worker side of test161's distributed workers (see
+// workerpool.go for the protocol).
+
+// WorkerConfig configures a worker process.
+type WorkerConfig struct {
+	Server   string // host:port of the server's worker endpoint
+	Token    string // Shared secret from the server's configuration
+	Name     string
+	Capacity uint   // Number of builds and tests to run at once
+	CacheDir string // Where to keep root directories, defaults to the temp dir
+
+	// How to reach a server that isn't on this machine, or nil for a plain
+	// connection. Servers only accept plain connections on the loopback
+	// interface.
+	TLS *tls.Config
+}
+
+// The number of root directories a worker keeps around. Tests from the same
+// build usually arrive close together, so we don't need many.
+const WORKER_ROOT_CACHE_SIZE = 8
+
+type workerRoot struct {
+	dir      string
+	ready    chan bool // Closed once the root is unpacked
+	err      error
+	users    int
+	lastUsed time.Time
+	release  func() // Removes roots we built, which live in their build directory
+}
+
+func (root *workerRoot) remove() {
+	if root.release != nil {
+		root.release()
+	} else if len(root.dir) > 0 {
+		os.RemoveAll(root.dir)
+	}
+}
+
+type worker struct {
+	conf   *WorkerConfig
+	env    *TestEnvironment
+	client *rpc.Client
+	id     string
+
+	l     sync.Mutex
+	roots map[string]*workerRoot // Root key -> local copy
+}
+
+// RunWorker registers with the server and runs the builds and tests it sends
+// until the worker is drained. The environment supplies the test161 commands,
+// targets, and build sandbox, which should match the server's.
+func RunWorker(env *TestEnvironment, conf *WorkerConfig) error {
+	if conf.Capacity == 0 {
+		return errors.New("Worker capacity must be greater than 0")
+	}
+
+	client, err := dialWorkerServer(conf)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	w := &worker{
+		conf:   conf,
+		env:    env,
+		client: client,
+		roots:  make(map[string]*workerRoot),
+	}
+	defer w.cleanup()
+
+	reg := &WorkerRegistration{
+		Token:    conf.Token,
+		Name:     conf.Name,
+		Capacity: conf.Capacity,
+	}
+	if err = client.Call("WorkerHub.Register", reg, &w.id); err != nil {
+		return err
+	}
+
+	// Keep the server from thinking we're gone while all our slots are busy
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(WORKER_HEARTBEAT)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				var reply int
+				client.Call("WorkerHub.Heartbeat", &WorkerRequest{WorkerID: w.id}, &reply)
+			}
+		}
+	}()
+
+	// Each slot polls for its own jobs
+	errChan := make(chan error)
+	for i := uint(0); i < conf.Capacity; i++ {
+		go func() {
+			errChan <- w.runSlot()
+		}()
+	}
+
+	// Once one slot has been told to exit, the rest just get errors since
+	// the server has forgotten about us.
+	exited := false
+	for i := uint(0); i < conf.Capacity; i++ {
+		if slotErr := <-errChan; slotErr == nil {
+			exited = true
+		} else if err == nil {
+			err = slotErr
+		}
+	}
+
+	if exited {
+		return nil
+	}
+	return err
+}
+
+// Connect to the server's worker endpoint. This is rpc.DialHTTPPath, but
+// over TLS if it's configured.
+func dialWorkerServer(conf *WorkerConfig) (*rpc.Client, error) {
+	if conf.TLS == nil {
+		return rpc.DialHTTPPath("tcp", conf.Server, WORKER_RPC_PATH)
+	}
+
+	conn, err := tls.Dial("tcp", conf.Server, conf.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	io.WriteString(conn, "CONNECT "+WORKER_RPC_PATH+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = errors.New("Unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return rpc.NewClient(conn), nil
+}
+
+// Run jobs until told to exit (nil) or something goes wrong.
+func (w *worker) runSlot() error {
+	for {
+		job := &WorkerJob{}
+		if err := w.client.Call("WorkerHub.GetJob", &WorkerRequest{WorkerID: w.id}, job); err != nil {
+			return err
+		} else if job.Exit {
+			return nil
+		} else if len(job.ID) == 0 {
+			continue
+		}
+
+		if err := w.runJob(job); err != nil {
+			return err
+		}
+	}
+}
+
+// Run a single job. Errors running the test go back to the server; the
+// returned error means we couldn't talk to the server.
+func (w *worker) runJob(job *WorkerJob) error {
+	if len(job.Build) > 0 {
+		return w.runBuild(job)
+	}
+
+	var test *Test
+	var runErr error
+
+	rootDir, err := w.acquireRoot(job)
+	if err == nil {
+		defer w.releaseRoot(job.RootKey)
+		test, err = job.test()
+	}
+
+	if err == nil {
+		env := w.env.CopyEnvironment()
+		env.keyMap = job.KeyMap
+		env.RootDir = rootDir
+		env.Persistence = &workerPersistence{w: w, jobID: job.ID, test: test}
+		runErr = test.Run(env)
+	} else {
+		runErr = err
+	}
+
+	res := &WorkerResult{
+		WorkerID: w.id,
+		JobID:    job.ID,
+	}
+	if runErr != nil {
+		res.Err = fmt.Sprintf("%v", runErr)
+	}
+	if test != nil {
+		if res.Test, err = json.Marshal(test); err != nil {
+			res.Err = fmt.Sprintf("%v", err)
+		}
+	}
+
+	var reply int
+	return w.client.Call("WorkerHub.Complete", res, &reply)
+}
+
+// Get a local copy of the job's root directory, fetching it from the server
+// if we don't have it.
+func (w *worker) acquireRoot(job *WorkerJob) (string, error) {
+	w.l.Lock()
+	root, ok := w.roots[job.RootKey]
+	if !ok {
+		root = &workerRoot{ready: make(chan bool)}
+		w.roots[job.RootKey] = root
+		w.evictRoots()
+	}
+	root.users += 1
+	root.lastUsed = time.Now()
+	w.l.Unlock()
+
+	if !ok {
+		root.dir, root.err = w.fetchRoot(job)
+		close(root.ready)
+	}
+	<-root.ready
+
+	if root.err != nil {
+		w.l.Lock()
+		root.users -= 1
+		if w.roots[job.RootKey] == root {
+			delete(w.roots, job.RootKey)
+		}
+		w.l.Unlock()
+		return "", root.err
+	}
+
+	return root.dir, nil
+}
+
+func (w *worker) releaseRoot(key string) {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	if root, ok := w.roots[key]; ok {
+		root.users -= 1
+	}
+}
+
+// Remove the least recently used roots that aren't in use until we're under
+// the cache size. Must hold w.l.
+func (w *worker) evictRoots() {
+	for len(w.roots) > WORKER_ROOT_CACHE_SIZE {
+		oldest := ""
+		for key, root := range w.roots {
+			if root.users > 0 {
+				continue
+			}
+			if oldest == "" || root.lastUsed.Before(w.roots[oldest].lastUsed) {
+				oldest = key
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		w.roots[oldest].remove()
+		delete(w.roots, oldest)
+	}
+}
+
+func (w *worker) cleanup() {
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	for key, root := range w.roots {
+		root.remove()
+		delete(w.roots, key)
+	}
+}
+
+// Add the root of a build we ran, so we don't fetch it for the build's tests.
+func (w *worker) addRoot(key string, res *BuildResults) {
+	root := &workerRoot{
+		dir:      res.RootDir,
+		ready:    make(chan bool),
+		lastUsed: time.Now(),
+		release:  res.Release,
+	}
+	close(root.ready)
+
+	w.l.Lock()
+	defer w.l.Unlock()
+
+	w.roots[key] = root
+	w.evictRoots()
+}
+
+func (w *worker) fetchRoot(job *WorkerJob) (string, error) {
+	var data []byte
+	req := &WorkerRequest{WorkerID: w.id, JobID: job.ID}
+	if err := w.client.Call("WorkerHub.GetRoot", req, &data); err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir(w.conf.CacheDir, "test161-root")
+	if err != nil {
+		return "", err
+	}
+
+	if err = untarDirectory(data, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// workerPersistence forwards a remote test's or build's persistence events to
+// the server.
+type workerPersistence struct {
+	w     *worker
+	jobID string
+	test  *Test      // Test jobs
+	build *BuildTest // Build jobs
+}
+
+func (wp *workerPersistence) Close() {
+}
+
+func (wp *workerPersistence) CanRetrieve() bool {
+	return false
+}
+
+func (wp *workerPersistence) Retrieve(what int, who map[string]interface{},
+	filter map[string]interface{}, res interface{}) error {
+	return errors.New("Workers can't retrieve data")
+}
+
+func (wp *workerPersistence) Notify(entity interface{}, msg, what int) error {
+	event := &WorkerEvent{
+		WorkerID: wp.w.id,
+		JobID:    wp.jobID,
+		Msg:      msg,
+		What:     what,
+		Command:  -1,
+	}
+
+	var err error
+
+	switch entity.(type) {
+	case *Test:
+		event.Data, err = json.Marshal(entity)
+	case *Command:
+		cmd := entity.(*Command)
+		for i, c := range wp.test.Commands {
+			if c == cmd {
+				event.Command = i
+				break
+			}
+		}
+		if event.Command < 0 {
+			return errors.New("Unknown command")
+		}
+		event.Data, err = json.Marshal(cmd)
+	case *BuildTest:
+		event.Data, err = json.Marshal(entity)
+	case *BuildCommand:
+		cmd := entity.(*BuildCommand)
+		for i, c := range wp.build.Commands {
+			if c == cmd {
+				event.Command = i
+				break
+			}
+		}
+		if event.Command < 0 {
+			return errors.New("Unknown command")
+		}
+		if msg == MSG_PERSIST_OUTPUT && len(cmd.Output) > 0 {
+			// Build output is long, so just send the new line
+			event.Data, err = json.Marshal(&BuildCommand{
+				Status: cmd.Status,
+				Output: cmd.Output[len(cmd.Output)-1:],
+			})
+		} else {
+			event.Data, err = json.Marshal(cmd)
+		}
+	default:
+		// Nothing else happens while running a test or build
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var reply int
+	return wp.w.client.Call("WorkerHub.Notify", event, &reply)
+}
+
+// Root directories are shipped as gzipped tarballs. We only need regular
+// files, directories, and symlinks. Sockets and disk images are left behind,
+// just like when tests copy the root.
+func tarDirectory(dir string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		if info.IsDir() && rel == ".sockets" {
+			return filepath.SkipDir
+		} else if rel == "LHD0.img" || rel == "LHD1.img" {
+			return nil
+		}
+
+		link := ""
+		mode := info.Mode()
+		if mode&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		} else if !mode.IsRegular() && !mode.IsDir() {
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if mode.IsRegular() {
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			f.Close()
+			return err
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func untarDirectory(data []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Don't let the archive write outside of dir
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.New(fmt.Sprintf("Invalid path in root archive: %v", header.Name))
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, os.FileMode(header.Mode)|0700)
+		case tar.TypeSymlink:
+			err = os.Symlink(header.Linkname, target)
+		case tar.TypeReg, tar.TypeRegA:
+			var f *os.File
+			f, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+			if err == nil {
+				_, err = io.Copy(f, tr)
+				f.Close()
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
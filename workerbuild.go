@@ -0,0 +1,377 @@
+package test161
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kevinburke/go.uuid"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// This file runs builds on distributed workers (see workerpool.go). Builds
+// that miss the build cache are sent to a worker with the users' deploy keys,
+// and the worker fetches the target's overlay from the server. The build's
+// output streams back like a test's. When it's done, the worker sends back
+// the root directory and the secure output keys. The server unpacks the root
+// so any worker (or the server) can run the tests, and the worker that built
+// it keeps its copy for the tests it gets.
+//
+// Workers build in temp directories, since each build could land on a
+// different worker. The server caches what they build like any other build,
+// using the commit history they send back.
+
+// A build waiting for or running on a worker
+type remoteBuild struct {
+	test       *BuildTest
+	overlayDir string // The overlay to send, or "" if there isn't one
+
+	// From the worker
+	keyMap  map[string]string
+	root    []byte
+	history *commitHistory
+}
+
+// The worker pool for builds, or nil to build here.
+func (env *TestEnvironment) buildWorkers() *WorkerPool {
+	if env.manager == nil {
+		return nil
+	}
+
+	env.manager.statsCond.L.Lock()
+	pool := env.manager.workers
+	env.manager.statsCond.L.Unlock()
+
+	if pool != nil && pool.active() {
+		return pool
+	}
+	return nil
+}
+
+// Run a build on a worker, blocking until it's done. Returns errNoWorkers if
+// the build never made it to a worker, in which case it should run here.
+func (p *WorkerPool) build(t *BuildTest) (*BuildResults, error) {
+	rb := &remoteBuild{test: t}
+
+	// Workers don't get the overlay repository, just the target's overlay,
+	// so they need its commit from us.
+	if len(t.conf.Overlay) > 0 {
+		overlayDir := path.Join(t.env.OverlayRoot, t.conf.Overlay)
+		if _, err := os.Stat(overlayDir); err == nil {
+			if len(t.overlayCommitID) == 0 {
+				if t.overlayCommitID, err = overlayCommit(t.env.OverlayRoot); err != nil {
+					t.Result = TEST_RESULT_INCORRECT
+					return nil, errors.New("Unable to get commit ID of overlay directory")
+				}
+			}
+			rb.overlayDir = overlayDir
+		}
+	}
+
+	err := p.runRemote(&remoteJob{
+		id:    uuid.NewV4().String(),
+		build: rb,
+		done:  make(chan error, 1),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Unpack the root so it's here for the tests
+	dir, err := ioutil.TempDir("", "os161")
+	if err != nil {
+		return nil, err
+	}
+	if err = untarDirectory(rb.root, dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	for id, key := range rb.keyMap {
+		t.env.keyMap[id] = key
+	}
+
+	// We never used our build directory
+	if t.isTempDir {
+		os.RemoveAll(t.dir)
+	}
+	t.dir = dir
+	t.rootDir = dir
+	t.isTempDir = true
+
+	if rb.history != nil {
+		t.saveCacheEntry(rb.history)
+	}
+
+	// The cache has its own copy
+	if t.cacheEntry != nil {
+		os.RemoveAll(dir)
+		t.isTempDir = false
+	}
+
+	return t.results(), nil
+}
+
+// Create the job description we send to a worker for a build. Workers always
+// build in temp directories.
+func newWorkerBuildJob(rj *remoteJob) (*WorkerJob, error) {
+	t := rj.build.test
+
+	conf := *t.conf
+	conf.CacheDir = ""
+	conf.OverlayCommit = t.overlayCommitID
+
+	data, err := json.Marshal(&conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// The keys GetDeployKeySSHCmd would use
+	keys := make(map[string][]byte)
+	for _, user := range t.conf.Users {
+		if key, err := ioutil.ReadFile(path.Join(t.env.KeyDir, user, "id_rsa")); err == nil {
+			keys[user] = key
+		}
+	}
+
+	return &WorkerJob{
+		ID:           rj.id,
+		Build:        data,
+		BuildID:      t.ID,
+		SubmissionID: t.SubmissionID,
+		DeployKeys:   keys,
+		HasOverlay:   len(rj.build.overlayDir) > 0,
+	}, nil
+}
+
+// Apply a remote build's persistence event to the local build, and pass it on
+// to the local persistence manager.
+func (rb *remoteBuild) update(args *WorkerEvent) error {
+	t := rb.test
+
+	if args.Command < 0 {
+		remote := &BuildTest{}
+		if err := json.Unmarshal(args.Data, remote); err != nil {
+			return err
+		}
+		t.updateFromRemote(remote)
+
+		// BuildTest.Run persists the build's completion once it has the root
+		if args.Msg != MSG_PERSIST_COMPLETE {
+			t.env.notifyAndLogErr("Remote Build Update", t, args.Msg, args.What)
+		}
+	} else if args.Command < len(t.Commands) {
+		remote := &BuildCommand{}
+		if err := json.Unmarshal(args.Data, remote); err != nil {
+			return err
+		}
+		cmd := t.Commands[args.Command]
+		if args.Msg == MSG_PERSIST_OUTPUT {
+			// Just the new line (see workerPersistence)
+			cmd.Output = append(cmd.Output, remote.Output...)
+		} else {
+			cmd.Output = remote.Output
+		}
+		cmd.Status = remote.Status
+		t.env.notifyAndLogErr("Remote Build Command Update", cmd, args.Msg, args.What)
+	} else {
+		return errors.New("Invalid command index")
+	}
+
+	return nil
+}
+
+// Copy the state of a remote build into the local one. The worker decides
+// which commands to run (e.g. it always clones), so they come from the
+// remote too.
+func (t *BuildTest) updateFromRemote(remote *BuildTest) {
+	t.Status = remote.Status
+	t.Result = remote.Result
+	t.PointsEarned = remote.PointsEarned
+	t.Diagnostics = remote.Diagnostics
+	t.KeyDigests = remote.KeyDigests
+
+	t.Commands = remote.Commands
+	for _, c := range t.Commands {
+		c.test = t
+	}
+}
+
+// Finish a build with its final state from the worker.
+func (h *WorkerHub) finishBuild(rj *remoteJob, res *WorkerResult) {
+	if !h.pool.finished(rj) {
+		return
+	}
+
+	var err error
+	var remote *BuildTest
+	if len(res.Test) > 0 {
+		remote = &BuildTest{}
+		if jsonErr := json.Unmarshal(res.Test, remote); jsonErr != nil {
+			remote = nil
+			err = errors.New(fmt.Sprintf("Invalid build from worker: %v", jsonErr))
+		}
+	}
+
+	if len(res.Err) > 0 {
+		err = errors.New(res.Err)
+	} else if err == nil && remote == nil {
+		err = errors.New("Worker didn't send the build")
+	} else if err == nil && len(res.Root) == 0 {
+		err = errors.New("Worker didn't send the build's root directory")
+	}
+
+	rj.l.Lock()
+	if remote != nil {
+		rj.build.test.updateFromRemote(remote)
+	} else {
+		rj.build.test.Result = TEST_RESULT_ABORT
+	}
+	rj.build.keyMap = res.KeyMap
+	rj.build.root = res.Root
+	if len(res.Commits) > 0 {
+		rj.build.history = &commitHistory{
+			Commits:  res.Commits,
+			PatchIDs: res.PatchIDs,
+		}
+	}
+	rj.l.Unlock()
+
+	rj.done <- err
+}
+
+// GetOverlay sends the overlay for a build as a gzipped tarball.
+func (h *WorkerHub) GetOverlay(args *WorkerRequest, reply *[]byte) error {
+	rj, err := h.pool.workerJob(args)
+	if err != nil {
+		return err
+	} else if rj.build == nil || len(rj.build.overlayDir) == 0 {
+		return errors.New("The job doesn't have an overlay")
+	}
+
+	data, err := tarDirectory(rj.build.overlayDir)
+	if err != nil {
+		return err
+	}
+
+	*reply = data
+	return nil
+}
+
+// Worker side
+
+// Run a build job. Like runJob, errors building go back to the server; the
+// returned error means we couldn't talk to the server.
+func (w *worker) runBuild(job *WorkerJob) error {
+	res := &WorkerResult{
+		WorkerID: w.id,
+		JobID:    job.ID,
+	}
+
+	test, results, err := w.build(job)
+	if err == nil {
+		res.KeyMap = test.env.keyMap
+
+		// The server can cache the build if it has the history
+		if history, err := readCommitHistory(test.srcDir, test.cmdEnv); err == nil {
+			res.Commits = history.Commits
+			res.PatchIDs = history.PatchIDs
+		}
+
+		if res.Root, err = tarDirectory(results.RootDir); err == nil {
+			// Keep our copy for the build's tests
+			w.addRoot(job.BuildID, results)
+		} else {
+			results.Release()
+		}
+	}
+
+	if err != nil {
+		res.Err = fmt.Sprintf("%v", err)
+	}
+	if test != nil {
+		if res.Test, err = json.Marshal(test); err != nil {
+			res.Err = fmt.Sprintf("%v", err)
+		}
+	}
+
+	var reply int
+	return w.client.Call("WorkerHub.Complete", res, &reply)
+}
+
+// Build with the job's deploy keys and overlay.
+func (w *worker) build(job *WorkerJob) (*BuildTest, *BuildResults, error) {
+	conf := &BuildConf{}
+	if err := json.Unmarshal(job.Build, conf); err != nil {
+		return nil, nil, err
+	}
+
+	dir, err := ioutil.TempDir(w.conf.CacheDir, "test161-build")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	env := w.env.CopyEnvironment()
+	env.CacheDir = ""
+	env.SecureKeyDir = ""
+	env.KeyDir = path.Join(dir, "keys")
+	env.OverlayRoot = path.Join(dir, "overlay")
+
+	if err = writeDeployKeys(env.KeyDir, job.DeployKeys); err != nil {
+		return nil, nil, err
+	}
+	if err = os.MkdirAll(env.OverlayRoot, 0700); err != nil {
+		return nil, nil, err
+	}
+	if job.HasOverlay {
+		if err = w.fetchOverlay(job, path.Join(env.OverlayRoot, conf.Overlay)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	test, err := conf.ToBuildTest(env)
+	if err != nil {
+		return nil, nil, err
+	}
+	test.ID = job.BuildID
+	test.SubmissionID = job.SubmissionID
+	env.Persistence = &workerPersistence{w: w, jobID: job.ID, build: test}
+
+	// The server needs our commands before their output
+	env.notifyAndLogErr("Remote Build Commands", test, MSG_PERSIST_UPDATE, MSG_FIELD_COMMANDS)
+
+	res, err := test.Run(env)
+	return test, res, err
+}
+
+func (w *worker) fetchOverlay(job *WorkerJob, dir string) error {
+	var data []byte
+	req := &WorkerRequest{WorkerID: w.id, JobID: job.ID}
+	if err := w.client.Call("WorkerHub.GetOverlay", req, &data); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return untarDirectory(data, dir)
+}
+
+// Save deploy keys where GetDeployKeySSHCmd looks for them.
+func writeDeployKeys(keyDir string, keys map[string][]byte) error {
+	for user, key := range keys {
+		if len(user) == 0 || user != path.Base(user) || user == ".." {
+			return errors.New(fmt.Sprintf("Invalid user for deploy key: %v", user))
+		}
+		userDir := path.Join(keyDir, user)
+		if err := os.MkdirAll(userDir, 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(userDir, "id_rsa"), key, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
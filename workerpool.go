@@ -0,0 +1,709 @@
+package test161
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kevinburke/go.uuid"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// This file implements the server side of test161's distributed workers.
+// Workers are separate processes, usually on other machines, that run builds
+// and tests for the server. Workers pull jobs from the server, so the server
+// never needs to connect to them:
+//
+//   1. The worker registers with a shared token and gets back an ID.
+//   2. The worker polls for jobs (WorkerHub.GetJob) while it has free slots.
+//   3. For each job, it fetches the root directory the submission was built
+//      into (once per build, workers cache them), runs the test, and streams
+//      persistence events back as the test runs (WorkerHub.Notify).
+//   4. When the test finishes, the worker sends the final state back
+//      (WorkerHub.Complete).
+//
+// Builds work the same way, except that the worker gets the deploy keys and
+// overlay instead of a root directory, and sends the root it built back (see
+// workerbuild.go).
+//
+// While workers are registered, the test manager sends every test to the
+// pool, and the manager's capacity is the total capacity of the workers.
+// Builds that miss the build cache go to the pool too. When the last worker
+// leaves, builds and tests run locally again.
+
+// The HTTP path workers use to reach the WorkerHub RPC server
+const WORKER_RPC_PATH = "/test161/workers"
+
+const (
+	WORKER_POLL_TIMEOUT = 20 * time.Second // Max time GetJob blocks
+	WORKER_HEARTBEAT    = 10 * time.Second // How often workers check in
+	WORKER_TIMEOUT      = 60 * time.Second // Workers we haven't heard from are removed
+)
+
+// Returned to the test manager if a job couldn't be handed to a worker, in
+// which case it runs locally instead.
+var errNoWorkers = errors.New("No workers available")
+
+// WorkerInfo describes a registered worker.
+type WorkerInfo struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Capacity   uint      `json:"capacity"`
+	Running    uint      `json:"running"`
+	Finished   uint      `json:"finished"`
+	Draining   bool      `json:"draining"`
+	Registered time.Time `json:"registered"`
+	LastSeen   time.Time `json:"last_seen"`
+}
+
+// WorkerRegistration is sent by a worker when it starts.
+type WorkerRegistration struct {
+	Token    string
+	Name     string
+	Capacity uint
+}
+
+// WorkerJob is a test or build for a worker to run. An empty ID means there
+// was nothing to do (the poll timed out), and Exit means the worker has been
+// drained and should shut down.
+type WorkerJob struct {
+	ID      string
+	Exit    bool
+	RootKey string            // Identifies the root directory, which is shared by a build's tests
+	KeyMap  map[string]string // Secure output keys
+	Test    []byte            // The test, as JSON
+	Prompts []string          // Prompt patterns for each command, which don't survive JSON
+
+	// Builds have these instead of a test
+	Build        []byte            // The build configuration, as JSON
+	BuildID      string            // The build's ID, which is also the root key of its tests
+	SubmissionID string            // The submission being built
+	DeployKeys   map[string][]byte // The users' deploy keys, by user
+	HasOverlay   bool              // Get the overlay with WorkerHub.GetOverlay
+}
+
+// WorkerRequest identifies a worker, and optionally one of its jobs.
+type WorkerRequest struct {
+	WorkerID string
+	JobID    string
+}
+
+// WorkerEvent is a persistence event for a remote test or build. Command is
+// the index of the command the event is for, or -1 if it's for the test
+// itself. Data is the JSON of the test or command.
+type WorkerEvent struct {
+	WorkerID string
+	JobID    string
+	Msg      int
+	What     int
+	Command  int
+	Data     []byte
+}
+
+// WorkerResult is the final state of a remote test or build. Builds also send
+// back their secure output keys, the root directory they built, and the
+// commit history for the build cache.
+type WorkerResult struct {
+	WorkerID string
+	JobID    string
+	Test     []byte
+	Err      string
+	KeyMap   map[string]string
+	Root     []byte // Gzipped tarball
+	Commits  []string
+	PatchIDs map[string]string
+}
+
+type remoteJob struct {
+	id     string
+	job    *test161Job  // The test, or nil for builds
+	build  *remoteBuild // The build, or nil for tests
+	worker *WorkerInfo  // nil until a worker takes it
+	done   chan error
+	l      sync.Mutex // Serializes updates to the test
+}
+
+// A WorkerPool tracks the registered workers and the jobs waiting for them.
+type WorkerPool struct {
+	l       sync.Mutex
+	cond    *sync.Cond
+	token   string
+	workers map[string]*WorkerInfo
+	pending []*remoteJob          // Waiting for a worker
+	jobs    map[string]*remoteJob // All unfinished jobs, by ID
+
+	// Called (without the pool lock) when capacity changes, so the test
+	// manager can let queued jobs go.
+	onChange func()
+}
+
+// NewWorkerPool creates a pool that accepts workers with the given token.
+func NewWorkerPool(token string) *WorkerPool {
+	p := &WorkerPool{
+		token:   token,
+		workers: make(map[string]*WorkerInfo),
+		pending: make([]*remoteJob, 0),
+		jobs:    make(map[string]*remoteJob),
+	}
+	p.cond = sync.NewCond(&p.l)
+
+	go p.reap()
+
+	return p
+}
+
+// Remove workers we haven't heard from in a while.
+func (p *WorkerPool) reap() {
+	for _ = range time.Tick(WORKER_HEARTBEAT) {
+		p.l.Lock()
+		lost := make([]string, 0)
+		for id, w := range p.workers {
+			if time.Since(w.LastSeen) > WORKER_TIMEOUT {
+				lost = append(lost, id)
+			}
+		}
+		p.l.Unlock()
+
+		for _, id := range lost {
+			p.remove(id, "worker lost")
+		}
+	}
+}
+
+func (p *WorkerPool) changed() {
+	if p.onChange != nil {
+		p.onChange()
+	}
+}
+
+// Returns true if there are workers that can take jobs.
+func (p *WorkerPool) active() bool {
+	return p.capacity() > 0
+}
+
+// The total capacity of the workers that aren't draining.
+func (p *WorkerPool) capacity() uint {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	var total uint
+	for _, w := range p.workers {
+		if !w.Draining {
+			total += w.Capacity
+		}
+	}
+	return total
+}
+
+// Workers returns a snapshot of the registered workers, sorted by name.
+func (p *WorkerPool) Workers() []*WorkerInfo {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	res := make([]*WorkerInfo, 0, len(p.workers))
+	for _, w := range p.workers {
+		copy := *w
+		res = append(res, &copy)
+	}
+	sort.Sort(workersByName(res))
+	return res
+}
+
+type workersByName []*WorkerInfo
+
+func (w workersByName) Len() int      { return len(w) }
+func (w workersByName) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+func (w workersByName) Less(i, j int) bool {
+	if w[i].Name != w[j].Name {
+		return w[i].Name < w[j].Name
+	}
+	return w[i].ID < w[j].ID
+}
+
+// Find workers by name or ID. Must hold p.l.
+func (p *WorkerPool) find(name string) []*WorkerInfo {
+	res := make([]*WorkerInfo, 0)
+	for id, w := range p.workers {
+		if id == name || w.Name == name {
+			res = append(res, w)
+		}
+	}
+	return res
+}
+
+// Drain stops sending jobs to the named worker(s). They shut down once their
+// running tests finish. Returns the number of workers drained.
+func (p *WorkerPool) Drain(name string) int {
+	p.l.Lock()
+	workers := p.find(name)
+	for _, w := range workers {
+		w.Draining = true
+	}
+	p.cond.Broadcast()
+	p.l.Unlock()
+
+	p.changed()
+	p.failPendingIfIdle()
+
+	return len(workers)
+}
+
+// Remove removes the named worker(s) immediately. Tests running on them are
+// aborted. Returns the number of workers removed.
+func (p *WorkerPool) Remove(name string) int {
+	p.l.Lock()
+	workers := p.find(name)
+	p.l.Unlock()
+
+	for _, w := range workers {
+		p.remove(w.ID, "worker removed")
+	}
+	return len(workers)
+}
+
+func (p *WorkerPool) remove(id, reason string) {
+	p.l.Lock()
+	if _, ok := p.workers[id]; !ok {
+		p.l.Unlock()
+		return
+	}
+	delete(p.workers, id)
+
+	// Fail the jobs the worker was running
+	lost := make([]*remoteJob, 0)
+	for jobID, rj := range p.jobs {
+		if rj.worker != nil && rj.worker.ID == id {
+			delete(p.jobs, jobID)
+			lost = append(lost, rj)
+		}
+	}
+	p.cond.Broadcast()
+	p.l.Unlock()
+
+	for _, rj := range lost {
+		rj.l.Lock()
+		if rj.build != nil {
+			// The build persists its own completion
+			rj.build.test.Result = TEST_RESULT_ABORT
+			rj.l.Unlock()
+			rj.done <- errors.New(fmt.Sprintf("Build aborted: %v", reason))
+			continue
+		}
+		rj.job.Test.Result = TEST_RESULT_ABORT
+		rj.job.Env.notifyAndLogErr("Remote Test Aborted", rj.job.Test, MSG_PERSIST_COMPLETE, 0)
+		rj.l.Unlock()
+		rj.done <- errors.New(fmt.Sprintf("Test aborted: %v", reason))
+	}
+
+	p.changed()
+	p.failPendingIfIdle()
+}
+
+// If nobody can take the pending jobs, hand them back to the manager.
+func (p *WorkerPool) failPendingIfIdle() {
+	if p.active() {
+		return
+	}
+
+	p.l.Lock()
+	pending := p.pending
+	p.pending = make([]*remoteJob, 0)
+	for _, rj := range pending {
+		delete(p.jobs, rj.id)
+	}
+	p.l.Unlock()
+
+	for _, rj := range pending {
+		rj.done <- errNoWorkers
+	}
+}
+
+// Run a job on a worker, blocking until it's done. Returns errNoWorkers if
+// the job never made it to a worker.
+func (p *WorkerPool) run(job *test161Job) error {
+	return p.runRemote(&remoteJob{
+		id:   uuid.NewV4().String(),
+		job:  job,
+		done: make(chan error, 1),
+	})
+}
+
+// Queue a test or build for the workers and wait for it to finish.
+func (p *WorkerPool) runRemote(rj *remoteJob) error {
+	p.l.Lock()
+	p.pending = append(p.pending, rj)
+	p.jobs[rj.id] = rj
+	p.cond.Broadcast()
+	p.l.Unlock()
+
+	// The workers may have left while we were queueing
+	p.failPendingIfIdle()
+
+	return <-rj.done
+}
+
+// Look up a worker and note that we've heard from it. Must hold p.l.
+func (p *WorkerPool) checkIn(id string) (*WorkerInfo, error) {
+	w, ok := p.workers[id]
+	if !ok {
+		return nil, errors.New("Unknown worker")
+	}
+	w.LastSeen = time.Now()
+	return w, nil
+}
+
+// Look up one of a worker's jobs.
+func (p *WorkerPool) workerJob(req *WorkerRequest) (*remoteJob, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if _, err := p.checkIn(req.WorkerID); err != nil {
+		return nil, err
+	}
+	rj, ok := p.jobs[req.JobID]
+	if !ok || rj.worker == nil || rj.worker.ID != req.WorkerID {
+		return nil, errors.New("Unknown job")
+	}
+	return rj, nil
+}
+
+// Create the job description we send to a worker.
+func newWorkerJob(rj *remoteJob) (*WorkerJob, error) {
+	if rj.build != nil {
+		return newWorkerBuildJob(rj)
+	}
+
+	test := rj.job.Test
+
+	data, err := json.Marshal(test)
+	if err != nil {
+		return nil, err
+	}
+
+	prompts := make([]string, len(test.Commands))
+	for i, c := range test.Commands {
+		if c.PromptPattern != nil {
+			prompts[i] = c.PromptPattern.String()
+		}
+	}
+
+	rootKey := rj.job.Env.rootKey
+	if len(rootKey) == 0 {
+		rootKey = rj.job.Env.RootDir
+	}
+
+	return &WorkerJob{
+		ID:      rj.id,
+		RootKey: rootKey,
+		KeyMap:  rj.job.Env.keyMap,
+		Test:    data,
+		Prompts: prompts,
+	}, nil
+}
+
+// Restore a test sent to a worker by newWorkerJob.
+func (job *WorkerJob) test() (*Test, error) {
+	test := &Test{}
+	if err := json.Unmarshal(job.Test, test); err != nil {
+		return nil, err
+	}
+	if len(job.Prompts) != len(test.Commands) {
+		return nil, errors.New("Prompt patterns don't match the test's commands")
+	}
+
+	for i, c := range test.Commands {
+		c.Test = test
+		if len(job.Prompts[i]) > 0 {
+			re, err := regexp.Compile(job.Prompts[i])
+			if err != nil {
+				return nil, err
+			}
+			c.PromptPattern = re
+		}
+	}
+
+	return test, nil
+}
+
+// Copy the state of a remote test into the local one. The local test keeps
+// its identity and links; everything a run can change comes from the remote.
+func (t *Test) updateFromRemote(remote *Test) {
+	t.Sys161 = remote.Sys161
+	t.Stat = remote.Stat
+	t.Monitor = remote.Monitor
+	t.Misc = remote.Misc
+	t.ConfString = remote.ConfString
+	t.WallTime = remote.WallTime
+	t.SimTime = remote.SimTime
+	t.Status = remote.Status
+	t.Result = remote.Result
+	t.PointsEarned = remote.PointsEarned
+	t.MemLeakBytes = remote.MemLeakBytes
+	t.MemLeakChecked = remote.MemLeakChecked
+	t.MemLeakPoints = remote.MemLeakPoints
+	t.MemLeakDeducted = remote.MemLeakDeducted
+	t.Salts = remote.Salts
+	t.Metrics = remote.Metrics
+	t.Invariants = remote.Invariants
+	t.PanicInfo = remote.PanicInfo
+
+	for i, c := range remote.Commands {
+		if i < len(t.Commands) {
+			t.Commands[i].updateFromRemote(c)
+		}
+	}
+}
+
+func (c *Command) updateFromRemote(remote *Command) {
+	id, test, prompt := c.ID, c.Test, c.PromptPattern
+	*c = *remote
+	c.ID, c.Test, c.PromptPattern = id, test, prompt
+}
+
+// The WorkerHub is the RPC interface of a WorkerPool.
+type WorkerHub struct {
+	pool *WorkerPool
+}
+
+// Hub returns the RPC interface for the pool, which should be registered with
+// an rpc.Server and served on WORKER_RPC_PATH.
+func (p *WorkerPool) Hub() *WorkerHub {
+	return &WorkerHub{p}
+}
+
+// Register a new worker.
+func (h *WorkerHub) Register(args *WorkerRegistration, reply *string) error {
+	p := h.pool
+
+	if len(p.token) == 0 || args.Token != p.token {
+		return errors.New("Invalid worker token")
+	} else if args.Capacity == 0 {
+		return errors.New("Worker capacity must be greater than 0")
+	}
+
+	now := time.Now()
+	w := &WorkerInfo{
+		ID:         uuid.NewV4().String(),
+		Name:       args.Name,
+		Capacity:   args.Capacity,
+		Registered: now,
+		LastSeen:   now,
+	}
+
+	p.l.Lock()
+	p.workers[w.ID] = w
+	p.l.Unlock()
+
+	p.changed()
+
+	*reply = w.ID
+	return nil
+}
+
+// Heartbeat lets the pool know the worker is still alive while it's busy.
+func (h *WorkerHub) Heartbeat(args *WorkerRequest, reply *int) error {
+	p := h.pool
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	_, err := p.checkIn(args.WorkerID)
+	return err
+}
+
+// GetJob waits (up to WORKER_POLL_TIMEOUT) for a job for the worker.
+func (h *WorkerHub) GetJob(args *WorkerRequest, reply *WorkerJob) error {
+	p := h.pool
+
+	timedOut := false
+	timer := time.AfterFunc(WORKER_POLL_TIMEOUT, func() {
+		p.l.Lock()
+		timedOut = true
+		p.cond.Broadcast()
+		p.l.Unlock()
+	})
+	defer timer.Stop()
+
+	p.l.Lock()
+
+	var rj *remoteJob
+	for {
+		w, err := p.checkIn(args.WorkerID)
+		if err != nil {
+			p.l.Unlock()
+			return err
+		}
+
+		if w.Draining {
+			if w.Running == 0 {
+				delete(p.workers, w.ID)
+				p.l.Unlock()
+				reply.Exit = true
+				return nil
+			}
+		} else if len(p.pending) > 0 && w.Running < w.Capacity {
+			rj = p.pending[0]
+			p.pending = p.pending[1:]
+			rj.worker = w
+			w.Running += 1
+			break
+		}
+
+		if timedOut {
+			p.l.Unlock()
+			return nil
+		}
+		p.cond.Wait()
+	}
+
+	p.l.Unlock()
+
+	job, err := newWorkerJob(rj)
+	if err != nil {
+		if rj.build != nil {
+			h.finishBuild(rj, &WorkerResult{Err: fmt.Sprintf("%v", err)})
+		} else {
+			h.finish(rj, nil, err)
+		}
+		return h.GetJob(args, reply)
+	}
+
+	*reply = *job
+	return nil
+}
+
+// GetRoot sends the root directory for a job as a gzipped tarball.
+func (h *WorkerHub) GetRoot(args *WorkerRequest, reply *[]byte) error {
+	rj, err := h.pool.workerJob(args)
+	if err != nil {
+		return err
+	} else if rj.job == nil {
+		return errors.New("Builds don't have a root directory")
+	}
+
+	data, err := tarDirectory(rj.job.Env.RootDir)
+	if err != nil {
+		return err
+	}
+
+	*reply = data
+	return nil
+}
+
+// Notify applies a remote persistence event to the local test, and passes it
+// on to the local persistence manager.
+func (h *WorkerHub) Notify(args *WorkerEvent, reply *int) error {
+	rj, err := h.pool.workerJob(&WorkerRequest{args.WorkerID, args.JobID})
+	if err != nil {
+		return err
+	}
+
+	rj.l.Lock()
+	defer rj.l.Unlock()
+
+	if rj.build != nil {
+		return rj.build.update(args)
+	}
+
+	test := rj.job.Test
+
+	if args.Command < 0 {
+		remote := &Test{}
+		if err = json.Unmarshal(args.Data, remote); err != nil {
+			return err
+		}
+		test.updateFromRemote(remote)
+		rj.job.Env.notifyAndLogErr("Remote Test Update", test, args.Msg, args.What)
+	} else if args.Command < len(test.Commands) {
+		remote := &Command{}
+		if err = json.Unmarshal(args.Data, remote); err != nil {
+			return err
+		}
+		cmd := test.Commands[args.Command]
+		cmd.updateFromRemote(remote)
+		rj.job.Env.notifyAndLogErr("Remote Command Update", cmd, args.Msg, args.What)
+	} else {
+		return errors.New("Invalid command index")
+	}
+
+	return nil
+}
+
+// Complete finishes a job with the test's final state.
+func (h *WorkerHub) Complete(args *WorkerResult, reply *int) error {
+	rj, err := h.pool.workerJob(&WorkerRequest{args.WorkerID, args.JobID})
+	if err != nil {
+		return err
+	} else if rj.build != nil {
+		h.finishBuild(rj, args)
+		return nil
+	}
+
+	remote := &Test{}
+	if err = json.Unmarshal(args.Test, remote); err != nil {
+		remote = nil
+		err = errors.New(fmt.Sprintf("Invalid test from worker: %v", err))
+	} else if len(args.Err) > 0 {
+		err = errors.New(args.Err)
+	}
+
+	h.finish(rj, remote, err)
+	return nil
+}
+
+func (h *WorkerHub) finish(rj *remoteJob, remote *Test, err error) {
+	if !h.pool.finished(rj) {
+		return
+	}
+
+	rj.l.Lock()
+	if remote != nil {
+		rj.job.Test.updateFromRemote(remote)
+	} else {
+		rj.job.Test.Result = TEST_RESULT_ABORT
+	}
+	rj.l.Unlock()
+
+	rj.done <- err
+}
+
+// Take a finished job off its worker. Returns false if the job was already
+// aborted because its worker was removed.
+func (p *WorkerPool) finished(rj *remoteJob) bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if _, ok := p.jobs[rj.id]; !ok {
+		return false
+	}
+	delete(p.jobs, rj.id)
+	rj.worker.Running -= 1
+	rj.worker.Finished += 1
+	p.cond.Broadcast()
+
+	return true
+}
+
+// Exported shared test manager functions
+
+// SetManagerWorkers sets the worker pool used by the shared test manager. Use
+// nil to run all tests locally.
+func SetManagerWorkers(pool *WorkerPool) {
+	m := testManager
+
+	if pool != nil {
+		pool.onChange = func() {
+			m.statsCond.L.Lock()
+			m.stats.Capacity = m.capacity()
+			m.statsCond.Broadcast()
+			m.statsCond.L.Unlock()
+		}
+	}
+
+	m.statsCond.L.Lock()
+	m.workers = pool
+	m.stats.Capacity = m.capacity()
+	m.statsCond.Broadcast()
+	m.statsCond.L.Unlock()
+}
@@ -0,0 +1,491 @@
+package test161
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path"
+	"testing"
+)
+
+func workerTestJob(t *testing.T) *test161Job {
+	test, err := TestFromString("sem1\nlt1")
+	assert.Nil(t, err)
+	if test == nil {
+		t.FailNow()
+	}
+
+	env := defaultEnv.CopyEnvironment()
+	env.RootDir = "/root/dir"
+	env.keyMap["sem1"] = "secret"
+
+	return &test161Job{
+		Test:     test,
+		Env:      env,
+		DoneChan: make(chan *Test161JobResult),
+	}
+}
+
+func TestWorkerJobRoundTrip(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	job := workerTestJob(t)
+	orig := job.Test
+
+	wj, err := newWorkerJob(&remoteJob{id: "job", job: job})
+	assert.Nil(err)
+	assert.Equal("/root/dir", wj.RootKey)
+	assert.Equal("secret", wj.KeyMap["sem1"])
+
+	test, err := wj.test()
+	assert.Nil(err)
+	if test == nil {
+		t.FailNow()
+	}
+
+	assert.Equal(len(orig.Commands), len(test.Commands))
+	for i, c := range test.Commands {
+		assert.Equal(orig.Commands[i].ID, c.ID)
+		assert.Equal(orig.Commands[i].Input.Line, c.Input.Line)
+		assert.True(c.Test == test)
+		if orig.Commands[i].PromptPattern != nil && c.PromptPattern != nil {
+			assert.Equal(orig.Commands[i].PromptPattern.String(), c.PromptPattern.String())
+		} else {
+			assert.Nil(orig.Commands[i].PromptPattern)
+			assert.Nil(c.PromptPattern)
+		}
+	}
+
+	// Results come back, but the local test keeps its identity
+	test.Result = TEST_RESULT_CORRECT
+	test.PointsEarned = 5
+	test.Commands[1].Status = COMMAND_STATUS_CORRECT
+	test.Commands[1].ID = "changed"
+	test.Commands[1].Output = []*OutputLine{&OutputLine{Line: "sem1: ok"}}
+	test.Salts = []string{"0a1b"}
+	test.Metrics = []*Metric{&Metric{Name: "ops/sec", Count: 1, Last: 2, Min: 2, Max: 2, Sum: 2}}
+
+	data, err := json.Marshal(test)
+	assert.Nil(err)
+	remote := &Test{}
+	assert.Nil(json.Unmarshal(data, remote))
+
+	id := orig.Commands[1].ID
+	orig.updateFromRemote(remote)
+	assert.Equal(TEST_RESULT_CORRECT, orig.Result)
+	assert.Equal(uint(5), orig.PointsEarned)
+	assert.Equal(COMMAND_STATUS_CORRECT, orig.Commands[1].Status)
+	assert.Equal("sem1: ok", orig.Commands[1].Output[0].Line)
+	assert.Equal([]string{"0a1b"}, orig.Salts)
+	assert.Equal(test.Metrics, orig.Metrics)
+	assert.Equal(id, orig.Commands[1].ID)
+	assert.True(orig.Commands[1].Test == orig)
+}
+
+func TestWorkerPoolRun(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	pool := NewWorkerPool("token")
+	hub := pool.Hub()
+
+	var id string
+	assert.NotNil(hub.Register(&WorkerRegistration{Token: "wrong", Name: "w1", Capacity: 1}, &id))
+	assert.Nil(hub.Register(&WorkerRegistration{Token: "token", Name: "w1", Capacity: 2}, &id))
+	assert.True(pool.active())
+	assert.Equal(uint(2), pool.capacity())
+
+	job := workerTestJob(t)
+	done := make(chan error)
+	go func() {
+		done <- pool.run(job)
+	}()
+
+	wj := &WorkerJob{}
+	assert.Nil(hub.GetJob(&WorkerRequest{WorkerID: id}, wj))
+	assert.NotEqual("", wj.ID)
+	assert.Equal(uint(1), pool.Workers()[0].Running)
+
+	// Stream a command update
+	test, err := wj.test()
+	assert.Nil(err)
+	test.Commands[1].Status = COMMAND_STATUS_RUNNING
+	data, _ := json.Marshal(test.Commands[1])
+
+	var reply int
+	event := &WorkerEvent{WorkerID: id, JobID: wj.ID, Msg: MSG_PERSIST_UPDATE, What: MSG_FIELD_STATUS, Command: 1, Data: data}
+	assert.Nil(hub.Notify(event, &reply))
+	assert.Equal(COMMAND_STATUS_RUNNING, job.Test.Commands[1].Status)
+
+	// Other workers can't touch it
+	event.WorkerID = "someone else"
+	assert.NotNil(hub.Notify(event, &reply))
+
+	// Finish
+	test.Result = TEST_RESULT_INCORRECT
+	data, _ = json.Marshal(test)
+	assert.Nil(hub.Complete(&WorkerResult{WorkerID: id, JobID: wj.ID, Test: data}, &reply))
+	assert.Nil(<-done)
+	assert.Equal(TEST_RESULT_INCORRECT, job.Test.Result)
+
+	workers := pool.Workers()
+	assert.Equal(1, len(workers))
+	assert.Equal(uint(0), workers[0].Running)
+	assert.Equal(uint(1), workers[0].Finished)
+
+	// Drain, after which the worker is told to exit
+	assert.Equal(1, pool.Drain("w1"))
+	assert.False(pool.active())
+	wj = &WorkerJob{}
+	assert.Nil(hub.GetJob(&WorkerRequest{WorkerID: id}, wj))
+	assert.True(wj.Exit)
+	assert.Equal(0, len(pool.Workers()))
+
+	// Nobody to run it
+	assert.Equal(errNoWorkers, pool.run(workerTestJob(t)))
+}
+
+func TestWorkerPoolRemove(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	pool := NewWorkerPool("token")
+	hub := pool.Hub()
+
+	var id string
+	assert.Nil(hub.Register(&WorkerRegistration{Token: "token", Name: "w1", Capacity: 1}, &id))
+
+	job := workerTestJob(t)
+	done := make(chan error)
+	go func() {
+		done <- pool.run(job)
+	}()
+
+	wj := &WorkerJob{}
+	assert.Nil(hub.GetJob(&WorkerRequest{WorkerID: id}, wj))
+
+	assert.Equal(0, pool.Remove("nobody"))
+	assert.Equal(1, pool.Remove("w1"))
+	assert.NotNil(<-done)
+	assert.Equal(TEST_RESULT_ABORT, job.Test.Result)
+
+	// The worker finds out it's gone
+	var reply int
+	assert.NotNil(hub.Complete(&WorkerResult{WorkerID: id, JobID: wj.ID}, &reply))
+	assert.NotNil(hub.GetJob(&WorkerRequest{WorkerID: id}, wj))
+}
+
+func TestWorkerTarDirectory(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	src, err := ioutil.TempDir("", "test161-tar")
+	assert.Nil(err)
+	defer os.RemoveAll(src)
+
+	assert.Nil(os.MkdirAll(path.Join(src, "bin"), 0755))
+	assert.Nil(ioutil.WriteFile(path.Join(src, "kernel-ASST1"), []byte("kernel"), 0755))
+	assert.Nil(os.Symlink("kernel-ASST1", path.Join(src, "kernel")))
+	assert.Nil(ioutil.WriteFile(path.Join(src, "bin", "sh"), []byte("shell"), 0755))
+	assert.Nil(ioutil.WriteFile(path.Join(src, "LHD0.img"), []byte("disk"), 0644))
+
+	data, err := tarDirectory(src)
+	assert.Nil(err)
+
+	dst, err := ioutil.TempDir("", "test161-untar")
+	assert.Nil(err)
+	defer os.RemoveAll(dst)
+
+	assert.Nil(untarDirectory(data, dst))
+
+	contents, err := ioutil.ReadFile(path.Join(dst, "kernel"))
+	assert.Nil(err)
+	assert.Equal("kernel", string(contents))
+
+	contents, err = ioutil.ReadFile(path.Join(dst, "bin", "sh"))
+	assert.Nil(err)
+	assert.Equal("shell", string(contents))
+
+	_, err = os.Stat(path.Join(dst, "LHD0.img"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestWorkerJobRootKey(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// Builds that miss the build cache share a root directory, so a worker
+	// must not reuse one build's root for the next.
+	keys := make([]string, 0)
+	for _, id := range []string{"build1", "build2"} {
+		build := &BuildTest{ID: id, rootDir: "/cache/repo/root"}
+		res := build.results()
+
+		job := workerTestJob(t)
+		job.Env.RootDir = res.RootDir
+		job.Env.rootKey = res.RootKey
+
+		wj, err := newWorkerJob(&remoteJob{id: id, job: job})
+		assert.Nil(err)
+		if wj != nil {
+			keys = append(keys, wj.RootKey)
+		}
+	}
+	if assert.Equal(2, len(keys)) {
+		assert.NotEqual(keys[0], keys[1])
+	}
+
+	// Cached roots are never reused, so builds can share them.
+	entry := &buildCacheEntry{}
+	build1 := &BuildTest{ID: "build1", rootDir: "/cache/roots/abc-1/root", cacheEntry: entry}
+	build2 := &BuildTest{ID: "build2", rootDir: "/cache/roots/abc-1/root", cacheEntry: entry}
+	assert.Equal(build1.results().RootKey, build2.results().RootKey)
+}
+
+func workerTestBuild(t *testing.T, dir string) *BuildTest {
+	env := defaultEnv.CopyEnvironment()
+	env.KeyDir = path.Join(dir, "keys")
+	env.OverlayRoot = path.Join(dir, "overlay")
+	assert.Nil(t, os.MkdirAll(path.Join(env.KeyDir, "alice@buffalo.edu"), 0700))
+	assert.Nil(t, ioutil.WriteFile(path.Join(env.KeyDir, "alice@buffalo.edu", "id_rsa"), []byte("key"), 0600))
+	assert.Nil(t, os.MkdirAll(path.Join(env.OverlayRoot, "asst1"), 0700))
+	assert.Nil(t, ioutil.WriteFile(path.Join(env.OverlayRoot, "asst1", "SECRET"), []byte("kern/test/sem.c\n"), 0600))
+
+	conf := &BuildConf{
+		Repo:     "git@github.com:ops-class/os161.git",
+		CommitID: "HEAD",
+		KConfig:  "ASST1",
+		Overlay:  "asst1",
+		Users:    []string{"alice@buffalo.edu", "bob@buffalo.edu"},
+		CacheDir: path.Join(dir, "cache"),
+	}
+	build, err := conf.ToBuildTest(env)
+	assert.Nil(t, err)
+	if build == nil {
+		t.FailNow()
+	}
+	build.overlayCommitID = "0123abcd"
+	return build
+}
+
+func TestWorkerBuildJob(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test161-build-job")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	build := workerTestBuild(t, dir)
+	defer os.RemoveAll(build.dir)
+
+	rb := &remoteBuild{test: build, overlayDir: path.Join(dir, "overlay", "asst1")}
+	wj, err := newWorkerJob(&remoteJob{id: "job", build: rb})
+	assert.Nil(err)
+	if wj == nil {
+		t.FailNow()
+	}
+
+	assert.Equal(build.ID, wj.BuildID)
+	assert.True(wj.HasOverlay)
+	assert.Equal(map[string][]byte{"alice@buffalo.edu": []byte("key")}, wj.DeployKeys)
+
+	// Workers build in temp directories, with the overlay commit from us
+	conf := &BuildConf{}
+	assert.Nil(json.Unmarshal(wj.Build, conf))
+	assert.Equal("", conf.CacheDir)
+	assert.Equal("0123abcd", conf.OverlayCommit)
+	assert.Equal("asst1", conf.Overlay)
+	assert.Equal(build.conf.Users, conf.Users)
+
+	// The keys end up where the build looks for them
+	keyDir := path.Join(dir, "worker-keys")
+	assert.Nil(writeDeployKeys(keyDir, wj.DeployKeys))
+	assert.Equal("GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o IdentitiesOnly=yes -i "+
+		path.Join(keyDir, "alice@buffalo.edu", "id_rsa"), GetDeployKeySSHCmd(conf.Users, keyDir))
+	assert.NotNil(writeDeployKeys(keyDir, map[string][]byte{"../evil": []byte("key")}))
+
+	// The worker doesn't look up the overlay commit
+	conf.OverlayCommit = "4567cdef"
+	env := defaultEnv.CopyEnvironment()
+	env.OverlayRoot = path.Join(dir, "overlay")
+	remote, err := conf.ToBuildTest(env)
+	assert.Nil(err)
+	if remote != nil {
+		defer os.RemoveAll(remote.dir)
+		assert.Equal("4567cdef", remote.overlayCommitID)
+		for _, c := range remote.Commands {
+			assert.NotEqual("git rev-parse HEAD", c.Input.Line)
+		}
+	}
+}
+
+func TestWorkerPoolBuild(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test161-build-pool")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	pool := NewWorkerPool("token")
+	hub := pool.Hub()
+
+	var id string
+	assert.Nil(hub.Register(&WorkerRegistration{Token: "token", Name: "w1", Capacity: 1}, &id))
+
+	build := workerTestBuild(t, dir)
+	type buildResult struct {
+		res *BuildResults
+		err error
+	}
+	done := make(chan buildResult)
+	go func() {
+		res, err := pool.build(build)
+		done <- buildResult{res, err}
+	}()
+
+	wj := &WorkerJob{}
+	assert.Nil(hub.GetJob(&WorkerRequest{WorkerID: id}, wj))
+	assert.True(len(wj.Build) > 0)
+
+	// The overlay, but not a root
+	var data []byte
+	req := &WorkerRequest{WorkerID: id, JobID: wj.ID}
+	assert.Nil(hub.GetOverlay(req, &data))
+	overlay := path.Join(dir, "worker-overlay")
+	assert.Nil(os.MkdirAll(overlay, 0700))
+	assert.Nil(untarDirectory(data, overlay))
+	contents, err := ioutil.ReadFile(path.Join(overlay, "SECRET"))
+	assert.Nil(err)
+	assert.Equal("kern/test/sem.c\n", string(contents))
+	assert.NotNil(hub.GetRoot(req, &data))
+
+	// The worker's commands replace ours
+	remote := &BuildTest{
+		ID:     build.ID,
+		Result: TEST_RESULT_RUNNING,
+		Commands: []*BuildCommand{
+			&BuildCommand{ID: "clone", Input: InputLine{Line: "git clone repo src"}},
+			&BuildCommand{ID: "bmake", Input: InputLine{Line: "bmake"}},
+		},
+	}
+	data, _ = json.Marshal(remote)
+	var reply int
+	event := &WorkerEvent{WorkerID: id, JobID: wj.ID, Msg: MSG_PERSIST_UPDATE, What: MSG_FIELD_COMMANDS, Command: -1, Data: data}
+	assert.Nil(hub.Notify(event, &reply))
+	if assert.Equal(2, len(build.Commands)) {
+		assert.Equal("clone", build.Commands[0].ID)
+		assert.True(build.Commands[1].test == build)
+	}
+
+	// Output arrives a line at a time
+	for _, line := range []string{"one", "two"} {
+		data, _ = json.Marshal(&BuildCommand{Status: COMMAND_STATUS_RUNNING, Output: []*OutputLine{&OutputLine{Line: line}}})
+		event = &WorkerEvent{WorkerID: id, JobID: wj.ID, Msg: MSG_PERSIST_OUTPUT, What: MSG_FIELD_OUTPUT, Command: 1, Data: data}
+		assert.Nil(hub.Notify(event, &reply))
+	}
+	if assert.Equal(2, len(build.Commands[1].Output)) {
+		assert.Equal("two", build.Commands[1].Output[1].Line)
+	}
+
+	// Finish with the root
+	root := path.Join(dir, "worker-root")
+	assert.Nil(os.MkdirAll(root, 0700))
+	assert.Nil(ioutil.WriteFile(path.Join(root, "kernel"), []byte("kernel"), 0755))
+	rootData, err := tarDirectory(root)
+	assert.Nil(err)
+
+	remote.Result = TEST_RESULT_CORRECT
+	data, _ = json.Marshal(remote)
+	assert.Nil(hub.Complete(&WorkerResult{
+		WorkerID: id,
+		JobID:    wj.ID,
+		Test:     data,
+		KeyMap:   map[string]string{"sem1": "secret"},
+		Root:     rootData,
+	}, &reply))
+
+	result := <-done
+	assert.Nil(result.err)
+	if result.res != nil {
+		defer result.res.Release()
+		contents, err = ioutil.ReadFile(path.Join(result.res.RootDir, "kernel"))
+		assert.Nil(err)
+		assert.Equal("kernel", string(contents))
+		assert.Equal(build.ID, result.res.RootKey)
+	}
+	assert.Equal(TEST_RESULT_CORRECT, build.Result)
+	assert.Equal("secret", build.env.keyMap["sem1"])
+
+	// Failed builds don't have a root
+	build = workerTestBuild(t, dir)
+	go func() {
+		res, err := pool.build(build)
+		done <- buildResult{res, err}
+	}()
+
+	wj = &WorkerJob{}
+	assert.Nil(hub.GetJob(&WorkerRequest{WorkerID: id}, wj))
+	remote.Result = TEST_RESULT_INCORRECT
+	data, _ = json.Marshal(remote)
+	assert.Nil(hub.Complete(&WorkerResult{WorkerID: id, JobID: wj.ID, Test: data, Err: "bmake failed"}, &reply))
+
+	result = <-done
+	assert.NotNil(result.err)
+	assert.Nil(result.res)
+	assert.Equal(TEST_RESULT_INCORRECT, build.Result)
+	os.RemoveAll(build.dir)
+}
+
+type workerTestEcho struct{}
+
+func (e *workerTestEcho) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func TestWorkerDialTLS(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	server := rpc.NewServer()
+	assert.Nil(server.RegisterName("Echo", &workerTestEcho{}))
+	mux := http.NewServeMux()
+	mux.Handle(WORKER_RPC_PATH, server)
+
+	ts := httptest.NewTLSServer(mux)
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	conf := &WorkerConfig{
+		Server: ts.Listener.Addr().String(),
+		TLS:    &tls.Config{RootCAs: roots, ServerName: "example.com"},
+	}
+
+	client, err := dialWorkerServer(conf)
+	if assert.Nil(err) {
+		var reply string
+		assert.Nil(client.Call("Echo.Echo", "hello", &reply))
+		assert.Equal("hello", reply)
+		client.Close()
+	}
+
+	// Plain connections don't work
+	conf.TLS = nil
+	_, err = dialWorkerServer(conf)
+	assert.NotNil(err)
+
+	// Neither do servers we don't trust
+	conf.TLS = &tls.Config{ServerName: "example.com"}
+	_, err = dialWorkerServer(conf)
+	assert.NotNil(err)
+}